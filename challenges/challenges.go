@@ -62,7 +62,7 @@ var blockedChallenge = NewBlockedChallenge()
 // The first applicable challenge is used, so order matters! Rules:
 // * Reservation must precede code, so that reserved addresses cannot be taken.
 // * There must be at least one catch-all challenge type for userExists == false if
-//   challengesAreOptional == false.
+//   challengesOptional == false.
 // * Blocked must be last, because it blocks all attempts at registration...
 var challengeTypes = []ChallengeType{
 	&resetChallenge,
@@ -71,10 +71,10 @@ var challengeTypes = []ChallengeType{
 	&blockedChallenge,
 }
 
-const challengesAreOptional bool = true
-
-func challengeNecessary(address string, userExists bool, isLocalAddress bool) (bool, error) {
-	if !challengesAreOptional || userExists || !isLocalAddress {
+// If challengesOptional is false, every registration needs a challenge.
+// Otherwise, new local users only need one if a challenge type requires it.
+func challengeNecessary(address string, userExists bool, isLocalAddress bool, challengesOptional bool) (bool, error) {
+	if !challengesOptional || userExists || !isLocalAddress {
 		return true, nil
 	}
 
@@ -112,9 +112,9 @@ func createChallengeAuth(challenge *Challenge) string {
 	return hex.EncodeToString(outBytes)
 }
 
-func CreateChallenge(address string, userExists bool, isLocalAddress bool) (*ChallengeReply, error) {
+func CreateChallenge(address string, userExists bool, isLocalAddress bool, challengesOptional bool) (*ChallengeReply, error) {
 	// return nil if no challenge is necessary
-	necessary, err := challengeNecessary(address, userExists, isLocalAddress)
+	necessary, err := challengeNecessary(address, userExists, isLocalAddress, challengesOptional)
 	if err != nil {
 		return nil, err
 	}
@@ -156,9 +156,9 @@ func CreateChallenge(address string, userExists bool, isLocalAddress bool) (*Cha
 	return challengeReply, nil
 }
 
-func CheckChallenge(clientAnswer *ChallengeClientAnswer, userExists bool, isLocalAddress bool) (bool, error) {
+func CheckChallenge(clientAnswer *ChallengeClientAnswer, userExists bool, isLocalAddress bool, challengesOptional bool) (bool, error) {
 	// check whether challenge is necessary at all
-	necessary, err := challengeNecessary(clientAnswer.Address, userExists, isLocalAddress)
+	necessary, err := challengeNecessary(clientAnswer.Address, userExists, isLocalAddress, challengesOptional)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200203101512(txn *sql.Tx) {
+	query := `
+CREATE TABLE inbound_limits
+(
+  user_id integer NOT NULL,
+  messages_per_hour integer NOT NULL,
+  bytes_per_day bigint NOT NULL,
+  excess_action character varying(10) NOT NULL DEFAULT 'reject',
+  CONSTRAINT inbound_limits_pkey PRIMARY KEY (user_id),
+  CONSTRAINT inbound_limits_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+
+CREATE TABLE inbound_deliveries
+(
+  user_id integer NOT NULL,
+  delivered timestamp with time zone NOT NULL DEFAULT now(),
+  size bigint NOT NULL,
+  CONSTRAINT inbound_deliveries_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+
+CREATE INDEX inbound_deliveries__user_id__delivered
+  ON inbound_deliveries
+  (user_id, delivered);
+
+CREATE TABLE messages_held
+(
+  id serial NOT NULL,
+  user_id integer NOT NULL,
+  address character varying(50) NOT NULL,
+  received character varying(32) NOT NULL,
+  keysafe text NOT NULL,
+  content text NOT NULL,
+  attachments bytea,
+  CONSTRAINT messages_held_pkey PRIMARY KEY (id),
+  CONSTRAINT messages_held_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+
+CREATE INDEX messages_held__user_id
+  ON messages_held
+  (user_id, id);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200203101512(txn *sql.Tx) {
+	query := `
+DROP TABLE messages_held;
+DROP TABLE inbound_deliveries;
+DROP TABLE inbound_limits;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
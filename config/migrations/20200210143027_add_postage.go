@@ -0,0 +1,54 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200210143027(txn *sql.Tx) {
+	query := `
+CREATE TABLE postage_settings
+(
+  user_id integer NOT NULL,
+  required boolean NOT NULL,
+  CONSTRAINT postage_settings_pkey PRIMARY KEY (user_id),
+  CONSTRAINT postage_settings_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+
+CREATE TABLE postage_used
+(
+  digest bytea NOT NULL,
+  expires timestamp with time zone NOT NULL,
+  CONSTRAINT postage_used_pkey PRIMARY KEY (digest)
+);
+
+CREATE INDEX postage_used__expires
+  ON postage_used
+  (expires);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200210143027(txn *sql.Tx) {
+	query := `
+DROP TABLE postage_used;
+DROP TABLE postage_settings;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
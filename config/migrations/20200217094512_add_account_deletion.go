@@ -0,0 +1,50 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200217094512(txn *sql.Tx) {
+	query := `
+ALTER TABLE users
+	ADD COLUMN deletion_scheduled timestamp with time zone;
+
+CREATE INDEX users__deletion_scheduled
+  ON users
+  (deletion_scheduled)
+  WHERE deletion_scheduled IS NOT NULL;
+
+CREATE TABLE address_tombstones
+(
+  address character varying(50) NOT NULL,
+  deleted timestamp with time zone NOT NULL DEFAULT now(),
+  CONSTRAINT address_tombstones_pkey PRIMARY KEY (address)
+);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200217094512(txn *sql.Tx) {
+	query := `
+DROP TABLE address_tombstones;
+
+ALTER TABLE users
+	DROP COLUMN deletion_scheduled;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
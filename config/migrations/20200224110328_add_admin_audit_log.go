@@ -0,0 +1,47 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200224110328(txn *sql.Tx) {
+	query := `
+CREATE TABLE admin_audit_log
+(
+  id serial NOT NULL,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  admin character varying(50) NOT NULL,
+  action character varying(50) NOT NULL,
+  address character varying(50) NOT NULL,
+  details text NOT NULL DEFAULT '',
+  CONSTRAINT admin_audit_log_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX admin_audit_log__address
+  ON admin_audit_log
+  (address, id);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200224110328(txn *sql.Tx) {
+	query := `
+DROP TABLE admin_audit_log;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
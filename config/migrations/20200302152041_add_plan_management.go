@@ -0,0 +1,64 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200302152041(txn *sql.Tx) {
+	query := `
+ALTER TABLE plans
+	ADD COLUMN max_attachment_size bigint NOT NULL DEFAULT 100 * 1024 * 1024,
+	ADD COLUMN max_devices integer NOT NULL DEFAULT 0,
+	ADD COLUMN features character varying(50)[] NOT NULL DEFAULT '{}';
+
+ALTER TABLE users
+	ADD COLUMN inbound_read_only boolean NOT NULL DEFAULT FALSE;
+
+CREATE TABLE plan_domain_rules
+(
+  domain character varying(255) NOT NULL,
+  plan_id integer NOT NULL,
+  CONSTRAINT plan_domain_rules_pkey PRIMARY KEY (domain),
+  CONSTRAINT plan_domain_rules_plan_id_fkey FOREIGN KEY (plan_id)
+	REFERENCES plans (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE RESTRICT
+);
+
+-- same as the formerly hard-coded defaults
+INSERT INTO plan_domain_rules (domain, plan_id) VALUES
+	('kullo.net', (SELECT id FROM plans WHERE name = 'Free')),
+	('kullo.test', (SELECT id FROM plans WHERE name = 'Free')),
+	('*', (SELECT id FROM plans WHERE name = 'Professional'));
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200302152041(txn *sql.Tx) {
+	query := `
+DROP TABLE plan_domain_rules;
+
+ALTER TABLE users
+	DROP COLUMN inbound_read_only;
+
+ALTER TABLE plans
+	DROP COLUMN max_attachment_size,
+	DROP COLUMN max_devices,
+	DROP COLUMN features;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
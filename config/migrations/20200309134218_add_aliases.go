@@ -0,0 +1,53 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200309134218(txn *sql.Tx) {
+	query := `
+-- number of addresses a user may have in addition to their primary address
+ALTER TABLE plans
+	ADD COLUMN max_aliases integer NOT NULL DEFAULT 0;
+
+UPDATE plans SET max_aliases = 3 WHERE name = 'Friend';
+UPDATE plans SET max_aliases = 10 WHERE name = 'Professional';
+
+-- NULL for messages from before aliases existed
+ALTER TABLE messages
+	ADD COLUMN recipient character varying(50);
+
+CREATE INDEX addresses__user_id
+  ON addresses
+  (user_id, id);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200309134218(txn *sql.Tx) {
+	query := `
+DROP INDEX addresses__user_id;
+
+ALTER TABLE messages
+	DROP COLUMN recipient;
+
+ALTER TABLE plans
+	DROP COLUMN max_aliases;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200316101734(txn *sql.Tx) {
+	query := `
+CREATE TABLE address_forwards
+(
+  address character varying(50) NOT NULL,
+  user_id integer NOT NULL,
+  expires timestamp with time zone NOT NULL,
+  CONSTRAINT address_forwards_pkey PRIMARY KEY (address),
+  CONSTRAINT address_forwards_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+
+CREATE INDEX address_forwards__expires
+  ON address_forwards
+  (expires);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200316101734(txn *sql.Tx) {
+	query := `
+DROP TABLE address_forwards;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200323143052(txn *sql.Tx) {
+	query := `
+-- one entry per request, so that a verification only counts for the one who
+-- requested it
+CREATE TABLE domain_verifications
+(
+  id serial NOT NULL,
+  domain character varying(255) NOT NULL,
+  token character varying(64) NOT NULL,
+  -- SHA-256 of the secret that only the requester knows
+  secret_hash bytea NOT NULL,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  -- last check of what has been published, checks are rate-limited
+  checked timestamp with time zone,
+  verified timestamp with time zone,
+  method character varying(20),
+  CONSTRAINT domain_verifications_pkey PRIMARY KEY (id),
+  CONSTRAINT domain_verifications_token_key UNIQUE (token)
+);
+CREATE INDEX domain_verifications__domain
+  ON domain_verifications
+  USING btree
+  (domain);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200323143052(txn *sql.Tx) {
+	query := `
+DROP TABLE domain_verifications;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200330091538(txn *sql.Tx) {
+	query := `
+CREATE TABLE federation_relays
+(
+  id character varying(32) NOT NULL,
+  recipient character varying(50) NOT NULL,
+  content_type character varying(100) NOT NULL,
+  body bytea NOT NULL,
+  status character varying(20) NOT NULL DEFAULT 'queued',
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt timestamp with time zone NOT NULL DEFAULT now(),
+  last_error text NOT NULL DEFAULT '',
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  updated timestamp with time zone NOT NULL DEFAULT now(),
+  CONSTRAINT federation_relays_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX federation_relays__status_next_attempt
+  ON federation_relays
+  (status, next_attempt);
+CREATE INDEX federation_relays__recipient
+  ON federation_relays
+  (recipient);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200330091538(txn *sql.Tx) {
+	query := `
+DROP TABLE federation_relays;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
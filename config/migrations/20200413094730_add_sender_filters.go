@@ -0,0 +1,62 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200413094730(txn *sql.Tx) {
+	query := `
+-- which senders a user accepts messages from, and counters of excluded ones
+CREATE TABLE sender_settings
+(
+  user_id integer NOT NULL,
+  accept character varying(10) NOT NULL DEFAULT 'all',
+  excluded_action character varying(10) NOT NULL DEFAULT 'reject',
+  blocked bigint NOT NULL DEFAULT 0,
+  unverified bigint NOT NULL DEFAULT 0,
+  not_allowed bigint NOT NULL DEFAULT 0,
+  last_excluded timestamp with time zone,
+  CONSTRAINT sender_settings_pkey PRIMARY KEY (user_id),
+  CONSTRAINT sender_settings_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+
+-- blocked and allowed sender addresses and domains
+CREATE TABLE sender_rules
+(
+  user_id integer NOT NULL,
+  pattern character varying(255) NOT NULL,
+  action character varying(10) NOT NULL,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  CONSTRAINT sender_rules_pkey PRIMARY KEY (user_id, pattern),
+  CONSTRAINT sender_rules_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200413094730(txn *sql.Tx) {
+	query := `
+DROP TABLE sender_rules;
+DROP TABLE sender_settings;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200420093615(txn *sql.Tx) {
+	query := `
+-- content and attachments shared by the copies of a message that has been
+-- sent to multiple recipients at once
+CREATE TABLE message_payloads (
+	id bigserial NOT NULL,
+	content text NOT NULL,
+	attachments bytea,
+	created timestamp with time zone NOT NULL DEFAULT now(),
+	CONSTRAINT message_payloads_pkey PRIMARY KEY (id)
+);
+
+-- if set, content and attachments of the message are empty
+ALTER TABLE messages
+	ADD COLUMN payload_id bigint
+	REFERENCES message_payloads (id);
+CREATE INDEX messages__payload_id
+  ON messages
+  (payload_id)
+  WHERE payload_id IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION delete_messages_entry(
+    IN address character varying,
+    IN id integer,
+    IN last_modified bigint)
+  RETURNS TABLE(id_ integer, last_modified_ bigint, conflict_ boolean) AS
+$BODY$
+BEGIN
+	RETURN QUERY
+		UPDATE messages m
+		SET last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', content = '', attachments = NULL, sender = NULL, payload_id = NULL
+		FROM addresses a
+		WHERE m.user_id = a.user_id
+			AND a.address = delete_messages_entry.address
+			AND m.id = delete_messages_entry.id
+			AND m.last_modified = delete_messages_entry.last_modified
+		RETURNING m.id, m.last_modified, FALSE;
+
+	IF NOT FOUND THEN
+		RETURN QUERY
+			SELECT m.id, m.last_modified, TRUE
+			FROM messages m, addresses a
+			WHERE m.user_id = a.user_id
+				AND a.address = delete_messages_entry.address
+				AND m.id = delete_messages_entry.id;
+	END IF;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100
+  ROWS 1000;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200420093615(txn *sql.Tx) {
+	query := `
+-- give the remaining copies their own payload again
+UPDATE messages m
+	SET content = p.content, attachments = p.attachments, payload_id = NULL
+	FROM message_payloads p
+	WHERE m.payload_id = p.id;
+
+CREATE OR REPLACE FUNCTION delete_messages_entry(
+    IN address character varying,
+    IN id integer,
+    IN last_modified bigint)
+  RETURNS TABLE(id_ integer, last_modified_ bigint, conflict_ boolean) AS
+$BODY$
+BEGIN
+	RETURN QUERY
+		UPDATE messages m
+		SET last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', content = '', attachments = NULL, sender = NULL
+		FROM addresses a
+		WHERE m.user_id = a.user_id
+			AND a.address = delete_messages_entry.address
+			AND m.id = delete_messages_entry.id
+			AND m.last_modified = delete_messages_entry.last_modified
+		RETURNING m.id, m.last_modified, FALSE;
+
+	IF NOT FOUND THEN
+		RETURN QUERY
+			SELECT m.id, m.last_modified, TRUE
+			FROM messages m, addresses a
+			WHERE m.user_id = a.user_id
+				AND a.address = delete_messages_entry.address
+				AND m.id = delete_messages_entry.id;
+	END IF;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100
+  ROWS 1000;
+
+ALTER TABLE messages
+	DROP COLUMN payload_id;
+DROP TABLE message_payloads;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200427101942(txn *sql.Tx) {
+	query := `
+-- content and attachments of messages, stored once per SHA-256 digest of data
+CREATE TABLE blobs (
+	digest bytea NOT NULL,
+	data bytea NOT NULL,
+	-- number of messages that use the blob
+	refs integer NOT NULL DEFAULT 0,
+	-- when refs dropped to 0, unreferenced blobs are collected after a while
+	unreferenced timestamp with time zone DEFAULT now(),
+	CONSTRAINT blobs_pkey PRIMARY KEY (digest)
+);
+CREATE INDEX blobs__unreferenced
+  ON blobs
+  (unreferenced)
+  WHERE refs = 0;
+
+-- if set, the content or attachments column of the message is empty
+ALTER TABLE messages
+	ADD COLUMN content_digest bytea REFERENCES blobs (digest),
+	ADD COLUMN attachments_digest bytea REFERENCES blobs (digest);
+
+-- Stores a blob unless it exists already. Messages that use it take their
+-- references through messages_blob_refs.
+CREATE OR REPLACE FUNCTION kullo_store_blob(
+    IN digest bytea,
+    IN data bytea)
+  RETURNS void AS
+$BODY$
+BEGIN
+	LOOP
+		-- postpone collection until the message using the blob has been inserted
+		UPDATE blobs b
+		SET unreferenced = now()
+		WHERE b.digest = kullo_store_blob.digest AND b.refs = 0;
+		PERFORM 1 FROM blobs b WHERE b.digest = kullo_store_blob.digest;
+		IF found THEN
+			RETURN;
+		END IF;
+
+		BEGIN
+			INSERT INTO blobs (digest, data)
+			VALUES (kullo_store_blob.digest, kullo_store_blob.data);
+			RETURN;
+		EXCEPTION WHEN unique_violation THEN
+			-- stored concurrently, try the update again
+		END;
+	END LOOP;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100;
+
+CREATE OR REPLACE FUNCTION messages_blob_refs()
+  RETURNS trigger AS
+$BODY$
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		UPDATE blobs
+		SET refs = refs - 1, unreferenced = CASE WHEN refs = 1 THEN now() END
+		WHERE digest = OLD.content_digest;
+		UPDATE blobs
+		SET refs = refs - 1, unreferenced = CASE WHEN refs = 1 THEN now() END
+		WHERE digest = OLD.attachments_digest;
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		UPDATE blobs
+		SET refs = refs + 1, unreferenced = NULL
+		WHERE digest = NEW.content_digest;
+		UPDATE blobs
+		SET refs = refs + 1, unreferenced = NULL
+		WHERE digest = NEW.attachments_digest;
+	END IF;
+	RETURN NULL;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100;
+
+-- also releases the references of messages that are deleted together with
+-- their user
+CREATE TRIGGER messages_blob_refs
+	AFTER INSERT OR DELETE OR UPDATE OF content_digest, attachments_digest
+	ON messages
+	FOR EACH ROW
+	EXECUTE PROCEDURE messages_blob_refs();
+
+CREATE OR REPLACE FUNCTION delete_messages_entry(
+    IN address character varying,
+    IN id integer,
+    IN last_modified bigint)
+  RETURNS TABLE(id_ integer, last_modified_ bigint, conflict_ boolean) AS
+$BODY$
+BEGIN
+	RETURN QUERY
+		UPDATE messages m
+		SET last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', content = '', attachments = NULL, sender = NULL, content_digest = NULL, attachments_digest = NULL
+		FROM addresses a
+		WHERE m.user_id = a.user_id
+			AND a.address = delete_messages_entry.address
+			AND m.id = delete_messages_entry.id
+			AND m.last_modified = delete_messages_entry.last_modified
+		RETURNING m.id, m.last_modified, FALSE;
+
+	IF NOT FOUND THEN
+		RETURN QUERY
+			SELECT m.id, m.last_modified, TRUE
+			FROM messages m, addresses a
+			WHERE m.user_id = a.user_id
+				AND a.address = delete_messages_entry.address
+				AND m.id = delete_messages_entry.id;
+	END IF;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100
+  ROWS 1000;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Shared payloads of multi-recipient messages become blobs, one at a
+	// time because attachments may be large.
+	var payloadID int64
+	for {
+		var content, attachments []byte
+		err = txn.QueryRow(
+			"SELECT id, content, attachments FROM message_payloads "+
+				"WHERE id > $1 ORDER BY id LIMIT 1",
+			payloadID).
+			Scan(&payloadID, &content, &attachments)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		contentDigest := storeBlob_20200427101942(txn, content)
+		var attachmentsDigest []byte
+		if attachments != nil {
+			attachmentsDigest = storeBlob_20200427101942(txn, attachments)
+		}
+		_, err = txn.Exec(
+			"UPDATE messages SET content_digest=$1, attachments_digest=$2 "+
+				"WHERE payload_id=$3",
+			contentDigest, attachmentsDigest, payloadID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	query = `
+ALTER TABLE messages
+	DROP COLUMN payload_id;
+DROP TABLE message_payloads;
+`
+	_, err = txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// All other messages move their inline content and attachments to blobs
+	// as well, so that every message has digests of its payload.
+	for {
+		keys := messageKeysWithoutBlobs_20200427101942(txn)
+		if len(keys) == 0 {
+			break
+		}
+		// one message at a time, attachments may be large
+		for _, key := range keys {
+			var content, attachments []byte
+			err = txn.QueryRow(
+				"SELECT convert_to(content, 'UTF8'), attachments "+
+					"FROM messages WHERE user_id=$1 AND id=$2",
+				key.userID, key.id).
+				Scan(&content, &attachments)
+			if err != nil {
+				log.Fatal(err)
+			}
+			contentDigest := storeBlob_20200427101942(txn, content)
+			var attachmentsDigest []byte
+			if attachments != nil {
+				attachmentsDigest = storeBlob_20200427101942(txn, attachments)
+			}
+			_, err = txn.Exec(
+				"UPDATE messages "+
+					"SET content_digest=$3, attachments_digest=$4, content='', attachments=NULL "+
+					"WHERE user_id=$1 AND id=$2",
+				key.userID, key.id, contentDigest, attachmentsDigest)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+type messageKey_20200427101942 struct {
+	userID int64
+	id     int64
+}
+
+// returns the next batch of messages whose payload is inline
+func messageKeysWithoutBlobs_20200427101942(txn *sql.Tx) []messageKey_20200427101942 {
+	rows, err := txn.Query(
+		"SELECT user_id, id FROM messages " +
+			"WHERE NOT deleted AND content_digest IS NULL " +
+			"ORDER BY user_id, id LIMIT 1000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	keys := []messageKey_20200427101942{}
+	for rows.Next() {
+		var key messageKey_20200427101942
+		err = rows.Scan(&key.userID, &key.id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return keys
+}
+
+func storeBlob_20200427101942(txn *sql.Tx, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	_, err := txn.Exec("SELECT kullo_store_blob($1, $2)", digest[:], data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return digest[:]
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200427101942(txn *sql.Tx) {
+	query := `
+CREATE TABLE message_payloads (
+	id bigserial NOT NULL,
+	content text NOT NULL,
+	attachments bytea,
+	created timestamp with time zone NOT NULL DEFAULT now(),
+	CONSTRAINT message_payloads_pkey PRIMARY KEY (id)
+);
+ALTER TABLE messages
+	ADD COLUMN payload_id bigint
+	REFERENCES message_payloads (id);
+CREATE INDEX messages__payload_id
+  ON messages
+  (payload_id)
+  WHERE payload_id IS NOT NULL;
+
+-- every message gets its own copy again
+UPDATE messages m
+	SET content = convert_from(b.data, 'UTF8')
+	FROM blobs b
+	WHERE m.content_digest = b.digest;
+UPDATE messages m
+	SET attachments = b.data
+	FROM blobs b
+	WHERE m.attachments_digest = b.digest;
+
+DROP TRIGGER messages_blob_refs ON messages;
+DROP FUNCTION messages_blob_refs();
+DROP FUNCTION kullo_store_blob(bytea, bytea);
+
+CREATE OR REPLACE FUNCTION delete_messages_entry(
+    IN address character varying,
+    IN id integer,
+    IN last_modified bigint)
+  RETURNS TABLE(id_ integer, last_modified_ bigint, conflict_ boolean) AS
+$BODY$
+BEGIN
+	RETURN QUERY
+		UPDATE messages m
+		SET last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', content = '', attachments = NULL, sender = NULL, payload_id = NULL
+		FROM addresses a
+		WHERE m.user_id = a.user_id
+			AND a.address = delete_messages_entry.address
+			AND m.id = delete_messages_entry.id
+			AND m.last_modified = delete_messages_entry.last_modified
+		RETURNING m.id, m.last_modified, FALSE;
+
+	IF NOT FOUND THEN
+		RETURN QUERY
+			SELECT m.id, m.last_modified, TRUE
+			FROM messages m, addresses a
+			WHERE m.user_id = a.user_id
+				AND a.address = delete_messages_entry.address
+				AND m.id = delete_messages_entry.id;
+	END IF;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100
+  ROWS 1000;
+
+ALTER TABLE messages
+	DROP COLUMN content_digest,
+	DROP COLUMN attachments_digest;
+DROP TABLE blobs;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
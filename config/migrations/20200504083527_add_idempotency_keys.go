@@ -0,0 +1,53 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200504083527(txn *sql.Tx) {
+	query := `
+-- results of requests that carried an Idempotency-Key header
+CREATE TABLE idempotency_keys (
+	-- SHA-256 over path and credentials of the request, clients only see
+	-- their own keys
+	scope bytea NOT NULL,
+	key character varying(255) NOT NULL,
+	-- SHA-256 over method, URI, credentials and body of the request
+	request_hash bytea NOT NULL,
+	-- 0 while the request is being processed
+	status integer NOT NULL DEFAULT 0,
+	content_type character varying(255) NOT NULL DEFAULT '',
+	body bytea NOT NULL DEFAULT '',
+	-- set if the result has been too large to be stored
+	discarded boolean NOT NULL DEFAULT FALSE,
+	created timestamp with time zone NOT NULL DEFAULT now(),
+	CONSTRAINT idempotency_keys_pkey PRIMARY KEY (scope, key)
+);
+CREATE INDEX idempotency_keys__created
+  ON idempotency_keys
+  (created);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200504083527(txn *sql.Tx) {
+	query := `
+DROP TABLE idempotency_keys;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200511092304(txn *sql.Tx) {
+	query := `
+-- last_modified of the newest tombstone that has been purged; clients that
+-- synced before it may have missed deletions
+ALTER TABLE users
+	ADD COLUMN messages_sync_horizon bigint NOT NULL DEFAULT 0;
+
+CREATE INDEX messages__last_modified
+  ON messages
+  (last_modified)
+  WHERE deleted;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200511092304(txn *sql.Tx) {
+	query := `
+DROP INDEX messages__last_modified;
+ALTER TABLE users
+	DROP COLUMN messages_sync_horizon;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200518140655(txn *sql.Tx) {
+	query := `
+-- set by the sender, the message is deleted afterwards
+ALTER TABLE messages
+	ADD COLUMN expires timestamp with time zone;
+ALTER TABLE messages_held
+	ADD COLUMN expires timestamp with time zone;
+CREATE INDEX messages__expires
+  ON messages
+  (expires)
+  WHERE expires IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION delete_messages_entry(
+    IN address character varying,
+    IN id integer,
+    IN last_modified bigint)
+  RETURNS TABLE(id_ integer, last_modified_ bigint, conflict_ boolean) AS
+$BODY$
+BEGIN
+	RETURN QUERY
+		UPDATE messages m
+		SET last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', content = '', attachments = NULL, sender = NULL, content_digest = NULL, attachments_digest = NULL, expires = NULL
+		FROM addresses a
+		WHERE m.user_id = a.user_id
+			AND a.address = delete_messages_entry.address
+			AND m.id = delete_messages_entry.id
+			AND m.last_modified = delete_messages_entry.last_modified
+		RETURNING m.id, m.last_modified, FALSE;
+
+	IF NOT FOUND THEN
+		RETURN QUERY
+			SELECT m.id, m.last_modified, TRUE
+			FROM messages m, addresses a
+			WHERE m.user_id = a.user_id
+				AND a.address = delete_messages_entry.address
+				AND m.id = delete_messages_entry.id;
+	END IF;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100
+  ROWS 1000;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200518140655(txn *sql.Tx) {
+	query := `
+CREATE OR REPLACE FUNCTION delete_messages_entry(
+    IN address character varying,
+    IN id integer,
+    IN last_modified bigint)
+  RETURNS TABLE(id_ integer, last_modified_ bigint, conflict_ boolean) AS
+$BODY$
+BEGIN
+	RETURN QUERY
+		UPDATE messages m
+		SET last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', content = '', attachments = NULL, sender = NULL, content_digest = NULL, attachments_digest = NULL
+		FROM addresses a
+		WHERE m.user_id = a.user_id
+			AND a.address = delete_messages_entry.address
+			AND m.id = delete_messages_entry.id
+			AND m.last_modified = delete_messages_entry.last_modified
+		RETURNING m.id, m.last_modified, FALSE;
+
+	IF NOT FOUND THEN
+		RETURN QUERY
+			SELECT m.id, m.last_modified, TRUE
+			FROM messages m, addresses a
+			WHERE m.user_id = a.user_id
+				AND a.address = delete_messages_entry.address
+				AND m.id = delete_messages_entry.id;
+	END IF;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100
+  ROWS 1000;
+
+ALTER TABLE messages_held
+	DROP COLUMN expires;
+ALTER TABLE messages
+	DROP COLUMN expires;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
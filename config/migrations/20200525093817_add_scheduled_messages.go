@@ -0,0 +1,56 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200525093817(txn *sql.Tx) {
+	query := `
+-- messages that are delivered to the recipient at deliver_at
+CREATE TABLE messages_scheduled
+(
+  -- random, also serves as the sender's handle for cancelling the delivery
+  id character varying(32) NOT NULL,
+  user_id integer NOT NULL,
+  address character varying(50) NOT NULL,
+  sender character varying(50),
+  keysafe text NOT NULL,
+  content text NOT NULL,
+  attachments bytea,
+  expires timestamp with time zone,
+  deliver_at timestamp with time zone NOT NULL,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  CONSTRAINT messages_scheduled_pkey PRIMARY KEY (id),
+  CONSTRAINT messages_scheduled_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+
+CREATE INDEX messages_scheduled__deliver_at
+  ON messages_scheduled
+  (deliver_at);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200525093817(txn *sql.Tx) {
+	query := `
+DROP TABLE messages_scheduled;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
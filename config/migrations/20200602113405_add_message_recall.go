@@ -0,0 +1,50 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200602113405(txn *sql.Tx) {
+	query := `
+-- SHA-256 of the token by which the sender can recall the message while it
+-- hasn't been read
+ALTER TABLE messages
+	ADD COLUMN recall_hash bytea;
+ALTER TABLE messages_held
+	ADD COLUMN recall_hash bytea;
+ALTER TABLE messages_scheduled
+	ADD COLUMN recall_hash bytea;
+CREATE INDEX messages__recall_hash
+  ON messages
+  (recall_hash)
+  WHERE recall_hash IS NOT NULL;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200602113405(txn *sql.Tx) {
+	query := `
+ALTER TABLE messages
+	DROP COLUMN recall_hash;
+ALTER TABLE messages_held
+	DROP COLUMN recall_hash;
+ALTER TABLE messages_scheduled
+	DROP COLUMN recall_hash;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
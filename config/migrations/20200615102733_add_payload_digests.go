@@ -0,0 +1,152 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200615102733(txn *sql.Tx) {
+	query := `
+-- SHA-256 of keysafe, content and attachments are digests of their blobs
+ALTER TABLE messages
+	ADD COLUMN keysafe_digest bytea;
+
+CREATE OR REPLACE FUNCTION delete_messages_entry(
+    IN address character varying,
+    IN id integer,
+    IN last_modified bigint)
+  RETURNS TABLE(id_ integer, last_modified_ bigint, conflict_ boolean) AS
+$BODY$
+BEGIN
+	RETURN QUERY
+		UPDATE messages m
+		SET last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', content = '', attachments = NULL, sender = NULL, content_digest = NULL, attachments_digest = NULL, expires = NULL, receipt = NULL, keysafe_digest = NULL
+		FROM addresses a
+		WHERE m.user_id = a.user_id
+			AND a.address = delete_messages_entry.address
+			AND m.id = delete_messages_entry.id
+			AND m.last_modified = delete_messages_entry.last_modified
+		RETURNING m.id, m.last_modified, FALSE;
+
+	IF NOT FOUND THEN
+		RETURN QUERY
+			SELECT m.id, m.last_modified, TRUE
+			FROM messages m, addresses a
+			WHERE m.user_id = a.user_id
+				AND a.address = delete_messages_entry.address
+				AND m.id = delete_messages_entry.id;
+	END IF;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100
+  ROWS 1000;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Content and attachments have been moved to blobs by 20200427101942,
+	// only the key safes are hashed here, in batches.
+	for {
+		digests := keySafeDigests_20200615102733(txn)
+		if len(digests) == 0 {
+			break
+		}
+		for _, d := range digests {
+			_, err = txn.Exec(
+				"UPDATE messages SET keysafe_digest=$3 WHERE user_id=$1 AND id=$2",
+				d.userID, d.id, d.digest)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+type keySafeDigest_20200615102733 struct {
+	userID int64
+	id     int64
+	digest []byte
+}
+
+// returns the digests of the next batch of messages without keysafe_digest
+func keySafeDigests_20200615102733(txn *sql.Tx) []keySafeDigest_20200615102733 {
+	rows, err := txn.Query(
+		"SELECT user_id, id, keysafe FROM messages " +
+			"WHERE NOT deleted AND keysafe_digest IS NULL " +
+			"ORDER BY user_id, id LIMIT 1000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	digests := []keySafeDigest_20200615102733{}
+	for rows.Next() {
+		var d keySafeDigest_20200615102733
+		var keySafe string
+		err = rows.Scan(&d.userID, &d.id, &keySafe)
+		if err != nil {
+			log.Fatal(err)
+		}
+		digest := sha256.Sum256([]byte(keySafe))
+		d.digest = digest[:]
+		digests = append(digests, d)
+	}
+	if err = rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return digests
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200615102733(txn *sql.Tx) {
+	query := `
+CREATE OR REPLACE FUNCTION delete_messages_entry(
+    IN address character varying,
+    IN id integer,
+    IN last_modified bigint)
+  RETURNS TABLE(id_ integer, last_modified_ bigint, conflict_ boolean) AS
+$BODY$
+BEGIN
+	RETURN QUERY
+		UPDATE messages m
+		SET last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', content = '', attachments = NULL, sender = NULL, content_digest = NULL, attachments_digest = NULL, expires = NULL, receipt = NULL
+		FROM addresses a
+		WHERE m.user_id = a.user_id
+			AND a.address = delete_messages_entry.address
+			AND m.id = delete_messages_entry.id
+			AND m.last_modified = delete_messages_entry.last_modified
+		RETURNING m.id, m.last_modified, FALSE;
+
+	IF NOT FOUND THEN
+		RETURN QUERY
+			SELECT m.id, m.last_modified, TRUE
+			FROM messages m, addresses a
+			WHERE m.user_id = a.user_id
+				AND a.address = delete_messages_entry.address
+				AND m.id = delete_messages_entry.id;
+	END IF;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100
+  ROWS 1000;
+
+ALTER TABLE messages
+	DROP COLUMN keysafe_digest;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200622084512(txn *sql.Tx) {
+	query := `
+-- set by the recipient, messages they have sent themselves are read
+ALTER TABLE messages
+	ADD COLUMN read boolean NOT NULL DEFAULT FALSE;
+-- number of messages that are neither read nor deleted
+ALTER TABLE users
+	ADD COLUMN unread_messages integer NOT NULL DEFAULT 0;
+
+-- what used to be counted as unread stays unread
+UPDATE messages
+	SET read = NOT (meta = '' AND NOT deleted AND received >= '2016-01-01T00:00:00Z');
+UPDATE users u
+	SET unread_messages = (
+		SELECT count(*) FROM messages m
+		WHERE m.user_id = u.id AND NOT m.read AND NOT m.deleted);
+
+CREATE OR REPLACE FUNCTION messages_unread_count()
+  RETURNS trigger AS
+$BODY$
+DECLARE
+	delta integer := 0;
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') AND NOT OLD.read AND NOT OLD.deleted THEN
+		delta := delta - 1;
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') AND NOT NEW.read AND NOT NEW.deleted THEN
+		delta := delta + 1;
+	END IF;
+
+	IF delta <> 0 THEN
+		IF TG_OP = 'DELETE' THEN
+			UPDATE users SET unread_messages = unread_messages + delta WHERE id = OLD.user_id;
+		ELSE
+			UPDATE users SET unread_messages = unread_messages + delta WHERE id = NEW.user_id;
+		END IF;
+	END IF;
+	RETURN NULL;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100;
+
+CREATE TRIGGER messages_unread_count
+	AFTER INSERT OR DELETE OR UPDATE OF read, deleted
+	ON messages
+	FOR EACH ROW
+	EXECUTE PROCEDURE messages_unread_count();
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200622084512(txn *sql.Tx) {
+	query := `
+DROP TRIGGER messages_unread_count ON messages;
+DROP FUNCTION messages_unread_count();
+ALTER TABLE users
+	DROP COLUMN unread_messages;
+ALTER TABLE messages
+	DROP COLUMN read;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200629141058(txn *sql.Tx) {
+	query := `
+-- chunks of blobs that are being streamed to storage
+CREATE SEQUENCE blob_uploads_id_seq;
+CREATE TABLE blob_uploads (
+	id bigint NOT NULL,
+	seq integer NOT NULL,
+	data bytea NOT NULL,
+	created timestamp with time zone NOT NULL DEFAULT now(),
+	CONSTRAINT blob_uploads_pkey PRIMARY KEY (id, seq)
+);
+CREATE INDEX blob_uploads__created
+  ON blob_uploads
+  (created);
+
+-- Stores the chunks of an upload as a blob unless it exists already, then
+-- deletes the chunks. Same as kullo_store_blob otherwise.
+CREATE OR REPLACE FUNCTION kullo_store_blob_upload(
+    IN digest bytea,
+    IN upload_id bigint)
+  RETURNS void AS
+$BODY$
+BEGIN
+	LOOP
+		UPDATE blobs b
+		SET unreferenced = now()
+		WHERE b.digest = kullo_store_blob_upload.digest AND b.refs = 0;
+		PERFORM 1 FROM blobs b WHERE b.digest = kullo_store_blob_upload.digest;
+		IF found THEN
+			EXIT;
+		END IF;
+
+		BEGIN
+			INSERT INTO blobs (digest, data)
+			SELECT kullo_store_blob_upload.digest, string_agg(u.data, ''::bytea ORDER BY u.seq)
+			FROM blob_uploads u
+			WHERE u.id = upload_id;
+			EXIT;
+		EXCEPTION WHEN unique_violation THEN
+			-- stored concurrently, try the update again
+		END;
+	END LOOP;
+
+	DELETE FROM blob_uploads u WHERE u.id = upload_id;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100;
+
+-- attachments that have been streamed to storage are referenced by held and
+-- scheduled messages instead of being copied
+ALTER TABLE messages_held
+	ADD COLUMN attachments_digest bytea REFERENCES blobs (digest);
+ALTER TABLE messages_scheduled
+	ADD COLUMN attachments_digest bytea REFERENCES blobs (digest);
+
+CREATE OR REPLACE FUNCTION pending_messages_blob_refs()
+  RETURNS trigger AS
+$BODY$
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		UPDATE blobs
+		SET refs = refs - 1, unreferenced = CASE WHEN refs = 1 THEN now() END
+		WHERE digest = OLD.attachments_digest;
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		UPDATE blobs
+		SET refs = refs + 1, unreferenced = NULL
+		WHERE digest = NEW.attachments_digest;
+	END IF;
+	RETURN NULL;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100;
+
+CREATE TRIGGER messages_held_blob_refs
+	AFTER INSERT OR DELETE OR UPDATE OF attachments_digest
+	ON messages_held
+	FOR EACH ROW
+	EXECUTE PROCEDURE pending_messages_blob_refs();
+CREATE TRIGGER messages_scheduled_blob_refs
+	AFTER INSERT OR DELETE OR UPDATE OF attachments_digest
+	ON messages_scheduled
+	FOR EACH ROW
+	EXECUTE PROCEDURE pending_messages_blob_refs();
+
+-- blobs are read in chunks, which requires them to be stored uncompressed
+ALTER TABLE blobs
+	ALTER COLUMN data SET STORAGE EXTERNAL;
+
+-- bodies of queued relays are kept as blobs, so that they can be streamed
+ALTER TABLE federation_relays
+	ADD COLUMN body_digest bytea REFERENCES blobs (digest),
+	ADD COLUMN body_size bigint NOT NULL DEFAULT 0;
+
+CREATE OR REPLACE FUNCTION federation_relays_blob_refs()
+  RETURNS trigger AS
+$BODY$
+BEGIN
+	IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		UPDATE blobs
+		SET refs = refs - 1, unreferenced = CASE WHEN refs = 1 THEN now() END
+		WHERE digest = OLD.body_digest;
+	END IF;
+	IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		UPDATE blobs
+		SET refs = refs + 1, unreferenced = NULL
+		WHERE digest = NEW.body_digest;
+	END IF;
+	RETURN NULL;
+END;
+$BODY$
+  LANGUAGE plpgsql VOLATILE
+  COST 100;
+
+CREATE TRIGGER federation_relays_blob_refs
+	AFTER INSERT OR DELETE OR UPDATE OF body_digest
+	ON federation_relays
+	FOR EACH ROW
+	EXECUTE PROCEDURE federation_relays_blob_refs();
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Bodies of queued relays become blobs, one at a time because they may be
+	// large. Finished relays have an empty body.
+	var relayID string
+	for {
+		var body []byte
+		err = txn.QueryRow(
+			"SELECT id, body FROM federation_relays "+
+				"WHERE id > $1 AND length(body) > 0 ORDER BY id LIMIT 1",
+			relayID).
+			Scan(&relayID, &body)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		digest := storeBlob_20200629141058(txn, body)
+		_, err = txn.Exec(
+			"UPDATE federation_relays SET body_digest=$1, body_size=$2 WHERE id=$3",
+			digest, len(body), relayID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	_, err = txn.Exec("ALTER TABLE federation_relays DROP COLUMN body")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func storeBlob_20200629141058(txn *sql.Tx, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	_, err := txn.Exec("SELECT kullo_store_blob($1, $2)", digest[:], data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return digest[:]
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200629141058(txn *sql.Tx) {
+	query := `
+-- queued relays get their own copy of the body again
+ALTER TABLE federation_relays
+	ADD COLUMN body bytea NOT NULL DEFAULT '';
+UPDATE federation_relays r
+	SET body = b.data
+	FROM blobs b
+	WHERE r.body_digest = b.digest;
+ALTER TABLE federation_relays
+	ALTER COLUMN body DROP DEFAULT;
+
+DROP TRIGGER federation_relays_blob_refs ON federation_relays;
+DROP FUNCTION federation_relays_blob_refs();
+
+ALTER TABLE blobs
+	ALTER COLUMN data SET STORAGE EXTENDED;
+
+-- pending messages get their own copy of the attachments again
+UPDATE messages_held h
+	SET attachments = b.data
+	FROM blobs b
+	WHERE h.attachments_digest = b.digest;
+UPDATE messages_scheduled s
+	SET attachments = b.data
+	FROM blobs b
+	WHERE s.attachments_digest = b.digest;
+
+DROP TRIGGER messages_held_blob_refs ON messages_held;
+DROP TRIGGER messages_scheduled_blob_refs ON messages_scheduled;
+DROP FUNCTION pending_messages_blob_refs();
+
+-- collected by the job once the grace period has passed
+UPDATE blobs b
+	SET refs = refs - r.count, unreferenced = CASE WHEN refs = r.count THEN now() END
+	FROM (
+		SELECT attachments_digest AS digest, count(*) AS count FROM (
+			SELECT attachments_digest FROM messages_held
+			UNION ALL
+			SELECT attachments_digest FROM messages_scheduled
+			UNION ALL
+			SELECT body_digest FROM federation_relays
+		) pending
+		WHERE attachments_digest IS NOT NULL
+		GROUP BY attachments_digest
+	) r
+	WHERE b.digest = r.digest;
+
+ALTER TABLE messages_held
+	DROP COLUMN attachments_digest;
+ALTER TABLE messages_scheduled
+	DROP COLUMN attachments_digest;
+ALTER TABLE federation_relays
+	DROP COLUMN body_digest,
+	DROP COLUMN body_size;
+
+DROP FUNCTION kullo_store_blob_upload(bytea, bigint);
+DROP TABLE blob_uploads;
+DROP SEQUENCE blob_uploads_id_seq;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
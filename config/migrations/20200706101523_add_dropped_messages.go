@@ -0,0 +1,56 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Up is executed when this migration is applied
+func Up_20200706101523(txn *sql.Tx) {
+	query := `
+-- messages of excluded senders that have been dropped silently, kept so that
+-- recalling or cancelling them looks the same as for other messages
+CREATE TABLE messages_dropped
+(
+  user_id integer NOT NULL,
+  recall_hash bytea NOT NULL,
+  -- set if the message has been sent with a delivery time
+  scheduled_id character varying(32),
+  deliver_at timestamp with time zone,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  CONSTRAINT messages_dropped_user_id_fkey FOREIGN KEY (user_id)
+	REFERENCES users (id) MATCH SIMPLE
+	ON UPDATE NO ACTION ON DELETE CASCADE
+);
+
+CREATE INDEX messages_dropped__user_id
+  ON messages_dropped
+  USING btree
+  (user_id);
+CREATE INDEX messages_dropped__created
+  ON messages_dropped
+  USING btree
+  (created);
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20200706101523(txn *sql.Tx) {
+	query := `
+DROP TABLE messages_dropped;
+`
+	_, err := txn.Exec(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"errors"
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+	"github.com/lib/pq"
+)
+
+var ErrTooManyAliases = errors.New("dao: plan doesn't allow more aliases")
+var ErrPrimaryAddress = errors.New("dao: primary address cannot be removed")
+
+type AliasesEntry struct {
+	Address string `json:"address"`
+	// the address the account has been registered with
+	Primary bool `json:"primary"`
+}
+
+// Addresses manages all addresses of a user. The first address of a user is
+// their primary address, all others are aliases.
+type Addresses struct {
+}
+
+// SameUser returns whether both addresses belong to the same user.
+func (dao *Addresses) SameUser(address string, otherAddress string) (bool, error) {
+	var same bool
+	err := dbconn.GetConn().
+		QueryRow("SELECT count(*) > 0 "+
+			"FROM addresses a1 JOIN addresses a2 ON a1.user_id = a2.user_id "+
+			"WHERE a1.address=$1 AND a2.address=$2",
+			address, otherAddress).
+		Scan(&same)
+	return same, err
+}
+
+// GetList returns all addresses of the user with the given address, primary
+// address first.
+func (dao *Addresses) GetList(address string) ([]AliasesEntry, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT a2.address "+
+			"FROM addresses a1 JOIN addresses a2 ON a1.user_id = a2.user_id "+
+			"WHERE a1.address=$1 "+
+			"ORDER BY a2.id",
+		address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AliasesEntry{}
+	for rows.Next() {
+		entry := AliasesEntry{}
+		err = rows.Scan(&entry.Address)
+		if err != nil {
+			return nil, err
+		}
+		entry.Primary = len(entries) == 0
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// InsertAlias adds alias to the user with the given address. Returns
+// ErrAddressAlreadyExists if the alias is taken and ErrTooManyAliases if the
+// plan of the user doesn't allow more aliases.
+func (dao *Addresses) InsertAlias(address string, alias *AddressesEntry) error {
+	transaction, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	// lock the user so that concurrent requests cannot exceed the limit
+	var userId uint32
+	var maxAliases uint32
+	err = transaction.QueryRow(
+		"SELECT u.id, p.max_aliases "+
+			"FROM users u JOIN plans p ON u.plan_id = p.id "+
+			"JOIN addresses a ON u.id = a.user_id "+
+			"WHERE a.address=$1 "+
+			"FOR UPDATE OF u",
+		address).Scan(&userId, &maxAliases)
+	if err != nil {
+		return err
+	}
+
+	var addressCount uint32
+	err = transaction.QueryRow(
+		"SELECT count(*) FROM addresses WHERE user_id=$1",
+		userId).Scan(&addressCount)
+	if err != nil {
+		return err
+	}
+	if addressCount > maxAliases {
+		return ErrTooManyAliases
+	}
+
+	var exists bool
+	err = transaction.QueryRow(
+		"SELECT count(id) > 0 FROM addresses WHERE address=$1",
+		alias.Address).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrAddressAlreadyExists
+	}
+
+	_, err = transaction.Exec(
+		"INSERT INTO addresses (user_id, address, registration_code) "+
+			"VALUES ($1, $2, $3)",
+		userId, alias.Address, alias.RegistrationCode)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		return ErrAddressAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+// DeleteAlias removes alias from the user with the given address. Like the
+// addresses of deleted accounts, it cannot be registered again for some time.
+// Returns sql.ErrNoRows if alias doesn't belong to the user and
+// ErrPrimaryAddress if it is their primary address.
+func (dao *Addresses) DeleteAlias(address string, alias string) error {
+	transaction, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	var aliasId uint32
+	var primaryId uint32
+	err = transaction.QueryRow(
+		"SELECT a2.id, (SELECT min(id) FROM addresses WHERE user_id = a1.user_id) "+
+			"FROM addresses a1 JOIN addresses a2 ON a1.user_id = a2.user_id "+
+			"WHERE a1.address=$1 AND a2.address=$2 "+
+			"FOR UPDATE OF a2",
+		address, alias).Scan(&aliasId, &primaryId)
+	if err != nil {
+		return err
+	}
+	if aliasId == primaryId {
+		return ErrPrimaryAddress
+	}
+
+	_, err = transaction.Exec(
+		"DELETE FROM addresses WHERE id=$1",
+		aliasId)
+	if err != nil {
+		return err
+	}
+	_, err = transaction.Exec(
+		"INSERT INTO address_tombstones (address) "+
+			"SELECT $1 WHERE NOT EXISTS "+
+			"(SELECT 1 FROM address_tombstones WHERE address=$1)",
+		alias)
+	if err != nil {
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+// ChangeAddress replaces the address oldAddress of a user with newEntry.
+// Deliveries to oldAddress are forwarded until forwardUntil. Returns
+// ErrAddressAlreadyExists if the new address is taken.
+func (dao *Addresses) ChangeAddress(oldAddress string, newEntry *AddressesEntry, forwardUntil time.Time) error {
+	transaction, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	var userId uint32
+	err = transaction.QueryRow(
+		"SELECT user_id FROM addresses WHERE address=$1 FOR UPDATE",
+		oldAddress).Scan(&userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = transaction.Exec(
+		"UPDATE addresses SET address=$1, registration_code=$2 WHERE address=$3",
+		newEntry.Address, newEntry.RegistrationCode, oldAddress)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		return ErrAddressAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+
+	// earlier forwards of the user follow automatically because they refer
+	// to the user, not to an address
+	_, err = transaction.Exec(
+		"INSERT INTO address_forwards (address, user_id, expires) VALUES ($1, $2, $3)",
+		oldAddress, userId, forwardUntil)
+	if err != nil {
+		return err
+	}
+
+	// keep the old address from being registered after forwarding ends
+	_, err = transaction.Exec(
+		"INSERT INTO address_tombstones (address) "+
+			"SELECT $1 WHERE NOT EXISTS "+
+			"(SELECT 1 FROM address_tombstones WHERE address=$1)",
+		oldAddress)
+	if err != nil {
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+// GetForwardTarget returns the primary address of the user that address is
+// forwarded to. Returns sql.ErrNoRows if address isn't forwarded.
+func (dao *Addresses) GetForwardTarget(address string) (string, error) {
+	var target string
+	err := dbconn.GetConn().
+		QueryRow("SELECT a.address "+
+			"FROM address_forwards f JOIN addresses a ON f.user_id = a.user_id "+
+			"WHERE f.address=$1 AND f.expires > now() "+
+			"ORDER BY a.id LIMIT 1",
+			address).
+		Scan(&target)
+	return target, err
+}
+
+func (dao *Addresses) DeleteExpiredForwards(now time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM address_forwards WHERE expires <= $1",
+		now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+)
+
+var ErrUnknownPlan = errors.New("dao: unknown plan")
+
+type AdminAccountEntry struct {
+	Address           string     `json:"address"`
+	UserID            uint32     `json:"userId"`
+	Disabled          bool       `json:"disabled"`
+	InboundReadOnly   bool       `json:"inboundReadOnly"`
+	PlanName          string     `json:"planName"`
+	StorageQuota      uint64     `json:"storageQuota"`
+	LastLogin         *time.Time `json:"lastLogin"`
+	HasResetCode      bool       `json:"hasResetCode"`
+	DeletionScheduled *time.Time `json:"deletionScheduled"`
+}
+
+type AdminAuditLogEntry struct {
+	ID      uint32    `json:"id"`
+	Created time.Time `json:"created"`
+	Admin   string    `json:"admin"`
+	Action  string    `json:"action"`
+	Address string    `json:"address"`
+	Details string    `json:"details"`
+}
+
+type Admin struct {
+}
+
+func (dao *Admin) GetAccount(address string) (*AdminAccountEntry, error) {
+	entry := &AdminAccountEntry{}
+	err := dbconn.GetConn().
+		QueryRow(
+			"SELECT a.address, u.id, u.disabled, u.inbound_read_only, p.name, p.storage_quota, "+
+				"u.last_login, length(u.reset_code) > 0, u.deletion_scheduled "+
+				"FROM users u, plans p, addresses a "+
+				"WHERE u.plan_id=p.id AND u.id=a.user_id AND a.address=$1", address).
+		Scan(&entry.Address, &entry.UserID, &entry.Disabled, &entry.InboundReadOnly, &entry.PlanName, &entry.StorageQuota,
+			&entry.LastLogin, &entry.HasResetCode, &entry.DeletionScheduled)
+	return entry, err
+}
+
+// SetDisabled records audit in the same transaction.
+func (dao *Admin) SetDisabled(address string, disabled bool, audit *AdminAuditLogEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users u "+
+			"SET disabled = $1 "+
+			"FROM addresses a "+
+			"WHERE u.id = a.user_id AND a.address = $2 ",
+		disabled, address)
+	if err != nil {
+		return err
+	}
+	err = insertAuditLogEntry(tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetResetCode records audit in the same transaction.
+func (dao *Admin) SetResetCode(address string, resetCode string, audit *AdminAuditLogEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users u "+
+			"SET reset_code = $1 "+
+			"FROM addresses a "+
+			"WHERE u.id = a.user_id AND a.address = $2 ",
+		resetCode, address)
+	if err != nil {
+		return err
+	}
+	err = insertAuditLogEntry(tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetPlan returns ErrUnknownPlan if there is no plan with the given name.
+// inboundReadOnly should be set if the user's storage usage exceeds the quota
+// of the new plan. Records audit in the same transaction.
+func (dao *Admin) SetPlan(address string, planName string, inboundReadOnly bool, audit *AdminAuditLogEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	users := Users{}
+	planId, err := users.getPlanId(tx, planName)
+	if err == sql.ErrNoRows {
+		return ErrUnknownPlan
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE users u "+
+			"SET plan_id = $1, inbound_read_only = $2 "+
+			"FROM addresses a "+
+			"WHERE u.id = a.user_id AND a.address = $3 ",
+		planId, inboundReadOnly, address)
+	if err != nil {
+		return err
+	}
+	err = insertAuditLogEntry(tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// InsertAuditLogEntry records an admin action that doesn't modify the
+// database. Actions that do record their entry in the same transaction.
+func (dao *Admin) InsertAuditLogEntry(entry *AdminAuditLogEntry) error {
+	return insertAuditLogEntry(dbconn.GetConn(), entry)
+}
+
+func insertAuditLogEntry(q queryRower, entry *AdminAuditLogEntry) error {
+	return q.QueryRow(
+		"INSERT INTO admin_audit_log (admin, action, address, details) "+
+			"VALUES ($1, $2, $3, $4) RETURNING id, created",
+		entry.Admin, entry.Action, entry.Address, entry.Details).
+		Scan(&entry.ID, &entry.Created)
+}
+
+// GetAuditLog returns the latest entries concerning the given address, newest first.
+func (dao *Admin) GetAuditLog(address string, limit uint32) ([]AdminAuditLogEntry, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT id, created, admin, action, address, details "+
+			"FROM admin_audit_log "+
+			"WHERE address=$1 "+
+			"ORDER BY id DESC LIMIT $2",
+		address, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AdminAuditLogEntry{}
+	for rows.Next() {
+		entry := AdminAuditLogEntry{}
+		err = rows.Scan(&entry.ID, &entry.Created, &entry.Admin,
+			&entry.Action, &entry.Address, &entry.Details)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
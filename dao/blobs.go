@@ -0,0 +1,171 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+)
+
+// size of the chunks in which blobs are streamed to and from storage
+const blobChunkSize int = 1 * MEBIBYTE
+
+// StoredBlob refers to a blob that has been streamed to storage before the
+// message that uses it is inserted. It is collected unless it is referenced
+// within the grace period of unreferenced blobs.
+type StoredBlob struct {
+	Digest []byte // SHA-256 of the data
+	Size   int
+}
+
+// BlobUploads stores blobs in chunks, so that they don't have to be held in
+// memory as a whole.
+type BlobUploads struct {
+}
+
+// BlobWriter streams data to storage. Only the current chunk is held in memory.
+type BlobWriter struct {
+	id    int64
+	seq   int
+	chunk []byte
+	hash  hash.Hash
+	size  int
+}
+
+func (dao *BlobUploads) NewWriter() (*BlobWriter, error) {
+	writer := &BlobWriter{
+		chunk: make([]byte, 0, blobChunkSize),
+		hash:  sha256.New(),
+	}
+	err := dbconn.GetConn().
+		QueryRow("SELECT nextval('blob_uploads_id_seq')").
+		Scan(&writer.id)
+	if err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (w *BlobWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := copy(w.chunk[len(w.chunk):cap(w.chunk)], data)
+		w.chunk = w.chunk[:len(w.chunk)+n]
+		data = data[n:]
+		written += n
+		if len(w.chunk) == cap(w.chunk) {
+			err := w.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *BlobWriter) flush() error {
+	if len(w.chunk) == 0 {
+		return nil
+	}
+	_, err := dbconn.GetConn().Exec(
+		"INSERT INTO blob_uploads (id, seq, data) VALUES ($1, $2, $3)",
+		w.id, w.seq, w.chunk)
+	if err != nil {
+		return err
+	}
+	w.hash.Write(w.chunk)
+	w.size += len(w.chunk)
+	w.seq++
+	w.chunk = w.chunk[:0]
+	return nil
+}
+
+// Close stores the chunks as a blob and returns a reference to it, or nil if
+// no data has been written.
+func (w *BlobWriter) Close() (*StoredBlob, error) {
+	err := w.flush()
+	if err != nil {
+		return nil, err
+	}
+	if w.size == 0 {
+		return nil, nil
+	}
+	digest := w.hash.Sum(nil)
+	_, err = dbconn.GetConn().Exec(
+		"SELECT kullo_store_blob_upload($1, $2)",
+		digest, w.id)
+	if err != nil {
+		return nil, err
+	}
+	return &StoredBlob{Digest: digest, Size: w.size}, nil
+}
+
+// Abort deletes the chunks that have been written so far.
+func (w *BlobWriter) Abort() error {
+	_, err := dbconn.GetConn().Exec(
+		"DELETE FROM blob_uploads WHERE id=$1",
+		w.id)
+	return err
+}
+
+// BlobReader streams a stored blob. Only the current chunk is held in memory.
+type BlobReader struct {
+	digest []byte
+	offset int
+	chunk  []byte
+	eof    bool
+}
+
+func newBlobReader(digest []byte) *BlobReader {
+	return &BlobReader{digest: digest}
+}
+
+// OpenBlob returns a reader for the blob with the given digest. Blobs are
+// stored uncompressed, so that chunks can be read without reading all of it.
+func (dao *Messages) OpenBlob(digest []byte) *BlobReader {
+	return newBlobReader(digest)
+}
+
+func (r *BlobReader) Read(data []byte) (int, error) {
+	if len(r.chunk) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		// substring counts from 1
+		err := dbconn.GetConn().QueryRow(
+			"SELECT substring(data FROM $2 FOR $3) FROM blobs WHERE digest=$1",
+			r.digest, r.offset+1, blobChunkSize).
+			Scan(&r.chunk)
+		if err != nil {
+			return 0, err
+		}
+		r.offset += len(r.chunk)
+		r.eof = len(r.chunk) < blobChunkSize
+		if len(r.chunk) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(data, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// DeleteUploadsBefore deletes chunks of uploads that have neither been closed
+// nor aborted, e.g. because the server has been stopped.
+func (dao *BlobUploads) DeleteUploadsBefore(before time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM blob_uploads WHERE created < $1",
+		before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -13,6 +13,11 @@ import (
 
 var ErrConflict = errors.New("dao: conflicting modification")
 
+// queryRower is implemented by *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type ID struct {
 	ID uint32 `json:"id"`
 }
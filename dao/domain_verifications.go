@@ -0,0 +1,113 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"database/sql"
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+)
+
+// ways to prove control of a domain
+const (
+	DOMAIN_VERIFICATION_DNS        string = "dns"
+	DOMAIN_VERIFICATION_WELL_KNOWN string = "wellKnown"
+)
+
+type DomainVerificationsEntry struct {
+	Domain string
+	// published by the requester
+	Token string
+	// SHA-256 of the secret by which the requester uses the verification
+	SecretHash []byte
+	// nil until the token has been found, updated whenever it is found again
+	Verified *time.Time
+	// DOMAIN_VERIFICATION_*, "" if not verified
+	Method string
+}
+
+type DomainVerifications struct {
+}
+
+const domainVerificationsColumns = "domain, token, secret_hash, verified, method"
+
+func scanDomainVerificationsEntry(row *sql.Row) (*DomainVerificationsEntry, error) {
+	entry := &DomainVerificationsEntry{}
+	var method sql.NullString
+	err := row.Scan(&entry.Domain, &entry.Token, &entry.SecretHash, &entry.Verified, &method)
+	entry.Method = method.String
+	return entry, err
+}
+
+// GetEntry returns sql.ErrNoRows if the token hasn't been issued for domain.
+func (dao *DomainVerifications) GetEntry(domain string, token string) (*DomainVerificationsEntry, error) {
+	return scanDomainVerificationsEntry(dbconn.GetConn().
+		QueryRow("SELECT "+domainVerificationsColumns+" "+
+			"FROM domain_verifications WHERE domain=$1 AND token=$2", domain, token))
+}
+
+// GetEntryBySecret returns the most recently verified entry that has been
+// requested with the secret, or sql.ErrNoRows if there is none.
+func (dao *DomainVerifications) GetEntryBySecret(domain string, secretHash []byte) (*DomainVerificationsEntry, error) {
+	return scanDomainVerificationsEntry(dbconn.GetConn().
+		QueryRow("SELECT "+domainVerificationsColumns+" "+
+			"FROM domain_verifications WHERE domain=$1 AND secret_hash=$2 "+
+			"ORDER BY verified DESC NULLS LAST LIMIT 1", domain, secretHash))
+}
+
+// CountIssuedSince returns the number of entries that have been requested for
+// domain after the given time.
+func (dao *DomainVerifications) CountIssuedSince(domain string, since time.Time) (uint32, error) {
+	var count uint32
+	err := dbconn.GetConn().
+		QueryRow("SELECT count(*) FROM domain_verifications WHERE domain=$1 AND created > $2",
+			domain, since).
+		Scan(&count)
+	return count, err
+}
+
+func (dao *DomainVerifications) InsertEntry(entry *DomainVerificationsEntry) error {
+	_, err := dbconn.GetConn().Exec(
+		"INSERT INTO domain_verifications (domain, token, secret_hash) "+
+			"VALUES ($1, $2, $3)",
+		entry.Domain, entry.Token, entry.SecretHash)
+	return err
+}
+
+// SetChecked records a check of the entry unless it has been checked after
+// notCheckedSince. Returns whether the check has been recorded.
+func (dao *DomainVerifications) SetChecked(token string, checked time.Time, notCheckedSince time.Time) (bool, error) {
+	result, err := dbconn.GetConn().Exec(
+		"UPDATE domain_verifications SET checked=$1 "+
+			"WHERE token=$2 AND (checked IS NULL OR checked <= $3)",
+		checked, token, notCheckedSince)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
+
+func (dao *DomainVerifications) SetVerified(token string, method string, verified time.Time) error {
+	_, err := dbconn.GetConn().Exec(
+		"UPDATE domain_verifications SET verified=$1, method=$2 WHERE token=$3",
+		verified, method, token)
+	return err
+}
+
+// DeleteExpired deletes entries that have neither been verified nor requested
+// since before.
+func (dao *DomainVerifications) DeleteExpired(before time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM domain_verifications WHERE coalesce(verified, created) < $1",
+		before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
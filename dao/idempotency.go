@@ -0,0 +1,105 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+	"github.com/lib/pq"
+)
+
+const IDEMPOTENCY_KEY_MAX_LENGTH int = 255
+
+// IdempotencyKeysEntry is the result of a request that may be repeated by the
+// client. Status is 0 while the request is being processed. Keys are unique
+// within their scope, which identifies the client.
+type IdempotencyKeysEntry struct {
+	Scope       []byte
+	Key         string
+	RequestHash []byte
+	Status      int
+	ContentType string
+	Body        []byte
+	// set if the body has been too large to be stored
+	Discarded bool
+	Created   time.Time
+}
+
+type IdempotencyKeys struct {
+}
+
+// Reserve stores the key for a request that is about to be processed. Returns
+// false if the key is known already.
+func (dao *IdempotencyKeys) Reserve(scope []byte, key string, requestHash []byte) (bool, error) {
+	result, err := dbconn.GetConn().Exec(
+		"INSERT INTO idempotency_keys (scope, key, request_hash) "+
+			"SELECT $1, $2, $3 "+
+			"WHERE NOT EXISTS (SELECT 1 FROM idempotency_keys WHERE scope=$1 AND key=$2)",
+		scope, key, requestHash)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		// inserted concurrently
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// GetEntry returns the entry for key, sql.ErrNoRows if there is none.
+func (dao *IdempotencyKeys) GetEntry(scope []byte, key string) (*IdempotencyKeysEntry, error) {
+	entry := &IdempotencyKeysEntry{}
+	err := dbconn.GetConn().
+		QueryRow("SELECT scope, key, request_hash, status, content_type, body, discarded, created "+
+			"FROM idempotency_keys WHERE scope=$1 AND key=$2", scope, key).
+		Scan(&entry.Scope, &entry.Key, &entry.RequestHash, &entry.Status, &entry.ContentType,
+			&entry.Body, &entry.Discarded, &entry.Created)
+	return entry, err
+}
+
+// Complete stores the result of the request.
+func (dao *IdempotencyKeys) Complete(scope []byte, key string, status int, contentType string, body []byte) error {
+	_, err := dbconn.GetConn().Exec(
+		"UPDATE idempotency_keys SET status=$1, content_type=$2, body=$3 WHERE scope=$4 AND key=$5",
+		status, contentType, body, scope, key)
+	return err
+}
+
+// Discard records that the request has succeeded without storing its result,
+// so that it isn't processed again.
+func (dao *IdempotencyKeys) Discard(scope []byte, key string, status int) error {
+	_, err := dbconn.GetConn().Exec(
+		"UPDATE idempotency_keys SET status=$1, discarded=TRUE WHERE scope=$2 AND key=$3",
+		status, scope, key)
+	return err
+}
+
+// Delete forgets the key, so that the request can be repeated.
+func (dao *IdempotencyKeys) Delete(scope []byte, key string) error {
+	_, err := dbconn.GetConn().Exec(
+		"DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2",
+		scope, key)
+	return err
+}
+
+// DeleteExpired deletes results that have been stored before completedBefore
+// and abandoned requests that started before pendingBefore.
+func (dao *IdempotencyKeys) DeleteExpired(completedBefore time.Time, pendingBefore time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM idempotency_keys "+
+			"WHERE created < $1 OR (status = 0 AND created < $2)",
+		completedBefore, pendingBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
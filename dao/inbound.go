@@ -0,0 +1,383 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"database/sql"
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+)
+
+const (
+	INBOUND_EXCESS_REJECT string = "reject"
+	INBOUND_EXCESS_HOLD   string = "hold"
+)
+
+type InboundLimitsEntry struct {
+	MessagesPerHour uint32 `json:"messagesPerHour"`
+	BytesPerDay     uint64 `json:"bytesPerDay"`
+	ExcessAction    string `json:"excessAction"`
+}
+
+type InboundUsage struct {
+	MessagesLastHour  uint32 `json:"messagesLastHour"`
+	BytesLastDay      uint64 `json:"bytesLastDay"`
+	MessagesHeld      uint32 `json:"messagesHeld"`
+	BytesHeld         uint64 `json:"bytesHeld"`
+	MessagesScheduled uint32 `json:"messagesScheduled"`
+	BytesScheduled    uint64 `json:"bytesScheduled"`
+}
+
+type InboundLimits struct {
+}
+
+// GetEntry returns the limits configured by the user, or sql.ErrNoRows if the
+// user hasn't configured any.
+func (dao *InboundLimits) GetEntry(address string) (*InboundLimitsEntry, error) {
+	entry := &InboundLimitsEntry{}
+	err := dbconn.GetConn().
+		QueryRow("SELECT il.messages_per_hour, il.bytes_per_day, il.excess_action "+
+			"FROM inbound_limits il JOIN addresses a USING (user_id) "+
+			"WHERE a.address=$1", address).
+		Scan(&entry.MessagesPerHour, &entry.BytesPerDay, &entry.ExcessAction)
+	return entry, err
+}
+
+func (dao *InboundLimits) InsertOrUpdateEntry(address string, entry *InboundLimitsEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE inbound_limits "+
+		"SET messages_per_hour=$1, bytes_per_day=$2, excess_action=$3 "+
+		"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$4)",
+		entry.MessagesPerHour, entry.BytesPerDay, entry.ExcessAction, address)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		_, err = tx.Exec("INSERT INTO inbound_limits "+
+			"(user_id, messages_per_hour, bytes_per_day, excess_action) "+
+			"VALUES ((SELECT user_id FROM addresses WHERE address=$1), $2, $3, $4)",
+			address, entry.MessagesPerHour, entry.BytesPerDay, entry.ExcessAction)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (dao *InboundLimits) GetUsage(address string) (*InboundUsage, error) {
+	return getInboundUsage(dbconn.GetConn(), address)
+}
+
+func getInboundUsage(q queryRower, address string) (*InboundUsage, error) {
+	usage := &InboundUsage{}
+	err := q.QueryRow(
+		"WITH usr AS (SELECT user_id FROM addresses WHERE address=$1) "+
+			"SELECT "+
+			"(SELECT count(*) FROM inbound_deliveries "+
+			"WHERE user_id=(SELECT user_id FROM usr) "+
+			"AND delivered > now() - interval '1 hour'), "+
+			"(SELECT coalesce(sum(size), 0) FROM inbound_deliveries "+
+			"WHERE user_id=(SELECT user_id FROM usr) "+
+			"AND delivered > now() - interval '1 day'), "+
+			"(SELECT count(*) FROM messages_held "+
+			"WHERE user_id=(SELECT user_id FROM usr)), "+
+			"(SELECT coalesce(sum("+heldEntrySize+"), 0) FROM messages_held "+
+			"WHERE user_id=(SELECT user_id FROM usr)), "+
+			"(SELECT count(*) FROM messages_scheduled "+
+			"WHERE user_id=(SELECT user_id FROM usr)), "+
+			"(SELECT coalesce(sum("+heldEntrySize+"), 0) FROM messages_scheduled "+
+			"WHERE user_id=(SELECT user_id FROM usr))",
+		address).
+		Scan(&usage.MessagesLastHour, &usage.BytesLastDay, &usage.MessagesHeld, &usage.BytesHeld,
+			&usage.MessagesScheduled, &usage.BytesScheduled)
+	return usage, err
+}
+
+func (dao *InboundLimits) RecordDelivery(address string, size uint64) error {
+	_, err := dbconn.GetConn().Exec(
+		"INSERT INTO inbound_deliveries (user_id, size) "+
+			"VALUES ((SELECT user_id FROM addresses WHERE address=$1), $2)",
+		address, size)
+	return err
+}
+
+func (dao *InboundLimits) DeleteDeliveriesBefore(before time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM inbound_deliveries WHERE delivered < $1",
+		before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// InboundDelivery locks the inbound usage of a user until it is committed or
+// rolled back, so that deliveries to the same user are decided one after
+// another and cannot exceed the limits together.
+type InboundDelivery struct {
+	tx      *sql.Tx
+	address string
+}
+
+func (dao *InboundLimits) BeginDelivery(address string) (*InboundDelivery, error) {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return nil, err
+	}
+	var userID uint32
+	err = tx.QueryRow(
+		"SELECT id FROM users WHERE id=(SELECT user_id FROM addresses WHERE address=$1) FOR UPDATE",
+		address).Scan(&userID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &InboundDelivery{tx: tx, address: address}, nil
+}
+
+func (d *InboundDelivery) GetUsage() (*InboundUsage, error) {
+	return getInboundUsage(d.tx, d.address)
+}
+
+// RecheckReadOnly is like Users.RecheckInboundReadOnly, but within the
+// delivery, whose lock would block the latter.
+func (d *InboundDelivery) RecheckReadOnly() (bool, error) {
+	return recheckInboundReadOnly(d.tx, d.address)
+}
+
+// Deliver inserts the entry into the user's inbox and records the delivery.
+func (d *InboundDelivery) Deliver(entry *MessagesEntry) error {
+	entry.Recipient = d.address
+	messages := Messages{}
+	err := messages.insertEntry(d.tx, d.address, entry)
+	if err != nil {
+		return err
+	}
+	return d.recordDelivery(entry.StorageSize())
+}
+
+// SetReceipt stores the receipt of a message that has been delivered within
+// this delivery, so that the message isn't delivered without it.
+func (d *InboundDelivery) SetReceipt(address string, id uint32, receipt string) error {
+	_, err := d.tx.Exec(
+		"UPDATE messages SET receipt=$3 "+
+			"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$1) AND id=$2",
+		address, id, receipt)
+	return err
+}
+
+func (d *InboundDelivery) recordDelivery(size uint64) error {
+	_, err := d.tx.Exec(
+		"INSERT INTO inbound_deliveries (user_id, size) "+
+			"VALUES ((SELECT user_id FROM addresses WHERE address=$1), $2)",
+		d.address, size)
+	return err
+}
+
+// Hold inserts the entry into the user's held messages.
+func (d *InboundDelivery) Hold(entry *MessagesEntry) error {
+	var att *[]byte
+	if len(entry.Attachments) > 0 {
+		att = &entry.Attachments
+	}
+	_, err := d.tx.Exec(
+		"INSERT INTO messages_held "+
+			"(user_id, address, sender, received, keysafe, content, attachments, attachments_digest, expires, recall_hash) "+
+			"VALUES ((SELECT user_id FROM addresses WHERE address=$1), $1, nullif($2, ''), $3, $4, $5, $6, $7, "+
+			"nullif($8, '')::timestamptz, $9)",
+		d.address, entry.Sender, entry.Received, entry.KeySafe, entry.Content, att, entry.storedAttachmentsDigest(),
+		entry.ExpiresAt, entry.RecallHash)
+	return err
+}
+
+// GetOldestHeldEntrySize returns the storage size of the held message that
+// would be released next. Returns sql.ErrNoRows if there are no held messages.
+func (d *InboundDelivery) GetOldestHeldEntrySize() (uint64, error) {
+	var size uint64
+	err := d.tx.QueryRow(
+		"SELECT "+heldEntrySize+" "+
+			"FROM messages_held "+
+			"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$1) "+
+			"ORDER BY id LIMIT 1",
+		d.address).Scan(&size)
+	return size, err
+}
+
+// ReleaseOldestHeldEntry moves the oldest held message of the user to the
+// user's inbox and records the delivery. Returns sql.ErrNoRows if there are no
+// held messages.
+func (d *InboundDelivery) ReleaseOldestHeldEntry() (*MessagesEntry, error) {
+	entry := &MessagesEntry{}
+	var attachments []byte
+	stored := &StoredBlob{}
+	err := d.tx.QueryRow(
+		"DELETE FROM messages_held "+
+			"WHERE id=(SELECT id FROM messages_held "+
+			"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$1) "+
+			"ORDER BY id LIMIT 1 FOR UPDATE) "+
+			"RETURNING address, coalesce(sender, ''), received, keysafe, content, attachments, "+
+			"attachments_digest, "+storedAttachmentsSize+", "+
+			formatTimestamp("expires")+", recall_hash",
+		d.address).
+		Scan(&entry.Recipient, &entry.Sender, &entry.Received, &entry.KeySafe, &entry.Content, &attachments,
+			&stored.Digest, &stored.Size, &entry.ExpiresAt, &entry.RecallHash)
+	if err != nil {
+		return nil, err
+	}
+	entry.Attachments = attachments
+	if stored.Digest != nil {
+		entry.StoredAttachments = stored
+	}
+
+	messages := Messages{}
+	// the alias the message has been sent to might have been removed since
+	err = messages.insertEntry(d.tx, d.address, entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, d.recordDelivery(entry.StorageSize())
+}
+
+// Schedule inserts the entry into the user's scheduled messages.
+func (d *InboundDelivery) Schedule(id string, entry *MessagesEntry) error {
+	var att *[]byte
+	if len(entry.Attachments) > 0 {
+		att = &entry.Attachments
+	}
+	_, err := d.tx.Exec(
+		"INSERT INTO messages_scheduled "+
+			"(id, user_id, address, sender, keysafe, content, attachments, attachments_digest, expires, deliver_at, recall_hash) "+
+			"VALUES ($1, (SELECT user_id FROM addresses WHERE address=$2), $2, nullif($3, ''), $4, $5, $6, $7, "+
+			"nullif($8, '')::timestamptz, $9::timestamptz, $10)",
+		id, d.address, entry.Sender, entry.KeySafe, entry.Content, att, entry.storedAttachmentsDigest(),
+		entry.ExpiresAt, entry.DeliverAt, entry.RecallHash)
+	return err
+}
+
+// GetScheduledEntrySize returns the storage size of a scheduled message of
+// the user. Returns sql.ErrNoRows if it has been cancelled.
+func (d *InboundDelivery) GetScheduledEntrySize(id string) (uint64, error) {
+	var size uint64
+	err := d.tx.QueryRow(
+		"SELECT "+heldEntrySize+" "+
+			"FROM messages_scheduled "+
+			"WHERE id=$1 AND user_id=(SELECT user_id FROM addresses WHERE address=$2)",
+		id, d.address).Scan(&size)
+	return size, err
+}
+
+// TakeScheduledEntry deletes a scheduled message of the user and returns it,
+// received now, so that it can be delivered, held or dropped. Returns
+// sql.ErrNoRows if it has been cancelled.
+func (d *InboundDelivery) TakeScheduledEntry(id string) (*MessagesEntry, error) {
+	entry := &MessagesEntry{}
+	var attachments []byte
+	stored := &StoredBlob{}
+	err := d.tx.QueryRow(
+		"DELETE FROM messages_scheduled "+
+			"WHERE id=$1 AND user_id=(SELECT user_id FROM addresses WHERE address=$2) "+
+			"RETURNING coalesce(sender, ''), keysafe, content, attachments, "+
+			"attachments_digest, "+storedAttachmentsSize+", "+
+			formatTimestamp("expires")+", recall_hash",
+		id, d.address).
+		Scan(&entry.Sender, &entry.KeySafe, &entry.Content, &attachments,
+			&stored.Digest, &stored.Size, &entry.ExpiresAt, &entry.RecallHash)
+	if err != nil {
+		return nil, err
+	}
+	entry.Recipient = d.address
+	entry.Attachments = attachments
+	if stored.Digest != nil {
+		entry.StoredAttachments = stored
+	}
+	entry.Received = time.Now().UTC().Format(time.RFC3339)
+	return entry, nil
+}
+
+// Drop records that a message with the given recall hash has been dropped,
+// so that the sender can recall it (and cancel it until deliverAt if that is
+// set) without learning that it has been dropped.
+func (d *InboundDelivery) Drop(recallHash []byte, scheduledID string, deliverAt string) error {
+	_, err := d.tx.Exec(
+		"INSERT INTO messages_dropped (user_id, recall_hash, scheduled_id, deliver_at) "+
+			"VALUES ((SELECT user_id FROM addresses WHERE address=$1), $2, nullif($3, ''), "+
+			"nullif($4, '')::timestamptz)",
+		d.address, recallHash, scheduledID, deliverAt)
+	return err
+}
+
+// InsertUsedPostage marks a postage stamp as used. Returns false if it has
+// been used before. Stamps are bound to a recipient, so the lock on the user
+// serializes concurrent uses of the same stamp.
+func (d *InboundDelivery) InsertUsedPostage(digest []byte, expires time.Time) (bool, error) {
+	result, err := d.tx.Exec(
+		"INSERT INTO postage_used (digest, expires) "+
+			"SELECT $1, $2 "+
+			"WHERE NOT EXISTS (SELECT 1 FROM postage_used WHERE digest=$1)",
+		digest, expires)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+func (d *InboundDelivery) Commit() error {
+	return d.tx.Commit()
+}
+
+func (d *InboundDelivery) Rollback() error {
+	return d.tx.Rollback()
+}
+
+type HeldMessages struct {
+}
+
+// size of the attachments that held or scheduled messages have in storage
+const storedAttachmentsSize = "coalesce((SELECT octet_length(b.data) FROM blobs b " +
+	"WHERE b.digest = attachments_digest), 0)"
+
+// storage size of a held or scheduled message, same as MessagesEntry.StorageSize
+const heldEntrySize = "octet_length(keysafe) + octet_length(content) + " +
+	"coalesce(octet_length(attachments), 0) + " + storedAttachmentsSize
+
+// GetAddressesWithHeldMessages returns one address per user that has held messages.
+func (dao *HeldMessages) GetAddressesWithHeldMessages() ([]string, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT DISTINCT ON (h.user_id) a.address " +
+			"FROM messages_held h JOIN addresses a ON h.user_id = a.user_id " +
+			"ORDER BY h.user_id, a.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []string{}
+	for rows.Next() {
+		var address string
+		err = rows.Scan(&address)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, rows.Err()
+}
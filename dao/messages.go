@@ -7,8 +7,12 @@
 package dao
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"time"
 
 	"bitbucket.org/kullo/server/dbconn"
 )
@@ -27,12 +31,26 @@ type MessagesEntry struct {
 	LastModified      uint64 `json:"lastModified"` // timestamp*10^6, µs since the epoch
 	Deleted           bool   `json:"deleted"`
 	Received          string `json:"dateReceived"`
+	Recipient         string `json:"recipient,omitempty"` // the address the message has been sent to
+	Sender            string `json:"sender,omitempty"`    // verified address of the sender, if they authenticated
+	ExpiresAt         string `json:"expiresAt,omitempty"` // the message is deleted after this time
+	DeliverAt         string `json:"deliverAt,omitempty"` // only on creation: the message is delivered at this time
 	Meta              string `json:"meta"`
+	Read              bool   `json:"read"` // set by the recipient
 	KeySafe           string `json:"keySafe"`
 	Content           string `json:"content"`
 	HasAttachments    bool   `json:"hasAttachments"`
 	AttachmentsBase64 string `json:"attachments,omitempty"`
 	Attachments       []byte `json:"-"`
+	// set instead of Attachments if they have been streamed to storage
+	StoredAttachments *StoredBlob `json:"-"`
+	// hex-encoded SHA-256 of keySafe and content as above and of the raw attachments
+	KeySafeSHA256     string `json:"keySafeSha256,omitempty"`
+	ContentSHA256     string `json:"contentSha256,omitempty"`
+	AttachmentsSHA256 string `json:"attachmentsSha256,omitempty"`
+	RecallHash        []byte `json:"-"` // SHA-256 of the token by which the sender can recall the message
+	// signed by the server when the message has been delivered by someone else
+	Receipt json.RawMessage `json:"receipt,omitempty"`
 }
 
 func (e *MessagesEntry) SetIDLastModifiedDeleted(id uint32, lastModified uint64, deleted bool) {
@@ -46,13 +64,74 @@ func (e *MessagesEntry) ValidForCreation() bool {
 	return (e.KeySafe != "" && len(e.KeySafe)*3 <= MESSAGE_KEY_SAFE_MAX_BYTES*4) &&
 		(e.Content != "" && len(e.Content)*3 <= MESSAGE_CONTENT_MAX_BYTES*4) &&
 		(len(e.Meta)*3 <= MESSAGE_META_MAX_BYTES*4) &&
-		(len(e.Attachments) <= MESSAGE_ATTACHMENTS_MAX_BYTES)
+		(e.AttachmentsSize() <= MESSAGE_ATTACHMENTS_MAX_BYTES)
+}
+
+// AttachmentsSize is the size of the raw attachments, wherever they are.
+func (e *MessagesEntry) AttachmentsSize() int {
+	if e.StoredAttachments != nil {
+		return e.StoredAttachments.Size
+	}
+	return len(e.Attachments)
+}
+
+// digest of attachments that have been streamed to storage, nil otherwise
+func (e *MessagesEntry) storedAttachmentsDigest() []byte {
+	if e.StoredAttachments != nil {
+		return e.StoredAttachments.Digest
+	}
+	return nil
+}
+
+// StorageSize is the number of bytes the entry occupies in the recipient's storage
+func (e *MessagesEntry) StorageSize() uint64 {
+	return uint64(len(e.KeySafe) + len(e.Content) + e.AttachmentsSize())
 }
 
 func (e *MessagesEntry) ValidForModification() bool {
 	return len(e.Meta)*3 <= MESSAGE_META_MAX_BYTES*4
 }
 
+// results of single operations of a batch
+const (
+	BATCH_OK          string = "ok"
+	BATCH_CONFLICT    string = "conflict"
+	BATCH_NOT_FOUND   string = "notFound"
+	BATCH_ROLLED_BACK string = "rolledBack"
+)
+
+const MESSAGES_BATCH_MAX_OPERATIONS int = 1000
+
+// MessagesBatchOperation sets Meta and/or Read, or deletes the message. Like
+// in ModifyMeta, setting Meta without Read marks the message as read.
+type MessagesBatchOperation struct {
+	ID           uint32  `json:"id"`
+	LastModified uint64  `json:"lastModified"`
+	Meta         *string `json:"meta"`
+	Read         *bool   `json:"read"`
+	Delete       bool    `json:"delete"`
+}
+
+// ValidForBatch checks that the operation either modifies or deletes the
+// message.
+func (op *MessagesBatchOperation) ValidForBatch() bool {
+	if op.Delete {
+		return op.Meta == nil && op.Read == nil
+	}
+	if op.Meta == nil {
+		return op.Read != nil
+	}
+	return len(*op.Meta)*3 <= MESSAGE_META_MAX_BYTES*4
+}
+
+// MessagesBatchResult is the outcome of an operation. LastModified is the
+// current value, so that clients can resolve conflicts.
+type MessagesBatchResult struct {
+	ID           uint32 `json:"id"`
+	LastModified uint64 `json:"lastModified"`
+	Status       string `json:"status"`
+}
+
 type Messages struct {
 }
 
@@ -81,12 +160,16 @@ func (dao *Messages) GetList(address string, modifiedAfter uint64, includeData b
 
 	fields := "m.id, m.last_modified"
 	if includeData {
-		fields += ", m.deleted, m.received, m.meta, m.keysafe, m.content, " +
-			"m.attachments IS NOT NULL"
+		fields += ", m.deleted, m.received, coalesce(m.recipient, ''), coalesce(m.sender, ''), " +
+			"m.meta, m.read, m.keysafe, coalesce(convert_from(c.data, 'UTF8'), m.content), " +
+			"m.attachments IS NOT NULL OR m.attachments_digest IS NOT NULL, " +
+			formatTimestamp("m.expires") + ", m.receipt, " +
+			payloadDigests
 	}
 	rows, err := dbconn.GetConn().
 		Query("SELECT "+fields+" "+
 			"FROM messages m JOIN addresses a USING (user_id) "+
+			"LEFT JOIN blobs c ON c.digest = m.content_digest "+
 			"WHERE a.address=$1 AND m.last_modified > $2 "+
 			"ORDER BY m.last_modified ASC "+
 			"LIMIT $3",
@@ -94,97 +177,511 @@ func (dao *Messages) GetList(address string, modifiedAfter uint64, includeData b
 	return resultsTotal, resultsReturned, rows, err
 }
 
-func (dao *Messages) GetUnreadCount(address string) uint32 {
+// hex-encoded digests of the payload of the message m, empty for tombstones
+const payloadDigests = "coalesce(encode(m.keysafe_digest, 'hex'), ''), " +
+	"coalesce(encode(m.content_digest, 'hex'), ''), " +
+	"coalesce(encode(m.attachments_digest, 'hex'), '')"
+
+// GetUnreadCount returns the number of messages that are neither read nor
+// deleted. It is maintained by the messages_unread_count trigger.
+func (dao *Messages) GetUnreadCount(address string) (uint32, error) {
 	var count uint32
-	dbconn.GetConn().QueryRow("SELECT count(*) FROM messages "+
-		"WHERE user_id = (SELECT user_id FROM addresses WHERE address = $1) "+
-		"AND meta = '' AND deleted = false AND received >= '2016-01-01T00:00:00Z'",
+	err := dbconn.GetConn().QueryRow("SELECT unread_messages FROM users "+
+		"WHERE id = (SELECT user_id FROM addresses WHERE address = $1)",
 		address).Scan(&count)
-	return count
+	return count, err
 }
 
 func (dao *Messages) GetStorageSize(address string) (uint64, error) {
 	var storageSize uint64
 	err := dbconn.GetConn().QueryRow(
-		"SELECT coalesce(sum( "+
-			"coalesce(octet_length(content), 0) + "+
-			"coalesce(octet_length(keysafe), 0) + "+
-			"coalesce(octet_length(attachments), 0) "+
-			"), 0) "+
-			"FROM messages "+
-			"WHERE user_id = (SELECT user_id FROM addresses WHERE address = $1) ",
+		"SELECT "+storageSizeOfUser("(SELECT user_id FROM addresses WHERE address = $1)"),
 		address).Scan(&storageSize)
 	return storageSize, err
 }
 
+// Returns an expression for the storage size of the user with the given ID.
+// Blobs are charged to every recipient in full, so that the storage of a user
+// doesn't depend on what others have received.
+func storageSizeOfUser(userID string) string {
+	return "(SELECT coalesce(sum( " +
+		"coalesce(octet_length(m.content), 0) + " +
+		"coalesce(octet_length(m.keysafe), 0) + " +
+		"coalesce(octet_length(m.attachments), 0) + " +
+		"coalesce(octet_length(c.data), 0) + " +
+		"coalesce(octet_length(b.data), 0) " +
+		"), 0) " +
+		"FROM messages m " +
+		"LEFT JOIN blobs c ON c.digest = m.content_digest " +
+		"LEFT JOIN blobs b ON b.digest = m.attachments_digest " +
+		"WHERE m.user_id = " + userID + ")"
+}
+
 func (dao *Messages) GetNextEntry(rows *sql.Rows) (*MessagesEntry, error) {
 	entry := &MessagesEntry{}
-	err := rows.Scan(&entry.ID, &entry.LastModified, &entry.Deleted, &entry.Received, &entry.Meta, &entry.KeySafe, &entry.Content, &entry.HasAttachments)
+	err := rows.Scan(&entry.ID, &entry.LastModified, &entry.Deleted, &entry.Received, &entry.Recipient, &entry.Sender, &entry.Meta, &entry.Read, &entry.KeySafe, &entry.Content, &entry.HasAttachments, &entry.ExpiresAt, (*[]byte)(&entry.Receipt),
+		&entry.KeySafeSHA256, &entry.ContentSHA256, &entry.AttachmentsSHA256)
 	return entry, err
 }
 
 func (dao *Messages) InsertEntry(address string, entry *MessagesEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	entry.Recipient = address
+	err = dao.insertEntry(tx, address, entry)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Inserts the entry into the inbox of the user with the given address.
+// entry.Recipient may be any address of the same user. Content and
+// attachments are stored as blobs, which are shared with all other messages
+// that have the same content or attachments. Stored attachments are referenced
+// as they are.
+func (dao *Messages) insertEntry(tx *sql.Tx, address string, entry *MessagesEntry) error {
+	contentDigest, err := storeBlob(tx, []byte(entry.Content))
+	if err != nil {
+		return err
+	}
+	attachmentsDigest := entry.storedAttachmentsDigest()
+	if attachmentsDigest == nil && len(entry.Attachments) > 0 {
+		attachmentsDigest, err = storeBlob(tx, entry.Attachments)
+		if err != nil {
+			return err
+		}
+	}
+
+	keySafeDigest := sha256.Sum256([]byte(entry.KeySafe))
+
 	query := "WITH usr AS (SELECT user_id FROM addresses WHERE address=$1) " +
-		"INSERT INTO messages (id, user_id, received, keysafe, content, attachments, meta) " +
+		"INSERT INTO messages (id, user_id, recipient, sender, received, keysafe, content, meta, read, keysafe_digest, content_digest, attachments_digest, expires, recall_hash) " +
 		"VALUES (kullo_new_id('messages', (SELECT user_id FROM usr)), " +
-		"(SELECT user_id FROM usr), $2, $3, $4, $5, $6) " +
+		"(SELECT user_id FROM usr), $2, nullif($3, ''), $4, $5, '', $6, $7, $8, $9, $10, nullif($11, '')::timestamptz, $12) " +
 		"RETURNING id, last_modified"
-	var att *[]byte
-	if len(entry.Attachments) > 0 {
-		att = &entry.Attachments
-	}
-	err := dbconn.GetConn().
-		QueryRow(query, address, entry.Received, entry.KeySafe, entry.Content, att, entry.Meta).
+	err = tx.
+		QueryRow(query, address, entry.Recipient, entry.Sender, entry.Received, entry.KeySafe, entry.Meta, entry.Read, keySafeDigest[:], contentDigest, attachmentsDigest, entry.ExpiresAt, entry.RecallHash).
 		Scan(&entry.ID, &entry.LastModified)
-	return err
+	if err != nil {
+		return err
+	}
+
+	entry.KeySafeSHA256 = hex.EncodeToString(keySafeDigest[:])
+	entry.ContentSHA256 = hex.EncodeToString(contentDigest)
+	entry.AttachmentsSHA256 = hex.EncodeToString(attachmentsDigest)
+	return nil
+}
+
+// Stores data as a blob unless it exists already and returns its digest. The
+// reference is taken by inserting a message that uses the digest.
+func storeBlob(tx *sql.Tx, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	_, err := tx.Exec("SELECT kullo_store_blob($1, $2)", digest[:], data)
+	return digest[:], err
 }
 
 func (dao *Messages) GetEntry(address string, id uint32) (*MessagesEntry, error) {
 	entry := &MessagesEntry{}
 	err := dbconn.GetConn().
-		QueryRow("SELECT m.id, m.last_modified, m.deleted, m.received, m.meta, "+
-			"m.keysafe, m.content, m.attachments IS NOT NULL "+
+		QueryRow("SELECT m.id, m.last_modified, m.deleted, m.received, "+
+			"coalesce(m.recipient, ''), coalesce(m.sender, ''), m.meta, m.read, "+
+			"m.keysafe, coalesce(convert_from(c.data, 'UTF8'), m.content), "+
+			"m.attachments IS NOT NULL OR m.attachments_digest IS NOT NULL, "+
+			formatTimestamp("m.expires")+", m.receipt, "+
+			payloadDigests+" "+
 			"FROM messages m JOIN addresses a USING (user_id) "+
+			"LEFT JOIN blobs c ON c.digest = m.content_digest "+
 			"WHERE a.address=$1 AND m.id=$2", address, id).
-		Scan(&entry.ID, &entry.LastModified, &entry.Deleted, &entry.Received, &entry.Meta, &entry.KeySafe, &entry.Content, &entry.HasAttachments)
+		Scan(&entry.ID, &entry.LastModified, &entry.Deleted, &entry.Received, &entry.Recipient, &entry.Sender, &entry.Meta, &entry.Read, &entry.KeySafe, &entry.Content, &entry.HasAttachments, &entry.ExpiresAt, (*[]byte)(&entry.Receipt),
+			&entry.KeySafeSHA256, &entry.ContentSHA256, &entry.AttachmentsSHA256)
 	return entry, err
 }
 
-func (dao *Messages) ModifyMeta(address string, entry *MessagesEntry) (*IDLastModified, error) {
-	var meta IDLastModified
+// ModifyMeta sets the meta of a message and its read state, see
+// modifyMetaAndRead.
+func (dao *Messages) ModifyMeta(address string, entry *MessagesEntry, read *bool) (*IDLastModified, error) {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := modifyMetaAndRead(tx, address, entry.ID, entry.LastModified, entry.Meta, read)
+	if err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+// SetRead sets the read state of a message. Unlike meta, it doesn't need the
+// current lastModified, the last change wins.
+func (dao *Messages) SetRead(address string, id uint32, read bool) (*IDLastModified, error) {
+	return setRead(dbconn.GetConn(), address, id, read)
+}
+
+func setRead(q queryRower, address string, id uint32, read bool) (*IDLastModified, error) {
+	var result IDLastModified
+	err := q.
+		QueryRow("UPDATE messages m SET last_modified = DEFAULT, read = $3 "+
+			"FROM addresses a "+
+			"WHERE m.user_id = a.user_id AND a.address = $1 AND m.id = $2 "+
+			"AND m.read <> $3 AND NOT m.deleted "+
+			"RETURNING m.id, m.last_modified",
+			address, id, read).
+		Scan(&result.ID, &result.LastModified)
+	if err != sql.ErrNoRows {
+		return &result, err
+	}
+
+	// unchanged or deleted
+	err = q.
+		QueryRow("SELECT m.id, m.last_modified "+
+			"FROM messages m JOIN addresses a USING (user_id) "+
+			"WHERE a.address = $1 AND m.id = $2",
+			address, id).
+		Scan(&result.ID, &result.LastModified)
+	return &result, err
+}
+
+// modifyMetaAndRead sets the meta of a message and its read state. Clients
+// that don't know about the read state set the meta when the user has read a
+// message, so it is marked as read unless read is given.
+func modifyMetaAndRead(q queryRower, address string, id uint32, lastModified uint64, meta string, read *bool) (*IDLastModified, error) {
+	result, err := modifyMeta(q, address, id, lastModified, meta)
+	if err != nil {
+		return result, err
+	}
+	markRead := true
+	if read != nil {
+		markRead = *read
+	}
+	return setRead(q, address, id, markRead)
+}
+
+func modifyMeta(q queryRower, address string, id uint32, lastModified uint64, meta string) (*IDLastModified, error) {
+	var result IDLastModified
 	var conflict bool
-	err := dbconn.GetConn().
+	err := q.
 		QueryRow("SELECT id_, last_modified_, conflict_ "+
 			"FROM update_messages_meta($1, $2, $3, $4)",
-			address, entry.ID, entry.LastModified, entry.Meta).
-		Scan(&meta.ID, &meta.LastModified, &conflict)
+			address, id, lastModified, meta).
+		Scan(&result.ID, &result.LastModified, &conflict)
 	if conflict {
-		return &meta, ErrConflict
+		return &result, ErrConflict
 	}
-	return &meta, err
+	return &result, err
 }
 
 func (dao *Messages) DeleteEntry(address string, id uint32, lastModified uint64) (*IDLastModified, error) {
-	var meta IDLastModified
+	return deleteEntry(dbconn.GetConn(), address, id, lastModified)
+}
+
+func deleteEntry(q queryRower, address string, id uint32, lastModified uint64) (*IDLastModified, error) {
+	var result IDLastModified
 	var conflict bool
-	err := dbconn.GetConn().
+	err := q.
 		QueryRow("SELECT id_, last_modified_, conflict_ "+
 			"FROM delete_messages_entry($1, $2, $3)",
 			address, id, lastModified).
-		Scan(&meta.ID, &meta.LastModified, &conflict)
+		Scan(&result.ID, &result.LastModified, &conflict)
 	if conflict {
-		return &meta, ErrConflict
+		return &result, ErrConflict
+	}
+	return &result, err
+}
+
+// ApplyBatch modifies the meta or read state of or deletes several messages
+// in one transaction. If atomic is set, nothing is changed unless all operations
+// succeed. Returns the result of each operation and whether the changes have
+// been committed.
+func (dao *Messages) ApplyBatch(address string, ops []MessagesBatchOperation, atomic bool) ([]MessagesBatchResult, bool, error) {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return nil, false, err
 	}
-	return &meta, err
+	defer tx.Rollback()
+
+	results := make([]MessagesBatchResult, len(ops))
+	failed := false
+	for i, op := range ops {
+		var result *IDLastModified
+		switch {
+		case op.Delete:
+			result, err = deleteEntry(tx, address, op.ID, op.LastModified)
+		case op.Meta == nil:
+			result, err = setRead(tx, address, op.ID, *op.Read)
+		default:
+			result, err = modifyMetaAndRead(tx, address, op.ID, op.LastModified, *op.Meta, op.Read)
+		}
+
+		results[i] = MessagesBatchResult{ID: op.ID, LastModified: result.LastModified}
+		switch {
+		case err == nil:
+			results[i].Status = BATCH_OK
+		case err == ErrConflict:
+			results[i].Status = BATCH_CONFLICT
+		case err == sql.ErrNoRows:
+			results[i].Status = BATCH_NOT_FOUND
+			results[i].LastModified = 0
+		default:
+			return nil, false, err
+		}
+		failed = failed || err != nil
+	}
+
+	if atomic && failed {
+		for i := range results {
+			if results[i].Status == BATCH_OK {
+				results[i].Status = BATCH_ROLLED_BACK
+				results[i].LastModified = ops[i].LastModified
+			}
+		}
+		return results, false, nil
+	}
+	return results, true, tx.Commit()
 }
 
-func (dao *Messages) GetAttachments(address string, id uint32) ([]byte, error) {
-	var attachments []byte
+// GetAttachments returns the attachments of a message and their SHA-256.
+func (dao *Messages) GetAttachments(address string, id uint32) ([]byte, []byte, error) {
+	var attachments, digest []byte
 	err := dbconn.GetConn().
-		QueryRow("SELECT m.attachments "+
+		QueryRow("SELECT coalesce(m.attachments, b.data), m.attachments_digest "+
 			"FROM messages m JOIN addresses a USING (user_id) "+
-			"WHERE a.address=$1 AND m.id=$2 AND m.attachments IS NOT NULL",
+			"LEFT JOIN blobs b ON b.digest = m.attachments_digest "+
+			"WHERE a.address=$1 AND m.id=$2 "+
+			"AND (m.attachments IS NOT NULL OR m.attachments_digest IS NOT NULL)",
 			address, id).
-		Scan(&attachments)
-	return attachments, err
+		Scan(&attachments, &digest)
+	return attachments, digest, err
+}
+
+// DeleteDroppedBefore deletes the records of dropped messages that have been
+// (or would have been) delivered before the given time.
+func (dao *Messages) DeleteDroppedBefore(before time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM messages_dropped WHERE coalesce(deliver_at, created) < $1",
+		before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteUnreferencedBlobs deletes blobs that haven't been used by any message
+// since the given time.
+func (dao *Messages) DeleteUnreferencedBlobs(unreferencedBefore time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM blobs WHERE refs = 0 AND unreferenced < $1",
+		unreferencedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetBlobDigests returns the digests of up to limit blobs that come after the
+// given digest, in order. Pass nil to start with the first blob.
+func (dao *Messages) GetBlobDigests(after []byte, limit int) ([][]byte, error) {
+	if after == nil {
+		// NULL wouldn't match anything
+		after = []byte{}
+	}
+	rows, err := dbconn.GetConn().Query(
+		"SELECT digest FROM blobs WHERE digest > $1 ORDER BY digest LIMIT $2",
+		after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	digests := [][]byte{}
+	for rows.Next() {
+		var digest []byte
+		err = rows.Scan(&digest)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+	return digests, rows.Err()
+}
+
+func (dao *Messages) GetBlob(digest []byte) ([]byte, error) {
+	var data []byte
+	err := dbconn.GetConn().QueryRow(
+		"SELECT data FROM blobs WHERE digest=$1", digest).
+		Scan(&data)
+	return data, err
+}
+
+// KeySafeDigestEntry is the stored digest of the key safe of a message.
+type KeySafeDigestEntry struct {
+	ID      uint32
+	UserID  uint32
+	KeySafe string
+	Digest  []byte
+}
+
+// GetKeySafeDigests returns the key safes and their digests of up to limit
+// messages that come after the given message, ordered by ID and user ID.
+func (dao *Messages) GetKeySafeDigests(afterID uint32, afterUserID uint32, limit int) ([]KeySafeDigestEntry, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT id, user_id, keysafe, keysafe_digest FROM messages "+
+			"WHERE (id, user_id) > ($1, $2) AND keysafe_digest IS NOT NULL "+
+			"ORDER BY id, user_id LIMIT $3",
+		afterID, afterUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []KeySafeDigestEntry{}
+	for rows.Next() {
+		var entry KeySafeDigestEntry
+		err = rows.Scan(&entry.ID, &entry.UserID, &entry.KeySafe, &entry.Digest)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// GetSyncHorizon returns the last_modified of the newest tombstone that has
+// been purged from the user's messages, 0 if there is none.
+func (dao *Messages) GetSyncHorizon(address string) (uint64, error) {
+	var horizon uint64
+	err := dbconn.GetConn().
+		QueryRow("SELECT u.messages_sync_horizon "+
+			"FROM users u JOIN addresses a ON a.user_id = u.id "+
+			"WHERE a.address=$1", address).
+		Scan(&horizon)
+	return horizon, err
+}
+
+// PurgeTombstones deletes deleted messages that were last modified before
+// the given time and moves the sync horizon of their users. The tombstone
+// with the highest ID of each user is kept, because new IDs are derived from
+// it. Returns the number of users whose horizon has moved.
+func (dao *Messages) PurgeTombstones(modifiedBefore uint64) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"WITH purged AS ("+
+			"DELETE FROM messages m "+
+			"WHERE m.deleted AND m.last_modified < $1 "+
+			"AND m.id < (SELECT max(x.id) FROM messages x WHERE x.user_id = m.user_id) "+
+			"RETURNING m.user_id, m.last_modified) "+
+			"UPDATE users u "+
+			"SET messages_sync_horizon = greatest(u.messages_sync_horizon, p.horizon) "+
+			"FROM (SELECT user_id, max(last_modified) AS horizon FROM purged GROUP BY user_id) p "+
+			"WHERE u.id = p.user_id",
+		modifiedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Returns an SQL expression that formats a nullable timestamp column like
+// MessagesEntry.Received, or an empty string if it is NULL.
+func formatTimestamp(column string) string {
+	return "coalesce(to_char(" + column + " AT TIME ZONE 'UTC', " +
+		"'YYYY-MM-DD\"T\"HH24:MI:SS\"Z\"'), '')"
+}
+
+// turns a message into a tombstone, same as delete_messages_entry
+const tombstoneAssignments = "last_modified = DEFAULT, deleted = TRUE, received = '', meta = '', keysafe = '', " +
+	"content = '', attachments = NULL, sender = NULL, content_digest = NULL, " +
+	"attachments_digest = NULL, expires = NULL, receipt = NULL, keysafe_digest = NULL"
+
+// ExpireEntries turns messages that have expired before now into tombstones,
+// so that synced clients delete them too, and deletes expired held messages.
+// Returns the number of expired messages.
+func (dao *Messages) ExpireEntries(now time.Time) (int64, error) {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE messages SET "+tombstoneAssignments+" WHERE expires < $1 AND NOT deleted",
+		now)
+	if err != nil {
+		return 0, err
+	}
+	expired, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err = tx.Exec("DELETE FROM messages_held WHERE expires < $1", now)
+	if err != nil {
+		return 0, err
+	}
+	expiredHeld, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return expired + expiredHeld, tx.Commit()
+}
+
+var ErrAlreadyRead = errors.New("dao: message has been read")
+
+// Recall deletes the message with the given recall token hash if it is still
+// held, scheduled or has been dropped, or turns it into a tombstone if it
+// hasn't been read yet.
+// Returns whether a message in the inbox has been changed, ErrAlreadyRead if
+// the recipient has read it, or sql.ErrNoRows if there is no such message.
+func (dao *Messages) Recall(address string, recallHash []byte) (bool, error) {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"messages_held", "messages_scheduled", "messages_dropped"} {
+		result, err := tx.Exec(
+			"DELETE FROM "+table+" "+
+				"WHERE recall_hash=$1 AND user_id=(SELECT user_id FROM addresses WHERE address=$2)",
+			recallHash, address)
+		if err != nil {
+			return false, err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if deleted > 0 {
+			return false, tx.Commit()
+		}
+	}
+
+	var id uint32
+	var read bool
+	err = tx.QueryRow(
+		"SELECT m.id, m.read FROM messages m JOIN addresses a USING (user_id) "+
+			"WHERE a.address=$1 AND m.recall_hash=$2 AND NOT m.deleted "+
+			"FOR UPDATE OF m",
+		address, recallHash).
+		Scan(&id, &read)
+	if err != nil {
+		return false, err
+	}
+	if read {
+		return false, ErrAlreadyRead
+	}
+
+	_, err = tx.Exec(
+		"UPDATE messages SET "+tombstoneAssignments+" "+
+			"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$1) AND id=$2",
+		address, id)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
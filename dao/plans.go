@@ -0,0 +1,223 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"bitbucket.org/kullo/server/dbconn"
+	"github.com/lib/pq"
+)
+
+// domain of the plan domain rule that matches all domains without a rule
+const PLAN_DOMAIN_ANY string = "*"
+
+var ErrPlanExists = errors.New("dao: plan already exists")
+var ErrNoDefaultPlan = errors.New("dao: no plan domain rule matches")
+
+type PlansEntry struct {
+	Name              string `json:"name"`
+	StorageQuota      uint64 `json:"storageQuota"`
+	MaxAttachmentSize uint64 `json:"maxAttachmentSize"`
+	// 0 means unlimited
+	MaxDevices uint32 `json:"maxDevices"`
+	// number of addresses in addition to the primary address
+	MaxAliases uint32   `json:"maxAliases"`
+	Features   []string `json:"features"`
+}
+
+type PlanDomainRulesEntry struct {
+	Domain   string `json:"domain"`
+	PlanName string `json:"planName"`
+}
+
+type Plans struct {
+}
+
+func (dao *Plans) GetList() ([]PlansEntry, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT name, storage_quota, max_attachment_size, max_devices, max_aliases, features " +
+			"FROM plans ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []PlansEntry{}
+	for rows.Next() {
+		entry := PlansEntry{}
+		err = rows.Scan(&entry.Name, &entry.StorageQuota, &entry.MaxAttachmentSize,
+			&entry.MaxDevices, &entry.MaxAliases, (*pq.StringArray)(&entry.Features))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (dao *Plans) GetEntry(name string) (*PlansEntry, error) {
+	entry := &PlansEntry{}
+	err := dbconn.GetConn().
+		QueryRow("SELECT name, storage_quota, max_attachment_size, max_devices, max_aliases, features "+
+			"FROM plans WHERE name=$1", name).
+		Scan(&entry.Name, &entry.StorageQuota, &entry.MaxAttachmentSize,
+			&entry.MaxDevices, &entry.MaxAliases, (*pq.StringArray)(&entry.Features))
+	return entry, err
+}
+
+// InsertEntry returns ErrPlanExists if there already is a plan with the same
+// name. Records audit in the same transaction.
+func (dao *Plans) InsertEntry(entry *PlansEntry, audit *AdminAuditLogEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO plans "+
+			"(name, storage_quota, max_attachment_size, max_devices, max_aliases, features) "+
+			"VALUES ($1, $2, $3, $4, $5, $6)",
+		entry.Name, entry.StorageQuota, entry.MaxAttachmentSize,
+		entry.MaxDevices, entry.MaxAliases, pq.StringArray(entry.Features))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		return ErrPlanExists
+	}
+	if err != nil {
+		return err
+	}
+	err = insertAuditLogEntry(tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateEntry returns sql.ErrNoRows if there is no plan with the given name.
+// Records audit in the same transaction.
+func (dao *Plans) UpdateEntry(entry *PlansEntry, audit *AdminAuditLogEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE plans "+
+			"SET storage_quota=$1, max_attachment_size=$2, max_devices=$3, "+
+			"max_aliases=$4, features=$5 "+
+			"WHERE name=$6",
+		entry.StorageQuota, entry.MaxAttachmentSize, entry.MaxDevices,
+		entry.MaxAliases, pq.StringArray(entry.Features), entry.Name)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	// users that fit into a raised quota accept inbound messages again
+	_, err = tx.Exec(
+		"UPDATE users u "+
+			"SET inbound_read_only = FALSE "+
+			"FROM plans p "+
+			"WHERE u.plan_id = p.id AND p.name = $1 AND u.inbound_read_only "+
+			"AND "+storageSizeOfUser("u.id")+" <= p.storage_quota",
+		entry.Name)
+	if err != nil {
+		return err
+	}
+	err = insertAuditLogEntry(tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (dao *Plans) GetDomainRules() ([]PlanDomainRulesEntry, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT r.domain, p.name " +
+			"FROM plan_domain_rules r JOIN plans p ON r.plan_id = p.id " +
+			"ORDER BY r.domain")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []PlanDomainRulesEntry{}
+	for rows.Next() {
+		entry := PlanDomainRulesEntry{}
+		err = rows.Scan(&entry.Domain, &entry.PlanName)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// ReplaceDomainRules replaces all rules. Returns ErrUnknownPlan if a rule
+// refers to a plan that doesn't exist. Records audit in the same transaction.
+func (dao *Plans) ReplaceDomainRules(rules []PlanDomainRulesEntry, audit *AdminAuditLogEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM plan_domain_rules")
+	if err != nil {
+		return err
+	}
+
+	users := Users{}
+	for _, rule := range rules {
+		planId, err := users.getPlanId(tx, rule.PlanName)
+		if err == sql.ErrNoRows {
+			return ErrUnknownPlan
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO plan_domain_rules (domain, plan_id) VALUES ($1, $2)",
+			rule.Domain, planId)
+		if err != nil {
+			return err
+		}
+	}
+	err = insertAuditLogEntry(tx, audit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the plan that new users with the given address get. A rule for the
+// exact domain takes precedence over the catch-all rule.
+func (dao *Plans) getDefaultPlanId(transaction *sql.Tx, address string) (uint32, error) {
+	domain := address[strings.LastIndex(address, "#")+1:]
+
+	var id uint32
+	err := transaction.QueryRow(
+		"SELECT plan_id FROM plan_domain_rules "+
+			"WHERE domain = $1 OR domain = $2 "+
+			"ORDER BY domain = $2 LIMIT 1",
+		domain, PLAN_DOMAIN_ANY).
+		Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrNoDefaultPlan
+	}
+	return id, err
+}
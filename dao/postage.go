@@ -0,0 +1,74 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+	"github.com/lib/pq"
+)
+
+// error code of unique_violation, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const pqUniqueViolation pq.ErrorCode = "23505"
+
+type PostageSettings struct {
+}
+
+// GetRequired returns whether the user requires postage on incoming messages,
+// or sql.ErrNoRows if the user hasn't decided.
+func (dao *PostageSettings) GetRequired(address string) (bool, error) {
+	var required bool
+	err := dbconn.GetConn().
+		QueryRow("SELECT ps.required "+
+			"FROM postage_settings ps JOIN addresses a USING (user_id) "+
+			"WHERE a.address=$1", address).
+		Scan(&required)
+	return required, err
+}
+
+func (dao *PostageSettings) SetRequired(address string, required bool) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE postage_settings SET required=$1 "+
+		"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$2)",
+		required, address)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		_, err = tx.Exec("INSERT INTO postage_settings (user_id, required) "+
+			"VALUES ((SELECT user_id FROM addresses WHERE address=$1), $2)",
+			address, required)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type UsedPostage struct {
+}
+
+func (dao *UsedPostage) DeleteExpired(now time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM postage_used WHERE expires < $1",
+		now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+)
+
+// states of relayed messages
+const (
+	RELAY_QUEUED    string = "queued"
+	RELAY_DELIVERED string = "delivered"
+	RELAY_BOUNCED   string = "bounced"
+)
+
+// RelaysEntry is a message for a user on another server that couldn't be
+// delivered right away.
+type RelaysEntry struct {
+	ID        string
+	Recipient string
+	// verified address of the sender, "" for anonymous messages
+	Sender      string
+	ContentType string
+	// SHA-256 of the body, which is kept as a blob; nil when the relay is
+	// finished
+	BodyDigest  []byte
+	BodySize    int64
+	Status      string
+	Attempts    uint32
+	NextAttempt time.Time
+	LastError   string
+	Created     time.Time
+	Updated     time.Time
+}
+
+type Relays struct {
+}
+
+// InsertEntry stores body and queues entry unless the recipient already has
+// maxCount queued entries or entry would make their queued bodies exceed
+// maxBytes. Returns whether entry has been queued. The body is streamed to
+// storage, BodyDigest and BodySize of entry are set accordingly.
+func (dao *Relays) InsertEntry(entry *RelaysEntry, body io.Reader, maxCount uint32, maxBytes uint64) (bool, error) {
+	writer, err := (&BlobUploads{}).NewWriter()
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(writer, body)
+	var blob *StoredBlob
+	if err == nil {
+		blob, err = writer.Close()
+	}
+	if err != nil {
+		// chunks that cannot be deleted now are deleted with stale uploads
+		writer.Abort()
+		return false, err
+	}
+	entry.BodyDigest = nil
+	entry.BodySize = 0
+	if blob != nil {
+		entry.BodyDigest = blob.Digest
+		entry.BodySize = int64(blob.Size)
+	}
+
+	// if the entry isn't queued, the blob is collected as unreferenced
+	result, err := dbconn.GetConn().Exec(
+		"INSERT INTO federation_relays "+
+			"(id, recipient, sender, content_type, body_digest, body_size, attempts, next_attempt, last_error) "+
+			"SELECT $1, $2, $3, $4, $5::bytea, $6::bigint, $7::integer, $8::timestamp with time zone, $9 "+
+			"WHERE (SELECT count(*) < $10 AND coalesce(sum(body_size), 0) + $6::bigint <= $11 "+
+			"FROM federation_relays WHERE recipient=$2 AND status=$12)",
+		entry.ID, entry.Recipient, entry.Sender, entry.ContentType, entry.BodyDigest, entry.BodySize,
+		entry.Attempts, entry.NextAttempt, entry.LastError,
+		maxCount, maxBytes, RELAY_QUEUED)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted == 1, err
+}
+
+// OpenBody returns a reader for the body of an entry returned by GetDue.
+func (dao *Relays) OpenBody(entry *RelaysEntry) io.Reader {
+	if entry.BodyDigest == nil {
+		return bytes.NewReader(nil)
+	}
+	return newBlobReader(entry.BodyDigest)
+}
+
+// GetEntry returns the entry without its body, sql.ErrNoRows if there is none.
+func (dao *Relays) GetEntry(id string) (*RelaysEntry, error) {
+	entry := &RelaysEntry{}
+	err := dbconn.GetConn().
+		QueryRow("SELECT id, recipient, status, attempts, next_attempt, last_error, created, updated "+
+			"FROM federation_relays WHERE id=$1", id).
+		Scan(&entry.ID, &entry.Recipient, &entry.Status, &entry.Attempts,
+			&entry.NextAttempt, &entry.LastError, &entry.Created, &entry.Updated)
+	return entry, err
+}
+
+// GetDue returns up to limit queued entries whose next attempt is due.
+func (dao *Relays) GetDue(now time.Time, limit uint32) ([]RelaysEntry, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT id, recipient, sender, content_type, body_digest, body_size, attempts "+
+			"FROM federation_relays "+
+			"WHERE status=$1 AND next_attempt <= $2 "+
+			"ORDER BY next_attempt LIMIT $3",
+		RELAY_QUEUED, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []RelaysEntry{}
+	for rows.Next() {
+		entry := RelaysEntry{}
+		err = rows.Scan(&entry.ID, &entry.Recipient, &entry.Sender,
+			&entry.ContentType, &entry.BodyDigest, &entry.BodySize, &entry.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// RecordAttempt records a failed attempt and schedules the next one.
+func (dao *Relays) RecordAttempt(id string, nextAttempt time.Time, lastError string) error {
+	_, err := dbconn.GetConn().Exec(
+		"UPDATE federation_relays "+
+			"SET attempts=attempts+1, next_attempt=$1, last_error=$2, updated=now() "+
+			"WHERE id=$3",
+		nextAttempt, lastError, id)
+	return err
+}
+
+// Finish sets the final status of an entry and drops the message.
+func (dao *Relays) Finish(id string, status string, lastError string) error {
+	_, err := dbconn.GetConn().Exec(
+		"UPDATE federation_relays "+
+			"SET status=$1, last_error=$2, body_digest=NULL, attempts=attempts+1, updated=now() "+
+			"WHERE id=$3",
+		status, lastError, id)
+	return err
+}
+
+// DeleteFinished deletes entries that have been finished before the given time.
+func (dao *Relays) DeleteFinished(before time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM federation_relays WHERE status<>$1 AND updated < $2",
+		RELAY_QUEUED, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
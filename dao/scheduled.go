@@ -0,0 +1,75 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+)
+
+// ScheduledMessages stores messages that have been sent with a delivery time.
+// They are invisible to the recipient until they have been released.
+type ScheduledMessages struct {
+}
+
+// Cancel deletes a scheduled message that hasn't been delivered yet, or a
+// dropped one whose delivery time hasn't passed. Returns false if there is no
+// such message.
+func (dao *ScheduledMessages) Cancel(address string, id string) (bool, error) {
+	for _, query := range []string{
+		"DELETE FROM messages_scheduled " +
+			"WHERE id=$1 AND user_id=(SELECT user_id FROM addresses WHERE address=$2)",
+		"DELETE FROM messages_dropped " +
+			"WHERE scheduled_id=$1 AND user_id=(SELECT user_id FROM addresses WHERE address=$2) " +
+			"AND deliver_at > now()",
+	} {
+		result, err := dbconn.GetConn().Exec(query, id, address)
+		if err != nil {
+			return false, err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil || rows > 0 {
+			return rows > 0, err
+		}
+	}
+	return false, nil
+}
+
+// ScheduledDueEntry identifies a scheduled message whose delivery time has
+// come.
+type ScheduledDueEntry struct {
+	ID string
+	// the alias the message has been sent to might have been removed since,
+	// so this is the first address of the recipient
+	Address string
+	// "" for anonymous messages
+	Sender string
+}
+
+// GetNextDueEntry returns the scheduled message that has been due first, or
+// sql.ErrNoRows if no message is due.
+func (dao *ScheduledMessages) GetNextDueEntry(now time.Time) (*ScheduledDueEntry, error) {
+	entry := &ScheduledDueEntry{}
+	err := dbconn.GetConn().QueryRow(
+		"SELECT s.id, "+
+			"(SELECT a.address FROM addresses a WHERE a.user_id=s.user_id ORDER BY a.id LIMIT 1), "+
+			"coalesce(s.sender, '') "+
+			"FROM messages_scheduled s "+
+			"WHERE s.deliver_at <= $1 "+
+			"ORDER BY s.deliver_at LIMIT 1",
+		now).Scan(&entry.ID, &entry.Address, &entry.Sender)
+	return entry, err
+}
+
+// Postpone moves the delivery time of a scheduled message to deliverAt.
+func (dao *ScheduledMessages) Postpone(id string, deliverAt time.Time) error {
+	_, err := dbconn.GetConn().Exec(
+		"UPDATE messages_scheduled SET deliver_at=$1 WHERE id=$2",
+		deliverAt, id)
+	return err
+}
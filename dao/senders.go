@@ -0,0 +1,267 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package dao
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"bitbucket.org/kullo/server/dbconn"
+	"github.com/lib/pq"
+)
+
+// whom a user accepts messages from
+const (
+	SENDERS_ACCEPT_ALL      string = "all"
+	SENDERS_ACCEPT_VERIFIED string = "verified"
+	SENDERS_ACCEPT_ALLOWED  string = "allowed"
+)
+
+// what happens to messages of excluded senders
+const (
+	SENDERS_EXCLUDED_REJECT string = "reject"
+	SENDERS_EXCLUDED_DROP   string = "drop"
+)
+
+// actions of sender rules
+const (
+	SENDER_RULE_BLOCK string = "block"
+	SENDER_RULE_ALLOW string = "allow"
+)
+
+// reasons for excluding a sender, i.e. the counters
+const (
+	SENDER_EXCLUDED_BLOCKED     string = "blocked"
+	SENDER_EXCLUDED_UNVERIFIED  string = "unverified"
+	SENDER_EXCLUDED_NOT_ALLOWED string = "not_allowed"
+)
+
+// max. number of sender rules per user
+const SENDER_RULES_MAX int = 1000
+
+var ErrTooManySenderRules = errors.New("dao: too many sender rules")
+
+type SenderSettingsEntry struct {
+	Accept         string `json:"accept"`
+	ExcludedAction string `json:"excludedAction"`
+}
+
+type SenderRulesEntry struct {
+	// an address or a domain
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+}
+
+type SenderCounters struct {
+	Blocked      uint64     `json:"blocked"`
+	Unverified   uint64     `json:"unverified"`
+	NotAllowed   uint64     `json:"notAllowed"`
+	LastExcluded *time.Time `json:"lastExcluded"`
+}
+
+type SenderFilters struct {
+}
+
+// GetSettings returns the settings of the user, or sql.ErrNoRows if the user
+// hasn't configured any.
+func (dao *SenderFilters) GetSettings(address string) (*SenderSettingsEntry, error) {
+	entry := &SenderSettingsEntry{}
+	err := dbconn.GetConn().
+		QueryRow("SELECT ss.accept, ss.excluded_action "+
+			"FROM sender_settings ss JOIN addresses a USING (user_id) "+
+			"WHERE a.address=$1", address).
+		Scan(&entry.Accept, &entry.ExcludedAction)
+	return entry, err
+}
+
+func (dao *SenderFilters) InsertOrUpdateSettings(address string, entry *SenderSettingsEntry) error {
+	err := dao.ensureSettings(address)
+	if err != nil {
+		return err
+	}
+	_, err = dbconn.GetConn().Exec(
+		"UPDATE sender_settings SET accept=$1, excluded_action=$2 "+
+			"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$3)",
+		entry.Accept, entry.ExcludedAction, address)
+	return err
+}
+
+func (dao *SenderFilters) GetCounters(address string) (*SenderCounters, error) {
+	counters := &SenderCounters{}
+	err := dbconn.GetConn().
+		QueryRow("SELECT ss.blocked, ss.unverified, ss.not_allowed, ss.last_excluded "+
+			"FROM sender_settings ss JOIN addresses a USING (user_id) "+
+			"WHERE a.address=$1", address).
+		Scan(&counters.Blocked, &counters.Unverified, &counters.NotAllowed, &counters.LastExcluded)
+	if err == sql.ErrNoRows {
+		return counters, nil
+	}
+	return counters, err
+}
+
+// Count increments the counter of the given reason (SENDER_EXCLUDED_*).
+func (dao *SenderFilters) Count(address string, reason string) error {
+	var column string
+	switch reason {
+	case SENDER_EXCLUDED_BLOCKED:
+		column = "blocked"
+	case SENDER_EXCLUDED_UNVERIFIED:
+		column = "unverified"
+	case SENDER_EXCLUDED_NOT_ALLOWED:
+		column = "not_allowed"
+	default:
+		return fmt.Errorf("dao: unknown exclusion reason %s", reason)
+	}
+
+	err := dao.ensureSettings(address)
+	if err != nil {
+		return err
+	}
+	_, err = dbconn.GetConn().Exec(
+		"UPDATE sender_settings SET "+column+"="+column+"+1, last_excluded=now() "+
+			"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$1)",
+		address)
+	return err
+}
+
+func (dao *SenderFilters) ResetCounters(address string) error {
+	_, err := dbconn.GetConn().Exec(
+		"UPDATE sender_settings "+
+			"SET blocked=0, unverified=0, not_allowed=0, last_excluded=NULL "+
+			"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$1)",
+		address)
+	return err
+}
+
+func (dao *SenderFilters) GetRules(address string) ([]SenderRulesEntry, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT sr.pattern, sr.action "+
+			"FROM sender_rules sr JOIN addresses a USING (user_id) "+
+			"WHERE a.address=$1 "+
+			"ORDER BY sr.pattern", address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []SenderRulesEntry{}
+	for rows.Next() {
+		rule := SenderRulesEntry{}
+		err = rows.Scan(&rule.Pattern, &rule.Action)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// GetMatchingRules returns the rules for the sender's address and domain.
+func (dao *SenderFilters) GetMatchingRules(address string, sender string) ([]SenderRulesEntry, error) {
+	domain := sender[strings.LastIndex(sender, "#")+1:]
+	rows, err := dbconn.GetConn().Query(
+		"SELECT sr.pattern, sr.action "+
+			"FROM sender_rules sr JOIN addresses a USING (user_id) "+
+			"WHERE a.address=$1 AND sr.pattern IN ($2, $3)",
+		address, sender, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []SenderRulesEntry{}
+	for rows.Next() {
+		rule := SenderRulesEntry{}
+		err = rows.Scan(&rule.Pattern, &rule.Action)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// SetRule inserts or replaces the rule for rule.Pattern. Returns
+// ErrTooManySenderRules if the user already has SENDER_RULES_MAX rules.
+func (dao *SenderFilters) SetRule(address string, rule *SenderRulesEntry) error {
+	tx, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userId uint32
+	var count int
+	err = tx.QueryRow(
+		"SELECT a.user_id, (SELECT count(*) FROM sender_rules WHERE user_id=a.user_id) "+
+			"FROM addresses a WHERE a.address=$1 "+
+			"FOR UPDATE",
+		address).Scan(&userId, &count)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		"UPDATE sender_rules SET action=$1 WHERE user_id=$2 AND pattern=$3",
+		rule.Action, userId, rule.Pattern)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		if count >= SENDER_RULES_MAX {
+			return ErrTooManySenderRules
+		}
+		_, err = tx.Exec(
+			"INSERT INTO sender_rules (user_id, pattern, action) VALUES ($1, $2, $3)",
+			userId, rule.Pattern, rule.Action)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteRule returns sql.ErrNoRows if there is no rule for pattern.
+func (dao *SenderFilters) DeleteRule(address string, pattern string) error {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM sender_rules "+
+			"WHERE user_id=(SELECT user_id FROM addresses WHERE address=$1) AND pattern=$2",
+		address, pattern)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Inserts the default settings for the user unless there are settings already.
+func (dao *SenderFilters) ensureSettings(address string) error {
+	_, err := dbconn.GetConn().Exec(
+		"INSERT INTO sender_settings (user_id) "+
+			"SELECT a.user_id FROM addresses a "+
+			"WHERE a.address=$1 "+
+			"AND NOT EXISTS (SELECT 1 FROM sender_settings ss WHERE ss.user_id=a.user_id)",
+		address)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		// inserted concurrently
+		return nil
+	}
+	return err
+}
@@ -9,20 +9,27 @@ package dao
 import (
 	"database/sql"
 	"errors"
-	"strings"
+	"time"
 
 	"bitbucket.org/kullo/server/dbconn"
+	"github.com/lib/pq"
 )
 
 type UsersEntry struct {
-	ID               uint32 `json:"id"`
-	AcceptedTerms    string `json:"acceptedTerms"`
-	PlanName         string `json:"planName"`
-	StorageQuota     uint64 `json:"storageQuota"`
-	ResetCode        string `json:"-"`
-	WebloginUsername string `json:"-"`
-	WebloginSecret   string `json:"-"`
-	Language         string `json:"-"`
+	ID                uint32     `json:"id"`
+	AcceptedTerms     string     `json:"acceptedTerms"`
+	PlanName          string     `json:"planName"`
+	StorageQuota      uint64     `json:"storageQuota"`
+	MaxAttachmentSize uint64     `json:"maxAttachmentSize"`
+	MaxDevices        uint32     `json:"maxDevices"` // 0 = unlimited
+	MaxAliases        uint32     `json:"maxAliases"`
+	Features          []string   `json:"features"`
+	InboundReadOnly   bool       `json:"-"` // storage quota of the plan is exceeded
+	ResetCode         string     `json:"-"`
+	WebloginUsername  string     `json:"-"`
+	WebloginSecret    string     `json:"-"`
+	Language          string     `json:"-"`
+	DeletionScheduled *time.Time `json:"-"` // nil unless deletion has been requested
 }
 
 type AddressesEntry struct {
@@ -99,15 +106,9 @@ func (dao *Users) getPlanId(transaction *sql.Tx, planName string) (uint32, error
 	return id, err
 }
 
-func (dao *Users) getDefaultPlanName(address string) string {
-	if strings.HasSuffix(address, "#kullo.net") || strings.HasSuffix(address, "#kullo.test") {
-		return "Free"
-	} else {
-		return "Professional"
-	}
-}
-
-func (dao *Users) InsertEntry(entry *AddressesEntry, acceptedTerms string) error {
+// InsertEntry creates a user with the plan planName. If planName is empty, the
+// plan domain rules decide which plan the user gets.
+func (dao *Users) InsertEntry(entry *AddressesEntry, acceptedTerms string, planName string) error {
 	transaction, err := dbconn.GetConn().Begin()
 	if err != nil {
 		return err
@@ -128,7 +129,16 @@ func (dao *Users) InsertEntry(entry *AddressesEntry, acceptedTerms string) error
 		return ErrAddressAlreadyExists
 	}
 
-	planId, err := dao.getPlanId(transaction, dao.getDefaultPlanName(entry.Address))
+	var planId uint32
+	if planName != "" {
+		planId, err = dao.getPlanId(transaction, planName)
+		if err == sql.ErrNoRows {
+			err = ErrUnknownPlan
+		}
+	} else {
+		plans := Plans{}
+		planId, err = plans.getDefaultPlanId(transaction, entry.Address)
+	}
 	if err != nil {
 		return err
 	}
@@ -157,17 +167,46 @@ func (dao *Users) GetEntry(address string) (*UsersEntry, error) {
 		QueryRow(
 			"SELECT u.id, u.reset_code, u.accepted_terms, "+
 				"p.name, p.storage_quota, "+
+				"p.max_attachment_size, p.max_devices, p.max_aliases, p.features, "+
+				"u.inbound_read_only, "+
 				"u.weblogin_username, u.weblogin_secret, "+
-				"u.language "+
+				"u.language, u.deletion_scheduled "+
 				"FROM users u, plans p, addresses a "+
 				"WHERE u.plan_id=p.id AND u.id=a.user_id AND a.address=$1", address).
 		Scan(&entry.ID, &entry.ResetCode, &entry.AcceptedTerms,
 			&entry.PlanName, &entry.StorageQuota,
+			&entry.MaxAttachmentSize, &entry.MaxDevices, &entry.MaxAliases,
+			(*pq.StringArray)(&entry.Features),
+			&entry.InboundReadOnly,
 			&entry.WebloginUsername, &entry.WebloginSecret,
-			&entry.Language)
+			&entry.Language, &entry.DeletionScheduled)
 	return entry, err
 }
 
+// RecheckInboundReadOnly lifts the read-only state for inbound messages once
+// the user's storage usage fits into the quota of their plan again, e.g. after
+// messages have been deleted. Returns whether the user is still read-only.
+func (dao *Users) RecheckInboundReadOnly(address string) (bool, error) {
+	return recheckInboundReadOnly(dbconn.GetConn(), address)
+}
+
+func recheckInboundReadOnly(q queryRower, address string) (bool, error) {
+	var readOnly bool
+	err := q.QueryRow(
+		"UPDATE users u "+
+			"SET inbound_read_only = "+storageSizeOfUser("u.id")+" > p.storage_quota "+
+			"FROM plans p "+
+			"WHERE u.plan_id = p.id AND u.inbound_read_only "+
+			"AND u.id = (SELECT user_id FROM addresses WHERE address = $1) "+
+			"RETURNING u.inbound_read_only",
+		address).Scan(&readOnly)
+	if err == sql.ErrNoRows {
+		// not read-only in the first place
+		return false, nil
+	}
+	return readOnly, err
+}
+
 func (dao *Users) Reset(address string) error {
 	transaction, err := dbconn.GetConn().Begin()
 	if err != nil {
@@ -182,9 +221,9 @@ func (dao *Users) Reset(address string) error {
 		return err
 	}
 
-	// delete reset code
+	// delete reset code, a reset account is in use again
 	_, err = transaction.Exec(
-		"UPDATE users SET reset_code='' WHERE id=$1",
+		"UPDATE users SET reset_code='', deletion_scheduled=NULL WHERE id=$1",
 		userId)
 	if err != nil {
 		return err
@@ -246,3 +285,121 @@ func (dao *Users) UpdateLatestLoginTimestampAndLanguage(address string, language
 		language, address)
 	return err
 }
+
+// AddressTombstoned returns whether the address has been given up recently,
+// either by deleting an account or alias or by changing an address.
+func (dao *Users) AddressTombstoned(address string) (bool, error) {
+	var tombstoned bool
+	err := dbconn.GetConn().
+		QueryRow("SELECT "+
+			"EXISTS (SELECT 1 FROM address_tombstones WHERE address=$1) OR "+
+			"EXISTS (SELECT 1 FROM address_forwards WHERE address=$1 AND expires > now())",
+			address).
+		Scan(&tombstoned)
+	return tombstoned, err
+}
+
+func (dao *Users) ScheduleDeletion(address string, deletion time.Time) error {
+	_, err := dbconn.GetConn().Exec(
+		"UPDATE users u "+
+			"SET deletion_scheduled = $1 "+
+			"FROM addresses a "+
+			"WHERE u.id = a.user_id AND a.address = $2 ",
+		deletion, address)
+	return err
+}
+
+// CancelDeletion returns false if no deletion has been scheduled.
+func (dao *Users) CancelDeletion(address string) (bool, error) {
+	result, err := dbconn.GetConn().Exec(
+		"UPDATE users u "+
+			"SET deletion_scheduled = NULL "+
+			"FROM addresses a "+
+			"WHERE u.id = a.user_id AND a.address = $1 "+
+			"AND u.deletion_scheduled IS NOT NULL",
+		address)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// GetAddressesDueForDeletion returns one address per user whose scheduled
+// deletion time has passed.
+func (dao *Users) GetAddressesDueForDeletion(now time.Time) ([]string, error) {
+	rows, err := dbconn.GetConn().Query(
+		"SELECT DISTINCT ON (u.id) a.address "+
+			"FROM users u JOIN addresses a ON u.id = a.user_id "+
+			"WHERE u.deletion_scheduled <= $1 "+
+			"ORDER BY u.id, a.id",
+		now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []string{}
+	for rows.Next() {
+		var address string
+		err = rows.Scan(&address)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, rows.Err()
+}
+
+// Delete removes the user and all of their data. Only tombstones of the
+// user's addresses are kept. Does nothing if the deletion has been cancelled
+// in the meantime.
+func (dao *Users) Delete(address string) error {
+	transaction, err := dbconn.GetConn().Begin()
+	if err != nil {
+		return err
+	}
+	defer transaction.Rollback()
+
+	var userId uint64
+	err = transaction.QueryRow(
+		"SELECT u.id FROM users u JOIN addresses a ON u.id = a.user_id "+
+			"WHERE a.address=$1 AND u.deletion_scheduled <= now() "+
+			"FOR UPDATE OF u",
+		address).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = transaction.Exec(
+		"INSERT INTO address_tombstones (address) "+
+			"SELECT address FROM addresses WHERE user_id=$1",
+		userId)
+	if err != nil {
+		return err
+	}
+
+	// messages, attachments, profile, keys, push registrations, notification
+	// settings and addresses are removed by ON DELETE CASCADE
+	_, err = transaction.Exec(
+		"DELETE FROM users WHERE id=$1",
+		userId)
+	if err != nil {
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+func (dao *Users) DeleteTombstonesBefore(before time.Time) (int64, error) {
+	result, err := dbconn.GetConn().Exec(
+		"DELETE FROM address_tombstones WHERE deleted < $1",
+		before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
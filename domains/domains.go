@@ -0,0 +1,214 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package domains
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/validation"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+// Domain is a local domain, i.e. a domain whose addresses are hosted by this
+// server.
+type Domain struct {
+	Name string `json:"name"`
+	// plan of new users, "" = use the plan domain rules
+	DefaultPlan string `json:"defaultPlan"`
+	// whether new users may register without a challenge if no challenge
+	// type requires one
+	ChallengesOptional bool `json:"challengesOptional"`
+	RegistrationOpen   bool `json:"registrationOpen"`
+	// directory of the notification templates, "" = default templates
+	Branding string `json:"branding"`
+}
+
+var ErrNoDomains = errors.New("domains: no domains configured")
+
+var (
+	mutex          sync.RWMutex
+	configPath     string
+	fallbackDomain string
+	domains        = map[string]*Domain{}
+)
+
+// Init loads the local domains from the config file at path. If the file
+// doesn't exist, fallback is the only local domain, with default settings.
+func Init(path string, fallback string) error {
+	mutex.Lock()
+	configPath = path
+	fallbackDomain = fallback
+	mutex.Unlock()
+	return Reload()
+}
+
+// Reload reads the config file passed to Init again. On error, the previous
+// configuration stays active.
+func Reload() error {
+	mutex.RLock()
+	path := configPath
+	fallback := fallbackDomain
+	mutex.RUnlock()
+
+	loaded, err := load(path, fallback)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	domains = loaded
+	mutex.Unlock()
+	return nil
+}
+
+// Get returns the local domain with the given name, nil if it isn't local.
+func Get(name string) *Domain {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	domain, ok := domains[name]
+	if !ok {
+		return nil
+	}
+	copied := *domain
+	return &copied
+}
+
+// ForAddress returns the local domain of address, nil if it isn't local.
+func ForAddress(address string) *Domain {
+	separator := strings.LastIndex(address, "#")
+	if separator < 0 {
+		return nil
+	}
+	return Get(address[separator+1:])
+}
+
+// List returns all local domains, ordered by name.
+func List() []Domain {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	list := make([]Domain, 0, len(domains))
+	for _, domain := range domains {
+		list = append(list, *domain)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Names returns the names of all local domains, ordered by name.
+func Names() []string {
+	names := []string{}
+	for _, domain := range List() {
+		names = append(names, domain.Name)
+	}
+	return names
+}
+
+func newDomain(name string) *Domain {
+	return &Domain{
+		Name:               name,
+		ChallengesOptional: true,
+		RegistrationOpen:   true,
+	}
+}
+
+func load(path string, fallback string) (map[string]*Domain, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := validation.ValidateDomain(fallback); err != nil {
+			return nil, fmt.Errorf("domains: bad domain %s", fallback)
+		}
+		return map[string]*Domain{fallback: newDomain(fallback)}, nil
+	}
+
+	conf, err := yaml.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := parse(conf.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	// fail early instead of on the first registration
+	plans := dao.Plans{}
+	for _, domain := range loaded {
+		if domain.DefaultPlan == "" {
+			continue
+		}
+		_, err := plans.GetEntry(domain.DefaultPlan)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("domains: unknown plan %s for %s",
+				domain.DefaultPlan, domain.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+// parse reads a map from domain names to their settings. Settings that are
+// missing get their default values.
+func parse(root yaml.Node) (map[string]*Domain, error) {
+	config, ok := root.(yaml.Map)
+	if !ok || len(config) == 0 {
+		return nil, ErrNoDomains
+	}
+
+	loaded := map[string]*Domain{}
+	for name, node := range config {
+		if _, err := validation.ValidateDomain(name); err != nil {
+			return nil, fmt.Errorf("domains: bad domain %s", name)
+		}
+		domain := newDomain(name)
+		loaded[name] = domain
+
+		if scalar, ok := node.(yaml.Scalar); node == nil || ok && scalar.String() == "" {
+			continue
+		}
+		settings, ok := node.(yaml.Map)
+		if !ok {
+			return nil, fmt.Errorf("domains: settings of %s must be a map", name)
+		}
+		for key, valueNode := range settings {
+			valueScalar, ok := valueNode.(yaml.Scalar)
+			if !ok && valueNode != nil {
+				return nil, fmt.Errorf("domains: %s.%s must be a scalar", name, key)
+			}
+			value := strings.TrimSpace(valueScalar.String())
+
+			var err error
+			switch key {
+			case "defaultPlan":
+				if value != "" {
+					domain.DefaultPlan, err = validation.ValidatePlanName(value)
+				}
+			case "challengesOptional":
+				domain.ChallengesOptional, err = strconv.ParseBool(value)
+			case "registrationOpen":
+				domain.RegistrationOpen, err = strconv.ParseBool(value)
+			case "branding":
+				if value != "" {
+					domain.Branding, err = validation.ValidateBranding(value)
+				}
+			default:
+				err = errors.New("unknown setting")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("domains: %s.%s: %v", name, key, err)
+			}
+		}
+	}
+	return loaded, nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package domains
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+func parseString(t *testing.T, config string) (map[string]*Domain, error) {
+	root, err := yaml.Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal("yaml.Parse:", err)
+	}
+	return parse(root)
+}
+
+func TestParse(t *testing.T) {
+	loaded, err := parseString(t, ""+
+		"kullo.test:\n"+
+		"  defaultPlan: Friend\n"+
+		"  challengesOptional: false\n"+
+		"  registrationOpen: false\n"+
+		"  branding: example\n"+
+		"example.com:\n"+
+		"  branding: example\n")
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if len(loaded) != 2 {
+		t.Fatal("Number of domains is", len(loaded))
+	}
+
+	expected := Domain{
+		Name:               "kullo.test",
+		DefaultPlan:        "Friend",
+		ChallengesOptional: false,
+		RegistrationOpen:   false,
+		Branding:           "example",
+	}
+	if *loaded["kullo.test"] != expected {
+		t.Errorf("Result is %+v", *loaded["kullo.test"])
+	}
+
+	expected = Domain{
+		Name:               "example.com",
+		ChallengesOptional: true,
+		RegistrationOpen:   true,
+		Branding:           "example",
+	}
+	if *loaded["example.com"] != expected {
+		t.Errorf("Result is %+v", *loaded["example.com"])
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	_, err := parseString(t, "")
+	if err != ErrNoDomains {
+		t.Error("Error is", err)
+	}
+}
+
+func TestParseBadDomain(t *testing.T) {
+	_, err := parseString(t, "Not a domain:\n  registrationOpen: true\n")
+	if err == nil {
+		t.Error("Bad domain accepted")
+	}
+}
+
+func TestParseBadSettings(t *testing.T) {
+	configs := []string{
+		"kullo.test:\n  registrationOpen: maybe\n",
+		"kullo.test:\n  branding: ../de\n",
+		"kullo.test:\n  defaultPlan: Free!\n",
+		"kullo.test:\n  colour: red\n",
+	}
+	for _, config := range configs {
+		_, err := parseString(t, config)
+		if err == nil {
+			t.Errorf("Config accepted: %q", config)
+		}
+	}
+}
@@ -14,6 +14,7 @@ def deploy():
 		execute(update_preregistrations)
 		execute(update_hooks)
 		execute(update_message_templates)
+		execute(update_secrets)
 		put('kulloserver', 'kulloserver-new', mode=0755)
 		run('rm kulloserver-old', warn_only=True)
 		run('mv kulloserver kulloserver-old', warn_only=True)
@@ -46,6 +47,22 @@ def update_message_templates():
 	with cd(KULLOSERVER_DIR):
 		put('config/message_templates', 'config')
 
+# not part of the repository, see README.md
+SECRETS = [
+	'config/postage_key.yml',
+	'config/admins.yml',
+	'config/receipt_keys.yml',
+]
+
+@task
+def update_secrets():
+	with cd(KULLOSERVER_DIR):
+		for path in SECRETS:
+			if os.path.exists(path):
+				put(path, path, mode=0600)
+			else:
+				print('Not deploying missing %s' % path)
+
 @task
 def update_goose():
 	gopath = os.environ['GOPATH']
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package federation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// request headers of the server-to-server API
+const (
+	PeerHeader      = "Kullo-Peer"
+	DateHeader      = "Kullo-Peer-Date"
+	SignatureHeader = "Kullo-Peer-Signature"
+)
+
+// how far the date of a request may be off
+const maxClockSkew = 5 * time.Minute
+
+var ErrUnknownPeer = errors.New("federation: unknown peer")
+var ErrBadDate = errors.New("federation: request date missing or out of range")
+var ErrBadSignature = errors.New("federation: bad signature")
+
+// sign returns the signature of a request. It covers the method, the path
+// with query, the date and the body, given by its SHA-256 digest so that the
+// body doesn't have to be held in memory.
+func sign(secret []byte, method string, requestUri string, date string, bodyHash []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + requestUri + "\n" + date + "\n"))
+	mac.Write([]byte(hex.EncodeToString(bodyHash)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature of a request by peer, which has been made at
+// date (seconds since the epoch).
+func verify(peer *Peer, method string, requestUri string, date string, signature string,
+	bodyHash []byte, now time.Time) error {
+
+	seconds, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return ErrBadDate
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return ErrBadDate
+	}
+
+	expected := sign(peer.Secret, method, requestUri, date, bodyHash)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package federation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/postage"
+	"bitbucket.org/kullo/server/util"
+)
+
+// path prefix of the server-to-server API
+const ApiPrefix = "/federation"
+
+// request header that carries the postage stamp of relayed messages
+const postageHeader = "Kullo-Postage"
+
+// request header that carries the verified address of the sender of relayed
+// messages
+const SenderHeader = "Kullo-Sender"
+
+// relays are bounced after this many attempts, i.e. after about two days
+const maxAttempts = 15
+
+// longest delay between two attempts
+const maxBackoff = 6 * time.Hour
+
+// Queued relays of a recipient are limited, so that senders cannot fill the
+// queue while the recipient's server is unreachable.
+const maxQueuedPerRecipient uint32 = 100
+const maxQueuedBytesPerRecipient = uint64(2 * dao.MESSAGE_ATTACHMENTS_MAX_BYTES)
+
+// Retries don't pay more postage than this, see buyPostage
+const maxPostageBits uint = 24
+
+// ErrQueueFull is returned by Enqueue if the recipient has too many queued
+// relays.
+var ErrQueueFull = errors.New("federation: too many messages queued for the recipient")
+
+// ErrBadEncoding is returned by EncodeMessage if a part of the message isn't
+// valid base64.
+var ErrBadEncoding = errors.New("federation: invalid encoding")
+
+// upper bound for server-to-server request bodies: a multipart message
+const maxBodySize = int64(dao.MESSAGE_ATTACHMENTS_MAX_BYTES + 2*dao.MEBIBYTE)
+
+// request bodies up to this size are kept in memory, larger ones are spooled
+// to a temporary file
+const bodyMemoryBytes = 1 * dao.MEBIBYTE
+
+type relaysDao interface {
+	InsertEntry(entry *dao.RelaysEntry, body io.Reader, maxCount uint32, maxBytes uint64) (bool, error)
+	OpenBody(entry *dao.RelaysEntry) io.Reader
+	GetEntry(id string) (*dao.RelaysEntry, error)
+	GetDue(now time.Time, limit uint32) ([]dao.RelaysEntry, error)
+	RecordAttempt(id string, nextAttempt time.Time, lastError string) error
+	Finish(id string, status string, lastError string) error
+}
+
+// requestBody is the body of a request to a peer. It is streamed, its digest
+// is known beforehand for the signature.
+type requestBody struct {
+	reader io.Reader
+	size   int64
+	sha256 []byte
+}
+
+// Response is the reply of a peer.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Delivered returns whether a relayed message has been accepted by the peer.
+func (self *Response) Delivered() bool {
+	return self.Status >= 200 && self.Status < 300
+}
+
+// Retryable returns whether the peer might accept a relayed message later.
+func (self *Response) Retryable() bool {
+	return self.Status >= 500 ||
+		self.Status == http.StatusRequestTimeout ||
+		self.Status == http.StatusTooManyRequests
+}
+
+// Federation exchanges messages and public keys with the home servers of
+// users that don't live on this server.
+type Federation struct {
+	// the name by which the peers know this server
+	name      string
+	directory *Directory
+	client    *http.Client
+	relaysDao relaysDao
+	now       func() time.Time
+}
+
+func NewFederation(name string, directory *Directory) Federation {
+	return Federation{
+		name:      name,
+		directory: directory,
+		client:    &http.Client{Timeout: 60 * time.Second},
+		relaysDao: &dao.Relays{},
+		now:       time.Now,
+	}
+}
+
+// HomeServer returns the peer that hosts address. Returns ErrNoHomeServer if
+// there is none.
+func (self *Federation) HomeServer(address string) (*Peer, error) {
+	domain := address[strings.LastIndex(address, "#")+1:]
+	return self.directory.HomeServer(domain)
+}
+
+// VouchesFor returns whether peer is the home server of address, so that it
+// can be trusted to have authenticated address as the sender of a message.
+func (self *Federation) VouchesFor(peer *Peer, address string) bool {
+	homeServer, err := self.HomeServer(address)
+	return err == nil && homeServer.Name == peer.Name
+}
+
+// Reload reads the peers from their config file again.
+func (self *Federation) Reload() error {
+	return self.directory.Reload()
+}
+
+// Get requests a resource of a user from their home server. suffix is
+// appended to the path of the user, e.g. "/keys/public".
+func (self *Federation) Get(peer *Peer, address string, suffix string, rawQuery string) (*Response, error) {
+	return self.do(peer, http.MethodGet, userPath(address)+suffix, rawQuery, nil, "", nil)
+}
+
+// Relay delivers a message to a user on another server. sender is the
+// verified address of the sender or "". contentType and body must be a
+// multipart body as created by EncodeMessage.
+func (self *Federation) Relay(peer *Peer, recipient string, sender string, stamp string,
+	contentType string, body *util.Spool) (*Response, error) {
+
+	err := body.Rewind()
+	if err != nil {
+		return nil, err
+	}
+	return self.relay(peer, recipient, sender, stamp, contentType,
+		&requestBody{body, body.Size(), body.SHA256()})
+}
+
+func (self *Federation) relay(peer *Peer, recipient string, sender string, stamp string,
+	contentType string, body *requestBody) (*Response, error) {
+
+	header := http.Header{}
+	if sender != "" {
+		header.Set(SenderHeader, sender)
+	}
+	if stamp != "" {
+		header.Set(postageHeader, stamp)
+	}
+	return self.do(peer, http.MethodPost, userPath(recipient)+"/messages", "",
+		header, contentType, body)
+}
+
+// Enqueue stores a message that couldn't be relayed right away, so that the
+// delivery can be retried later. Returns the ID of the relay by which the
+// sender can ask whether the message has been delivered or bounced, or
+// ErrQueueFull. The stamp of the sender isn't kept, it will have expired by
+// the time of the retry.
+func (self *Federation) Enqueue(recipient string, sender string,
+	contentType string, body *util.Spool, lastError string) (string, error) {
+
+	err := body.Rewind()
+	if err != nil {
+		return "", err
+	}
+	idBytes := make([]byte, 16)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return "", err
+	}
+	entry := &dao.RelaysEntry{
+		ID:          hex.EncodeToString(idBytes),
+		Recipient:   recipient,
+		Sender:      sender,
+		ContentType: contentType,
+		Attempts:    1,
+		NextAttempt: self.now().Add(backoff(1)),
+		LastError:   lastError,
+	}
+	queued, err := self.relaysDao.InsertEntry(entry, body, maxQueuedPerRecipient, maxQueuedBytesPerRecipient)
+	if err != nil {
+		return "", err
+	}
+	if !queued {
+		return "", ErrQueueFull
+	}
+	return entry.ID, nil
+}
+
+// GetRelay returns the state of a queued relay, sql.ErrNoRows if there is none.
+func (self *Federation) GetRelay(id string) (*dao.RelaysEntry, error) {
+	return self.relaysDao.GetEntry(id)
+}
+
+// RetryQueued tries to deliver all queued messages whose next attempt is due.
+// Messages that cannot be delivered are bounced.
+func (self *Federation) RetryQueued() error {
+	for {
+		entries, err := self.relaysDao.GetDue(self.now(), 100)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		for _, entry := range entries {
+			err = self.retry(&entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (self *Federation) retry(entry *dao.RelaysEntry) error {
+	lastError := ""
+	retryable := true
+
+	// the peer configuration may have changed since the message was queued
+	peer, err := self.HomeServer(entry.Recipient)
+	if err != nil {
+		lastError = err.Error()
+		retryable = false
+	} else {
+		resp, err := self.relayWithPostage(peer, entry)
+		switch {
+		case err != nil:
+			lastError = err.Error()
+		case resp.Delivered():
+			return self.relaysDao.Finish(entry.ID, dao.RELAY_DELIVERED, "")
+		default:
+			lastError = DescribeFailure(resp)
+			// the difficulty may have risen between challenge and delivery
+			retryable = resp.Retryable() || resp.Status == http.StatusPaymentRequired
+		}
+	}
+
+	attempts := entry.Attempts + 1
+	if !retryable || attempts >= maxAttempts {
+		log.Printf("[federation] bounced relay %s to %s: %s", entry.ID, entry.Recipient, lastError)
+		return self.relaysDao.Finish(entry.ID, dao.RELAY_BOUNCED, lastError)
+	}
+	return self.relaysDao.RecordAttempt(entry.ID, self.now().Add(backoff(attempts)), lastError)
+}
+
+// relayWithPostage relays a queued message with a stamp for a fresh challenge
+// of the peer. If the peer doesn't answer the challenge request successfully,
+// that answer is returned instead.
+func (self *Federation) relayWithPostage(peer *Peer, entry *dao.RelaysEntry) (*Response, error) {
+	resp, err := self.Get(peer, entry.Recipient, "/messages/postage",
+		"size="+strconv.FormatInt(entry.BodySize, 10))
+	if err != nil || !resp.Delivered() {
+		return resp, err
+	}
+	stamp, err := buyPostage(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return self.relay(peer, entry.Recipient, entry.Sender, stamp, entry.ContentType,
+		&requestBody{self.relaysDao.OpenBody(entry), entry.BodySize, entry.BodyDigest})
+}
+
+// buyPostage solves the challenge in the reply of a peer to a postage request.
+// Returns "" if the recipient doesn't require postage. The body is an upper
+// bound for the size of the message, so the challenge covers it.
+func buyPostage(reply []byte) (string, error) {
+	var postageReply struct {
+		Required  bool `json:"required"`
+		Challenge struct {
+			Bits uint `json:"bits"`
+		} `json:"challenge"`
+		Token string `json:"token"`
+	}
+	err := json.Unmarshal(reply, &postageReply)
+	if err != nil {
+		return "", fmt.Errorf("federation: bad postage reply: %v", err)
+	}
+	if !postageReply.Required {
+		return "", nil
+	}
+	// This server does the work on behalf of the sender, bounded by the
+	// number of queued relays.
+	if postageReply.Challenge.Bits > maxPostageBits {
+		return "", fmt.Errorf("federation: postage of %d bits is too expensive", postageReply.Challenge.Bits)
+	}
+	return postage.Solve(postageReply.Token, postageReply.Challenge.Bits), nil
+}
+
+// Authenticate checks that req has been sent by a peer. The body is spooled,
+// hashed on the way, and made available again for further processing. The
+// caller must close req.Body to delete the spool.
+func (self *Federation) Authenticate(req *http.Request) (*Peer, error) {
+	peer := self.directory.Peer(req.Header.Get(PeerHeader))
+	if peer == nil {
+		return nil, ErrUnknownPeer
+	}
+
+	body := util.NewSpool(bodyMemoryBytes)
+	_, err := io.Copy(body, io.LimitReader(req.Body, maxBodySize))
+	if err == nil {
+		err = body.Rewind()
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	req.Body = body
+
+	requestUri := req.RequestURI
+	if requestUri == "" {
+		requestUri = req.URL.RequestURI()
+	}
+	err = verify(peer, req.Method, requestUri, req.Header.Get(DateHeader),
+		req.Header.Get(SignatureHeader), body.SHA256(), self.now())
+	if err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+func (self *Federation) do(peer *Peer, method string, path string, rawQuery string,
+	header http.Header, contentType string, body *requestBody) (*Response, error) {
+
+	if body == nil {
+		emptyHash := sha256.Sum256(nil)
+		body = &requestBody{bytes.NewReader(nil), 0, emptyHash[:]}
+	}
+
+	// The signature covers the path relative to the base URL of the peer, so
+	// that peers can be run behind a reverse proxy with a path prefix.
+	requestUri := path
+	if rawQuery != "" {
+		requestUri += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, peer.URL.String()+requestUri, body.reader)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = body.size
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	date := strconv.FormatInt(self.now().Unix(), 10)
+	req.Header.Set(PeerHeader, self.name)
+	req.Header.Set(DateHeader, date)
+	req.Header.Set(SignatureHeader, sign(peer.Secret, method, requestUri, date, body.sha256))
+
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Status: resp.StatusCode, Header: resp.Header, Body: respBody}, nil
+}
+
+// EncodeMessage creates the body by which a message is relayed. It has the
+// same format as multipart bodies of POST /{address}/messages. attachments
+// are streamed into the body, pass nil if there are none. The caller must
+// close the body.
+func EncodeMessage(entry *dao.MessagesEntry, attachments io.Reader) (string, *util.Spool, error) {
+	body := util.NewSpool(bodyMemoryBytes)
+	contentType, err := encodeMessage(body, entry, attachments)
+	if err != nil {
+		body.Close()
+		return "", nil, err
+	}
+	return contentType, body, nil
+}
+
+func encodeMessage(body io.Writer, entry *dao.MessagesEntry, attachments io.Reader) (string, error) {
+	writer := multipart.NewWriter(body)
+
+	for _, part := range []struct {
+		name   string
+		base64 string
+	}{
+		{"keySafe", entry.KeySafe},
+		{"content", entry.Content},
+	} {
+		data, err := base64.StdEncoding.DecodeString(part.base64)
+		if err != nil {
+			return "", ErrBadEncoding
+		}
+		err = writer.WriteField(part.name, string(data))
+		if err != nil {
+			return "", err
+		}
+	}
+	if entry.ExpiresAt != "" {
+		err := writer.WriteField("expiresAt", entry.ExpiresAt)
+		if err != nil {
+			return "", err
+		}
+	}
+	if attachments != nil {
+		partWriter, err := writer.CreateFormFile("attachments", "attachments")
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(partWriter, attachments)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		return "", err
+	}
+	return writer.FormDataContentType(), nil
+}
+
+// DescribeFailure returns a description of a failed request for bounce reports.
+func DescribeFailure(resp *Response) string {
+	message := strings.TrimSpace(string(resp.Body))
+	if len(message) > 200 {
+		message = message[:200]
+	}
+	return fmt.Sprintf("%d %s: %s", resp.Status, http.StatusText(resp.Status), message)
+}
+
+func userPath(address string) string {
+	return ApiPrefix + "/users/" + url.PathEscape(address)
+}
+
+// Returns the delay after the given number of attempts.
+func backoff(attempts uint32) time.Duration {
+	if attempts > 10 {
+		return maxBackoff
+	}
+	delay := time.Minute << attempts
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,518 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package federation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/postage"
+	"bitbucket.org/kullo/server/util"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+const testSecret = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+
+var testNow = time.Date(2020, 3, 30, 12, 0, 0, 0, time.UTC)
+
+type relaysDaoStub struct {
+	entries map[string]*dao.RelaysEntry
+	bodies  map[string][]byte
+}
+
+func (self *relaysDaoStub) InsertEntry(entry *dao.RelaysEntry, body io.Reader, maxCount uint32, maxBytes uint64) (bool, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return false, err
+	}
+	digest := sha256.Sum256(data)
+	entry.BodyDigest = digest[:]
+	entry.BodySize = int64(len(data))
+
+	count := uint32(0)
+	size := uint64(entry.BodySize)
+	for _, queued := range self.entries {
+		if queued.Recipient == entry.Recipient && queued.Status == dao.RELAY_QUEUED {
+			count++
+			size += uint64(queued.BodySize)
+		}
+	}
+	if count >= maxCount || size > maxBytes {
+		return false, nil
+	}
+	copied := *entry
+	copied.Status = dao.RELAY_QUEUED
+	self.entries[entry.ID] = &copied
+	self.bodies[entry.ID] = data
+	return true, nil
+}
+
+func (self *relaysDaoStub) OpenBody(entry *dao.RelaysEntry) io.Reader {
+	return bytes.NewReader(self.bodies[entry.ID])
+}
+
+func (self *relaysDaoStub) GetEntry(id string) (*dao.RelaysEntry, error) {
+	entry, ok := self.entries[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+func (self *relaysDaoStub) GetDue(now time.Time, limit uint32) ([]dao.RelaysEntry, error) {
+	entries := []dao.RelaysEntry{}
+	for _, entry := range self.entries {
+		if entry.Status == dao.RELAY_QUEUED && !entry.NextAttempt.After(now) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+func (self *relaysDaoStub) RecordAttempt(id string, nextAttempt time.Time, lastError string) error {
+	entry := self.entries[id]
+	entry.Attempts++
+	entry.NextAttempt = nextAttempt
+	entry.LastError = lastError
+	return nil
+}
+
+func (self *relaysDaoStub) Finish(id string, status string, lastError string) error {
+	entry := self.entries[id]
+	entry.Attempts++
+	entry.Status = status
+	entry.LastError = lastError
+	entry.BodyDigest = nil
+	delete(self.bodies, id)
+	return nil
+}
+
+func parsePeersString(t *testing.T, config string) (map[string]*Peer, error) {
+	root, err := yaml.Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal("yaml.Parse:", err)
+	}
+	return parsePeers(root)
+}
+
+func makeDirectory(t *testing.T, peerUrl string) *Directory {
+	peers, err := parsePeersString(t, ""+
+		"other:\n"+
+		"  url: "+peerUrl+"\n"+
+		"  secret: "+testSecret+"\n"+
+		"  domains:\n"+
+		"    - other.test\n")
+	if err != nil {
+		t.Fatal("parsePeers failed:", err)
+	}
+	return &Directory{
+		peers: peers,
+		lookupSRV: func(service, proto, name string) (string, []*net.SRV, error) {
+			if name == "srv.test" {
+				return "", []*net.SRV{{Target: "127.0.0.1.", Port: 443}}, nil
+			}
+			return "", nil, errors.New("no such host")
+		},
+	}
+}
+
+func makeFederationUut(directory *Directory, now time.Time) *Federation {
+	return &Federation{
+		name:      "other",
+		directory: directory,
+		client:    http.DefaultClient,
+		relaysDao: &relaysDaoStub{entries: map[string]*dao.RelaysEntry{}, bodies: map[string][]byte{}},
+		now:       func() time.Time { return now },
+	}
+}
+
+func makeBody(t *testing.T, data string) *util.Spool {
+	body := util.NewSpool(bodyMemoryBytes)
+	_, err := body.Write([]byte(data))
+	if err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	return body
+}
+
+func TestParsePeers(t *testing.T) {
+	directory := makeDirectory(t, "https://kullo.other.test/")
+	peer := directory.Peer("other")
+	if peer == nil {
+		t.Fatal("Peer not found")
+	}
+	if peer.URL.String() != "https://kullo.other.test" {
+		t.Error("URL is", peer.URL)
+	}
+	if len(peer.Secret) != 32 {
+		t.Error("Secret length is", len(peer.Secret))
+	}
+	if len(peer.Domains) != 1 || peer.Domains[0] != "other.test" {
+		t.Error("Domains are", peer.Domains)
+	}
+}
+
+func TestParsePeersBad(t *testing.T) {
+	configs := []string{
+		"other:\n  secret: " + testSecret + "\n",
+		"other:\n  url: ftp://other.test\n  secret: " + testSecret + "\n",
+		"other:\n  url: https://other.test\n  secret: 0011\n",
+		"other:\n  url: https://other.test\n  secret: " + testSecret + "\n  domains:\n    - Not a domain\n",
+	}
+	for _, config := range configs {
+		_, err := parsePeersString(t, config)
+		if err == nil {
+			t.Errorf("Config accepted: %q", config)
+		}
+	}
+}
+
+func TestHomeServer(t *testing.T) {
+	directory := makeDirectory(t, "https://127.0.0.1")
+	peer, err := directory.HomeServer("other.test")
+	if err != nil || peer.Name != "other" {
+		t.Error("Static lookup returned", peer, err)
+	}
+	peer, err = directory.HomeServer("srv.test")
+	if err != nil || peer.Name != "other" {
+		t.Error("SRV lookup returned", peer, err)
+	}
+	_, err = directory.HomeServer("unknown.test")
+	if err != ErrNoHomeServer {
+		t.Error("Error is", err)
+	}
+}
+
+func TestVouchesFor(t *testing.T) {
+	uut := makeFederationUut(makeDirectory(t, "https://127.0.0.1"), testNow)
+	peer := uut.directory.Peer("other")
+	if !uut.VouchesFor(peer, "x#other.test") {
+		t.Error("Peer doesn't vouch for its own users")
+	}
+	if uut.VouchesFor(peer, "x#kullo.test") {
+		t.Error("Peer vouches for users of other servers")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	directory := makeDirectory(t, "https://127.0.0.1")
+	peer := directory.Peer("other")
+	date := "1585569600" // testNow
+	bodyHash := sha256.Sum256([]byte("body"))
+	otherBodyHash := sha256.Sum256([]byte("other body"))
+	signature := sign(peer.Secret, "POST", "/federation/users/x%23other.test/messages", date, bodyHash[:])
+
+	err := verify(peer, "POST", "/federation/users/x%23other.test/messages", date, signature, bodyHash[:], testNow)
+	if err != nil {
+		t.Error("Error is", err)
+	}
+	err = verify(peer, "POST", "/federation/users/x%23other.test/messages", date, signature, otherBodyHash[:], testNow)
+	if err != ErrBadSignature {
+		t.Error("Modified body: error is", err)
+	}
+	err = verify(peer, "GET", "/federation/users/x%23other.test/messages", date, signature, bodyHash[:], testNow)
+	if err != ErrBadSignature {
+		t.Error("Modified method: error is", err)
+	}
+	err = verify(peer, "POST", "/federation/users/x%23other.test/messages", date, signature, bodyHash[:],
+		testNow.Add(2*maxClockSkew))
+	if err != ErrBadDate {
+		t.Error("Old request: error is", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var uut *Federation
+	var receivedPath string
+	var receivedStamp string
+	var receivedSender string
+	var receivedBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := uut.Authenticate(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		defer r.Body.Close()
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+		receivedPath = r.URL.Path
+		receivedStamp = r.Header.Get(postageHeader)
+		receivedSender = r.Header.Get(SenderHeader)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	// the peer is configured as "other" on both sides
+	uut = makeFederationUut(makeDirectory(t, server.URL), time.Now())
+	peer, _ := uut.HomeServer("x#other.test")
+	body := makeBody(t, "body")
+	defer body.Close()
+	resp, err := uut.Relay(peer, "x#other.test", "y#kullo.test", "stamp", "text/plain", body)
+	if err != nil {
+		t.Fatal("Relay failed:", err)
+	}
+	if !resp.Delivered() {
+		t.Error("Status is", resp.Status)
+	}
+	if receivedPath != "/federation/users/x#other.test/messages" {
+		t.Error("Path is", receivedPath)
+	}
+	if receivedStamp != "stamp" {
+		t.Error("Stamp is", receivedStamp)
+	}
+	if receivedSender != "y#kullo.test" {
+		t.Error("Sender is", receivedSender)
+	}
+	if string(receivedBody) != "body" {
+		t.Errorf("Body is %q", receivedBody)
+	}
+
+	// requests by strangers are rejected
+	resp2, err := http.Get(server.URL + "/federation/users/x%23other.test/keys/public")
+	if err != nil {
+		t.Fatal("Get failed:", err)
+	}
+	if resp2.StatusCode != http.StatusUnauthorized {
+		t.Error("Status of unsigned request is", resp2.StatusCode)
+	}
+}
+
+func TestRetryQueued(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		if strings.HasSuffix(r.URL.Path, "/postage") {
+			w.Write([]byte(`{"required": false}`))
+		}
+	}))
+	defer server.Close()
+
+	uut := makeFederationUut(makeDirectory(t, server.URL), testNow)
+	id, err := uut.Enqueue("x#other.test", "", "text/plain", makeBody(t, "body"), "timeout")
+	if err != nil {
+		t.Fatal("Enqueue failed:", err)
+	}
+
+	// not due yet
+	uut.RetryQueued()
+	entry, _ := uut.GetRelay(id)
+	if entry.Attempts != 1 {
+		t.Error("Attempts after first retry:", entry.Attempts)
+	}
+
+	// temporary failure
+	uut.now = func() time.Time { return testNow.Add(time.Hour) }
+	uut.RetryQueued()
+	entry, _ = uut.GetRelay(id)
+	if entry.Status != dao.RELAY_QUEUED || entry.Attempts != 2 {
+		t.Error("Entry after temporary failure:", entry.Status, entry.Attempts)
+	}
+	if !strings.HasPrefix(entry.LastError, "503") {
+		t.Error("LastError is", entry.LastError)
+	}
+
+	// success
+	status = http.StatusOK
+	uut.now = func() time.Time { return testNow.Add(2 * time.Hour) }
+	uut.RetryQueued()
+	entry, _ = uut.GetRelay(id)
+	if entry.Status != dao.RELAY_DELIVERED {
+		t.Error("Status is", entry.Status)
+	}
+}
+
+func TestRetryQueuedBounce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	uut := makeFederationUut(makeDirectory(t, server.URL), testNow.Add(time.Hour))
+	id, _ := uut.Enqueue("x#other.test", "", "text/plain", makeBody(t, "body"), "timeout")
+	uut.now = func() time.Time { return testNow.Add(2 * time.Hour) }
+	uut.RetryQueued()
+
+	entry, _ := uut.GetRelay(id)
+	if entry.Status != dao.RELAY_BOUNCED {
+		t.Error("Status is", entry.Status)
+	}
+	if !strings.HasPrefix(entry.LastError, "404") {
+		t.Error("LastError is", entry.LastError)
+	}
+}
+
+func TestRetryQueuedBuysPostage(t *testing.T) {
+	var uut *Federation
+	var receivedStamp string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/postage") {
+			if r.URL.Query().Get("size") != "4" {
+				t.Error("Size is", r.URL.Query().Get("size"))
+			}
+			w.Write([]byte(`{"required": true, "challenge": {"bits": 8}, "token": "fresh"}`))
+			return
+		}
+		// the stored body is sent and signed
+		_, err := uut.Authenticate(r)
+		if err != nil {
+			t.Error("Authenticate failed:", err)
+			return
+		}
+		defer r.Body.Close()
+		received, _ := ioutil.ReadAll(r.Body)
+		if string(received) != "body" {
+			t.Errorf("Body is %q", received)
+		}
+		receivedStamp = r.Header.Get(postageHeader)
+	}))
+	defer server.Close()
+
+	uut = makeFederationUut(makeDirectory(t, server.URL), testNow)
+	id, _ := uut.Enqueue("x#other.test", "", "text/plain", makeBody(t, "body"), "timeout")
+	uut.now = func() time.Time { return testNow.Add(time.Hour) }
+	uut.RetryQueued()
+
+	entry, _ := uut.GetRelay(id)
+	if entry.Status != dao.RELAY_DELIVERED {
+		t.Error("Status is", entry.Status)
+	}
+	nonce := strings.TrimPrefix(receivedStamp, "fresh:")
+	hash := sha256.Sum256([]byte("fresh:" + nonce))
+	if nonce == receivedStamp || postage.LeadingZeroBits(hash[:]) < 8 {
+		t.Error("Stamp is", receivedStamp)
+	}
+}
+
+func TestRetryQueuedPostageTooExpensive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/postage") {
+			w.Write([]byte(`{"required": true, "challenge": {"bits": 200}, "token": "fresh"}`))
+			return
+		}
+		t.Error("Message has been relayed without postage")
+	}))
+	defer server.Close()
+
+	uut := makeFederationUut(makeDirectory(t, server.URL), testNow)
+	id, _ := uut.Enqueue("x#other.test", "", "text/plain", makeBody(t, "body"), "timeout")
+	uut.now = func() time.Time { return testNow.Add(time.Hour) }
+	uut.RetryQueued()
+
+	entry, _ := uut.GetRelay(id)
+	if entry.Status != dao.RELAY_QUEUED || !strings.Contains(entry.LastError, "too expensive") {
+		t.Error("Entry is", entry.Status, entry.LastError)
+	}
+}
+
+func TestEnqueueQueueFull(t *testing.T) {
+	uut := makeFederationUut(makeDirectory(t, "http://127.0.0.1:1"), testNow)
+	for i := uint32(0); i < maxQueuedPerRecipient; i++ {
+		_, err := uut.Enqueue("x#other.test", "", "text/plain", makeBody(t, "body"), "timeout")
+		if err != nil {
+			t.Fatal("Enqueue failed:", err)
+		}
+	}
+	_, err := uut.Enqueue("x#other.test", "", "text/plain", makeBody(t, "body"), "timeout")
+	if err != ErrQueueFull {
+		t.Error("Error is", err)
+	}
+
+	// other recipients have their own queue
+	_, err = uut.Enqueue("y#other.test", "", "text/plain", makeBody(t, "body"), "timeout")
+	if err != nil {
+		t.Error("Enqueue failed:", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if backoff(1) != 2*time.Minute {
+		t.Error("backoff(1) is", backoff(1))
+	}
+	if backoff(maxAttempts) != maxBackoff {
+		t.Error("backoff(maxAttempts) is", backoff(maxAttempts))
+	}
+	var total time.Duration
+	for attempts := uint32(1); attempts < maxAttempts; attempts++ {
+		total += backoff(attempts)
+	}
+	if total < 24*time.Hour || total > 72*time.Hour {
+		t.Error("Total delay is", total)
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	entry := &dao.MessagesEntry{
+		KeySafe:   "a2V5U2FmZQ==", // "keySafe"
+		Content:   "Y29udGVudA==", // "content"
+		ExpiresAt: "2020-06-01T12:00:00Z",
+	}
+	contentType, body, err := EncodeMessage(entry, strings.NewReader("attachments"))
+	if err != nil {
+		t.Fatal("EncodeMessage failed:", err)
+	}
+	defer body.Close()
+	err = body.Rewind()
+	if err != nil {
+		t.Fatal("Rewind failed:", err)
+	}
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal("ParseMediaType failed:", err)
+	}
+	reader := multipart.NewReader(body, params["boundary"])
+	parts := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		data, _ := ioutil.ReadAll(part)
+		parts[part.FormName()] = string(data)
+	}
+	expected := map[string]string{
+		"keySafe":     "keySafe",
+		"content":     "content",
+		"attachments": "attachments",
+		"expiresAt":   "2020-06-01T12:00:00Z",
+	}
+	for name, value := range expected {
+		if parts[name] != value {
+			t.Errorf("Part %s is %q", name, parts[name])
+		}
+	}
+}
+
+func TestEncodeMessageBadEncoding(t *testing.T) {
+	entry := &dao.MessagesEntry{KeySafe: "not base64", Content: "Y29udGVudA=="}
+	_, _, err := EncodeMessage(entry, nil)
+	if err != ErrBadEncoding {
+		t.Error("Error is", err)
+	}
+}
+
+func TestUserPath(t *testing.T) {
+	path := userPath("x#other.test")
+	if path != "/federation/users/"+url.PathEscape("x#other.test") {
+		t.Error("Path is", path)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package federation
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"bitbucket.org/kullo/server/validation"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+var ErrNoHomeServer = errors.New("federation: no home server known for domain")
+
+// DNS service name of the SRV records that point to the home server of a domain
+const srvService = "kullo-federation"
+
+// Peer is another Kullo server that this server exchanges messages with.
+type Peer struct {
+	// the name by which the peers know each other
+	Name string
+	// base URL of the public API without trailing slash, e.g.
+	// https://kullo.example.com
+	URL *url.URL
+	// shared secret used to authenticate requests in both directions
+	Secret []byte
+	// domains that are known to be hosted by the peer
+	Domains []string
+}
+
+type srvLookupFunc func(service, proto, name string) (string, []*net.SRV, error)
+
+// Directory knows the peers and finds the home server of a domain, either
+// from the static configuration or from DNS SRV records, which must point to a
+// configured peer.
+type Directory struct {
+	mutex     sync.RWMutex
+	path      string
+	peers     map[string]*Peer
+	lookupSRV srvLookupFunc
+}
+
+// NewDirectory reads the peers from the config file at path. If the file
+// doesn't exist, there are no peers and federation is disabled.
+func NewDirectory(path string) (*Directory, error) {
+	directory := &Directory{
+		path:      path,
+		peers:     map[string]*Peer{},
+		lookupSRV: net.LookupSRV,
+	}
+	return directory, directory.Reload()
+}
+
+// Reload reads the config file again. On error, the previous configuration
+// stays active.
+func (self *Directory) Reload() error {
+	peers := map[string]*Peer{}
+	if _, err := os.Stat(self.path); !os.IsNotExist(err) {
+		conf, err := yaml.ReadFile(self.path)
+		if err != nil {
+			return err
+		}
+		peers, err = parsePeers(conf.Root)
+		if err != nil {
+			return err
+		}
+	}
+
+	self.mutex.Lock()
+	self.peers = peers
+	self.mutex.Unlock()
+	return nil
+}
+
+// Peer returns the peer with the given name, nil if there is none.
+func (self *Directory) Peer(name string) *Peer {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.peers[name]
+}
+
+// HomeServer returns the peer that hosts domain. Returns ErrNoHomeServer if
+// no configured peer is responsible for domain.
+func (self *Directory) HomeServer(domain string) (*Peer, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	if len(self.peers) == 0 {
+		return nil, ErrNoHomeServer
+	}
+	for _, peer := range self.peers {
+		for _, peerDomain := range peer.Domains {
+			if peerDomain == domain {
+				return peer, nil
+			}
+		}
+	}
+
+	// lookup errors mostly mean that there are no records
+	_, records, err := self.lookupSRV(srvService, "tcp", domain)
+	if err != nil {
+		return nil, ErrNoHomeServer
+	}
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		for _, peer := range self.peers {
+			if peer.URL.Hostname() == target {
+				return peer, nil
+			}
+		}
+	}
+	return nil, ErrNoHomeServer
+}
+
+// parsePeers reads a map from peer names to their settings:
+//
+//	other:
+//	  url: https://kullo.example.com
+//	  secret: 0123...  (hex, at least 32 bytes)
+//	  domains:
+//	    - example.com
+func parsePeers(root yaml.Node) (map[string]*Peer, error) {
+	peers := map[string]*Peer{}
+	if root == nil {
+		return peers, nil
+	}
+	config, ok := root.(yaml.Map)
+	if !ok {
+		return nil, errors.New("federation: peers must be a map")
+	}
+
+	for name, node := range config {
+		settings, ok := node.(yaml.Map)
+		if !ok {
+			return nil, fmt.Errorf("federation: settings of %s must be a map", name)
+		}
+		peer := &Peer{Name: name, Domains: []string{}}
+
+		rawUrl, ok := settings["url"].(yaml.Scalar)
+		if !ok {
+			return nil, fmt.Errorf("federation: %s.url is missing", name)
+		}
+		var err error
+		peer.URL, err = url.Parse(strings.TrimSuffix(rawUrl.String(), "/"))
+		if err != nil || (peer.URL.Scheme != "https" && peer.URL.Scheme != "http") {
+			return nil, fmt.Errorf("federation: %s.url is invalid", name)
+		}
+
+		secret, ok := settings["secret"].(yaml.Scalar)
+		if !ok {
+			return nil, fmt.Errorf("federation: %s.secret is missing", name)
+		}
+		peer.Secret, err = hex.DecodeString(secret.String())
+		if err != nil || len(peer.Secret) < 32 {
+			return nil, fmt.Errorf("federation: %s.secret must be at least 32 bytes of hex", name)
+		}
+
+		if domainsNode, ok := settings["domains"]; ok && domainsNode != nil {
+			domains, ok := domainsNode.(yaml.List)
+			if !ok {
+				return nil, fmt.Errorf("federation: %s.domains must be a list", name)
+			}
+			for _, domainNode := range domains {
+				domain, ok := domainNode.(yaml.Scalar)
+				if !ok {
+					return nil, fmt.Errorf("federation: %s.domains must be a list", name)
+				}
+				if _, err := validation.ValidateDomain(domain.String()); err != nil {
+					return nil, fmt.Errorf("federation: bad domain %s for %s", domain, name)
+				}
+				peer.Domains = append(peer.Domains, domain.String())
+			}
+		}
+		peers[name] = peer
+	}
+	return peers, nil
+}
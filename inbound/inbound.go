@@ -0,0 +1,199 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package inbound
+
+import (
+	"database/sql"
+	"errors"
+
+	"bitbucket.org/kullo/server/dao"
+)
+
+var ErrLimitTooHigh = errors.New("Limit exceeds the server maximum")
+var ErrBadExcessAction = errors.New("Excess action must be 'reject' or 'hold'")
+
+type Decision int
+
+const (
+	// The message can be delivered right away
+	DecisionAccept Decision = iota
+	// The message exceeds the limits and must be held back
+	DecisionHold
+	// The message exceeds the limits and must be rejected
+	DecisionReject
+)
+
+type limitsDao interface {
+	GetEntry(address string) (*dao.InboundLimitsEntry, error)
+	GetUsage(address string) (*dao.InboundUsage, error)
+}
+
+type Limiter struct {
+	limitsDao limitsDao
+	maximum   dao.InboundLimitsEntry
+	// upper bounds for the held messages of a user, 0 means unlimited
+	maxHeldMessages uint32
+	maxHeldBytes    uint64
+	// upper bounds for the scheduled messages of a user, 0 means unlimited
+	maxScheduledMessages uint32
+	maxScheduledBytes    uint64
+}
+
+// NewLimiter creates a Limiter with server-wide maximum values. They are used
+// for users that haven't configured their own limits. A value of 0 means
+// unlimited.
+func NewLimiter(maxMessagesPerHour uint32, maxBytesPerDay uint64, maxHeldMessages uint32, maxHeldBytes uint64,
+	maxScheduledMessages uint32, maxScheduledBytes uint64) Limiter {
+	return Limiter{
+		limitsDao: &dao.InboundLimits{},
+		maximum: dao.InboundLimitsEntry{
+			MessagesPerHour: maxMessagesPerHour,
+			BytesPerDay:     maxBytesPerDay,
+			ExcessAction:    dao.INBOUND_EXCESS_REJECT,
+		},
+		maxHeldMessages:      maxHeldMessages,
+		maxHeldBytes:         maxHeldBytes,
+		maxScheduledMessages: maxScheduledMessages,
+		maxScheduledBytes:    maxScheduledBytes,
+	}
+}
+
+// Limits returns the limits that are in effect for the given address.
+func (self *Limiter) Limits(address string) (*dao.InboundLimitsEntry, error) {
+	entry, err := self.limitsDao.GetEntry(address)
+	if err == sql.ErrNoRows {
+		maximum := self.maximum
+		return &maximum, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the server maximum may have been lowered after the user set the limits
+	entry.MessagesPerHour = clip32(entry.MessagesPerHour, self.maximum.MessagesPerHour)
+	entry.BytesPerDay = clip64(entry.BytesPerDay, self.maximum.BytesPerDay)
+	return entry, nil
+}
+
+// Validate checks limits that a user wants to set.
+func (self *Limiter) Validate(entry *dao.InboundLimitsEntry) error {
+	if !withinMaximum(uint64(entry.MessagesPerHour), uint64(self.maximum.MessagesPerHour)) ||
+		!withinMaximum(entry.BytesPerDay, self.maximum.BytesPerDay) {
+		return ErrLimitTooHigh
+	}
+	if entry.ExcessAction != dao.INBOUND_EXCESS_REJECT &&
+		entry.ExcessAction != dao.INBOUND_EXCESS_HOLD {
+		return ErrBadExcessAction
+	}
+	return nil
+}
+
+// Decide decides what to do with an unauthenticated message of the given
+// size. usage must be locked until the decision has been carried out, see
+// dao.InboundDelivery.
+func (self *Limiter) Decide(address string, usage *dao.InboundUsage, size uint64) (Decision, error) {
+	limits, err := self.Limits(address)
+	if err != nil {
+		return DecisionReject, err
+	}
+
+	if Fits(limits, usage, size) {
+		return DecisionAccept, nil
+	}
+	// don't hold messages that could never be released
+	if limits.ExcessAction == dao.INBOUND_EXCESS_HOLD &&
+		(limits.BytesPerDay == 0 || size <= limits.BytesPerDay) &&
+		self.heldMessagesFit(usage, size) {
+		return DecisionHold, nil
+	}
+	return DecisionReject, nil
+}
+
+// holding messages must not let senders fill up the recipient's storage
+func (self *Limiter) heldMessagesFit(usage *dao.InboundUsage, size uint64) bool {
+	if self.maxHeldMessages > 0 && usage.MessagesHeld >= self.maxHeldMessages {
+		return false
+	}
+	if self.maxHeldBytes > 0 && usage.BytesHeld+size > self.maxHeldBytes {
+		return false
+	}
+	return true
+}
+
+// ScheduledMessagesFit checks whether a message of the given size can be
+// scheduled for later delivery. The limits only apply when it is delivered,
+// so this keeps senders from filling up the recipient's storage in the
+// meantime. usage must be locked, like for Decide.
+func (self *Limiter) ScheduledMessagesFit(usage *dao.InboundUsage, size uint64) bool {
+	if self.maxScheduledMessages > 0 && usage.MessagesScheduled >= self.maxScheduledMessages {
+		return false
+	}
+	if self.maxScheduledBytes > 0 && usage.BytesScheduled+size > self.maxScheduledBytes {
+		return false
+	}
+	return true
+}
+
+// Load returns how much of the recipient's limits has been used up, where 1.0
+// means that the limits have been reached. It is 0 if there are no limits.
+func (self *Limiter) Load(address string) (float64, error) {
+	limits, err := self.Limits(address)
+	if err != nil {
+		return 0, err
+	}
+	usage, err := self.limitsDao.GetUsage(address)
+	if err != nil {
+		return 0, err
+	}
+
+	var load float64
+	if limits.MessagesPerHour > 0 {
+		load = float64(usage.MessagesLastHour) / float64(limits.MessagesPerHour)
+	}
+	if limits.BytesPerDay > 0 {
+		bytesLoad := float64(usage.BytesLastDay) / float64(limits.BytesPerDay)
+		if bytesLoad > load {
+			load = bytesLoad
+		}
+	}
+	return load, nil
+}
+
+// Fits returns true iff a message of the given size can be delivered without
+// exceeding the limits.
+func Fits(limits *dao.InboundLimitsEntry, usage *dao.InboundUsage, size uint64) bool {
+	if limits.MessagesPerHour > 0 && usage.MessagesLastHour >= limits.MessagesPerHour {
+		return false
+	}
+	if limits.BytesPerDay > 0 && usage.BytesLastDay+size > limits.BytesPerDay {
+		return false
+	}
+	return true
+}
+
+// ### begin private stuff ###
+
+func withinMaximum(value uint64, maximum uint64) bool {
+	if maximum == 0 {
+		return true
+	}
+	return value > 0 && value <= maximum
+}
+
+func clip32(value uint32, maximum uint32) uint32 {
+	if maximum != 0 && (value == 0 || value > maximum) {
+		return maximum
+	}
+	return value
+}
+
+func clip64(value uint64, maximum uint64) uint64 {
+	if maximum != 0 && (value == 0 || value > maximum) {
+		return maximum
+	}
+	return value
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package inbound
+
+import (
+	"database/sql"
+	"testing"
+
+	"bitbucket.org/kullo/server/dao"
+)
+
+const (
+	userWithoutLimits string = "no.limits#kullo.test"
+	userRejecting     string = "rejecting#kullo.test"
+	userHolding       string = "holding#kullo.test"
+)
+
+type limitsDaoStub struct {
+	usage dao.InboundUsage
+}
+
+func (self *limitsDaoStub) GetEntry(address string) (*dao.InboundLimitsEntry, error) {
+	switch address {
+	case userRejecting:
+		return &dao.InboundLimitsEntry{
+			MessagesPerHour: 5,
+			BytesPerDay:     1000,
+			ExcessAction:    dao.INBOUND_EXCESS_REJECT,
+		}, nil
+	case userHolding:
+		return &dao.InboundLimitsEntry{
+			MessagesPerHour: 500,
+			BytesPerDay:     20000,
+			ExcessAction:    dao.INBOUND_EXCESS_HOLD,
+		}, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (self *limitsDaoStub) GetUsage(address string) (*dao.InboundUsage, error) {
+	usage := self.usage
+	return &usage, nil
+}
+
+func makeLimiterUut(usage dao.InboundUsage) *Limiter {
+	uut := NewLimiter(100, 10000, 3, 5000, 2, 5000)
+	uut.limitsDao = &limitsDaoStub{usage: usage}
+	return &uut
+}
+
+func TestLimitsDefault(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{})
+	limits, err := uut.Limits(userWithoutLimits)
+	if err != nil {
+		t.Fatal("Limits failed:", err)
+	}
+	if limits.MessagesPerHour != 100 || limits.BytesPerDay != 10000 {
+		t.Error("unexpected default limits", limits)
+	}
+	if limits.ExcessAction != dao.INBOUND_EXCESS_REJECT {
+		t.Error("unexpected default action", limits.ExcessAction)
+	}
+}
+
+func TestLimitsClipped(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{})
+	limits, err := uut.Limits(userHolding)
+	if err != nil {
+		t.Fatal("Limits failed:", err)
+	}
+	if limits.MessagesPerHour != 100 {
+		t.Error("messages per hour not clipped:", limits.MessagesPerHour)
+	}
+	if limits.BytesPerDay != 10000 {
+		t.Error("bytes per day not clipped:", limits.BytesPerDay)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{})
+
+	ok := dao.InboundLimitsEntry{MessagesPerHour: 10, BytesPerDay: 100, ExcessAction: "hold"}
+	if err := uut.Validate(&ok); err != nil {
+		t.Error("valid limits rejected:", err)
+	}
+
+	tooHigh := dao.InboundLimitsEntry{MessagesPerHour: 101, BytesPerDay: 100, ExcessAction: "hold"}
+	if err := uut.Validate(&tooHigh); err != ErrLimitTooHigh {
+		t.Error("too high limits not rejected:", err)
+	}
+
+	unlimited := dao.InboundLimitsEntry{MessagesPerHour: 0, BytesPerDay: 100, ExcessAction: "hold"}
+	if err := uut.Validate(&unlimited); err != ErrLimitTooHigh {
+		t.Error("unlimited value not rejected:", err)
+	}
+
+	badAction := dao.InboundLimitsEntry{MessagesPerHour: 10, BytesPerDay: 100, ExcessAction: "drop"}
+	if err := uut.Validate(&badAction); err != ErrBadExcessAction {
+		t.Error("bad action not rejected:", err)
+	}
+}
+
+func TestDecideAccept(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{})
+	usage := dao.InboundUsage{MessagesLastHour: 4, BytesLastDay: 500}
+	decision, err := uut.Decide(userRejecting, &usage, 500)
+	if err != nil {
+		t.Fatal("Decide failed:", err)
+	}
+	if decision != DecisionAccept {
+		t.Error("should accept, got", decision)
+	}
+}
+
+func TestDecideReject(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{})
+
+	// too many messages
+	usage := dao.InboundUsage{MessagesLastHour: 5, BytesLastDay: 0}
+	decision, err := uut.Decide(userRejecting, &usage, 1)
+	if err != nil {
+		t.Fatal("Decide failed:", err)
+	}
+	if decision != DecisionReject {
+		t.Error("should reject (messages), got", decision)
+	}
+
+	// too many bytes
+	usage = dao.InboundUsage{MessagesLastHour: 0, BytesLastDay: 500}
+	decision, err = uut.Decide(userRejecting, &usage, 501)
+	if err != nil {
+		t.Fatal("Decide failed:", err)
+	}
+	if decision != DecisionReject {
+		t.Error("should reject (bytes), got", decision)
+	}
+}
+
+func TestDecideHold(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{})
+	usage := dao.InboundUsage{MessagesLastHour: 100}
+	decision, err := uut.Decide(userHolding, &usage, 1)
+	if err != nil {
+		t.Fatal("Decide failed:", err)
+	}
+	if decision != DecisionHold {
+		t.Error("should hold, got", decision)
+	}
+
+	// larger than the daily limit -> can never be released
+	decision, err = uut.Decide(userHolding, &usage, 10001)
+	if err != nil {
+		t.Fatal("Decide failed:", err)
+	}
+	if decision != DecisionReject {
+		t.Error("should reject, got", decision)
+	}
+}
+
+func TestDecideHeldMessagesCapped(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{})
+
+	// too many held messages
+	usage := dao.InboundUsage{MessagesLastHour: 100, MessagesHeld: 3, BytesHeld: 100}
+	decision, err := uut.Decide(userHolding, &usage, 1)
+	if err != nil {
+		t.Fatal("Decide failed:", err)
+	}
+	if decision != DecisionReject {
+		t.Error("should reject (held messages), got", decision)
+	}
+
+	// too many held bytes
+	usage = dao.InboundUsage{MessagesLastHour: 100, MessagesHeld: 2, BytesHeld: 4000}
+	decision, err = uut.Decide(userHolding, &usage, 1001)
+	if err != nil {
+		t.Fatal("Decide failed:", err)
+	}
+	if decision != DecisionReject {
+		t.Error("should reject (held bytes), got", decision)
+	}
+}
+
+func TestScheduledMessagesFit(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{})
+
+	usage := dao.InboundUsage{MessagesScheduled: 1, BytesScheduled: 4000}
+	if !uut.ScheduledMessagesFit(&usage, 1000) {
+		t.Error("should fit")
+	}
+	if uut.ScheduledMessagesFit(&usage, 1001) {
+		t.Error("shouldn't fit (scheduled bytes)")
+	}
+	usage = dao.InboundUsage{MessagesScheduled: 2}
+	if uut.ScheduledMessagesFit(&usage, 1) {
+		t.Error("shouldn't fit (scheduled messages)")
+	}
+
+	unlimited := NewLimiter(0, 0, 0, 0, 0, 0)
+	usage = dao.InboundUsage{MessagesScheduled: 1000000, BytesScheduled: 1 << 40}
+	if !unlimited.ScheduledMessagesFit(&usage, 1<<30) {
+		t.Error("should fit (unlimited)")
+	}
+}
+
+func TestUnlimitedServer(t *testing.T) {
+	uut := NewLimiter(0, 0, 0, 0, 0, 0)
+	uut.limitsDao = &limitsDaoStub{}
+	usage := dao.InboundUsage{MessagesLastHour: 1000000, BytesLastDay: 1 << 40}
+	decision, err := uut.Decide(userWithoutLimits, &usage, 1<<30)
+	if err != nil {
+		t.Fatal("Decide failed:", err)
+	}
+	if decision != DecisionAccept {
+		t.Error("should accept, got", decision)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	uut := makeLimiterUut(dao.InboundUsage{MessagesLastHour: 1, BytesLastDay: 500})
+	load, err := uut.Load(userRejecting)
+	if err != nil {
+		t.Fatal("Load failed:", err)
+	}
+	if load != 0.5 {
+		t.Error("unexpected load", load)
+	}
+
+	unlimited := NewLimiter(0, 0, 0, 0, 0, 0)
+	unlimited.limitsDao = &limitsDaoStub{usage: dao.InboundUsage{MessagesLastHour: 1000}}
+	load, err = unlimited.Load(userWithoutLimits)
+	if err != nil {
+		t.Fatal("Load failed:", err)
+	}
+	if load != 0 {
+		t.Error("unlimited server should have no load, got", load)
+	}
+}
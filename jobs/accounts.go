@@ -0,0 +1,54 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/util"
+)
+
+var usersDao = dao.Users{}
+var addressesDao = dao.Addresses{}
+
+func startAccountWorkers(tombstonePeriod time.Duration) {
+	runPeriodically("delete accounts", 10*time.Minute, deleteAccounts)
+	runPeriodically("clean up address tombstones", 24*time.Hour, func() error {
+		return cleanUpAddressTombstones(tombstonePeriod)
+	})
+	runPeriodically("clean up address forwards", 24*time.Hour, cleanUpAddressForwards)
+}
+
+func deleteAccounts() error {
+	addresses, err := usersDao.GetAddressesDueForDeletion(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		err = usersDao.Delete(address)
+		if err != nil {
+			// don't let a single user block the others
+			util.LogServerError(err)
+			continue
+		}
+		log.Printf("Deleted account %s", address)
+	}
+	return nil
+}
+
+func cleanUpAddressTombstones(tombstonePeriod time.Duration) error {
+	_, err := usersDao.DeleteTombstonesBefore(time.Now().Add(-tombstonePeriod))
+	return err
+}
+
+func cleanUpAddressForwards() error {
+	_, err := addressesDao.DeleteExpiredForwards(time.Now())
+	return err
+}
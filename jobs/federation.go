@@ -0,0 +1,29 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package jobs
+
+import (
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/federation"
+)
+
+// how long senders can look up the outcome of a relay
+const finishedRelaysRetention = 30 * 24 * time.Hour
+
+var relaysDao = dao.Relays{}
+
+func startFederationWorkers(fed *federation.Federation) {
+	runPeriodically("retry queued relays", time.Minute, fed.RetryQueued)
+	runPeriodically("clean up finished relays", 24*time.Hour, cleanUpFinishedRelays)
+}
+
+func cleanUpFinishedRelays() error {
+	_, err := relaysDao.DeleteFinished(time.Now().Add(-finishedRelaysRetention))
+	return err
+}
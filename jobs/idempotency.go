@@ -0,0 +1,31 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package jobs
+
+import (
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+)
+
+// requests that haven't finished after this time are considered abandoned,
+// e.g. because the server has been restarted
+const idempotencyPendingTimeout = 10 * time.Minute
+
+var idempotencyKeysDao = dao.IdempotencyKeys{}
+
+func startIdempotencyWorkers(retention time.Duration) {
+	runPeriodically("clean up idempotency keys", time.Minute, func() error {
+		return cleanUpIdempotencyKeys(retention)
+	})
+}
+
+func cleanUpIdempotencyKeys(retention time.Duration) error {
+	now := time.Now()
+	_, err := idempotencyKeysDao.DeleteExpired(now.Add(-retention), now.Add(-idempotencyPendingTimeout))
+	return err
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package jobs
+
+import (
+	"database/sql"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/inbound"
+	"bitbucket.org/kullo/server/notifications"
+	"bitbucket.org/kullo/server/receipts"
+	"bitbucket.org/kullo/server/senders"
+	"bitbucket.org/kullo/server/util"
+)
+
+var inboundLimitsDao = dao.InboundLimits{}
+var heldMessagesDao = dao.HeldMessages{}
+var scheduledMessagesDao = dao.ScheduledMessages{}
+
+// Scheduled messages that cannot be delivered when they are due, because the
+// recipient's storage is full or the limits have been reached, are retried
+// after this delay.
+const scheduledMessageRetryDelay = time.Hour
+
+func startInboundWorkers(limiter *inbound.Limiter, senderFilter *senders.Filter, receiptSigner *receipts.Signer) {
+	runPeriodically("release held messages", time.Minute, func() error {
+		return releaseHeldMessages(limiter, receiptSigner)
+	})
+	runPeriodically("deliver scheduled messages", time.Minute, func() error {
+		return deliverScheduledMessages(limiter, senderFilter, receiptSigner)
+	})
+	runPeriodically("clean up inbound deliveries", time.Hour, cleanUpInboundDeliveries)
+}
+
+func releaseHeldMessages(limiter *inbound.Limiter, receiptSigner *receipts.Signer) error {
+	addresses, err := heldMessagesDao.GetAddressesWithHeldMessages()
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		err = releaseHeldMessagesOf(limiter, receiptSigner, address)
+		if err != nil {
+			// don't let a single user block the others
+			util.LogServerError(err)
+		}
+	}
+	return nil
+}
+
+// Releases as many held messages as the recipient's limits allow
+func releaseHeldMessagesOf(limiter *inbound.Limiter, receiptSigner *receipts.Signer, address string) error {
+	limits, err := limiter.Limits(address)
+	if err != nil {
+		return err
+	}
+
+	for {
+		entry, err := releaseOldestHeldEntry(limits, receiptSigner, address)
+		if err != nil || entry == nil {
+			return err
+		}
+		notifications.SendIncomingMessageNotifications(address, entry.ID)
+	}
+}
+
+// Returns nil if there's no held message, the recipient's storage is full or
+// the message doesn't fit into the limits
+func releaseOldestHeldEntry(limits *dao.InboundLimitsEntry, receiptSigner *receipts.Signer, address string) (*dao.MessagesEntry, error) {
+	delivery, err := inboundLimitsDao.BeginDelivery(address)
+	if err != nil {
+		return nil, err
+	}
+	defer delivery.Rollback()
+
+	// messages stay held until the recipient has deleted enough of them
+	readOnly, err := delivery.RecheckReadOnly()
+	if err != nil || readOnly {
+		return nil, err
+	}
+
+	usage, err := delivery.GetUsage()
+	if err != nil {
+		return nil, err
+	}
+	size, err := delivery.GetOldestHeldEntrySize()
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !inbound.Fits(limits, usage, size) {
+		return nil, nil
+	}
+
+	entry, err := delivery.ReleaseOldestHeldEntry()
+	if err != nil {
+		return nil, err
+	}
+	// if issuing fails, the message stays held and is retried
+	_, err = receiptSigner.Issue(delivery, address, entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, delivery.Commit()
+}
+
+// Delivers the scheduled messages that are due. They pass the same checks as
+// messages without a delivery time, apart from postage, which has been paid
+// when they were scheduled.
+func deliverScheduledMessages(limiter *inbound.Limiter, senderFilter *senders.Filter, receiptSigner *receipts.Signer) error {
+	for {
+		due, err := scheduledMessagesDao.GetNextDueEntry(time.Now())
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = deliverScheduledEntry(limiter, senderFilter, receiptSigner, due)
+		if err != nil {
+			// don't let a single message block the others
+			util.LogServerError(err)
+			err = postponeScheduledEntry(due)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func deliverScheduledEntry(limiter *inbound.Limiter, senderFilter *senders.Filter, receiptSigner *receipts.Signer,
+	due *dao.ScheduledDueEntry) error {
+
+	// messages might have been deleted since the recipient's storage was full
+	readOnly, err := usersDao.RecheckInboundReadOnly(due.Address)
+	if err != nil {
+		return err
+	}
+	if readOnly {
+		return postponeScheduledEntry(due)
+	}
+
+	senderDecision, err := senderFilter.Check(due.Address, due.Sender)
+	if err != nil {
+		return err
+	}
+
+	delivery, err := inboundLimitsDao.BeginDelivery(due.Address)
+	if err != nil {
+		return err
+	}
+	defer delivery.Rollback()
+
+	if senderDecision != senders.DecisionAccept {
+		// The sender cannot be told about the rejection anymore, so the
+		// message is dropped and can still be recalled.
+		entry, err := delivery.TakeScheduledEntry(due.ID)
+		if err == sql.ErrNoRows {
+			// cancelled in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = delivery.Drop(entry.RecallHash, "", "")
+		if err != nil {
+			return err
+		}
+		return delivery.Commit()
+	}
+
+	size, err := delivery.GetScheduledEntrySize(due.ID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	usage, err := delivery.GetUsage()
+	if err != nil {
+		return err
+	}
+	decision, err := limiter.Decide(due.Address, usage, size)
+	if err != nil {
+		return err
+	}
+	if decision == inbound.DecisionReject {
+		return postponeScheduledEntry(due)
+	}
+
+	entry, err := delivery.TakeScheduledEntry(due.ID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if decision == inbound.DecisionHold {
+		err = delivery.Hold(entry)
+		if err != nil {
+			return err
+		}
+		return delivery.Commit()
+	}
+
+	err = delivery.Deliver(entry)
+	if err != nil {
+		return err
+	}
+	// if issuing fails, the message stays scheduled and is retried
+	_, err = receiptSigner.Issue(delivery, due.Address, entry)
+	if err != nil {
+		return err
+	}
+	err = delivery.Commit()
+	if err != nil {
+		return err
+	}
+	notifications.SendIncomingMessageNotifications(due.Address, entry.ID)
+	return nil
+}
+
+func postponeScheduledEntry(due *dao.ScheduledDueEntry) error {
+	return scheduledMessagesDao.Postpone(due.ID, time.Now().Add(scheduledMessageRetryDelay))
+}
+
+func cleanUpInboundDeliveries() error {
+	// usage is only ever calculated for the last day
+	_, err := inboundLimitsDao.DeleteDeliveriesBefore(time.Now().Add(-24 * time.Hour))
+	return err
+}
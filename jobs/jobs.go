@@ -0,0 +1,59 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"bitbucket.org/kullo/server/federation"
+	"bitbucket.org/kullo/server/inbound"
+	"bitbucket.org/kullo/server/receipts"
+	"bitbucket.org/kullo/server/senders"
+	"bitbucket.org/kullo/server/util"
+)
+
+type Config struct {
+	InboundLimiter *inbound.Limiter
+	// applies the recipient's sender rules to scheduled messages when they are delivered
+	SenderFilter *senders.Filter
+	// signs receipts for held and scheduled messages when they are delivered
+	ReceiptSigner *receipts.Signer
+	// how long addresses of deleted accounts are blocked
+	AddressTombstonePeriod time.Duration
+	Federation             *federation.Federation
+	// how long tombstones of deleted messages are kept, 0 keeps them forever
+	MessageTombstoneHorizon time.Duration
+	// how often stored payloads of messages are verified, 0 never verifies them
+	PayloadVerificationInterval time.Duration
+	// how long results of requests with an idempotency key are kept
+	IdempotencyKeyRetention time.Duration
+}
+
+func StartWorkers(config Config) {
+	startInboundWorkers(config.InboundLimiter, config.SenderFilter, config.ReceiptSigner)
+	startPostageWorkers()
+	startVerificationWorkers()
+	startAccountWorkers(config.AddressTombstonePeriod)
+	startFederationWorkers(config.Federation)
+	startMessageWorkers(config.MessageTombstoneHorizon, config.PayloadVerificationInterval)
+	startIdempotencyWorkers(config.IdempotencyKeyRetention)
+}
+
+// Runs the given job every interval. Errors are logged, the job keeps running.
+func runPeriodically(name string, interval time.Duration, job func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			err := job()
+			if err != nil {
+				log.Printf("[jobs] %s failed", name)
+				util.LogServerError(err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package jobs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"log"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+)
+
+// Blobs that have just been stored aren't referenced until the message that
+// uses them has been inserted, so they are kept for a while.
+const blobGracePeriod = time.Hour
+
+// Chunks of uploads are deleted by the request that has written them unless
+// it has been interrupted, so those left over are collected after a while.
+const blobUploadMaxAge = 24 * time.Hour
+
+// Dropped messages can be recalled for a while, like messages that the
+// recipient doesn't read.
+const droppedMessageRetention = 30 * 24 * time.Hour
+
+// number of blobs or key safes that are verified per query
+const payloadVerificationBatchSize = 1000
+
+var messagesDao = dao.Messages{}
+var blobUploadsDao = dao.BlobUploads{}
+
+func startMessageWorkers(tombstoneHorizon time.Duration, verificationInterval time.Duration) {
+	runPeriodically("clean up unreferenced blobs", time.Hour, cleanUpBlobs)
+	runPeriodically("expire messages", time.Minute, expireMessages)
+	runPeriodically("clean up dropped messages", time.Hour, cleanUpDroppedMessages)
+	if tombstoneHorizon > 0 {
+		runPeriodically("purge message tombstones", 24*time.Hour, func() error {
+			return purgeTombstones(tombstoneHorizon)
+		})
+	}
+	if verificationInterval > 0 {
+		runPeriodically("verify message payloads", verificationInterval, verifyPayloads)
+	}
+}
+
+func cleanUpDroppedMessages() error {
+	_, err := messagesDao.DeleteDroppedBefore(time.Now().Add(-droppedMessageRetention))
+	return err
+}
+
+func cleanUpBlobs() error {
+	_, err := blobUploadsDao.DeleteUploadsBefore(time.Now().Add(-blobUploadMaxAge))
+	if err != nil {
+		return err
+	}
+	_, err = messagesDao.DeleteUnreferencedBlobs(time.Now().Add(-blobGracePeriod))
+	return err
+}
+
+func purgeTombstones(horizon time.Duration) error {
+	// last_modified is in µs since the epoch
+	modifiedBefore := uint64(time.Now().Add(-horizon).UnixNano() / 1000)
+	users, err := messagesDao.PurgeTombstones(modifiedBefore)
+	if err != nil {
+		return err
+	}
+	log.Printf("[jobs] purged message tombstones of %d users", users)
+	return nil
+}
+
+func expireMessages() error {
+	_, err := messagesDao.ExpireEntries(time.Now())
+	return err
+}
+
+// verifyPayloads checks the stored payloads of messages against their
+// digests and logs those that have been corrupted.
+func verifyPayloads() error {
+	corruptedBlobs, err := verifyBlobs()
+	if err != nil {
+		return err
+	}
+	corruptedKeySafes, err := verifyKeySafes()
+	if err != nil {
+		return err
+	}
+	log.Printf("[jobs] verified message payloads: %d corrupted blobs, %d corrupted key safes",
+		corruptedBlobs, corruptedKeySafes)
+	return nil
+}
+
+func verifyBlobs() (int, error) {
+	corrupted := 0
+	var after []byte
+	for {
+		digests, err := messagesDao.GetBlobDigests(after, payloadVerificationBatchSize)
+		if err != nil {
+			return 0, err
+		}
+		// one blob at a time, attachments may be large
+		for _, digest := range digests {
+			data, err := messagesDao.GetBlob(digest)
+			if err == sql.ErrNoRows {
+				// collected in the meantime
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			actual := sha256.Sum256(data)
+			if !bytes.Equal(actual[:], digest) {
+				log.Printf("[jobs] corrupted blob %x", digest)
+				corrupted++
+			}
+		}
+		if len(digests) < payloadVerificationBatchSize {
+			return corrupted, nil
+		}
+		after = digests[len(digests)-1]
+	}
+}
+
+func verifyKeySafes() (int, error) {
+	corrupted := 0
+	var afterID, afterUserID uint32
+	for {
+		entries, err := messagesDao.GetKeySafeDigests(afterID, afterUserID, payloadVerificationBatchSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			actual := sha256.Sum256([]byte(entry.KeySafe))
+			if !bytes.Equal(actual[:], entry.Digest) {
+				log.Printf("[jobs] corrupted key safe of message %d of user %d", entry.ID, entry.UserID)
+				corrupted++
+			}
+		}
+		if len(entries) < payloadVerificationBatchSize {
+			return corrupted, nil
+		}
+		afterID = entries[len(entries)-1].ID
+		afterUserID = entries[len(entries)-1].UserID
+	}
+}
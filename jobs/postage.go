@@ -0,0 +1,25 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package jobs
+
+import (
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+)
+
+var usedPostageDao = dao.UsedPostage{}
+
+func startPostageWorkers() {
+	runPeriodically("clean up used postage", time.Hour, cleanUpUsedPostage)
+}
+
+func cleanUpUsedPostage() error {
+	// expired stamps are rejected anyway, so they cannot be replayed
+	_, err := usedPostageDao.DeleteExpired(time.Now())
+	return err
+}
@@ -0,0 +1,26 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package jobs
+
+import (
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/verification"
+)
+
+var domainVerificationsDao = dao.DomainVerifications{}
+
+func startVerificationWorkers() {
+	runPeriodically("clean up domain verifications", time.Hour, cleanUpDomainVerifications)
+}
+
+func cleanUpDomainVerifications() error {
+	// expired verifications don't allow registrations anymore
+	_, err := domainVerificationsDao.DeleteExpired(time.Now().Add(-verification.Validity))
+	return err
+}
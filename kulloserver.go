@@ -10,20 +10,31 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/text/language"
 
 	"bitbucket.org/kullo/server/dao"
 	"bitbucket.org/kullo/server/dbconn"
+	"bitbucket.org/kullo/server/domains"
+	"bitbucket.org/kullo/server/federation"
+	"bitbucket.org/kullo/server/inbound"
+	"bitbucket.org/kullo/server/jobs"
 	"bitbucket.org/kullo/server/logging"
 	"bitbucket.org/kullo/server/notifications"
+	"bitbucket.org/kullo/server/postage"
+	"bitbucket.org/kullo/server/receipts"
+	"bitbucket.org/kullo/server/senders"
 	"bitbucket.org/kullo/server/util"
+	"bitbucket.org/kullo/server/verification"
 	"bitbucket.org/kullo/server/webservice"
 	"github.com/emicklei/go-restful"
 	"github.com/kylelemons/go-gypsy/yaml"
@@ -47,6 +58,40 @@ func openDb(dbEnvironment string, configDir string) {
 	}
 }
 
+func readAdminCredentials(configDir string) webservice.AdminCredentials {
+	conf, err := yaml.ReadFile(configDir + "/admins.yml")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	admins, ok := conf.Root.(yaml.Map)
+	if !ok {
+		log.Fatal("admins.yml must map admin names to bcrypt hashes of their passwords")
+	}
+	credentials := webservice.AdminCredentials{}
+	for name, node := range admins {
+		hash, ok := node.(yaml.Scalar)
+		if !ok {
+			log.Fatalf("admins.yml: bad password hash for %s", name)
+		}
+		credentials[name] = hash.String()
+	}
+	return credentials
+}
+
+// reads a password from stdin and prints its hash for admins.yml
+func hashAdminPassword() {
+	password, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hash, err := webservice.HashAdminPassword(strings.TrimSuffix(string(password), "\n"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(hash)
+}
+
 func statusHandler(rw http.ResponseWriter, req *http.Request) {
 	users := dao.Users{}
 	_, err := users.UserExists("hi#kullo.net")
@@ -69,14 +114,64 @@ func main() {
 	port := flag.Int("port", 8001, "Server port")
 	configDir := flag.String("configDir", "./config", "configuration directory")
 	dbEnvironment := flag.String("env", "local", "database configuration environment name")
-	domain := flag.String("domain", "kullo.test", "domain part of this server's addresses")
+	domain := flag.String("domain", "kullo.test", "domain part of this server's addresses if there is no domains.yml")
 	gcmApiKey := flag.String("gcmApiKey", "", "API key for Google Cloud Messaging")
 	accessLogFile := flag.String("accessLogFile", "/tmp/kulloserver-access.log", "file name of the access log")
 	errorLogFile := flag.String("errorLogFile", "", "file name of the error log")
 	cpuProfile := flag.String("cpuprofile", "", "write cpu profile to given file")
 	memProfile := flag.String("memprofile", "", "write memory profile to given file")
+	inboundMessagesPerHour := flag.Uint("inboundMessagesPerHour", 100, "max. number of unauthenticated messages a user can receive per hour (0 = unlimited)")
+	inboundBytesPerDay := flag.Uint64("inboundBytesPerDay", 1024*1024*1024, "max. size of unauthenticated messages a user can receive per day (0 = unlimited)")
+	inboundMaxHeldMessages := flag.Uint("inboundMaxHeldMessages", 1000, "max. number of held messages per user, further messages are rejected (0 = unlimited)")
+	inboundMaxHeldBytes := flag.Uint64("inboundMaxHeldBytes", 1024*1024*1024, "max. size of held messages per user, further messages are rejected (0 = unlimited)")
+	inboundMaxScheduledMessages := flag.Uint("inboundMaxScheduledMessages", 1000, "max. number of scheduled messages per user, further messages are rejected (0 = unlimited)")
+	inboundMaxScheduledBytes := flag.Uint64("inboundMaxScheduledBytes", 1024*1024*1024, "max. size of scheduled messages per user, further messages are rejected (0 = unlimited)")
+	postageRequiredByDefault := flag.Bool("postageRequiredByDefault", false, "require postage on unauthenticated messages unless the recipient opted out")
+	postageBaseBits := flag.Uint("postageBaseBits", 16, "postage difficulty (in bits) for small messages to idle recipients")
+	postageMaxBits := flag.Uint("postageMaxBits", 24, "max. postage difficulty (in bits)")
+	postageKey := flag.String("postageKey", "", "YAML file with the key that authenticates postage challenges (default: postage_key.yml in configDir)")
+	accountDeletionGracePeriod := flag.Duration("accountDeletionGracePeriod", 7*24*time.Hour, "time until a deleted account is purged, during which the deletion can be cancelled")
+	addressForwardingPeriod := flag.Duration("addressForwardingPeriod", 90*24*time.Hour, "time during which messages to the old address of a renamed account are forwarded")
+	messageMaxLifetime := flag.Duration("messageMaxLifetime", 365*24*time.Hour, "upper bound for the expiry that senders can set on messages (0: unlimited)")
+	messageTombstoneHorizon := flag.Duration("messageTombstoneHorizon", 0, "time after which tombstones of deleted messages are purged; clients that haven't synced since then must do a full resync (0: never)")
+	payloadVerificationInterval := flag.Duration("payloadVerificationInterval", 7*24*time.Hour, "how often stored message payloads are verified against their digests (0: never)")
+	idempotencyKeyRetention := flag.Duration("idempotencyKeyRetention", 24*time.Hour, "time during which requests with an Idempotency-Key header can be repeated")
+	addressTombstonePeriod := flag.Duration("addressTombstonePeriod", 365*24*time.Hour, "time during which the address of a purged account cannot be registered again")
+	verificationStub := flag.String("verificationStub", "", "YAML file with the DNS TXT records and well-known documents of domains, instead of looking them up (for tests)")
+	federationName := flag.String("federationName", "", "name by which federation peers know this server (default: value of -domain)")
+	federationPeers := flag.String("federationPeers", "", "YAML file with the federation peers (default: peers.yml in configDir)")
+	receiptKeys := flag.String("receiptKeys", "", "YAML file with the keys for signing delivery receipts (default: receipt_keys.yml in configDir)")
+	adminListen := flag.String("adminListen", "", "address the admin API listens on, e.g. 127.0.0.1:8002; needs admins.yml in configDir (empty = disabled)")
+	hashPassword := flag.Bool("hashAdminPassword", false, "print the hash of the admin password read from stdin, for admins.yml, and exit")
 	flag.Parse()
 
+	if *hashPassword {
+		hashAdminPassword()
+		return
+	}
+
+	if *federationName == "" {
+		*federationName = *domain
+	}
+	if *federationPeers == "" {
+		*federationPeers = *configDir + "/peers.yml"
+	}
+	if *postageKey == "" {
+		*postageKey = *configDir + "/postage_key.yml"
+	}
+	if *receiptKeys == "" {
+		*receiptKeys = *configDir + "/receipt_keys.yml"
+	}
+	receiptSigner, err := receipts.NewSigner(*receiptKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	peers, err := federation.NewDirectory(*federationPeers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fed := federation.NewFederation(*federationName, peers)
+
 	logging.OpenErrorLog(*errorLogFile)
 	defer logging.CloseErrorLog()
 	logging.OpenAccessLog(*accessLogFile)
@@ -94,7 +189,7 @@ func main() {
 
 	// handle SIGINT (Ctrl+C)
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGUSR1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGHUP)
 	go func() {
 		for {
 			sig := <-signalChan
@@ -118,6 +213,17 @@ func main() {
 				log.Println("Reopening logs")
 				logging.OpenErrorLog(*errorLogFile)
 				logging.OpenAccessLog(*accessLogFile)
+
+			case syscall.SIGHUP:
+				// reload local domains
+				log.Println("Reloading domains")
+				if err := domains.Reload(); err != nil {
+					log.Print("Reloading domains failed: ", err)
+				}
+				log.Println("Reloading federation peers")
+				if err := fed.Reload(); err != nil {
+					log.Print("Reloading federation peers failed: ", err)
+				}
 			}
 		}
 	}()
@@ -129,23 +235,82 @@ func main() {
 	openDb(*dbEnvironment, *configDir)
 	defer dbconn.Close()
 
-	webservice.SetAvailableLanguages(language.English, language.German)
+	// needs the DB to check the default plans
+	err = domains.Init(*configDir+"/domains.yml", *domain)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the first language is the default
+	availableLanguages := []language.Tag{language.English, language.German}
+	webservice.SetAvailableLanguages(availableLanguages...)
+	notifications.SetDefaultLanguage(availableLanguages[0].String())
+
+	inboundLimiter := inbound.NewLimiter(
+		uint32(*inboundMessagesPerHour), *inboundBytesPerDay, uint32(*inboundMaxHeldMessages), *inboundMaxHeldBytes,
+		uint32(*inboundMaxScheduledMessages), *inboundMaxScheduledBytes)
+	postmaster, err := postage.NewPostmaster(
+		&inboundLimiter, *postageKey, *postageRequiredByDefault, *postageBaseBits, *postageMaxBits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	senderFilter := senders.NewFilter()
+
+	var resolver verification.Resolver = verification.NewNetResolver()
+	if *verificationStub != "" {
+		resolver = verification.NewStubResolver(*verificationStub)
+	}
+	verifier := verification.NewVerifier(resolver)
 
 	// set up restful
 	restful.Filter(logging.AccessLoggingFilter())
 	restful.Filter(webservice.LanguageFilter)
 	restful.DefaultResponseContentType(restful.MIME_JSON)
 	restful.PrettyPrintResponses = false
-	restful.Add(webservice.NewAccounts(*domain).RestfulWebService)
-	restful.Add(webservice.NewAccount().RestfulWebService)
-	restful.Add(webservice.NewMessages().RestfulWebService)
+	restful.Add(webservice.NewAccounts(&verifier).RestfulWebService)
+	restful.Add(webservice.NewAccount(&verifier, *accountDeletionGracePeriod, *addressForwardingPeriod).RestfulWebService)
+	restful.Add(webservice.NewAliases(&verifier).RestfulWebService)
+	restful.Add(webservice.NewDomainVerification(&verifier).RestfulWebService)
+	messagesWebservice := webservice.NewMessages(&inboundLimiter, &postmaster, &senderFilter, &receiptSigner, &fed, *messageMaxLifetime)
+	keysAsymmWebservice := webservice.NewKeysAsymm(&fed)
+	restful.Add(messagesWebservice.RestfulWebService)
 	restful.Add(webservice.NewKeysSymm().RestfulWebService)
-	restful.Add(webservice.NewKeysAsymm().RestfulWebService)
+	restful.Add(keysAsymmWebservice.RestfulWebService)
 	restful.Add(webservice.NewPush().RestfulWebService)
 	restful.Add(webservice.NewProfile().RestfulWebService)
+	restful.Add(webservice.NewInbound(&inboundLimiter, &postmaster).RestfulWebService)
+	restful.Add(webservice.NewSenders(&senderFilter).RestfulWebService)
+	restful.Add(webservice.NewReceipts(&receiptSigner).RestfulWebService)
+	restful.Add(webservice.NewFederation(&fed, messagesWebservice, keysAsymmWebservice).RestfulWebService)
 
 	notifications.StartWorkers(*gcmApiKey)
+	jobs.StartWorkers(jobs.Config{
+		InboundLimiter:              &inboundLimiter,
+		SenderFilter:                &senderFilter,
+		ReceiptSigner:               &receiptSigner,
+		AddressTombstonePeriod:      *addressTombstonePeriod,
+		MessageTombstoneHorizon:     *messageTombstoneHorizon,
+		PayloadVerificationInterval: *payloadVerificationInterval,
+		IdempotencyKeyRetention:     *idempotencyKeyRetention,
+		Federation:                  &fed,
+	})
+
+	// admin API, separated from the public API
+	if *adminListen != "" {
+		adminContainer := restful.NewContainer()
+		adminContainer.Filter(logging.AccessLoggingFilter())
+		adminCredentials := readAdminCredentials(*configDir)
+		adminContainer.Add(webservice.NewAdmin(adminCredentials).RestfulWebService)
+		adminContainer.Add(webservice.NewAdminPlans(adminCredentials).RestfulWebService)
+		adminContainer.Add(webservice.NewAdminPlanDomainRules(adminCredentials).RestfulWebService)
+		adminContainer.Add(webservice.NewAdminDomains(adminCredentials).RestfulWebService)
+		go func() {
+			log.Print(fmt.Sprintf("Starting admin HTTP server on %s ...", *adminListen))
+			log.Fatal(http.ListenAndServe(*adminListen, adminContainer))
+		}()
+	}
 
-	log.Print(fmt.Sprintf("Starting HTTP server for %s on port %d ...", *domain, *port))
+	log.Print(fmt.Sprintf("Starting HTTP server for %s on port %d ...",
+		strings.Join(domains.Names(), ", "), *port))
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
 }
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
+
+	"bitbucket.org/kullo/server/domains"
 )
 
 const programDir = "/opt/kulloserver/config/hooks/"
@@ -30,11 +32,13 @@ type messageQueueEntry struct {
 type welcomeData struct {
 	address  string
 	language string
+	branding string
 }
 
 type resetData struct {
 	address  string
 	language string
+	branding string
 }
 
 type messageNotificationData struct {
@@ -43,6 +47,7 @@ type messageNotificationData struct {
 	username     string
 	cancelSecret string
 	language     string
+	branding     string
 }
 
 var messageQueue = make(chan messageQueueEntry, 100)
@@ -61,11 +66,13 @@ func startWorkerForExternalMessages() {
 				data := entry.data.(*welcomeData)
 				args = append(args, data.address)
 				args = append(args, data.language)
+				args = append(args, data.branding)
 			case msgTypeReset:
 				program = "reset"
 				data := entry.data.(*resetData)
 				args = append(args, data.address)
 				args = append(args, data.language)
+				args = append(args, data.branding)
 			case msgTypeMessageNotification:
 				program = "message_notification"
 				data := entry.data.(*messageNotificationData)
@@ -74,6 +81,7 @@ func startWorkerForExternalMessages() {
 				args = append(args, data.username)
 				args = append(args, data.cancelSecret)
 				args = append(args, data.language)
+				args = append(args, data.branding)
 			default:
 				log.Print(fmt.Sprintf(
 					"[notifications] unknown msgType: '%d'",
@@ -99,6 +107,7 @@ func SendWelcomeMessage(address string, language string) {
 		data: &welcomeData{
 			address:  address,
 			language: language,
+			branding: branding(address),
 		}}
 }
 
@@ -108,6 +117,7 @@ func SendResetMessage(address string, language string) {
 		data: &resetData{
 			address:  address,
 			language: language,
+			branding: branding(address),
 		}}
 }
 
@@ -122,5 +132,15 @@ func SendMessageNotification(kulloAddress string, emailAddress string,
 			username:     username,
 			cancelSecret: cancelSecret,
 			language:     language,
+			branding:     branding(kulloAddress),
 		}}
 }
+
+// Returns the branding of the domain of address, "" for the default templates.
+func branding(address string) string {
+	domain := domains.ForAddress(address)
+	if domain == nil {
+		return ""
+	}
+	return domain.Branding
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package notifications
+
+import (
+	"database/sql"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/util"
+)
+
+var defaultLanguage = "en"
+
+func SetDefaultLanguage(language string) {
+	defaultLanguage = language
+}
+
+func recipientLanguage(address string) string {
+	users := dao.Users{}
+	recipient, err := users.GetEntry(address)
+	if err != nil {
+		util.LogServerError(err)
+		return defaultLanguage
+	} else if recipient.Language != "" {
+		return recipient.Language
+	} else {
+		return defaultLanguage
+	}
+}
+
+// Informs the owner of the given address about a message that has been put
+// into their inbox by someone else, via push and email (if enabled).
+func SendIncomingMessageNotifications(address string, messageId uint32) {
+	messagesDao := dao.Messages{}
+	unreadMessages := -1
+	unreadCount, err := messagesDao.GetUnreadCount(address)
+	if err != nil {
+		util.LogServerError(err)
+	} else {
+		unreadMessages = int(unreadCount)
+	}
+	SendPushNotifications(PushNotification{
+		Type:           PushTypeIncomingMessage,
+		Address:        address,
+		MessageId:      int(messageId),
+		UnreadMessages: unreadMessages,
+	})
+
+	notificationsDao := dao.Notifications{}
+	n, err := notificationsDao.GetConfirmedEntry(address)
+	switch err {
+	case nil:
+		SendMessageNotification(
+			address, n.Email, n.WebloginUsername, n.CancelSecret,
+			recipientLanguage(address))
+	case sql.ErrNoRows:
+		// no (confirmed) email address found, do nothing
+	default:
+		util.LogServerError(err)
+	}
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+
+// Package postage implements hashcash-style proof-of-work stamps for messages
+// that are sent without authentication.
+//
+// A sender requests a challenge for a recipient and a maximum message size.
+// The server replies with a token and the difficulty (bits). The sender then
+// finds a nonce so that SHA-256(token + ":" + nonce) starts with at least that
+// many zero bits and sends "token:nonce" as the stamp along with the message.
+package postage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/inbound"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+const tokenVersion = "1"
+
+// Stamps must be used within this time after the challenge has been created
+const ChallengeValidity = 15 * time.Minute
+
+// Each doubling of the message size beyond this adds one bit of difficulty
+const sizeStep uint64 = 1024 * 1024
+
+// A recipient who has used up their inbound limits adds this many bits
+const maxLoadBits = 4
+
+var ErrMissing = errors.New("Postage is required")
+var ErrMalformed = errors.New("Postage stamp is malformed")
+var ErrInvalid = errors.New("Postage stamp is invalid")
+var ErrExpired = errors.New("Postage stamp has expired")
+var ErrUsed = errors.New("Postage stamp has already been used")
+
+type Challenge struct {
+	Recipient string `json:"recipient"`
+	MaxSize   uint64 `json:"maxSize"`
+	Timestamp uint64 `json:"timestamp"`
+	Bits      uint   `json:"bits"`
+	Auth      string `json:"auth"`
+}
+
+// Token returns the string that is to be prefixed to the nonce
+func (c *Challenge) Token() string {
+	return serializeChallenge(c) + ":" + c.Auth
+}
+
+type settingsDao interface {
+	GetRequired(address string) (bool, error)
+}
+
+type usedPostageDao interface {
+	InsertUsedPostage(digest []byte, expires time.Time) (bool, error)
+}
+
+type loadMeter interface {
+	Load(address string) (float64, error)
+}
+
+type Postmaster struct {
+	settingsDao       settingsDao
+	loadMeter         loadMeter
+	key               []byte
+	requiredByDefault bool
+	baseBits          uint
+	maxBits           uint
+	now               func() time.Time
+}
+
+// NewPostmaster creates a Postmaster that requires baseBits of work for small
+// messages to recipients with little inbound load, and never more than
+// maxBits. If requiredByDefault is set, postage is required for recipients
+// that haven't opted in or out. Challenges are authenticated with the key
+// from the YAML file at keyPath, so that they stay valid across restarts and
+// on all instances that share the key.
+func NewPostmaster(limiter *inbound.Limiter, keyPath string, requiredByDefault bool, baseBits uint, maxBits uint) (Postmaster, error) {
+	key, err := readKey(keyPath)
+	if err != nil {
+		return Postmaster{}, err
+	}
+
+	return Postmaster{
+		settingsDao:       &dao.PostageSettings{},
+		loadMeter:         limiter,
+		key:               key,
+		requiredByDefault: requiredByDefault,
+		baseBits:          baseBits,
+		maxBits:           maxBits,
+		now:               time.Now,
+	}, nil
+}
+
+// Required returns whether unauthenticated messages to the given address
+// must carry postage.
+func (self *Postmaster) Required(address string) (bool, error) {
+	required, err := self.settingsDao.GetRequired(address)
+	if err == sql.ErrNoRows {
+		return self.requiredByDefault, nil
+	}
+	return required, err
+}
+
+// Difficulty returns the number of bits that are required for sending a
+// message of the given size to the given address.
+func (self *Postmaster) Difficulty(address string, size uint64) (uint, error) {
+	load, err := self.loadMeter.Load(address)
+	if err != nil {
+		return 0, err
+	}
+
+	difficulty := self.baseBits
+	for steps := size / sizeStep; steps > 0; steps >>= 1 {
+		difficulty++
+	}
+	if load >= 1 {
+		difficulty += maxLoadBits
+	} else if load > 0 {
+		difficulty += uint(load * maxLoadBits)
+	}
+
+	if difficulty > self.maxBits {
+		difficulty = self.maxBits
+	}
+	return difficulty, nil
+}
+
+// CreateChallenge creates a challenge for a message of up to maxSize bytes.
+func (self *Postmaster) CreateChallenge(address string, maxSize uint64) (*Challenge, error) {
+	difficulty, err := self.Difficulty(address, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := &Challenge{
+		Recipient: address,
+		MaxSize:   maxSize,
+		Timestamp: uint64(self.now().Unix()),
+		Bits:      difficulty,
+	}
+	challenge.Auth = self.createAuth(challenge)
+	return challenge, nil
+}
+
+// Stamp is a valid postage stamp that hasn't been used yet.
+type Stamp struct {
+	digest  []byte
+	expires time.Time
+	maxSize uint64
+}
+
+// MaxSize returns the size of the largest message the stamp pays for.
+func (self *Stamp) MaxSize() uint64 {
+	return self.maxSize
+}
+
+// CheckStamp checks the stamp of a message of the given size to the given
+// address. Returns a nil Stamp if the message carries no postage and doesn't
+// need to. The stamp must be used once the message has been accepted.
+func (self *Postmaster) CheckStamp(address string, size uint64, stamp string) (*Stamp, error) {
+	if stamp == "" {
+		required, err := self.Required(address)
+		if err != nil {
+			return nil, err
+		}
+		if required {
+			return nil, ErrMissing
+		}
+		return nil, nil
+	}
+
+	challenge, nonce, err := parseStamp(stamp)
+	if err != nil {
+		return nil, err
+	}
+
+	expectedAuth := []byte(self.createAuth(challenge))
+	if !hmac.Equal(expectedAuth, []byte(challenge.Auth)) {
+		return nil, ErrInvalid
+	}
+	if challenge.Recipient != address || size > challenge.MaxSize {
+		return nil, ErrInvalid
+	}
+
+	issued := time.Unix(int64(challenge.Timestamp), 0)
+	expires := issued.Add(ChallengeValidity)
+	if self.now().After(expires) {
+		return nil, ErrExpired
+	}
+
+	if LeadingZeroBits(stampHash(challenge.Token(), nonce)) < challenge.Bits {
+		return nil, ErrInvalid
+	}
+
+	// one stamp per challenge, no matter which nonce has been used
+	tokenDigest := sha256.Sum256([]byte(challenge.Token()))
+	return &Stamp{digest: tokenDigest[:], expires: expires, maxSize: challenge.MaxSize}, nil
+}
+
+// Use marks the stamp as used. usedPostage should belong to the transaction
+// that accepts the message, so that stamps of rejected messages can be used
+// again. Returns ErrUsed if the stamp has been used before. Does nothing for a
+// nil Stamp.
+func (self *Stamp) Use(usedPostage usedPostageDao) error {
+	if self == nil {
+		return nil
+	}
+	fresh, err := usedPostage.InsertUsedPostage(self.digest, self.expires)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrUsed
+	}
+	return nil
+}
+
+// Solve finds a nonce for a challenge with the given token and difficulty and
+// returns the stamp. This is what senders do, it is only needed by servers
+// that relay messages on their behalf.
+func Solve(token string, bits uint) string {
+	for nonce := uint64(0); ; nonce++ {
+		nonceString := strconv.FormatUint(nonce, 10)
+		if LeadingZeroBits(stampHash(token, nonceString)) >= bits {
+			return token + ":" + nonceString
+		}
+	}
+}
+
+// LeadingZeroBits counts the zero bits at the beginning of hash.
+func LeadingZeroBits(hash []byte) uint {
+	var count uint
+	for _, b := range hash {
+		count += uint(bits.LeadingZeros8(b))
+		if b != 0 {
+			break
+		}
+	}
+	return count
+}
+
+// ### begin private stuff ###
+
+// reads "key: <32 bytes of hex>"
+func readKey(path string) ([]byte, error) {
+	conf, err := yaml.ReadFile(path)
+	if os.IsNotExist(err) {
+		// stamps are short-lived, so this only fails messages in flight
+		log.Printf("postage: %s doesn't exist, using a random key that is lost on restart", path)
+		key := make([]byte, 32)
+		_, err = rand.Read(key)
+		return key, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyHex, err := conf.Get("key")
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("postage: key must be 32 bytes of hex")
+	}
+	return key, nil
+}
+
+func serializeChallenge(challenge *Challenge) string {
+	return tokenVersion +
+		":" + strconv.FormatUint(uint64(challenge.Bits), 10) +
+		":" + strconv.FormatUint(challenge.Timestamp, 10) +
+		":" + strconv.FormatUint(challenge.MaxSize, 10) +
+		":" + challenge.Recipient
+}
+
+func (self *Postmaster) createAuth(challenge *Challenge) string {
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte(serializeChallenge(challenge)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func stampHash(token string, nonce string) []byte {
+	hash := sha256.Sum256([]byte(token + ":" + nonce))
+	return hash[:]
+}
+
+// parses "version:bits:timestamp:maxSize:recipient:auth:nonce"
+func parseStamp(stamp string) (*Challenge, string, error) {
+	parts := strings.Split(stamp, ":")
+	if len(parts) != 7 || parts[0] != tokenVersion || parts[6] == "" {
+		return nil, "", ErrMalformed
+	}
+
+	difficulty, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return nil, "", ErrMalformed
+	}
+	timestamp, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil, "", ErrMalformed
+	}
+	maxSize, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil {
+		return nil, "", ErrMalformed
+	}
+
+	challenge := &Challenge{
+		Recipient: parts[4],
+		MaxSize:   maxSize,
+		Timestamp: timestamp,
+		Bits:      uint(difficulty),
+		Auth:      parts[5],
+	}
+	return challenge, parts[6], nil
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package postage
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	userUndecided string = "undecided#kullo.test"
+	userOptedIn   string = "opted.in#kullo.test"
+	userOptedOut  string = "opted.out#kullo.test"
+	userBusy      string = "busy#kullo.test"
+)
+
+type settingsDaoStub struct{}
+
+func (self *settingsDaoStub) GetRequired(address string) (bool, error) {
+	switch address {
+	case userOptedIn, userBusy:
+		return true, nil
+	case userOptedOut:
+		return false, nil
+	}
+	return false, sql.ErrNoRows
+}
+
+type usedPostageDaoStub struct {
+	used map[string]bool
+}
+
+func (self *usedPostageDaoStub) InsertUsedPostage(digest []byte, expires time.Time) (bool, error) {
+	if self.used[string(digest)] {
+		return false, nil
+	}
+	self.used[string(digest)] = true
+	return true, nil
+}
+
+type loadMeterStub struct{}
+
+func (self *loadMeterStub) Load(address string) (float64, error) {
+	if address == userBusy {
+		return 0.5, nil
+	}
+	return 0, nil
+}
+
+var testNow = time.Date(2020, 2, 10, 12, 0, 0, 0, time.UTC)
+
+func makePostmasterUut(requiredByDefault bool) *Postmaster {
+	return &Postmaster{
+		settingsDao:       &settingsDaoStub{},
+		loadMeter:         &loadMeterStub{},
+		key:               []byte("test key"),
+		requiredByDefault: requiredByDefault,
+		baseBits:          8,
+		maxBits:           12,
+		now:               func() time.Time { return testNow },
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	cases := []struct {
+		hash     []byte
+		expected uint
+	}{
+		{[]byte{0xff}, 0},
+		{[]byte{0x01, 0xff}, 7},
+		{[]byte{0x00, 0x40}, 9},
+		{[]byte{0x00, 0x00}, 16},
+	}
+	for _, c := range cases {
+		if result := LeadingZeroBits(c.hash); result != c.expected {
+			t.Errorf("LeadingZeroBits(%x) = %d, expected %d", c.hash, result, c.expected)
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	for _, requiredByDefault := range []bool{false, true} {
+		uut := makePostmasterUut(requiredByDefault)
+
+		required, err := uut.Required(userUndecided)
+		if err != nil || required != requiredByDefault {
+			t.Error("undecided user should get default", requiredByDefault, required, err)
+		}
+		required, err = uut.Required(userOptedIn)
+		if err != nil || !required {
+			t.Error("opted in user must require postage", err)
+		}
+		required, err = uut.Required(userOptedOut)
+		if err != nil || required {
+			t.Error("opted out user must not require postage", err)
+		}
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	uut := makePostmasterUut(true)
+
+	cases := []struct {
+		address  string
+		size     uint64
+		expected uint
+	}{
+		{userOptedIn, 0, 8},
+		{userOptedIn, sizeStep - 1, 8},
+		{userOptedIn, sizeStep, 9},
+		{userOptedIn, 4 * sizeStep, 11},
+		{userOptedIn, 1000 * sizeStep, 12}, // capped
+		{userBusy, 0, 10},
+	}
+	for _, c := range cases {
+		difficulty, err := uut.Difficulty(c.address, c.size)
+		if err != nil {
+			t.Fatal("Difficulty failed:", err)
+		}
+		if difficulty != c.expected {
+			t.Errorf("Difficulty(%s, %d) = %d, expected %d",
+				c.address, c.size, difficulty, c.expected)
+		}
+	}
+}
+
+func TestCheckValidStamp(t *testing.T) {
+	uut := makePostmasterUut(true)
+	challenge, err := uut.CreateChallenge(userOptedIn, 1000)
+	if err != nil {
+		t.Fatal("CreateChallenge failed:", err)
+	}
+
+	stamp := Solve(challenge.Token(), challenge.Bits)
+	usedPostage := &usedPostageDaoStub{used: map[string]bool{}}
+	checked, err := uut.CheckStamp(userOptedIn, 1000, stamp)
+	if err != nil {
+		t.Fatal("valid stamp rejected:", err)
+	}
+	if err := checked.Use(usedPostage); err != nil {
+		t.Error("valid stamp not usable:", err)
+	}
+
+	// a replayed stamp is still valid, but cannot be used again
+	checked, err = uut.CheckStamp(userOptedIn, 1000, stamp)
+	if err != nil {
+		t.Fatal("valid stamp rejected:", err)
+	}
+	if err := checked.Use(usedPostage); err != ErrUsed {
+		t.Error("replayed stamp not rejected:", err)
+	}
+}
+
+func TestCheckMissingStamp(t *testing.T) {
+	uut := makePostmasterUut(false)
+	if _, err := uut.CheckStamp(userOptedIn, 1000, ""); err != ErrMissing {
+		t.Error("missing stamp not rejected:", err)
+	}
+	checked, err := uut.CheckStamp(userUndecided, 1000, "")
+	if err != nil {
+		t.Error("missing stamp rejected for optional postage:", err)
+	}
+	if err := checked.Use(&usedPostageDaoStub{used: map[string]bool{}}); err != nil {
+		t.Error("missing stamp not usable for optional postage:", err)
+	}
+}
+
+func TestCheckStampMismatch(t *testing.T) {
+	uut := makePostmasterUut(true)
+	challenge, err := uut.CreateChallenge(userOptedIn, 1000)
+	if err != nil {
+		t.Fatal("CreateChallenge failed:", err)
+	}
+	stamp := Solve(challenge.Token(), challenge.Bits)
+
+	if _, err := uut.CheckStamp(userUndecided, 1000, stamp); err != ErrInvalid {
+		t.Error("stamp for other recipient not rejected:", err)
+	}
+	if _, err := uut.CheckStamp(userOptedIn, 1001, stamp); err != ErrInvalid {
+		t.Error("stamp for smaller message not rejected:", err)
+	}
+
+	// lower the difficulty without updating the auth
+	parts := strings.Split(stamp, ":")
+	parts[1] = "0"
+	if _, err := uut.CheckStamp(userOptedIn, 1000, strings.Join(parts, ":")); err != ErrInvalid {
+		t.Error("forged stamp not rejected:", err)
+	}
+
+	if _, err := uut.CheckStamp(userOptedIn, 1000, "1:2:3"); err != ErrMalformed {
+		t.Error("malformed stamp not rejected:", err)
+	}
+}
+
+func TestCheckStampInsufficientWork(t *testing.T) {
+	uut := makePostmasterUut(true)
+	challenge, err := uut.CreateChallenge(userOptedIn, 1000)
+	if err != nil {
+		t.Fatal("CreateChallenge failed:", err)
+	}
+	token := challenge.Token()
+
+	var badNonce string
+	for nonce := 0; ; nonce++ {
+		badNonce = strconv.Itoa(nonce)
+		if LeadingZeroBits(stampHash(token, badNonce)) < challenge.Bits {
+			break
+		}
+	}
+	if _, err := uut.CheckStamp(userOptedIn, 1000, token+":"+badNonce); err != ErrInvalid {
+		t.Error("unsolved stamp not rejected:", err)
+	}
+}
+
+func TestCheckExpiredStamp(t *testing.T) {
+	uut := makePostmasterUut(true)
+	challenge, err := uut.CreateChallenge(userOptedIn, 1000)
+	if err != nil {
+		t.Fatal("CreateChallenge failed:", err)
+	}
+	stamp := Solve(challenge.Token(), challenge.Bits)
+
+	uut.now = func() time.Time { return testNow.Add(ChallengeValidity + time.Second) }
+	if _, err := uut.CheckStamp(userOptedIn, 1000, stamp); err != ErrExpired {
+		t.Error("expired stamp not rejected:", err)
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "postage_key.yml")
+	keyHex := strings.Repeat("ab", 32)
+	if err := ioutil.WriteFile(path, []byte("key: "+keyHex+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := readKey(path)
+	if err != nil {
+		t.Fatal("readKey failed:", err)
+	}
+	if hex.EncodeToString(key) != keyHex {
+		t.Error("unexpected key", key)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("key: abcd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readKey(path); err == nil {
+		t.Error("short key not rejected")
+	}
+
+	// a missing key file is replaced by a random key
+	key, err = readKey(filepath.Join(dir, "missing.yml"))
+	if err != nil {
+		t.Fatal("readKey failed for missing file:", err)
+	}
+	if len(key) != 32 {
+		t.Error("unexpected random key length", len(key))
+	}
+}
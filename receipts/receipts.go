@@ -0,0 +1,213 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package receipts
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	"bitbucket.org/kullo/server/dao"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+const Algorithm = "Ed25519"
+
+// prefix of the signed data, changes whenever its format changes
+const signedDataPrefix = "kullo-receipt-v1"
+
+// Receipt proves that the server has delivered a message to a recipient at
+// the given time. Digests are those of the message as returned by the API:
+// hex-encoded SHA-256 hashes of the keySafe and content (base64) and of the
+// raw attachments, or empty if there are no attachments.
+type Receipt struct {
+	Recipient         string `json:"recipient"`
+	ID                uint32 `json:"id"`
+	Received          string `json:"dateReceived"`
+	KeySafeSHA256     string `json:"keySafeSha256"`
+	ContentSHA256     string `json:"contentSha256"`
+	AttachmentsSHA256 string `json:"attachmentsSha256"`
+	KeyID             string `json:"keyId"`
+	Signature         string `json:"signature"` // base64
+}
+
+// signedData returns the fields of the receipt that are signed, one per line:
+//
+//	kullo-receipt-v1
+//	<recipient>
+//	<id>
+//	<dateReceived>
+//	<keySafeSha256>
+//	<contentSha256>
+//	<attachmentsSha256>
+//	<keyId>
+func (self *Receipt) signedData() []byte {
+	var data bytes.Buffer
+	for _, field := range []string{
+		signedDataPrefix,
+		self.Recipient,
+		strconv.FormatUint(uint64(self.ID), 10),
+		self.Received,
+		self.KeySafeSHA256,
+		self.ContentSHA256,
+		self.AttachmentsSHA256,
+		self.KeyID,
+	} {
+		data.WriteString(field)
+		data.WriteByte('\n')
+	}
+	return data.Bytes()
+}
+
+// PublicKey is published so that anyone can verify receipts.
+type PublicKey struct {
+	ID        string `json:"keyId"`
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"publicKey"` // base64
+	Current   bool   `json:"current"`
+}
+
+// Store stores receipts with their messages, usually within the delivery
+// that has inserted them.
+type Store interface {
+	SetReceipt(address string, id uint32, receipt string) error
+}
+
+// Signer issues receipts for delivered messages.
+type Signer struct {
+	keys    map[string]ed25519.PrivateKey
+	current string
+}
+
+// NewSigner reads the signing keys from a YAML file like this:
+//
+//	current: 2020-06
+//	keys:
+//	  2020-06: <seed, 32 bytes of hex>
+//
+// If the file doesn't exist, no receipts are issued.
+func NewSigner(path string) (Signer, error) {
+	conf, err := yaml.ReadFile(path)
+	if os.IsNotExist(err) {
+		// receipts must stay verifiable, so a random key is no option
+		log.Printf("receipts: %s doesn't exist, no receipts are issued", path)
+		return Signer{keys: map[string]ed25519.PrivateKey{}}, nil
+	}
+	if err != nil {
+		return Signer{}, err
+	}
+	keys, current, err := parseKeys(conf.Root)
+	if err != nil {
+		return Signer{}, err
+	}
+	return Signer{keys: keys, current: current}, nil
+}
+
+func parseKeys(root yaml.Node) (map[string]ed25519.PrivateKey, string, error) {
+	config, ok := root.(yaml.Map)
+	if !ok {
+		return nil, "", errors.New("receipts: keys must be a map")
+	}
+	current, ok := config["current"].(yaml.Scalar)
+	if !ok {
+		return nil, "", errors.New("receipts: current is missing")
+	}
+	seeds, ok := config["keys"].(yaml.Map)
+	if !ok {
+		return nil, "", errors.New("receipts: keys must map key IDs to seeds")
+	}
+
+	keys := map[string]ed25519.PrivateKey{}
+	for id, node := range seeds {
+		seed, ok := node.(yaml.Scalar)
+		if !ok {
+			return nil, "", fmt.Errorf("receipts: seed of %s is missing", id)
+		}
+		seedBytes, err := hex.DecodeString(seed.String())
+		if err != nil || len(seedBytes) != ed25519.SeedSize {
+			return nil, "", fmt.Errorf("receipts: seed of %s must be %d bytes of hex", id, ed25519.SeedSize)
+		}
+		keys[id] = ed25519.NewKeyFromSeed(seedBytes)
+	}
+	if _, ok := keys[current.String()]; !ok {
+		return nil, "", fmt.Errorf("receipts: current key %s is missing", current.String())
+	}
+	return keys, current.String(), nil
+}
+
+// Sign creates a receipt for an entry that has been inserted into a
+// recipient's inbox. The digests are taken from the entry as they have been
+// stored, so that the receipt always matches the message.
+func (self *Signer) Sign(entry *dao.MessagesEntry) *Receipt {
+	receipt := &Receipt{
+		Recipient:         entry.Recipient,
+		ID:                entry.ID,
+		Received:          entry.Received,
+		KeySafeSHA256:     entry.KeySafeSHA256,
+		ContentSHA256:     entry.ContentSHA256,
+		AttachmentsSHA256: entry.AttachmentsSHA256,
+		KeyID:             self.current,
+	}
+	signature := ed25519.Sign(self.keys[self.current], receipt.signedData())
+	receipt.Signature = base64.StdEncoding.EncodeToString(signature)
+	return receipt
+}
+
+// Issue signs a receipt for an entry that has been inserted into the inbox of
+// address and stores it with the message in store. Returns nil if the server
+// has no keys.
+func (self *Signer) Issue(store Store, address string, entry *dao.MessagesEntry) (*Receipt, error) {
+	if self.current == "" {
+		return nil, nil
+	}
+	receipt := self.Sign(entry)
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	err = store.SetReceipt(address, entry.ID, string(data))
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// Verify checks the signature of a receipt against the keys of this server.
+func (self *Signer) Verify(receipt *Receipt) bool {
+	key, ok := self.keys[receipt.KeyID]
+	if !ok {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(receipt.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key.Public().(ed25519.PublicKey), receipt.signedData(), signature)
+}
+
+// PublicKeys returns the public keys of all keys, sorted by ID.
+func (self *Signer) PublicKeys() []PublicKey {
+	keys := make([]PublicKey, 0, len(self.keys))
+	for id, key := range self.keys {
+		keys = append(keys, PublicKey{
+			ID:        id,
+			Algorithm: Algorithm,
+			Key:       base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+			Current:   id == self.current,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package receipts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"bitbucket.org/kullo/server/dao"
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+const testKeys = "" +
+	"current: new\n" +
+	"keys:\n" +
+	"  old: 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n" +
+	"  new: 202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f\n"
+
+type storeStub struct {
+	receipts map[uint32]string
+}
+
+func (self *storeStub) SetReceipt(address string, id uint32, receipt string) error {
+	self.receipts[id] = receipt
+	return nil
+}
+
+func parseKeysString(t *testing.T, config string) (*Signer, error) {
+	root, err := yaml.Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal("yaml.Parse:", err)
+	}
+	keys, current, err := parseKeys(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{keys: keys, current: current}, nil
+}
+
+func makeSignerUut(t *testing.T) (*Signer, *storeStub) {
+	uut, err := parseKeysString(t, testKeys)
+	if err != nil {
+		t.Fatal("parseKeys failed:", err)
+	}
+	return uut, &storeStub{receipts: map[uint32]string{}}
+}
+
+func digest(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// makeEntry returns an entry with digests as set by inserting it
+func makeEntry() *dao.MessagesEntry {
+	return &dao.MessagesEntry{
+		ID:                42,
+		Recipient:         "recipient#kullo.test",
+		Received:          "2020-06-01T12:00:00Z",
+		KeySafe:           "a2V5IHNhZmU=",
+		Content:           "Y29udGVudA==",
+		Attachments:       []byte("attachments"),
+		KeySafeSHA256:     digest([]byte("a2V5IHNhZmU=")),
+		ContentSHA256:     digest([]byte("Y29udGVudA==")),
+		AttachmentsSHA256: digest([]byte("attachments")),
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	uut, _ := makeSignerUut(t)
+	receipt := uut.Sign(makeEntry())
+	if receipt.KeyID != "new" {
+		t.Errorf("Receipt signed with %q, expected the current key", receipt.KeyID)
+	}
+	if receipt.ContentSHA256 != digest([]byte("Y29udGVudA==")) {
+		t.Error("Content digest doesn't match")
+	}
+	if !uut.Verify(receipt) {
+		t.Error("Valid receipt doesn't verify")
+	}
+}
+
+func TestSignMatchesInsertedEntry(t *testing.T) {
+	uut, _ := makeSignerUut(t)
+	withoutAttachments := makeEntry()
+	withoutAttachments.Attachments = nil
+	// no digest is stored for missing attachments
+	withoutAttachments.AttachmentsSHA256 = ""
+
+	for _, entry := range []*dao.MessagesEntry{makeEntry(), withoutAttachments} {
+		receipt := uut.Sign(entry)
+		if receipt.KeySafeSHA256 != entry.KeySafeSHA256 ||
+			receipt.ContentSHA256 != entry.ContentSHA256 ||
+			receipt.AttachmentsSHA256 != entry.AttachmentsSHA256 {
+			t.Errorf("Receipt digests %s/%s/%s, expected %s/%s/%s",
+				receipt.KeySafeSHA256, receipt.ContentSHA256, receipt.AttachmentsSHA256,
+				entry.KeySafeSHA256, entry.ContentSHA256, entry.AttachmentsSHA256)
+		}
+		if !uut.Verify(receipt) {
+			t.Error("Valid receipt doesn't verify")
+		}
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	uut, _ := makeSignerUut(t)
+
+	for name, tamper := range map[string]func(*Receipt){
+		"recipient": func(r *Receipt) { r.Recipient = "other#kullo.test" },
+		"id":        func(r *Receipt) { r.ID++ },
+		"received":  func(r *Receipt) { r.Received = "2020-06-02T12:00:00Z" },
+		"content":   func(r *Receipt) { r.ContentSHA256 = digest([]byte("other")) },
+		"key":       func(r *Receipt) { r.KeyID = "old" },
+		"unknown":   func(r *Receipt) { r.KeyID = "unknown" },
+		"signature": func(r *Receipt) { r.Signature = "not base64" },
+	} {
+		receipt := uut.Sign(makeEntry())
+		tamper(receipt)
+		if uut.Verify(receipt) {
+			t.Errorf("Receipt with tampered %s verifies", name)
+		}
+	}
+}
+
+func TestIssueStoresReceipt(t *testing.T) {
+	uut, stub := makeSignerUut(t)
+	receipt, err := uut.Issue(stub, "alias#kullo.test", makeEntry())
+	if err != nil {
+		t.Fatal("Issue failed:", err)
+	}
+
+	stored := &Receipt{}
+	err = json.Unmarshal([]byte(stub.receipts[42]), stored)
+	if err != nil {
+		t.Fatal("Stored receipt isn't JSON:", err)
+	}
+	if *stored != *receipt {
+		t.Errorf("Stored receipt %+v, expected %+v", stored, receipt)
+	}
+}
+
+func TestWithoutKeyFile(t *testing.T) {
+	uut, err := NewSigner("/nonexistent/receipt_keys.yml")
+	if err != nil {
+		t.Fatal("NewSigner failed:", err)
+	}
+	stub := &storeStub{receipts: map[uint32]string{}}
+
+	receipt, err := uut.Issue(stub, "alias#kullo.test", makeEntry())
+	if err != nil {
+		t.Fatal("Issue failed:", err)
+	}
+	if receipt != nil || len(stub.receipts) != 0 {
+		t.Error("Issued a receipt without keys")
+	}
+	if len(uut.PublicKeys()) != 0 {
+		t.Error("Published keys without keys")
+	}
+}
+
+func TestPublicKeys(t *testing.T) {
+	uut, _ := makeSignerUut(t)
+	keys := uut.PublicKeys()
+	if len(keys) != 2 || keys[0].ID != "new" || keys[1].ID != "old" {
+		t.Fatalf("Unexpected public keys: %+v", keys)
+	}
+	if !keys[0].Current || keys[1].Current {
+		t.Error("Only the new key should be current")
+	}
+}
+
+func TestParseKeysErrors(t *testing.T) {
+	for _, config := range []string{
+		"keys:\n  a: 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n",
+		"current: a\n",
+		"current: a\nkeys:\n  a: 0001\n",
+		"current: a\nkeys:\n  a: not hex\n",
+		"current: b\nkeys:\n  a: 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n",
+	} {
+		_, err := parseKeysString(t, config)
+		if err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package senders
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/validation"
+)
+
+var ErrBadAccept = errors.New("Accept must be 'all', 'verified' or 'allowed'")
+var ErrBadExcludedAction = errors.New("Excluded action must be 'reject' or 'drop'")
+var ErrBadPattern = errors.New("Pattern must be an address or a domain")
+var ErrBadRuleAction = errors.New("Action must be 'block' or 'allow'")
+
+type Decision int
+
+const (
+	// The message can be delivered
+	DecisionAccept Decision = iota
+	// The sender is excluded and the message must be rejected
+	DecisionReject
+	// The sender is excluded and the message must be dropped silently
+	DecisionDrop
+)
+
+type filtersDao interface {
+	GetSettings(address string) (*dao.SenderSettingsEntry, error)
+	GetMatchingRules(address string, sender string) ([]dao.SenderRulesEntry, error)
+	Count(address string, reason string) error
+}
+
+// Filter decides whether recipients accept messages from a sender, based on
+// their rules for sender addresses and domains.
+type Filter struct {
+	filtersDao filtersDao
+}
+
+func NewFilter() Filter {
+	return Filter{
+		filtersDao: &dao.SenderFilters{},
+	}
+}
+
+// Settings returns the settings that are in effect for the given address.
+func (self *Filter) Settings(address string) (*dao.SenderSettingsEntry, error) {
+	entry, err := self.filtersDao.GetSettings(address)
+	if err == sql.ErrNoRows {
+		return &dao.SenderSettingsEntry{
+			Accept:         dao.SENDERS_ACCEPT_ALL,
+			ExcludedAction: dao.SENDERS_EXCLUDED_REJECT,
+		}, nil
+	}
+	return entry, err
+}
+
+// Check decides what to do with a message for address from sender, which is
+// the verified address of the sender or "" for anonymous messages. Messages
+// of excluded senders are counted.
+func (self *Filter) Check(address string, sender string) (Decision, error) {
+	settings, err := self.Settings(address)
+	if err != nil {
+		return DecisionReject, err
+	}
+
+	var rule *dao.SenderRulesEntry
+	if sender != "" {
+		rules, err := self.filtersDao.GetMatchingRules(address, sender)
+		if err != nil {
+			return DecisionReject, err
+		}
+		// rules for the address take precedence over those for the domain
+		for index := range rules {
+			if rule == nil || rules[index].Pattern == sender {
+				rule = &rules[index]
+			}
+		}
+	}
+
+	var reason string
+	switch {
+	case rule != nil && rule.Action == dao.SENDER_RULE_ALLOW:
+		return DecisionAccept, nil
+	case rule != nil && rule.Action == dao.SENDER_RULE_BLOCK:
+		reason = dao.SENDER_EXCLUDED_BLOCKED
+	case settings.Accept == dao.SENDERS_ACCEPT_ALLOWED:
+		reason = dao.SENDER_EXCLUDED_NOT_ALLOWED
+	case settings.Accept == dao.SENDERS_ACCEPT_VERIFIED && sender == "":
+		reason = dao.SENDER_EXCLUDED_UNVERIFIED
+	default:
+		return DecisionAccept, nil
+	}
+
+	err = self.filtersDao.Count(address, reason)
+	if err != nil {
+		return DecisionReject, err
+	}
+	if settings.ExcludedAction == dao.SENDERS_EXCLUDED_DROP {
+		return DecisionDrop, nil
+	}
+	return DecisionReject, nil
+}
+
+// ValidateSettings checks settings that a user wants to set.
+func ValidateSettings(entry *dao.SenderSettingsEntry) error {
+	if entry.Accept != dao.SENDERS_ACCEPT_ALL &&
+		entry.Accept != dao.SENDERS_ACCEPT_VERIFIED &&
+		entry.Accept != dao.SENDERS_ACCEPT_ALLOWED {
+		return ErrBadAccept
+	}
+	if entry.ExcludedAction != dao.SENDERS_EXCLUDED_REJECT &&
+		entry.ExcludedAction != dao.SENDERS_EXCLUDED_DROP {
+		return ErrBadExcludedAction
+	}
+	return nil
+}
+
+// ValidatePattern checks the pattern of a rule, which must be an address or a
+// domain.
+func ValidatePattern(pattern string) error {
+	var err error
+	if strings.Contains(pattern, "#") {
+		_, err = validation.ValidateAddress(pattern)
+	} else {
+		_, err = validation.ValidateDomain(pattern)
+	}
+	if err != nil {
+		return ErrBadPattern
+	}
+	return nil
+}
+
+// ValidateRuleAction checks the action of a rule.
+func ValidateRuleAction(action string) error {
+	if action != dao.SENDER_RULE_BLOCK && action != dao.SENDER_RULE_ALLOW {
+		return ErrBadRuleAction
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package senders
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"bitbucket.org/kullo/server/dao"
+)
+
+const (
+	userWithoutSettings string = "no.settings#kullo.test"
+	userVerifiedOnly    string = "verified.only#kullo.test"
+	userAllowedOnly     string = "allowed.only#kullo.test"
+)
+
+type filtersDaoStub struct {
+	rules  []dao.SenderRulesEntry
+	counts map[string]int
+}
+
+func (self *filtersDaoStub) GetSettings(address string) (*dao.SenderSettingsEntry, error) {
+	switch address {
+	case userVerifiedOnly:
+		return &dao.SenderSettingsEntry{
+			Accept:         dao.SENDERS_ACCEPT_VERIFIED,
+			ExcludedAction: dao.SENDERS_EXCLUDED_DROP,
+		}, nil
+	case userAllowedOnly:
+		return &dao.SenderSettingsEntry{
+			Accept:         dao.SENDERS_ACCEPT_ALLOWED,
+			ExcludedAction: dao.SENDERS_EXCLUDED_REJECT,
+		}, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (self *filtersDaoStub) GetMatchingRules(address string, sender string) ([]dao.SenderRulesEntry, error) {
+	domain := sender[strings.LastIndex(sender, "#")+1:]
+	rules := []dao.SenderRulesEntry{}
+	for _, rule := range self.rules {
+		if rule.Pattern == sender || rule.Pattern == domain {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func (self *filtersDaoStub) Count(address string, reason string) error {
+	self.counts[reason]++
+	return nil
+}
+
+func makeFilterUut(rules ...dao.SenderRulesEntry) (*Filter, *filtersDaoStub) {
+	stub := &filtersDaoStub{rules: rules, counts: map[string]int{}}
+	uut := NewFilter()
+	uut.filtersDao = stub
+	return &uut, stub
+}
+
+func expectDecision(t *testing.T, uut *Filter, address string, sender string, expected Decision) {
+	decision, err := uut.Check(address, sender)
+	if err != nil {
+		t.Fatal("Check failed:", err)
+	}
+	if decision != expected {
+		t.Errorf("Decision for %q -> %s is %d, expected %d", sender, address, decision, expected)
+	}
+}
+
+func TestSettingsDefault(t *testing.T) {
+	uut, _ := makeFilterUut()
+	settings, err := uut.Settings(userWithoutSettings)
+	if err != nil {
+		t.Fatal("Settings failed:", err)
+	}
+	if settings.Accept != dao.SENDERS_ACCEPT_ALL || settings.ExcludedAction != dao.SENDERS_EXCLUDED_REJECT {
+		t.Error("unexpected default settings", settings)
+	}
+}
+
+func TestCheckWithoutRules(t *testing.T) {
+	uut, stub := makeFilterUut()
+	expectDecision(t, uut, userWithoutSettings, "", DecisionAccept)
+	expectDecision(t, uut, userWithoutSettings, "someone#spam.test", DecisionAccept)
+	if len(stub.counts) != 0 {
+		t.Error("accepted messages have been counted", stub.counts)
+	}
+}
+
+func TestCheckBlocked(t *testing.T) {
+	uut, stub := makeFilterUut(
+		dao.SenderRulesEntry{Pattern: "spam.test", Action: dao.SENDER_RULE_BLOCK},
+		dao.SenderRulesEntry{Pattern: "friend#spam.test", Action: dao.SENDER_RULE_ALLOW},
+	)
+	expectDecision(t, uut, userWithoutSettings, "someone#spam.test", DecisionReject)
+	expectDecision(t, uut, userWithoutSettings, "friend#spam.test", DecisionAccept)
+	expectDecision(t, uut, userWithoutSettings, "", DecisionAccept)
+	if stub.counts[dao.SENDER_EXCLUDED_BLOCKED] != 1 {
+		t.Error("unexpected counts", stub.counts)
+	}
+}
+
+func TestCheckAddressRuleTakesPrecedence(t *testing.T) {
+	uut, _ := makeFilterUut(
+		dao.SenderRulesEntry{Pattern: "someone#spam.test", Action: dao.SENDER_RULE_BLOCK},
+		dao.SenderRulesEntry{Pattern: "spam.test", Action: dao.SENDER_RULE_ALLOW},
+	)
+	expectDecision(t, uut, userWithoutSettings, "someone#spam.test", DecisionReject)
+	expectDecision(t, uut, userWithoutSettings, "other#spam.test", DecisionAccept)
+}
+
+func TestCheckVerifiedOnly(t *testing.T) {
+	uut, stub := makeFilterUut()
+	expectDecision(t, uut, userVerifiedOnly, "", DecisionDrop)
+	expectDecision(t, uut, userVerifiedOnly, "someone#spam.test", DecisionAccept)
+	if stub.counts[dao.SENDER_EXCLUDED_UNVERIFIED] != 1 {
+		t.Error("unexpected counts", stub.counts)
+	}
+}
+
+func TestCheckAllowedOnly(t *testing.T) {
+	uut, stub := makeFilterUut(
+		dao.SenderRulesEntry{Pattern: "friend#spam.test", Action: dao.SENDER_RULE_ALLOW},
+	)
+	expectDecision(t, uut, userAllowedOnly, "friend#spam.test", DecisionAccept)
+	expectDecision(t, uut, userAllowedOnly, "someone#spam.test", DecisionReject)
+	expectDecision(t, uut, userAllowedOnly, "", DecisionReject)
+	if stub.counts[dao.SENDER_EXCLUDED_NOT_ALLOWED] != 2 {
+		t.Error("unexpected counts", stub.counts)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	good := &dao.SenderSettingsEntry{Accept: dao.SENDERS_ACCEPT_VERIFIED, ExcludedAction: dao.SENDERS_EXCLUDED_DROP}
+	if ValidateSettings(good) != nil {
+		t.Error("good settings rejected")
+	}
+	if ValidateSettings(&dao.SenderSettingsEntry{Accept: "some", ExcludedAction: "drop"}) != ErrBadAccept {
+		t.Error("bad accept not rejected")
+	}
+	if ValidateSettings(&dao.SenderSettingsEntry{Accept: "all", ExcludedAction: "hold"}) != ErrBadExcludedAction {
+		t.Error("bad excluded action not rejected")
+	}
+
+	for _, pattern := range []string{"someone#spam.test", "spam.test"} {
+		if ValidatePattern(pattern) != nil {
+			t.Errorf("good pattern %q rejected", pattern)
+		}
+	}
+	for _, pattern := range []string{"", "#spam.test", "some one#spam.test", "spam..test"} {
+		if ValidatePattern(pattern) != ErrBadPattern {
+			t.Errorf("bad pattern %q not rejected", pattern)
+		}
+	}
+	if ValidateRuleAction("hold") != ErrBadRuleAction {
+		t.Error("bad rule action not rejected")
+	}
+}
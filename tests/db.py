@@ -43,6 +43,23 @@ def delete_user(cursor, user):
         "DELETE FROM users u USING addresses a " +
         "WHERE u.id = a.user_id AND a.address = %s", [user['address']])
 
+def add_domain_verification(cursor, domain, token, secret, verified):
+    cursor.execute(
+        "DELETE FROM domain_verifications WHERE domain = %s", [domain])
+    cursor.execute(
+        "INSERT INTO domain_verifications " +
+        "(domain, token, secret_hash, verified, method) " +
+        "VALUES (%s, %s, %s, CASE WHEN %s THEN now() END, " +
+        "CASE WHEN %s THEN 'dns' END)",
+        [domain, token, psycopg2.Binary(hashlib.sha256(secret).digest()),
+        verified, verified])
+
+def set_messages_sync_horizon(cursor, user, horizon):
+    cursor.execute(
+        "UPDATE users u SET messages_sync_horizon = %s FROM addresses a " +
+        "WHERE u.id = a.user_id AND a.address = %s",
+        [horizon, user['address']])
+
 def setup():
     with get_connection(settings.DB_CONNECTION_STRING) as conn:
         with conn.cursor() as cursor:
@@ -52,3 +69,13 @@ def setup():
                 add_user(cursor, usr)
             for usr in settings.RESET_USERS.itervalues():
                 add_user(cursor, usr)
+            for domain, secret in settings.VERIFIED_DOMAINS.iteritems():
+                add_domain_verification(
+                    cursor, domain, 'verified', secret, True)
+            add_domain_verification(
+                cursor, settings.STUB_PUBLISHED_DOMAIN['domain'],
+                settings.STUB_PUBLISHED_DOMAIN['token'],
+                settings.STUB_PUBLISHED_DOMAIN['secret'], False)
+            cursor.execute(
+                "DELETE FROM domain_verifications WHERE domain = %s",
+                [settings.UNVERIFIED_DOMAIN])
@@ -8,10 +8,33 @@ import yaml
 
 BASEPATH = os.path.dirname(os.path.abspath(__file__))
 SERVER = 'http://127.0.0.1:8001'
+ADMIN_SERVER = 'http://127.0.0.1:8002'
+ADMIN_CREDENTIALS = ('kullo', 'kullo')  # see make testconfig
 ALLOWED_CLOCK_DIFFERENCE = timedelta(seconds=60)  # account for leap seconds
 
 CODE_CHALLENGE_ANSWER_TOO_LARGE = '8428db8d3c43f76e1000'
 
+# domains that aren't local but may be registered on with the verification
+# secret (set up in the DB)
+VERIFIED_DOMAINS = {
+    'other.test': '0c6ad0a3c4e0ea3c8e4f1b0f4b2e6a8d9c1f3e5a7b9d0c2e4f6a8b0d2c4e6f8a',
+}
+# unverified domain with the token published in config/verification_stub.yml,
+# the server must be started with -verificationStub
+STUB_PUBLISHED_DOMAIN = {
+    'domain': 'published.test',
+    'token': '5f2b8a3c9d1e4f6a7b8c9d0e1f2a3b4c',
+    'secret': 'published-secret',
+}
+UNVERIFIED_DOMAIN = 'unverified.test'
+# the server is its own federation peer for this domain, the server must be
+# started with -federationPeers config/peers_loopback.yml
+LOOPBACK_PEER = {
+    'name': 'kullo.test',
+    'secret': '6b756c6c6f2d6c6f6f706261636b2d736563726574000000000000000000000000',
+    'domain': 'loopback.test',
+}
+
 EXISTING_USERS = {
     1: {
     	'address': 'existing_1#kullo.test',
@@ -30,6 +53,18 @@ EXISTING_USERS = {
         'plan': 'Friend',
         'loginKey': 'fedcba9876543210' * 8,
     },
+    3: {
+        'address': 'existing_3#kullo.test',
+        'acceptedTerms': 'https://www.kullo.net/agb/?version=1',
+        'plan': 'Free',
+        'loginKey': '0f1e2d3c4b5a6978' * 8,
+    },
+    4: {
+        'address': 'existing_4#kullo.test',
+        'acceptedTerms': 'https://www.kullo.net/agb/?version=1',
+        'plan': 'Free',
+        'loginKey': '1a2b3c4d5e6f7089' * 8,
+    },
 }
 
 NONEXISTING_USERS = {
@@ -1,11 +1,14 @@
 # vim: set expandtab shiftwidth=4 :
 # pylint: disable=missing-docstring
 
+import base64
 import json
 import requests
+import time
 
 from . import base
 from . import settings
+from . import test_accounts
 
 class AccountTest(base.BaseTest):
     user = settings.EXISTING_USERS[1]
@@ -67,3 +70,140 @@ class AccountTest(base.BaseTest):
         resp = self.get_info(languages='ork')
         # doesn't fail but fall back internally on 'en'
         self.assertEqual(resp.status_code, requests.codes.ok)
+
+
+class AccountDeletionTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+    wrong_user = settings.EXISTING_USERS[2]
+
+    def schedule_deletion(self, login_key, auth=None):
+        if auth is None:
+            auth = self.auth_good()
+        return requests.delete(
+            self.url_prefix(self.user) + '/account',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'loginKey': login_key}),
+            **auth)
+
+    def get_deletion(self):
+        return requests.get(
+            self.url_prefix(self.user) + '/account/deletion',
+            **self.auth_good())
+
+    def cancel_deletion(self, auth=None):
+        if auth is None:
+            auth = self.auth_good()
+        return requests.delete(
+            self.url_prefix(self.user) + '/account/deletion',
+            **auth)
+
+    def test_schedule_bad_auth(self):
+        resp = self.schedule_deletion(self.user['loginKey'], auth=self.auth_wrong_user())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_schedule_wrong_login_key(self):
+        resp = self.schedule_deletion(self.wrong_user['loginKey'])
+        self.assertEqual(resp.status_code, requests.codes.forbidden)
+
+    def test_schedule_missing_login_key(self):
+        resp = self.schedule_deletion('')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_cancel_bad_auth(self):
+        resp = self.cancel_deletion(auth=self.auth_wrong_user())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_cancel_not_scheduled(self):
+        resp = self.cancel_deletion()
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_schedule_and_cancel(self):
+        resp = self.schedule_deletion(self.user['loginKey'])
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        scheduled = json.loads(resp.text)['deletionScheduled']
+        self.assertTrue(scheduled is not None)
+
+        resp = self.get_deletion()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(resp.text)['deletionScheduled'], scheduled)
+
+        resp = self.cancel_deletion()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = self.get_deletion()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(resp.text)['deletionScheduled'], None)
+
+
+class AddressChangeTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+
+    @staticmethod
+    def make_address():
+        return 'renamed%d#kullo.test' % int(time.time() * 1000)
+
+    def change_address(self, user, new_address, login_key=None):
+        if login_key is None:
+            login_key = user['loginKey']
+        return requests.put(
+            self.url_prefix(user) + '/account/address',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'address': new_address, 'loginKey': login_key}),
+            **self.auth_good(user))
+
+    def register_user(self):
+        user = dict(settings.NONEXISTING_USERS[1])
+        user['address'] = self.make_address()
+        resp = test_accounts.register_account(test_accounts.make_body(user))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        return user
+
+    def test_wrong_login_key(self):
+        resp = self.change_address(self.user, self.make_address(), login_key='baadbaad' * 16)
+        self.assertEqual(resp.status_code, requests.codes.forbidden)
+
+    def test_invalid_address(self):
+        resp = self.change_address(self.user, 'no address')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_taken_address(self):
+        resp = self.change_address(self.user, settings.EXISTING_USERS[2]['address'])
+        self.assertEqual(resp.status_code, requests.codes.conflict)
+
+    def test_change_address(self):
+        old_user = self.register_user()
+        new_user = dict(old_user)
+        new_user['address'] = self.make_address()
+
+        resp = self.change_address(old_user, new_user['address'])
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        body = json.loads(resp.text)
+        self.assertEqual(body['address'], new_user['address'])
+        self.assertIn('forwardingUntil', body)
+
+        # login only works with the new address
+        resp = requests.get(self.url_prefix(old_user) + '/account/info', **self.auth_good(old_user))
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+        resp = requests.get(self.url_prefix(new_user) + '/account/info', **self.auth_good(new_user))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        # key lookups on the old address are redirected
+        resp = requests.get(self.url_prefix(old_user) + '/keys/public', allow_redirects=False)
+        self.assertEqual(resp.status_code, requests.codes.moved_permanently)
+        self.assertEqual(json.loads(resp.text)['movedTo'], new_user['address'])
+        self.assertEqual(resp.headers['Kullo-Moved-To'], new_user['address'])
+
+        # deliveries to the old address are forwarded
+        resp = requests.post(
+            self.url_prefix(old_user) + '/messages/',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': base64.b64encode('I am the key safe'),
+                'content': base64.b64encode('I am a message'),
+            }))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(resp.headers['Kullo-Moved-To'], new_user['address'])
+
+        # the old address cannot be registered by others
+        resp = test_accounts.register_account(test_accounts.make_body(old_user))
+        self.assertEqual(resp.status_code, requests.codes.conflict)
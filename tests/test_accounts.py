@@ -9,7 +9,9 @@ from . import db
 from . import settings
 
 def make_body(user):
+    domain = user['address'].split('#')[1]
     return {
+        'domainVerificationSecret': settings.VERIFIED_DOMAINS.get(domain, ''),
         'address': user['address'],
         'loginKey': user['loginKey'],
         'privateDataKey': user['privateDataKey'],
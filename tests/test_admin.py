@@ -0,0 +1,279 @@
+# vim: set expandtab shiftwidth=4 :
+# pylint: disable=missing-docstring
+
+import base64
+import json
+import requests
+import time
+import urllib2
+
+from . import base
+from . import settings
+
+
+class AdminTest(base.BaseTest):
+    user = settings.EXISTING_USERS[2]
+
+    @classmethod
+    def admin_url_prefix(cls, user):
+        return settings.ADMIN_SERVER + '/accounts/' + urllib2.quote(user['address'])
+
+    def admin_auth(self):
+        return {'auth': settings.ADMIN_CREDENTIALS}
+
+    def get_account(self, auth=None, user=None):
+        if auth is None:
+            auth = self.admin_auth()
+        if user is None:
+            user = self.user
+        return requests.get(self.admin_url_prefix(user), **auth)
+
+    def put(self, path, data):
+        return requests.put(
+            self.admin_url_prefix(self.user) + path,
+            headers={'content-type': 'application/json'},
+            data=json.dumps(data),
+            **self.admin_auth())
+
+    def get_audit_log(self):
+        return requests.get(
+            self.admin_url_prefix(self.user) + '/auditLog',
+            **self.admin_auth())
+
+    def test_bad_auth(self):
+        resp = self.get_account(auth={})
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+        resp = self.get_account(auth={'auth': ('kullo', 'wrong')})
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+        # user credentials are no admin credentials
+        resp = self.get_account(auth=self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_not_on_public_port(self):
+        resp = requests.get(
+            settings.SERVER + '/accounts/' + urllib2.quote(self.user['address']),
+            **self.admin_auth())
+        self.assertNotEqual(resp.status_code, requests.codes.ok)
+
+    def test_get_nonexisting(self):
+        resp = self.get_account(user=settings.NONEXISTING_USERS[1])
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_get_account(self):
+        resp = self.get_account()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        body = json.loads(resp.text)
+        self.assertEqual(body['address'], self.user['address'])
+        self.assertEqual(body['planName'], self.user['plan'])
+        self.assertFalse(body['disabled'])
+        self.assertIn('lastLogin', body)
+        self.assertIn('storageUsed', body)
+        self.assertIn('pushRegistrations', body)
+
+        resp = self.get_audit_log()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        actions = [entry['action'] for entry in json.loads(resp.text)['data']]
+        self.assertEqual(actions[0], 'look up account')
+
+    def test_disable_and_enable(self):
+        resp = self.put('/disabled', {'disabled': True})
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = requests.get(self.url_prefix(self.user) + '/account/info', **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+        resp = self.put('/disabled', {'disabled': False})
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = requests.get(self.url_prefix(self.user) + '/account/info', **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = self.get_audit_log()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        actions = [entry['action'] for entry in json.loads(resp.text)['data']]
+        self.assertEqual(actions[:2], ['enable', 'disable'])
+
+    def test_disable_bad_body(self):
+        resp = self.put('/disabled', {})
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_change_plan(self):
+        resp = self.put('/plan', {'planName': 'Professional'})
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(self.get_account().text)['planName'], 'Professional')
+
+        resp = self.put('/plan', {'planName': self.user['plan']})
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(self.get_account().text)['planName'], self.user['plan'])
+
+    def test_read_only_lifted_by_raised_quota(self):
+        plans_url = settings.ADMIN_SERVER + '/plans'
+        plan = AdminPlansTest.make_plan('Tiny%d' % int(time.time() * 1000))
+        plan['storageQuota'] = 1
+        resp = requests.post(
+            plans_url, headers={'content-type': 'application/json'},
+            data=json.dumps(plan), **self.admin_auth())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        # make sure that the user stores more than the quota
+        resp = requests.post(
+            self.url_prefix(self.user) + '/messages/',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': base64.b64encode('I am the key safe'),
+                'content': base64.b64encode('I am a message'),
+            }))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        try:
+            resp = self.put('/plan', {'planName': plan['name'], 'overQuota': 'readOnlyInbound'})
+            self.assertEqual(resp.status_code, requests.codes.ok)
+            self.assertTrue(json.loads(self.get_account().text)['inboundReadOnly'])
+
+            plan['storageQuota'] = 1024 * 1024 * 1024
+            resp = requests.put(
+                plans_url + '/' + plan['name'], headers={'content-type': 'application/json'},
+                data=json.dumps(plan), **self.admin_auth())
+            self.assertEqual(resp.status_code, requests.codes.ok)
+            self.assertFalse(json.loads(self.get_account().text)['inboundReadOnly'])
+        finally:
+            resp = self.put('/plan', {'planName': self.user['plan']})
+            self.assertEqual(resp.status_code, requests.codes.ok)
+
+    def test_change_plan_unknown(self):
+        resp = self.put('/plan', {'planName': 'Unobtainium'})
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_change_plan_bad_over_quota(self):
+        resp = self.put('/plan', {'planName': 'Professional', 'overQuota': 'ignore'})
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+
+class AdminPlansTest(base.BaseTest):
+    plans_url = settings.ADMIN_SERVER + '/plans'
+    rules_url = settings.ADMIN_SERVER + '/planDomainRules'
+
+    def admin_auth(self):
+        return {'auth': settings.ADMIN_CREDENTIALS}
+
+    def send(self, method, url, data):
+        return requests.request(
+            method, url,
+            headers={'content-type': 'application/json'},
+            data=json.dumps(data),
+            **self.admin_auth())
+
+    @staticmethod
+    def make_plan(name):
+        return {
+            'name': name,
+            'storageQuota': 1024 * 1024 * 1024,
+            'maxAttachmentSize': 10 * 1024 * 1024,
+            'maxDevices': 3,
+            'maxAliases': 1,
+            'features': ['test'],
+        }
+
+    def test_bad_auth(self):
+        resp = requests.get(self.plans_url)
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+        resp = requests.get(self.rules_url)
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_list(self):
+        resp = requests.get(self.plans_url, **self.admin_auth())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        names = [plan['name'] for plan in json.loads(resp.text)['data']]
+        for name in settings.STORAGE_QUOTA:
+            self.assertIn(name, names)
+
+    def test_get_unknown(self):
+        resp = requests.get(self.plans_url + '/Unobtainium', **self.admin_auth())
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_create_and_modify(self):
+        plan = self.make_plan('Test%d' % int(time.time() * 1000))
+        resp = self.send('POST', self.plans_url, plan)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = self.send('POST', self.plans_url, plan)
+        self.assertEqual(resp.status_code, requests.codes.conflict)
+
+        plan['maxDevices'] = 0
+        plan['features'] = []
+        resp = self.send('PUT', self.plans_url + '/' + plan['name'], plan)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = requests.get(self.plans_url + '/' + plan['name'], **self.admin_auth())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(resp.text), plan)
+
+    def test_create_invalid(self):
+        plan = self.make_plan('Invalid')
+        plan['maxAttachmentSize'] = 0
+        resp = self.send('POST', self.plans_url, plan)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+        plan = self.make_plan('Invalid')
+        plan['features'] = ['no spaces']
+        resp = self.send('POST', self.plans_url, plan)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_modify_unknown(self):
+        resp = self.send('PUT', self.plans_url + '/Unobtainium', self.make_plan('Unobtainium'))
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_domain_rules(self):
+        resp = requests.get(self.rules_url, **self.admin_auth())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        rules = json.loads(resp.text)['data']
+        self.assertIn('*', [rule['domain'] for rule in rules])
+
+        # writing the same rules back doesn't change anything
+        resp = self.send('PUT', self.rules_url, {'data': rules})
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+    def test_domain_rules_without_default(self):
+        rules = [{'domain': 'kullo.test', 'planName': 'Free'}]
+        resp = self.send('PUT', self.rules_url, {'data': rules})
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_domain_rules_unknown_plan(self):
+        rules = [{'domain': '*', 'planName': 'Unobtainium'}]
+        resp = self.send('PUT', self.rules_url, {'data': rules})
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+
+class AdminDomainsTest(base.BaseTest):
+    domains_url = settings.ADMIN_SERVER + '/domains'
+
+    def admin_auth(self):
+        return {'auth': settings.ADMIN_CREDENTIALS}
+
+    def test_bad_auth(self):
+        resp = requests.get(self.domains_url)
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+        resp = requests.post(self.domains_url + '/reload')
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_list(self):
+        resp = requests.get(self.domains_url, **self.admin_auth())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        body = json.loads(resp.text)
+        names = [domain['name'] for domain in body['data']]
+        local_domain = settings.EXISTING_USERS[1]['address'].split('#')[1]
+        self.assertIn(local_domain, names)
+        for domain in body['data']:
+            self.assertIn('defaultPlan', domain)
+            self.assertIn('challengesOptional', domain)
+            self.assertIn('registrationOpen', domain)
+            self.assertIn('branding', domain)
+
+    def test_reload(self):
+        resp = requests.get(self.domains_url, **self.admin_auth())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        before = json.loads(resp.text)
+
+        resp = requests.post(self.domains_url + '/reload', **self.admin_auth())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(resp.text), before)
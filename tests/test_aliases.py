@@ -0,0 +1,122 @@
+# vim: set expandtab shiftwidth=4 :
+# pylint: disable=missing-docstring
+
+import base64
+import json
+import requests
+import time
+import urllib2
+
+from . import base
+from . import settings
+
+
+class AliasesTest(base.BaseTest):
+    user = settings.EXISTING_USERS[2]
+    wrong_user = settings.EXISTING_USERS[1]
+
+    @staticmethod
+    def make_alias():
+        return 'alias%d#kullo.test' % int(time.time() * 1000)
+
+    def get_list(self, auth=None):
+        if auth is None:
+            auth = self.auth_good()
+        return requests.get(self.url_prefix(self.user) + '/aliases', **auth)
+
+    def add_alias(self, alias, user=None):
+        if user is None:
+            user = self.user
+        return requests.post(
+            self.url_prefix(user) + '/aliases',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'address': alias}),
+            **self.auth_good(user))
+
+    def delete_alias(self, alias):
+        return requests.delete(
+            self.url_prefix(self.user) + '/aliases/' + urllib2.quote(alias),
+            **self.auth_good())
+
+    def test_get_list_without_auth(self):
+        resp = self.get_list(auth={})
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_get_list_wrong_user(self):
+        resp = self.get_list(auth=self.auth_wrong_user())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_get_list(self):
+        resp = self.get_list()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        entries = json.loads(resp.text)['data']
+        self.assertEqual(entries[0], {'address': self.user['address'], 'primary': True})
+
+    def test_add_and_remove(self):
+        alias = self.make_alias()
+        resp = self.add_alias(alias)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = self.get_list()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertIn(
+            {'address': alias, 'primary': False},
+            json.loads(resp.text)['data'])
+
+        # the same address cannot be added twice
+        resp = self.add_alias(alias)
+        self.assertEqual(resp.status_code, requests.codes.conflict)
+
+        # login with the alias
+        alias_user = {'address': alias, 'loginKey': self.user['loginKey']}
+        resp = requests.get(
+            self.url_prefix(alias_user) + '/account/info',
+            **self.auth_good(alias_user))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = requests.get(
+            self.url_prefix(self.user) + '/account/info',
+            **self.auth_good(alias_user))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        # messages to the alias land in the shared inbox
+        resp = requests.post(
+            self.url_prefix(alias_user) + '/messages/',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': base64.b64encode('I am the key safe'),
+                'content': base64.b64encode('I am a message'),
+            }))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages',
+            params={'includeData': True},
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        recipients = [msg.get('recipient') for msg in json.loads(resp.text)['data']]
+        self.assertIn(alias, recipients)
+
+        resp = self.delete_alias(alias)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = self.delete_alias(alias)
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+        # removed aliases cannot be registered again
+        resp = self.add_alias(alias)
+        self.assertEqual(resp.status_code, requests.codes.conflict)
+
+    def test_add_existing(self):
+        resp = self.add_alias(self.wrong_user['address'])
+        self.assertEqual(resp.status_code, requests.codes.conflict)
+
+    def test_add_invalid(self):
+        resp = self.add_alias('no address')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_add_not_allowed_by_plan(self):
+        # the Free plan has no aliases
+        resp = self.add_alias(self.make_alias(), user=self.wrong_user)
+        self.assertEqual(resp.status_code, requests.codes.forbidden)
+
+    def test_remove_primary(self):
+        resp = self.delete_alias(self.user['address'])
+        self.assertEqual(resp.status_code, requests.codes.conflict)
@@ -0,0 +1,105 @@
+# vim: set expandtab shiftwidth=4 :
+# pylint: disable=missing-docstring
+
+import json
+import requests
+
+from . import base
+from . import settings
+from . import test_accounts
+
+
+class DomainVerificationTest(base.BaseTest):
+    @classmethod
+    def verification_url(cls, domain):
+        return settings.SERVER + '/domains/' + domain + '/verification'
+
+    def test_local_domain(self):
+        local_domain = settings.EXISTING_USERS[1]['address'].split('#')[1]
+        resp = requests.post(self.verification_url(local_domain))
+        self.assertEqual(resp.status_code, requests.codes.conflict)
+
+    def test_bad_domain(self):
+        resp = requests.post(self.verification_url('not_a_domain'))
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_not_requested(self):
+        url = self.verification_url('never-requested.test') + '/unknown'
+        resp = requests.get(url)
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+        resp = requests.post(url + '/check')
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_issue_and_check_unpublished(self):
+        url = self.verification_url(settings.UNVERIFIED_DOMAIN)
+        resp = requests.post(url)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        issued = json.loads(resp.text)
+        self.assertEqual(issued['domain'], settings.UNVERIFIED_DOMAIN)
+        self.assertFalse(issued['verified'])
+        self.assertTrue(issued['secret'])
+        self.assertEqual(issued['wellKnownContent'], issued['token'])
+        self.assertEqual(
+            issued['txtRecordName'],
+            '_kullo-verification.' + settings.UNVERIFIED_DOMAIN)
+        self.assertEqual(
+            issued['txtRecordValue'],
+            'kullo-verification=' + issued['token'])
+        self.assertEqual(
+            issued['wellKnownUrl'],
+            'https://' + settings.UNVERIFIED_DOMAIN + '/.well-known/kullo-verification')
+
+        # every request gets its own token and secret
+        resp = requests.post(url)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        other = json.loads(resp.text)
+        self.assertNotEqual(other['token'], issued['token'])
+        self.assertNotEqual(other['secret'], issued['secret'])
+
+        # the secret is only returned once
+        resp = requests.get(url + '/' + issued['token'])
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertNotIn('secret', json.loads(resp.text))
+
+        resp = requests.post(url + '/' + issued['token'] + '/check')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertFalse(json.loads(resp.text)['verified'])
+
+    def test_check_rate_limited(self):
+        url = self.verification_url(settings.UNVERIFIED_DOMAIN)
+        resp = requests.post(url)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        token = json.loads(resp.text)['token']
+
+        resp = requests.post(url + '/' + token + '/check')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = requests.post(url + '/' + token + '/check')
+        self.assertEqual(resp.status_code, requests.codes.too_many_requests)
+
+    def test_check_published(self):
+        domain = settings.STUB_PUBLISHED_DOMAIN['domain']
+        url = self.verification_url(domain) + '/' + settings.STUB_PUBLISHED_DOMAIN['token']
+        resp = requests.post(url + '/check')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        body = json.loads(resp.text)
+        self.assertTrue(body['verified'])
+        self.assertEqual(body['method'], 'dns')
+
+        resp = requests.get(url)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertTrue(json.loads(resp.text)['verified'])
+
+    def test_registration_on_unverified_domain(self):
+        body = test_accounts.make_body(settings.NONLOCAL_USERS[1])
+        body['address'] = 'someone#' + settings.UNVERIFIED_DOMAIN
+        resp = test_accounts.register_account(body)
+        self.assertEqual(resp.status_code, requests.codes.forbidden)
+        self.assertNotIn('challenge', json.loads(resp.text))
+
+    def test_registration_without_secret(self):
+        body = test_accounts.make_body(settings.NONLOCAL_USERS[1])
+        for secret in ['', 'wrong']:
+            body['domainVerificationSecret'] = secret
+            resp = test_accounts.register_account(body)
+            self.assertEqual(resp.status_code, requests.codes.forbidden)
+            self.assertNotIn('challenge', json.loads(resp.text))
@@ -0,0 +1,147 @@
+# vim: set expandtab shiftwidth=4 :
+# pylint: disable=missing-docstring
+
+import base64
+import binascii
+import hashlib
+import hmac
+import json
+import time
+import urllib2
+
+import requests
+from requests_toolbelt.multipart.encoder import MultipartEncoder
+
+from . import base
+from . import settings
+
+
+def sign(method, path, date, body):
+    secret = binascii.unhexlify(settings.LOOPBACK_PEER['secret'])
+    mac = hmac.new(secret, '\n'.join([method, path, date, '']), hashlib.sha256)
+    mac.update(hashlib.sha256(body).hexdigest())
+    return base64.b64encode(mac.digest())
+
+def peer_request(method, path, body='', headers=None, signature=None):
+    date = str(int(time.time()))
+    headers = dict(headers or {})
+    headers['Kullo-Peer'] = settings.LOOPBACK_PEER['name']
+    headers['Kullo-Peer-Date'] = date
+    headers['Kullo-Peer-Signature'] = signature or sign(method, path, date, body)
+    return requests.request(
+        method, settings.SERVER + path, data=body, headers=headers)
+
+def federation_path(address, suffix):
+    return '/federation/users/' + urllib2.quote(address, safe='') + suffix
+
+
+class FederationApiTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+
+    def test_unsigned(self):
+        resp = requests.get(
+            settings.SERVER + federation_path(self.user['address'], '/keys/public'))
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_bad_signature(self):
+        resp = peer_request(
+            'GET', federation_path(self.user['address'], '/keys/public'),
+            signature=base64.b64encode('x' * 32))
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_get_public_keys(self):
+        resp = peer_request(
+            'GET', federation_path(self.user['address'], '/keys/public'))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        keys = json.loads(resp.text)
+        self.assertEqual(keys[0]['pubkey'], self.user['encryptionPubkey'])
+        self.assertFalse('privkey' in keys[0])
+
+    def test_get_postage(self):
+        resp = peer_request(
+            'GET', federation_path(self.user['address'], '/messages/postage?size=100'))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertTrue('required' in json.loads(resp.text))
+
+    def test_deliver_message(self):
+        encoder = MultipartEncoder({
+            'keySafe': 'Relayed key safe',
+            'content': 'Relayed message',
+            'attachments': 'Relayed attachment',
+        })
+        resp = peer_request(
+            'POST', federation_path(self.user['address'], '/messages'),
+            body=encoder.to_string(),
+            headers={'content-type': encoder.content_type})
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(sorted(json.loads(resp.text)), ['recallToken', 'receipt'])
+
+    def test_deliver_message_with_sender(self):
+        encoder = MultipartEncoder({
+            'keySafe': 'Relayed key safe',
+            'content': 'Relayed message with sender',
+        })
+        path = federation_path(self.user['address'], '/messages')
+
+        # the peer hosts the sender's domain
+        resp = peer_request(
+            'POST', path, body=encoder.to_string(),
+            headers={
+                'content-type': encoder.content_type,
+                'Kullo-Sender': 'someone#' + settings.LOOPBACK_PEER['domain'],
+            })
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        # the peer doesn't host the sender's domain
+        resp = peer_request(
+            'POST', path, body=encoder.to_string(),
+            headers={
+                'content-type': encoder.content_type,
+                'Kullo-Sender': settings.EXISTING_USERS[2]['address'],
+            })
+        self.assertEqual(resp.status_code, requests.codes.forbidden)
+
+    def test_deliver_message_unknown_user(self):
+        encoder = MultipartEncoder({
+            'keySafe': 'Relayed key safe',
+            'content': 'Relayed message',
+        })
+        resp = peer_request(
+            'POST', federation_path('nobody#kullo.test', '/messages'),
+            body=encoder.to_string(),
+            headers={'content-type': encoder.content_type})
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+
+class FederationRelayTest(base.BaseTest):
+    remote_user = {'address': 'nobody#' + settings.LOOPBACK_PEER['domain']}
+    unknown_user = {'address': 'nobody#nowhere.test'}
+
+    def post_message(self, user):
+        return requests.post(
+            self.url_prefix(user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': base64.b64encode('Relayed key safe'),
+                'content': base64.b64encode('Relayed message'),
+            }))
+
+    def test_proxied_keys_of_unknown_user(self):
+        # the home server answers
+        resp = requests.get(self.url_prefix(self.remote_user) + '/keys/public')
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_relay_to_unknown_user(self):
+        # the home server rejects the message for good, so it isn't queued
+        resp = self.post_message(self.remote_user)
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_no_home_server(self):
+        resp = self.post_message(self.unknown_user)
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+        resp = requests.get(self.url_prefix(self.unknown_user) + '/keys/public')
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_relay_status_not_found(self):
+        resp = requests.get(settings.SERVER + '/federation/relays/' + '0' * 32)
+        self.assertEqual(resp.status_code, requests.codes.not_found)
@@ -0,0 +1,124 @@
+# vim: set expandtab shiftwidth=4 :
+# pylint: disable=missing-docstring
+
+import json
+import requests
+
+from . import base
+from . import settings
+
+# server defaults, see kulloserver.go
+MAX_MESSAGES_PER_HOUR = 100
+MAX_BYTES_PER_DAY = 1024 * 1024 * 1024
+
+
+class InboundTest(base.BaseTest):
+    user = settings.EXISTING_USERS[2]
+    wrong_user = settings.EXISTING_USERS[1]
+
+    def get_info(self, auth=None):
+        if auth is None:
+            auth = self.auth_good()
+        return requests.get(
+            self.url_prefix(self.user) + '/inbound',
+            **auth)
+
+    def modify_limits(self, limits, auth=None):
+        if auth is None:
+            auth = self.auth_good()
+        return requests.put(
+            self.url_prefix(self.user) + '/inbound/limits',
+            headers={'content-type': 'application/json'},
+            data=json.dumps(limits),
+            **auth)
+
+    def test_get_info_without_auth(self):
+        resp = self.get_info(auth={})
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_get_info_wrong_user(self):
+        resp = self.get_info(auth=self.auth_wrong_user())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_get_info_bad_login_key(self):
+        resp = self.get_info(auth=self.auth_bad_login_key())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_modify_limits_without_auth(self):
+        limits = {
+            'messagesPerHour': 1,
+            'bytesPerDay': 1,
+            'excessAction': 'reject',
+        }
+        resp = self.modify_limits(limits, auth={})
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_get_info(self):
+        resp = self.get_info()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        json_result = json.loads(resp.text)
+        limits = json_result['limits']
+        self.assertTrue(0 < limits['messagesPerHour'] <= MAX_MESSAGES_PER_HOUR)
+        self.assertTrue(0 < limits['bytesPerDay'] <= MAX_BYTES_PER_DAY)
+        self.assertIn(limits['excessAction'], ['reject', 'hold'])
+        usage = json_result['usage']
+        self.assertIn('messagesLastHour', usage)
+        self.assertIn('bytesLastDay', usage)
+        self.assertIn('messagesHeld', usage)
+        self.assertIn('bytesHeld', usage)
+        self.assertIn('messagesScheduled', usage)
+        self.assertIn('bytesScheduled', usage)
+        self.assertIn('postageRequired', json_result)
+
+    def test_modify_limits(self):
+        limits = {
+            'messagesPerHour': MAX_MESSAGES_PER_HOUR,
+            'bytesPerDay': MAX_BYTES_PER_DAY,
+            'excessAction': 'hold',
+        }
+        resp = self.modify_limits(limits)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = self.get_info()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(resp.text)['limits'], limits)
+
+        # reset to defaults
+        limits['excessAction'] = 'reject'
+        resp = self.modify_limits(limits)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+    def test_modify_limits_too_high(self):
+        limits = {
+            'messagesPerHour': MAX_MESSAGES_PER_HOUR + 1,
+            'bytesPerDay': MAX_BYTES_PER_DAY,
+            'excessAction': 'reject',
+        }
+        resp = self.modify_limits(limits)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_modify_limits_zero(self):
+        limits = {
+            'messagesPerHour': 0,
+            'bytesPerDay': MAX_BYTES_PER_DAY,
+            'excessAction': 'reject',
+        }
+        resp = self.modify_limits(limits)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_modify_limits_bad_action(self):
+        limits = {
+            'messagesPerHour': MAX_MESSAGES_PER_HOUR,
+            'bytesPerDay': MAX_BYTES_PER_DAY,
+            'excessAction': 'drop',
+        }
+        resp = self.modify_limits(limits)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_modify_postage_bad_body(self):
+        resp = requests.put(
+            self.url_prefix(self.user) + '/inbound/postage',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({}),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
@@ -1,11 +1,15 @@
 # pylint: disable=missing-docstring
 
 import base64
+from datetime import datetime, timedelta
+import hashlib
 import json
 import requests
+import uuid
 from requests_toolbelt.multipart.encoder import MultipartEncoder
 
 from . import base
+from . import db
 from . import settings
 
 def b64e(plain):
@@ -70,6 +74,7 @@ class MessagesTest(base.BaseTest):
         resp = self.get_list()
         self.assertEqual(resp.status_code, requests.codes.ok)
         json_result = json.loads(resp.text)
+        self.assertNotIn('error', json_result)
         self.assertEqual(json_result['resultsTotal'], len(messages))
         self.assertEqual(json_result['resultsReturned'], len(messages))
         self.assertEqual(len(json_result['data']), len(messages))
@@ -107,7 +112,7 @@ class MessagesTest(base.BaseTest):
             'content': b64e(message['content']),
         })
         self.assertEqual(resp.status_code, requests.codes.ok)
-        self.assertEqual(json.loads(resp.text), {})
+        self.assertEqual(sorted(json.loads(resp.text)), ['recallToken', 'receipt'])
         message['id'] = base.VALUE_NOT_AVAILABLE
         message['lastModified'] = base.VALUE_NOT_AVAILABLE
         message['dateReceived'] = base.VALUE_NOT_AVAILABLE
@@ -154,7 +159,7 @@ class MessagesTest(base.BaseTest):
         })
         resp = self.create_message_multipart(encoder)
         self.assertEqual(resp.status_code, requests.codes.ok)
-        self.assertEqual(json.loads(resp.text), {})
+        self.assertEqual(sorted(json.loads(resp.text)), ['recallToken', 'receipt'])
         message['id'] = base.VALUE_NOT_AVAILABLE
         message['lastModified'] = base.VALUE_NOT_AVAILABLE
         message['dateReceived'] = base.VALUE_NOT_AVAILABLE
@@ -353,3 +358,810 @@ class MessagesTest(base.BaseTest):
 
         # get list, verify modifications
         self.subtest_get_list(messages)
+
+
+class MessageSenderTest(base.BaseTest):
+    user = settings.EXISTING_USERS[3]
+    sender = settings.EXISTING_USERS[1]
+
+    def sender_auth(self, address, login_key):
+        credentials = base64.b64encode(address + ':' + login_key)
+        return {'Kullo-Sender-Authorization': 'Basic ' + credentials}
+
+    def create_message(self, content, headers):
+        headers = dict(headers)
+        headers['content-type'] = 'application/json'
+        return requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers=headers,
+            data=json.dumps({
+                'keySafe': b64e('key safe'),
+                'content': b64e(content),
+                'sender': 'forged#kullo.test',
+            }))
+
+    def get_sender(self, content):
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages',
+            params={'includeData': True},
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        for message in json.loads(resp.text)['data']:
+            if b64d(message['content']) == content:
+                return message.get('sender')
+        self.fail('message not found')
+
+    def test_verified_sender(self):
+        resp = self.create_message('verified', self.sender_auth(
+            self.sender['address'], self.sender['loginKey']))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(self.get_sender('verified'), self.sender['address'])
+
+    def test_anonymous_sender(self):
+        resp = self.create_message('anonymous', {})
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(self.get_sender('anonymous'), None)
+
+    def test_bad_sender_credentials(self):
+        resp = self.create_message('bad credentials', self.sender_auth(
+            self.sender['address'], 'baadbaad' * 16))
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+        resp = self.create_message('bad credentials', {
+            'Kullo-Sender-Authorization': 'Basic not base64'})
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+
+class MessageFanOutTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+    recipients = [settings.EXISTING_USERS[2], settings.EXISTING_USERS[3]]
+
+    def fan_out(self, data, auth=None):
+        auth = auth or self.auth_good()
+        return requests.post(
+            self.url_prefix(self.user) + '/messages/fanout',
+            headers={'content-type': 'application/json'},
+            data=json.dumps(data),
+            **auth)
+
+    def find_message(self, recipient, content):
+        resp = requests.get(
+            self.url_prefix(recipient) + '/messages',
+            params={'includeData': True},
+            **self.auth_good(recipient))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        for message in json.loads(resp.text)['data']:
+            if message['content'] == b64e(content):
+                return message
+        self.fail('message not found')
+
+    def get_attachments(self, recipient, message_id):
+        return requests.get(
+            self.url_prefix(recipient) + '/messages/' + str(message_id) +
+            '/attachments',
+            **self.auth_good(recipient))
+
+    def test_fan_out(self):
+        key_safes = {self.user['address']: b64e('own key safe')}
+        for recipient in self.recipients:
+            key_safes[recipient['address']] = b64e('key safe ' + recipient['address'])
+        key_safes['doesntexist#kullo.test'] = b64e('key safe')
+
+        resp = self.fan_out({
+            'content': b64e('fan-out content'),
+            'attachments': b64e('fan-out attachments'),
+            'meta': b64e('own meta'),
+            'keySafes': key_safes,
+        })
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        reply = json.loads(resp.text)
+        self.assertIsoTimeIsNow(reply['dateReceived'])
+        results = reply['results']
+        self.assertEqual(len(results), 4)
+
+        own_result = results[self.user['address']]
+        self.assertEqual(own_result['status'], requests.codes.ok)
+        own = self.find_message(self.user, 'fan-out content')
+        self.assertEqual(own['id'], own_result['id'])
+        self.assertEqual(own['meta'], b64e('own meta'))
+        self.assertEqual(own['keySafe'], b64e('own key safe'))
+
+        for recipient in self.recipients:
+            self.assertEqual(results[recipient['address']]['status'], requests.codes.ok)
+            message = self.find_message(recipient, 'fan-out content')
+            self.assertEqual(message['meta'], '')
+            self.assertEqual(message['sender'], self.user['address'])
+            self.assertEqual(message['keySafe'], b64e('key safe ' + recipient['address']))
+            self.assertTrue(message['hasAttachments'])
+            resp = self.get_attachments(recipient, message['id'])
+            self.assertEqual(resp.status_code, requests.codes.ok)
+            self.assertEqual(resp.content, 'fan-out attachments')
+
+        self.assertEqual(results['doesntexist#kullo.test']['status'], requests.codes.not_found)
+
+        # deleting one copy leaves the others intact
+        resp = requests.delete(
+            self.url_prefix(self.user) + '/messages/' + str(own['id']),
+            params={'lastModified': own['lastModified']},
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        message = self.find_message(self.recipients[0], 'fan-out content')
+        resp = self.get_attachments(self.recipients[0], message['id'])
+        self.assertEqual(resp.content, 'fan-out attachments')
+
+    def get_storage_used(self, user):
+        resp = requests.get(
+            self.url_prefix(user) + '/account/info',
+            **self.auth_good(user))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        return json.loads(resp.text)['storageUsed']
+
+    def test_shared_blobs_are_charged_to_every_recipient(self):
+        before = [self.get_storage_used(r) for r in self.recipients]
+
+        key_safe = b64e('key safe')
+        content = b64e('shared content')
+        attachments = 'shared attachments'
+        resp = self.fan_out({
+            'content': content,
+            'attachments': b64e(attachments),
+            'keySafes': dict((r['address'], key_safe) for r in self.recipients),
+        })
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        size = len(key_safe) + len(content) + len(attachments)
+        for recipient, used_before in zip(self.recipients, before):
+            self.assertEqual(self.get_storage_used(recipient), used_before + size)
+
+    def test_bad_requests(self):
+        resp = self.fan_out({'content': b64e('content'), 'keySafes': {}})
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+        resp = self.fan_out({
+            'content': b64e('content'),
+            'keySafes': {self.recipients[0]['address']: ''},
+        })
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+        resp = self.fan_out({
+            'content': b64e('content'),
+            'keySafes': {self.recipients[0]['address']: b64e('key safe')},
+        }, self.auth_bad_login_key())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+
+class MessageIdempotencyTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+
+    def create_message(self, key, content, auth=None):
+        auth = auth or {}
+        return requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={
+                'content-type': 'application/json',
+                'Idempotency-Key': key,
+            },
+            data=json.dumps({
+                'keySafe': b64e('key safe'),
+                'content': b64e(content),
+            }),
+            **auth)
+
+    def test_replay(self):
+        key = str(uuid.uuid4())
+        resp = self.create_message(key, 'idempotent', self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        original = json.loads(resp.text)
+
+        resp = self.create_message(key, 'idempotent', self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(resp.headers.get('Idempotent-Replayed'), 'true')
+        self.assertEqual(json.loads(resp.text), original)
+
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages',
+            params={'includeData': True},
+            **self.auth_good())
+        copies = [m for m in json.loads(resp.text)['data']
+                  if m['content'] == b64e('idempotent')]
+        self.assertEqual(len(copies), 1)
+
+    def test_different_request(self):
+        key = str(uuid.uuid4())
+        resp = self.create_message(key, 'first', self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = self.create_message(key, 'second', self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.unprocessable_entity)
+
+        # keys are scoped by client, so other clients may use them as well
+        resp = self.create_message(key, 'first')
+        self.assertNotEqual(resp.status_code, requests.codes.unprocessable_entity)
+        self.assertNotIn('Idempotent-Replayed', resp.headers)
+
+    def test_anonymous_senders(self):
+        # anonymous keys are scoped by the request, so different senders
+        # don't get each other's results or conflicts
+        key = str(uuid.uuid4())
+        resp = self.create_message(key, 'anonymous first')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        first = json.loads(resp.text)
+
+        resp = self.create_message(key, 'anonymous second')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertNotIn('Idempotent-Replayed', resp.headers)
+        self.assertNotEqual(json.loads(resp.text)['recallToken'], first['recallToken'])
+
+        # the very same request is still replayed
+        resp = self.create_message(key, 'anonymous first')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(resp.headers.get('Idempotent-Replayed'), 'true')
+        self.assertEqual(json.loads(resp.text), first)
+
+    def test_key_of_failed_request_can_be_reused(self):
+        key = str(uuid.uuid4())
+        resp = self.create_message(key, '', self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+        resp = self.create_message(key, 'reused', self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertNotIn('Idempotent-Replayed', resp.headers)
+
+
+class MessageBatchTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+
+    def create_message(self):
+        resp = requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': b64e('key safe'),
+                'content': b64e('batch'),
+            }),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        return json.loads(resp.text)
+
+    def get_message(self, message_id):
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/' + str(message_id),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        return json.loads(resp.text)
+
+    def apply_batch(self, operations, atomic):
+        return requests.post(
+            self.url_prefix(self.user) + '/messages/batch',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'atomic': atomic, 'operations': operations}),
+            **self.auth_good())
+
+    def test_best_effort(self):
+        msg1, msg2, msg3 = [self.create_message() for _ in range(3)]
+        resp = self.apply_batch([
+            {'id': msg1['id'], 'lastModified': msg1['lastModified'], 'meta': b64e('read')},
+            {'id': msg2['id'], 'lastModified': msg2['lastModified'], 'delete': True},
+            {'id': msg3['id'], 'lastModified': msg3['lastModified'] - 1, 'meta': b64e('read')},
+            {'id': 999999, 'lastModified': 1, 'delete': True},
+        ], atomic=False)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        reply = json.loads(resp.text)
+        self.assertTrue(reply['committed'])
+        self.assertEqual([r['status'] for r in reply['results']],
+                         ['ok', 'ok', 'conflict', 'notFound'])
+        self.assertEqual(reply['results'][2]['lastModified'], msg3['lastModified'])
+
+        self.assertEqual(self.get_message(msg1['id'])['meta'], b64e('read'))
+        self.assertTrue(self.get_message(msg2['id'])['deleted'])
+        self.assertEqual(self.get_message(msg3['id'])['meta'], '')
+
+    def test_read_state(self):
+        # own messages are read
+        msg1, msg2 = [self.create_message() for _ in range(2)]
+        resp = self.apply_batch([
+            {'id': msg1['id'], 'lastModified': msg1['lastModified'], 'read': False},
+            {'id': msg2['id'], 'lastModified': msg2['lastModified'],
+             'meta': b64e('meta'), 'read': False},
+        ], atomic=True)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        msg1 = self.get_message(msg1['id'])
+        self.assertFalse(msg1['read'])
+        self.assertEqual(msg1['meta'], '')
+        msg2 = self.get_message(msg2['id'])
+        self.assertFalse(msg2['read'])
+        self.assertEqual(msg2['meta'], b64e('meta'))
+
+        # setting the meta without the read state marks messages as read
+        resp = self.apply_batch([
+            {'id': msg1['id'], 'lastModified': msg1['lastModified'], 'meta': b64e('meta')},
+        ], atomic=True)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertTrue(self.get_message(msg1['id'])['read'])
+
+    def test_atomic(self):
+        msg1, msg2 = [self.create_message() for _ in range(2)]
+        resp = self.apply_batch([
+            {'id': msg1['id'], 'lastModified': msg1['lastModified'], 'delete': True},
+            {'id': msg2['id'], 'lastModified': msg2['lastModified'] - 1, 'delete': True},
+        ], atomic=True)
+        self.assertEqual(resp.status_code, requests.codes.conflict)
+        reply = json.loads(resp.text)
+        self.assertFalse(reply['committed'])
+        self.assertEqual([r['status'] for r in reply['results']],
+                         ['rolledBack', 'conflict'])
+        self.assertFalse(self.get_message(msg1['id'])['deleted'])
+
+    def test_invalid_operations(self):
+        msg = self.create_message()
+        resp = self.apply_batch([
+            {'id': msg['id'], 'lastModified': msg['lastModified'],
+             'meta': b64e('read'), 'delete': True},
+        ], atomic=False)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+        resp = self.apply_batch([
+            {'id': msg['id'], 'lastModified': msg['lastModified'],
+             'read': True, 'delete': True},
+        ], atomic=False)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+        resp = self.apply_batch([
+            {'id': msg['id'], 'lastModified': msg['lastModified']},
+        ], atomic=False)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+        resp = self.apply_batch([], atomic=False)
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+
+class MessageSyncHorizonTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+    horizon = 1500000000000000
+
+    def set_horizon(self, horizon):
+        with db.get_connection(settings.DB_CONNECTION_STRING) as conn:
+            with conn.cursor() as cursor:
+                db.set_messages_sync_horizon(cursor, self.user, horizon)
+
+    def setUp(self):
+        self.set_horizon(self.horizon)
+
+    def tearDown(self):
+        self.set_horizon(0)
+
+    def get_list(self, modified_after):
+        return requests.get(
+            self.url_prefix(self.user) + '/messages',
+            params={'modifiedAfter': modified_after},
+            **self.auth_good())
+
+    def test_older_than_horizon(self):
+        resp = self.get_list(self.horizon - 1)
+        self.assertEqual(resp.status_code, requests.codes.gone)
+        self.assertEqual(json.loads(resp.text)['syncHorizon'], self.horizon)
+
+    def test_full_sync_and_recent(self):
+        resp = self.get_list(0)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = self.get_list(self.horizon)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+
+class MessageExpiryTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+
+    def create_message(self, expires_at):
+        return requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': b64e('key safe'),
+                'content': b64e('expiring'),
+                'expiresAt': expires_at,
+            }),
+            **self.auth_good())
+
+    def get_message(self, message_id):
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/' + str(message_id),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        return json.loads(resp.text)
+
+    def test_expires_at(self):
+        expires_at = (datetime.utcnow() + timedelta(days=1)).strftime('%Y-%m-%dT%H:%M:%SZ')
+        resp = self.create_message(expires_at)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        message = self.get_message(json.loads(resp.text)['id'])
+        self.assertEqual(message['expiresAt'], expires_at)
+
+    def test_expires_at_is_capped(self):
+        resp = self.create_message('2999-01-01T00:00:00Z')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        message = self.get_message(json.loads(resp.text)['id'])
+        expires_at = datetime.strptime(message['expiresAt'], '%Y-%m-%dT%H:%M:%SZ')
+        self.assertTrue(expires_at < datetime(2999, 1, 1))
+
+    def test_bad_expires_at(self):
+        resp = self.create_message('2000-01-01T00:00:00Z')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+        resp = self.create_message('tomorrow')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+
+class MessageSchedulingTest(base.BaseTest):
+    user = settings.EXISTING_USERS[3]
+
+    def create_message(self, content, deliver_at, auth=None):
+        auth = auth or {}
+        return requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': b64e('key safe'),
+                'content': b64e(content),
+                'deliverAt': deliver_at,
+            }),
+            **auth)
+
+    def cancel(self, scheduled_id):
+        return requests.delete(
+            self.url_prefix(self.user) + '/messages/scheduled/' + scheduled_id)
+
+    def is_visible(self, content):
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages',
+            params={'includeData': True},
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        for message in json.loads(resp.text)['data']:
+            if not message['deleted'] and b64d(message['content']) == content:
+                return True
+        return False
+
+    def test_schedule_and_cancel(self):
+        deliver_at = (datetime.utcnow() + timedelta(days=1)).strftime('%Y-%m-%dT%H:%M:%SZ')
+        resp = self.create_message('scheduled', deliver_at)
+        self.assertEqual(resp.status_code, requests.codes.accepted)
+        body = json.loads(resp.text)
+        self.assertEqual(body['deliverAt'], deliver_at)
+        self.assertFalse(self.is_visible('scheduled'))
+
+        resp = self.cancel(body['scheduledId'])
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = self.cancel(body['scheduledId'])
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_bad_deliver_at(self):
+        resp = self.create_message('in the past', '2000-01-01T00:00:00Z')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+        resp = self.create_message('too late', '2999-01-01T00:00:00Z')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_own_messages_cannot_be_scheduled(self):
+        deliver_at = (datetime.utcnow() + timedelta(days=1)).strftime('%Y-%m-%dT%H:%M:%SZ')
+        resp = self.create_message('own', deliver_at, self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+
+class MessageRecallTest(base.BaseTest):
+    user = settings.EXISTING_USERS[3]
+
+    def create_message(self, content):
+        resp = requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': b64e('key safe'),
+                'content': b64e(content),
+            }))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        return json.loads(resp.text)['recallToken']
+
+    def recall(self, recall_token):
+        return requests.post(
+            self.url_prefix(self.user) + '/messages/recall',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'recallToken': recall_token}))
+
+    def find_message(self, content):
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages',
+            params={'includeData': True},
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        for message in json.loads(resp.text)['data']:
+            if not message['deleted'] and b64d(message['content']) == content:
+                return message
+        return None
+
+    def test_recall_unread(self):
+        recall_token = self.create_message('recall me')
+        self.assertIsNotNone(self.find_message('recall me'))
+
+        resp = self.recall(recall_token)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertIsNone(self.find_message('recall me'))
+
+        resp = self.recall(recall_token)
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+    def test_recall_read(self):
+        recall_token = self.create_message('already read')
+        message = self.find_message('already read')
+        resp = requests.patch(
+            self.url_prefix(self.user) + '/messages/' + str(message['id']),
+            params={'lastModified': message['lastModified']},
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'meta': b64e('read'), 'read': True}),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = self.recall(recall_token)
+        self.assertEqual(resp.status_code, requests.codes.conflict)
+        self.assertIsNotNone(self.find_message('already read'))
+
+    def test_unknown_token(self):
+        resp = self.recall('00' * 32)
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+
+class MessageReceiptTest(base.BaseTest):
+    user = settings.EXISTING_USERS[3]
+
+    def sha256(self, data):
+        return hashlib.sha256(data).hexdigest()
+
+    def test_receipt(self):
+        resp = requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': b64e('receipt key safe'),
+                'content': b64e('receipt content'),
+                'attachments': b64e('receipt attachments'),
+            }))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        receipt = json.loads(resp.text)['receipt']
+        self.assertEqual(receipt['recipient'], self.user['address'])
+        self.assertIsoTimeIsNow(receipt['dateReceived'])
+        self.assertEqual(receipt['keySafeSha256'], self.sha256(b64e('receipt key safe')))
+        self.assertEqual(receipt['contentSha256'], self.sha256(b64e('receipt content')))
+        self.assertEqual(receipt['attachmentsSha256'], self.sha256('receipt attachments'))
+
+        # the signing key is published
+        resp = requests.get(settings.SERVER + '/.well-known/kullo/receipt-keys')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        keys = json.loads(resp.text)['keys']
+        current = [key for key in keys if key['current']]
+        self.assertEqual(len(current), 1)
+        self.assertEqual(current[0]['keyId'], receipt['keyId'])
+        self.assertEqual(current[0]['algorithm'], 'Ed25519')
+
+        # the receipt is stored with the message
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/' + str(receipt['id']),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(resp.text)['receipt'], receipt)
+
+    def test_receipt_matches_message_without_attachments(self):
+        resp = requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': b64e('receipt key safe'),
+                'content': b64e('receipt content'),
+            }))
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        receipt = json.loads(resp.text)['receipt']
+
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/' + str(receipt['id']),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        message = json.loads(resp.text)
+        self.assertEqual(receipt['keySafeSha256'], message['keySafeSha256'])
+        self.assertEqual(receipt['contentSha256'], message['contentSha256'])
+        # both have no digest for missing attachments
+        self.assertEqual(receipt['attachmentsSha256'], '')
+        self.assertNotIn('attachmentsSha256', message)
+
+
+class MessageDigestTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+
+    def sha256(self, data):
+        return hashlib.sha256(data).digest()
+
+    def test_digests(self):
+        resp = requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': b64e('digest key safe'),
+                'content': b64e('digest content'),
+                'attachments': b64e('digest attachments'),
+            }),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        message_id = json.loads(resp.text)['id']
+
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/' + str(message_id),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        message = json.loads(resp.text)
+        self.assertEqual(message['keySafeSha256'],
+                         self.sha256(b64e('digest key safe')).encode('hex'))
+        self.assertEqual(message['contentSha256'],
+                         self.sha256(b64e('digest content')).encode('hex'))
+        self.assertEqual(message['attachmentsSha256'],
+                         self.sha256('digest attachments').encode('hex'))
+
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/' + str(message_id) + '/attachments',
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        digest = base64.b64encode(self.sha256('digest attachments'))
+        self.assertEqual(resp.headers['digest'], 'SHA-256=' + digest)
+        self.assertEqual(resp.headers['repr-digest'], 'sha-256=:' + digest + ':')
+
+
+class MessageReadStateTest(base.BaseTest):
+    user = settings.EXISTING_USERS[3]
+
+    def create_message(self, content, auth=None):
+        if auth is None:
+            auth = {}
+        resp = requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({
+                'keySafe': b64e('key safe'),
+                'content': b64e(content),
+            }),
+            **auth)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+    def find_message(self, content):
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages',
+            params={'includeData': True},
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        for message in json.loads(resp.text)['data']:
+            if not message['deleted'] and b64d(message['content']) == content:
+                return message
+        return None
+
+    def get_unread(self):
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/unread',
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        return json.loads(resp.text)['count']
+
+    def set_read(self, message_id, read):
+        return requests.put(
+            self.url_prefix(self.user) + '/messages/' + str(message_id) + '/read',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'read': read}),
+            **self.auth_good())
+
+    def test_read_and_unread(self):
+        unread = self.get_unread()
+        self.create_message('read state')
+        self.assertEqual(self.get_unread(), unread + 1)
+        message = self.find_message('read state')
+        self.assertFalse(message['read'])
+
+        resp = self.set_read(message['id'], True)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertTrue(self.find_message('read state')['read'])
+        self.assertEqual(self.get_unread(), unread)
+
+        # setting the same state again doesn't change the count
+        resp = self.set_read(message['id'], True)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(self.get_unread(), unread)
+
+        resp = self.set_read(message['id'], False)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(self.get_unread(), unread + 1)
+
+    def test_modify_meta_with_read(self):
+        unread = self.get_unread()
+        self.create_message('read with meta')
+        message = self.find_message('read with meta')
+
+        resp = requests.patch(
+            self.url_prefix(self.user) + '/messages/' + str(message['id']),
+            params={'lastModified': message['lastModified']},
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'meta': b64e('meta'), 'read': True}),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        message = self.find_message('read with meta')
+        self.assertTrue(message['read'])
+        self.assertEqual(b64d(message['meta']), 'meta')
+        self.assertEqual(self.get_unread(), unread)
+
+    def test_modify_meta_without_read(self):
+        # clients that don't know about the read state set the meta on reading
+        unread = self.get_unread()
+        self.create_message('read by meta')
+        message = self.find_message('read by meta')
+
+        resp = requests.patch(
+            self.url_prefix(self.user) + '/messages/' + str(message['id']),
+            params={'lastModified': message['lastModified']},
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'meta': b64e('meta')}),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertTrue(self.find_message('read by meta')['read'])
+        self.assertEqual(self.get_unread(), unread)
+
+    def test_own_messages_are_read(self):
+        unread = self.get_unread()
+        self.create_message('read own', auth=self.auth_good())
+        self.assertTrue(self.find_message('read own')['read'])
+        self.assertEqual(self.get_unread(), unread)
+
+    def test_unknown_message(self):
+        resp = self.set_read(999999999, True)
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+
+
+class MessageStreamingTest(base.BaseTest):
+    user = settings.EXISTING_USERS[1]
+
+    def create_message(self, attachments, headers=None, auth=None):
+        encoder = MultipartEncoder({
+            'keySafe': 'streamed key safe',
+            'content': 'streamed content',
+            'attachments': attachments,
+        }, boundary='streaming-test-boundary')
+        headers = dict(headers or {})
+        headers['content-type'] = encoder.content_type
+        return requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers=headers,
+            data=encoder,
+            **(auth or {}))
+
+    def large_attachments(self):
+        # larger than the chunks in which they are stored
+        return ''.join(uuid.uuid4().bytes for _ in range(160 * 1024))
+
+    def test_large_attachments(self):
+        attachments = self.large_attachments()
+        headers = {'Idempotency-Key': str(uuid.uuid4())}
+        resp = self.create_message(attachments, headers, self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        message_id = json.loads(resp.text)['id']
+
+        # the body, which has been spooled to disk, is recognized again
+        resp = self.create_message(attachments, headers, self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(resp.headers['idempotent-replayed'], 'true')
+        self.assertEqual(json.loads(resp.text)['id'], message_id)
+
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/' + str(message_id) + '/attachments',
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(resp.content, attachments)
+
+        resp = requests.get(
+            self.url_prefix(self.user) + '/messages/' + str(message_id),
+            **self.auth_good())
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertEqual(json.loads(resp.text)['attachmentsSha256'],
+                         hashlib.sha256(attachments).hexdigest())
+
+    def test_receipt_covers_streamed_attachments(self):
+        attachments = self.large_attachments()
+        resp = self.create_message(attachments)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        receipt = json.loads(resp.text)['receipt']
+        self.assertEqual(receipt['attachmentsSha256'],
+                         hashlib.sha256(attachments).hexdigest())
@@ -0,0 +1,142 @@
+# vim: set expandtab shiftwidth=4 :
+# pylint: disable=missing-docstring
+
+import base64
+import hashlib
+import itertools
+import json
+import requests
+from requests_toolbelt.multipart.encoder import MultipartEncoder
+
+from . import base
+from . import settings
+
+POSTAGE_HEADER = 'Kullo-Postage'
+
+
+def leading_zero_bits(digest):
+    count = 0
+    for byte in bytearray(digest):
+        if byte == 0:
+            count += 8
+            continue
+        while byte & 0x80 == 0:
+            count += 1
+            byte <<= 1
+        break
+    return count
+
+
+def solve(token, bits):
+    for nonce in itertools.count():
+        stamp = token + ':' + str(nonce)
+        if leading_zero_bits(hashlib.sha256(stamp).digest()) >= bits:
+            return stamp
+
+
+class PostageTest(base.BaseTest):
+    user = settings.EXISTING_USERS[2]
+
+    def set_required(self, required):
+        return requests.put(
+            self.url_prefix(self.user) + '/inbound/postage',
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'required': required}),
+            **self.auth_good())
+
+    def get_challenge(self, size):
+        return requests.get(
+            self.url_prefix(self.user) + '/messages/postage',
+            params={'size': size})
+
+    def create_message(self, stamp=None):
+        headers = {'content-type': 'application/json'}
+        if stamp is not None:
+            headers[POSTAGE_HEADER] = stamp
+        return requests.post(
+            self.url_prefix(self.user) + '/messages/',
+            headers=headers,
+            data=json.dumps({
+                'keySafe': base64.b64encode('I am the key safe'),
+                'content': base64.b64encode('I am a message'),
+            }))
+
+    def create_message_multipart(self, attachments, stamp=None):
+        encoder = MultipartEncoder(fields={
+            'keySafe': 'I am the key safe',
+            'content': 'I am a message',
+            'attachments': ('attachments', attachments),
+        })
+        headers = {'content-type': encoder.content_type}
+        if stamp is not None:
+            headers[POSTAGE_HEADER] = stamp
+        return requests.post(
+            self.url_prefix(self.user) + '/messages/',
+            headers=headers,
+            data=encoder)
+
+    def setUp(self):
+        resp = self.set_required(True)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+    def tearDown(self):
+        resp = self.set_required(False)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+    def test_get_challenge_bad_size(self):
+        resp = self.get_challenge('lots')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+
+    def test_get_challenge(self):
+        resp = self.get_challenge(1000)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        json_result = json.loads(resp.text)
+        self.assertTrue(json_result['required'])
+        challenge = json_result['challenge']
+        self.assertEqual(challenge['recipient'], self.user['address'])
+        self.assertEqual(challenge['maxSize'], 1000)
+        self.assertTrue(challenge['bits'] > 0)
+
+    def test_post_without_postage(self):
+        resp = self.create_message()
+        self.assertEqual(resp.status_code, requests.codes.payment_required)
+
+    def test_post_with_bad_postage(self):
+        resp = self.create_message('this is no stamp')
+        self.assertEqual(resp.status_code, requests.codes.payment_required)
+
+    def test_post_with_postage(self):
+        resp = self.get_challenge(1000)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        json_result = json.loads(resp.text)
+        stamp = solve(json_result['token'], json_result['challenge']['bits'])
+
+        resp = self.create_message(stamp)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        # replay
+        resp = self.create_message(stamp)
+        self.assertEqual(resp.status_code, requests.codes.payment_required)
+
+    def test_postage_too_small(self):
+        resp = self.get_challenge(1)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        json_result = json.loads(resp.text)
+        stamp = solve(json_result['token'], json_result['challenge']['bits'])
+
+        resp = self.create_message(stamp)
+        self.assertEqual(resp.status_code, requests.codes.payment_required)
+
+    def test_multipart_postage_checked_before_attachments(self):
+        resp = self.create_message_multipart('x' * 1000)
+        self.assertEqual(resp.status_code, requests.codes.payment_required)
+
+        # attachments beyond what the stamp pays for are rejected as soon as
+        # they exceed it
+        resp = self.get_challenge(100)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        json_result = json.loads(resp.text)
+        stamp = solve(json_result['token'], json_result['challenge']['bits'])
+
+        resp = self.create_message_multipart('x' * 1000, stamp)
+        self.assertEqual(resp.status_code, requests.codes.payment_required)
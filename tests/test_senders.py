@@ -0,0 +1,140 @@
+# pylint: disable=missing-docstring
+
+import base64
+import json
+import requests
+
+from . import base
+from . import settings
+
+
+class SendersTest(base.BaseTest):
+    user = settings.EXISTING_USERS[4]
+    sender = settings.EXISTING_USERS[1]
+
+    def tearDown(self):
+        self.put_settings({'accept': 'all', 'excludedAction': 'reject'})
+        for rule in self.get_info().json()['rules']:
+            self.delete_rule(rule['pattern'])
+        self.reset_counters()
+
+    def get_info(self, auth=None):
+        auth = auth or self.auth_good()
+        return requests.get(self.url_prefix(self.user) + '/senders', **auth)
+
+    def put_settings(self, data):
+        return requests.put(
+            self.url_prefix(self.user) + '/senders/settings',
+            headers={'content-type': 'application/json'},
+            data=json.dumps(data),
+            **self.auth_good())
+
+    def put_rule(self, pattern, action):
+        return requests.put(
+            self.url_prefix(self.user) + '/senders/rules/' + pattern,
+            headers={'content-type': 'application/json'},
+            data=json.dumps({'action': action}),
+            **self.auth_good())
+
+    def delete_rule(self, pattern):
+        return requests.delete(
+            self.url_prefix(self.user) + '/senders/rules/' + pattern,
+            **self.auth_good())
+
+    def reset_counters(self):
+        return requests.delete(
+            self.url_prefix(self.user) + '/senders/counters',
+            **self.auth_good())
+
+    def send_message(self, verified):
+        headers = {'content-type': 'application/json'}
+        if verified:
+            credentials = base64.b64encode(
+                self.sender['address'] + ':' + self.sender['loginKey'])
+            headers['Kullo-Sender-Authorization'] = 'Basic ' + credentials
+        return requests.post(
+            self.url_prefix(self.user) + '/messages',
+            headers=headers,
+            data=json.dumps({
+                'keySafe': base64.b64encode('key safe'),
+                'content': base64.b64encode('content'),
+            }))
+
+    def test_defaults(self):
+        resp = self.get_info()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        info = resp.json()
+        self.assertEqual(info['settings'],
+                         {'accept': 'all', 'excludedAction': 'reject'})
+        self.assertEqual(info['rules'], [])
+        self.assertEqual(info['counters']['blocked'], 0)
+
+    def test_auth(self):
+        resp = self.get_info(self.auth_bad_login_key())
+        self.assertEqual(resp.status_code, requests.codes.unauthorized)
+
+    def test_block_address(self):
+        resp = self.put_rule(self.sender['address'], 'block')
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        resp = self.send_message(verified=True)
+        self.assertEqual(resp.status_code, requests.codes.forbidden)
+        resp = self.send_message(verified=False)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        counters = self.get_info().json()['counters']
+        self.assertEqual(counters['blocked'], 1)
+        self.assertIsNotNone(counters['lastExcluded'])
+
+        resp = self.delete_rule(self.sender['address'])
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        resp = self.delete_rule(self.sender['address'])
+        self.assertEqual(resp.status_code, requests.codes.not_found)
+        resp = self.send_message(verified=True)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+    def test_allow_overrides_domain_block(self):
+        self.put_rule('kullo.test', 'block')
+        self.put_rule(self.sender['address'], 'allow')
+
+        resp = self.send_message(verified=True)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+    def test_verified_only_drop(self):
+        resp = self.put_settings({'accept': 'verified', 'excludedAction': 'drop'})
+        self.assertEqual(resp.status_code, requests.codes.ok)
+
+        # dropped messages are answered like held messages
+        resp = self.send_message(verified=False)
+        self.assertEqual(resp.status_code, requests.codes.accepted)
+        self.assertEqual(list(resp.json()), ['recallToken'])
+
+        # and can be recalled once
+        recall_token = resp.json()['recallToken']
+        for status in [requests.codes.ok, requests.codes.not_found]:
+            resp = requests.post(
+                self.url_prefix(self.user) + '/messages/recall',
+                headers={'content-type': 'application/json'},
+                data=json.dumps({'recallToken': recall_token}))
+            self.assertEqual(resp.status_code, status)
+
+        resp = self.send_message(verified=True)
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        self.assertIn('id', resp.json())
+
+        counters = self.get_info().json()['counters']
+        self.assertEqual(counters['unverified'], 1)
+
+        resp = self.reset_counters()
+        self.assertEqual(resp.status_code, requests.codes.ok)
+        counters = self.get_info().json()['counters']
+        self.assertEqual(counters['unverified'], 0)
+        self.assertIsNone(counters['lastExcluded'])
+
+    def test_bad_input(self):
+        resp = self.put_settings({'accept': 'nobody', 'excludedAction': 'drop'})
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+        resp = self.put_rule('not a domain', 'block')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
+        resp = self.put_rule('example.com', 'ignore')
+        self.assertEqual(resp.status_code, requests.codes.bad_request)
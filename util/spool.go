@@ -0,0 +1,105 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Spool keeps data that is read more than once, e.g. a request body that has
+// to be hashed before it can be processed. Data is kept in memory up to
+// maxMemory bytes and in a temporary file beyond. It is hashed with SHA-256
+// as it is written.
+type Spool struct {
+	maxMemory int
+	memory    bytes.Buffer
+	file      *os.File
+	hash      hash.Hash
+	size      int64
+	reader    io.Reader
+}
+
+func NewSpool(maxMemory int) *Spool {
+	return &Spool{
+		maxMemory: maxMemory,
+		hash:      sha256.New(),
+	}
+}
+
+// Write appends data. It must not be called after Rewind.
+func (self *Spool) Write(data []byte) (int, error) {
+	if self.file == nil && self.memory.Len()+len(data) > self.maxMemory {
+		file, err := ioutil.TempFile("", "kullo-spool-")
+		if err != nil {
+			return 0, err
+		}
+		self.file = file
+		_, err = file.Write(self.memory.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		self.memory = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if self.file != nil {
+		n, err = self.file.Write(data)
+	} else {
+		n, err = self.memory.Write(data)
+	}
+	self.hash.Write(data[:n])
+	self.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes that have been written.
+func (self *Spool) Size() int64 {
+	return self.size
+}
+
+// SHA256 returns the digest of the data that has been written.
+func (self *Spool) SHA256() []byte {
+	return self.hash.Sum(nil)
+}
+
+// Rewind starts reading the data from the beginning. It can be called again
+// to read the data once more.
+func (self *Spool) Rewind() error {
+	if self.file == nil {
+		self.reader = bytes.NewReader(self.memory.Bytes())
+		return nil
+	}
+	_, err := self.file.Seek(0, io.SeekStart)
+	self.reader = self.file
+	return err
+}
+
+// Read reads the data after Rewind has been called.
+func (self *Spool) Read(data []byte) (int, error) {
+	if self.reader == nil {
+		return 0, io.EOF
+	}
+	return self.reader.Read(data)
+}
+
+// Close deletes the temporary file, if any.
+func (self *Spool) Close() error {
+	self.reader = nil
+	if self.file == nil {
+		return nil
+	}
+	self.file.Close()
+	err := os.Remove(self.file.Name())
+	self.file = nil
+	return err
+}
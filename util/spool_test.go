@@ -0,0 +1,65 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	for _, size := range []int{0, 10, 16, 100} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		uut := NewSpool(16)
+		// in two writes, so that the second one may overflow to the file
+		uut.Write(data[:size/2])
+		uut.Write(data[size/2:])
+
+		if uut.Size() != int64(size) {
+			t.Errorf("Size of %d bytes is %d", size, uut.Size())
+		}
+		expected := sha256.Sum256(data)
+		if !bytes.Equal(uut.SHA256(), expected[:]) {
+			t.Errorf("Digest of %d bytes is wrong", size)
+		}
+		if (uut.file != nil) != (size > 16) {
+			t.Errorf("Temporary file of %d bytes: %v", size, uut.file != nil)
+		}
+
+		// can be read more than once
+		for i := 0; i < 2; i++ {
+			err := uut.Rewind()
+			if err != nil {
+				t.Fatal("Rewind failed:", err)
+			}
+			read, err := ioutil.ReadAll(uut)
+			if err != nil {
+				t.Fatal("ReadAll failed:", err)
+			}
+			if !bytes.Equal(read, data) {
+				t.Errorf("Read %d bytes instead of %d", len(read), size)
+			}
+		}
+
+		var name string
+		if uut.file != nil {
+			name = uut.file.Name()
+		}
+		err := uut.Close()
+		if err != nil {
+			t.Error("Close failed:", err)
+		}
+		if name != "" {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Error("Temporary file hasn't been deleted")
+			}
+		}
+	}
+}
@@ -23,6 +23,8 @@ var loginKeyMatcher = regexp.MustCompile("^[0-9a-f]{128}$")
 var symmetricKeyMatcher = regexp.MustCompile("^" + base64chars + "{44,200}$") // min 256 bit = 32 bytes = 44 base64 chars
 var pubkeyMatcher = regexp.MustCompile("^" + base64chars + "{500,}$")
 var privkeyMatcher = regexp.MustCompile("^" + base64chars + "{1000,}$")
+var planNameMatcher = regexp.MustCompile("^[A-Za-z0-9]+([ \\-_][A-Za-z0-9]+)*$")
+var featureMatcher = regexp.MustCompile("^[a-z0-9]+([\\-_][a-z0-9]+)*$")
 
 type ValidatorFunc func(string) (string, error)
 
@@ -41,17 +43,21 @@ func addressHasValidFormat(addr string) bool {
 	if len(localAndDomainPart[0]) > 64 {
 		return false
 	}
-	if len(localAndDomainPart[1]) > 255 {
+	return localPartMatcher.MatchString(localAndDomainPart[0]) &&
+		domainHasValidFormat(localAndDomainPart[1])
+}
+
+func domainHasValidFormat(domain string) bool {
+	if len(domain) > 255 {
 		return false
 	}
-	domainLabels := strings.Split(localAndDomainPart[1], ".")
+	domainLabels := strings.Split(domain, ".")
 	for _, label := range domainLabels {
 		if len(label) > 63 {
 			return false
 		}
 	}
-	return localPartMatcher.MatchString(localAndDomainPart[0]) &&
-		domainPartMatcher.MatchString(localAndDomainPart[1])
+	return domainPartMatcher.MatchString(domain)
 }
 
 func ValidateAddress(addr string) (string, error) {
@@ -101,3 +107,32 @@ func ValidatePrivateKey(privkey string) (string, error) {
 	}
 	return regexValidate(privkey, privkeyMatcher)
 }
+
+func ValidateDomain(domain string) (string, error) {
+	if !domainHasValidFormat(domain) {
+		return "", ErrBadFormat
+	}
+	return domain, nil
+}
+
+func ValidatePlanName(name string) (string, error) {
+	if len(name) > 50 {
+		return "", ErrBadFormat
+	}
+	return regexValidate(name, planNameMatcher)
+}
+
+func ValidateFeature(feature string) (string, error) {
+	if len(feature) > 50 {
+		return "", ErrBadFormat
+	}
+	return regexValidate(feature, featureMatcher)
+}
+
+// A branding names a directory of notification templates.
+func ValidateBranding(branding string) (string, error) {
+	if len(branding) > 50 {
+		return "", ErrBadFormat
+	}
+	return regexValidate(branding, featureMatcher)
+}
@@ -187,3 +187,41 @@ func TestPrivateKey(t *testing.T) {
 	expectValid(t, ValidatePrivateKey, cutOrRepeat(allBase64chars, 1000), "valid (shortest)")
 	expectValid(t, ValidatePrivateKey, cutOrRepeat(allBase64chars, 4000), "valid (long)")
 }
+
+func TestDomain(t *testing.T) {
+	expectValid(t, ValidateDomain, "kullo.net", "simple domain")
+	expectValid(t, ValidateDomain, "ku-llo.example.net", "domain with - and two .")
+	expectInvalid(t, ValidateDomain, "kullo", "domain without .")
+	expectInvalid(t, ValidateDomain, "test#kullo.net", "address")
+	expectInvalid(t, ValidateDomain, "*", "wildcard")
+	expectInvalid(t, ValidateDomain, "b."+strings.Repeat("b", 64), "domain label too long")
+}
+
+func TestPlanName(t *testing.T) {
+	expectValid(t, ValidatePlanName, "Free", "simple name")
+	expectValid(t, ValidatePlanName, "Pro 2020", "name with space")
+	expectValid(t, ValidatePlanName, "Pro-Team_XL", "name with - and _")
+	expectInvalid(t, ValidatePlanName, "", "empty name")
+	expectInvalid(t, ValidatePlanName, " Free", "leading space")
+	expectInvalid(t, ValidatePlanName, "Free  XL", "double space")
+	expectInvalid(t, ValidatePlanName, "Free!", "special char")
+	expectValid(t, ValidatePlanName, strings.Repeat("a", 50), "longest possible")
+	expectInvalid(t, ValidatePlanName, strings.Repeat("a", 51), "too long")
+}
+
+func TestFeature(t *testing.T) {
+	expectValid(t, ValidateFeature, "aliases", "simple feature")
+	expectValid(t, ValidateFeature, "custom-domain_2", "feature with - and _")
+	expectInvalid(t, ValidateFeature, "", "empty feature")
+	expectInvalid(t, ValidateFeature, "Aliases", "uppercase")
+	expectInvalid(t, ValidateFeature, "two words", "space")
+	expectInvalid(t, ValidateFeature, strings.Repeat("a", 51), "too long")
+}
+
+func TestBranding(t *testing.T) {
+	expectValid(t, ValidateBranding, "example", "simple branding")
+	expectValid(t, ValidateBranding, "example-corp_2", "branding with - and _")
+	expectInvalid(t, ValidateBranding, "", "empty branding")
+	expectInvalid(t, ValidateBranding, "../de", "path")
+	expectInvalid(t, ValidateBranding, strings.Repeat("a", 51), "too long")
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package verification
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kylelemons/go-gypsy/yaml"
+)
+
+var ErrNotPublished = errors.New("verification: nothing has been published")
+var ErrNotPublic = errors.New("verification: address is not public")
+var ErrRedirect = errors.New("verification: redirects are not followed")
+
+// the token is short, anything longer is not a token document
+const maxWellKnownSize = 1024
+
+// Resolver looks up what the owner of a domain has published.
+type Resolver interface {
+	// LookupTXT returns the DNS TXT records of name.
+	LookupTXT(name string) ([]string, error)
+	// FetchWellKnown returns the content of WellKnownPath on domain.
+	FetchWellKnown(domain string) (string, error)
+}
+
+// NetResolver asks DNS and the web servers of the domains.
+type NetResolver struct {
+	client *http.Client
+}
+
+// Anyone can make the server fetch the well-known document of any domain, so
+// requests must not reach the server's own network. Addresses are checked
+// after DNS resolution, when connecting, so that domains cannot resolve to
+// something else in between.
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isPublic returns whether ip may be connected to on behalf of others.
+func isPublic(ip net.IP) bool {
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPublic is a net.Dialer Control function that refuses connections to
+// addresses that aren't public.
+func checkPublic(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublic(ip) {
+		return ErrNotPublic
+	}
+	return nil
+}
+
+func NewNetResolver() *NetResolver {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: checkPublic,
+	}
+	return &NetResolver{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// a proxy would connect on our behalf, past checkPublic
+			Transport: &http.Transport{
+				Proxy:               nil,
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+			// the document must be served by the domain itself
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return ErrRedirect
+			},
+		},
+	}
+}
+
+func (self *NetResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+func (self *NetResolver) FetchWellKnown(domain string) (string, error) {
+	resp, err := self.client.Get("https://" + domain + WellKnownPath)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("verification: %s returned %s", domain, resp.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWellKnownSize))
+	return string(content), err
+}
+
+// StubResolver reads what has been "published" from a YAML file, which maps
+// domains to their TXT records and well-known document:
+//
+//	example.com:
+//	  txt:
+//	    - kullo-verification=0123...
+//	  wellKnown: 0123...
+//
+// The file is read on every lookup, so that tests can change it while the
+// server is running.
+type StubResolver struct {
+	path string
+}
+
+func NewStubResolver(path string) *StubResolver {
+	return &StubResolver{path: path}
+}
+
+func (self *StubResolver) LookupTXT(name string) ([]string, error) {
+	node, err := self.lookup(strings.TrimPrefix(name, TxtRecordPrefix), "txt")
+	if err != nil {
+		return nil, err
+	}
+	list, ok := node.(yaml.List)
+	if !ok {
+		return nil, ErrNotPublished
+	}
+	records := []string{}
+	for _, item := range list {
+		if scalar, ok := item.(yaml.Scalar); ok {
+			records = append(records, scalar.String())
+		}
+	}
+	return records, nil
+}
+
+func (self *StubResolver) FetchWellKnown(domain string) (string, error) {
+	node, err := self.lookup(domain, "wellKnown")
+	if err != nil {
+		return "", err
+	}
+	scalar, ok := node.(yaml.Scalar)
+	if !ok {
+		return "", ErrNotPublished
+	}
+	return scalar.String(), nil
+}
+
+func (self *StubResolver) lookup(domain string, key string) (yaml.Node, error) {
+	conf, err := yaml.ReadFile(self.path)
+	if err != nil {
+		return nil, err
+	}
+	domains, ok := conf.Root.(yaml.Map)
+	if !ok {
+		return nil, ErrNotPublished
+	}
+	published, ok := domains[domain].(yaml.Map)
+	if !ok {
+		return nil, ErrNotPublished
+	}
+	node, ok := published[key]
+	if !ok {
+		return nil, ErrNotPublished
+	}
+	return node, nil
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package verification
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+)
+
+// prefix of the DNS name of the TXT record
+const TxtRecordPrefix = "_kullo-verification."
+
+// prefix of the content of the TXT record, followed by the token
+const TxtValuePrefix = "kullo-verification="
+
+// path of the document that contains the token, served over HTTPS
+const WellKnownPath = "/.well-known/kullo-verification"
+
+// how long a verification allows registrations after the token has last been
+// found, so that domains that have changed hands don't stay usable
+const Validity = 7 * 24 * time.Hour
+
+// Issuing and checking are public and checks make the server query the
+// domain, so both are limited per domain and token respectively.
+const (
+	maxIssuedPerDomain = 10
+	issueWindow        = time.Hour
+	minCheckInterval   = time.Minute
+)
+
+// ErrRateLimited is returned by Issue and Check if there have been too many
+// requests for the domain or token recently.
+var ErrRateLimited = errors.New("verification: too many requests, try again later")
+
+type verificationsDao interface {
+	GetEntry(domain string, token string) (*dao.DomainVerificationsEntry, error)
+	GetEntryBySecret(domain string, secretHash []byte) (*dao.DomainVerificationsEntry, error)
+	CountIssuedSince(domain string, since time.Time) (uint32, error)
+	InsertEntry(entry *dao.DomainVerificationsEntry) error
+	SetChecked(token string, checked time.Time, notCheckedSince time.Time) (bool, error)
+	SetVerified(token string, method string, verified time.Time) error
+}
+
+// Verifier checks that registrants of addresses on domains that aren't local
+// control these domains. They prove it by publishing a token that the
+// Verifier issued, either in a DNS TXT record or in a well-known document.
+// Along with the token, the requester gets a secret by which only they can
+// use the verification for registrations.
+type Verifier struct {
+	verificationsDao verificationsDao
+	resolver         Resolver
+	now              func() time.Time
+}
+
+func NewVerifier(resolver Resolver) Verifier {
+	return Verifier{
+		verificationsDao: &dao.DomainVerifications{},
+		resolver:         resolver,
+		now:              time.Now,
+	}
+}
+
+// Get returns the verification of domain with token, sql.ErrNoRows if it
+// hasn't been issued.
+func (self *Verifier) Get(domain string, token string) (*dao.DomainVerificationsEntry, error) {
+	return self.verificationsDao.GetEntry(domain, token)
+}
+
+// Issue creates a verification of domain and returns it together with the
+// secret that the requester has to present on registration. Each request gets
+// its own token, so that requests by others neither invalidate nor share what
+// the owner has published. Returns ErrRateLimited if too many verifications
+// of domain have been issued recently.
+func (self *Verifier) Issue(domain string) (*dao.DomainVerificationsEntry, string, error) {
+	issued, err := self.verificationsDao.CountIssuedSince(domain, self.now().Add(-issueWindow))
+	if err != nil {
+		return nil, "", err
+	}
+	if issued >= maxIssuedPerDomain {
+		return nil, "", ErrRateLimited
+	}
+
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	entry := &dao.DomainVerificationsEntry{
+		Domain:     domain,
+		Token:      token,
+		SecretHash: hashSecret(secret),
+	}
+	err = self.verificationsDao.InsertEntry(entry)
+	if err != nil {
+		return nil, "", err
+	}
+	return entry, secret, nil
+}
+
+// Check looks for the token and marks domain as verified if it is still
+// published. Checking again extends the validity. Returns sql.ErrNoRows if the
+// token hasn't been issued for domain, ErrRateLimited if it has been checked
+// less than minCheckInterval ago.
+func (self *Verifier) Check(domain string, token string) (*dao.DomainVerificationsEntry, error) {
+	entry, err := self.verificationsDao.GetEntry(domain, token)
+	if err != nil {
+		return nil, err
+	}
+	now := self.now()
+	checked, err := self.verificationsDao.SetChecked(entry.Token, now, now.Add(-minCheckInterval))
+	if err != nil {
+		return nil, err
+	}
+	if !checked {
+		return nil, ErrRateLimited
+	}
+
+	// Lookup errors mostly mean that nothing has been published (yet), so
+	// they don't fail the check.
+	method := ""
+	records, err := self.resolver.LookupTXT(TxtRecordPrefix + domain)
+	if err == nil && containsToken(records, entry.Token) {
+		method = dao.DOMAIN_VERIFICATION_DNS
+	} else {
+		content, err := self.resolver.FetchWellKnown(domain)
+		if err == nil && strings.TrimSpace(content) == entry.Token {
+			method = dao.DOMAIN_VERIFICATION_WELL_KNOWN
+		}
+	}
+	if method == "" {
+		return entry, nil
+	}
+
+	verified := now
+	err = self.verificationsDao.SetVerified(entry.Token, method, verified)
+	if err != nil {
+		return nil, err
+	}
+	entry.Verified = &verified
+	entry.Method = method
+	return entry, nil
+}
+
+// Valid returns whether entry currently allows registrations.
+func (self *Verifier) Valid(entry *dao.DomainVerificationsEntry) bool {
+	return entry.Verified != nil && self.now().Before(entry.Verified.Add(Validity))
+}
+
+// IsVerified returns whether registrations for domain are allowed for the
+// holder of secret.
+func (self *Verifier) IsVerified(domain string, secret string) (bool, error) {
+	if secret == "" {
+		return false, nil
+	}
+	entry, err := self.verificationsDao.GetEntryBySecret(domain, hashSecret(secret))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return self.Valid(entry), nil
+}
+
+func randomHex(length int) (string, error) {
+	bytes := make([]byte, length)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func hashSecret(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+func containsToken(records []string, token string) bool {
+	for _, record := range records {
+		if strings.TrimSpace(record) == TxtValuePrefix+token {
+			return true
+		}
+	}
+	return false
+}
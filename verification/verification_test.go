@@ -0,0 +1,388 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package verification
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+)
+
+type verificationsDaoStub struct {
+	entries map[string]dao.DomainVerificationsEntry
+	now     *time.Time
+	created map[string]time.Time
+	checked map[string]time.Time
+}
+
+func (self *verificationsDaoStub) GetEntry(domain string, token string) (*dao.DomainVerificationsEntry, error) {
+	entry, ok := self.entries[token]
+	if !ok || entry.Domain != domain {
+		return nil, sql.ErrNoRows
+	}
+	return &entry, nil
+}
+
+func (self *verificationsDaoStub) GetEntryBySecret(domain string, secretHash []byte) (*dao.DomainVerificationsEntry, error) {
+	for _, entry := range self.entries {
+		if entry.Domain == domain && bytes.Equal(entry.SecretHash, secretHash) {
+			return &entry, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (self *verificationsDaoStub) CountIssuedSince(domain string, since time.Time) (uint32, error) {
+	count := uint32(0)
+	for token, entry := range self.entries {
+		if entry.Domain == domain && self.created[token].After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (self *verificationsDaoStub) InsertEntry(entry *dao.DomainVerificationsEntry) error {
+	self.entries[entry.Token] = *entry
+	self.created[entry.Token] = *self.now
+	return nil
+}
+
+func (self *verificationsDaoStub) SetChecked(token string, checked time.Time, notCheckedSince time.Time) (bool, error) {
+	last, ok := self.checked[token]
+	if ok && last.After(notCheckedSince) {
+		return false, nil
+	}
+	self.checked[token] = checked
+	return true, nil
+}
+
+func (self *verificationsDaoStub) SetVerified(token string, method string, verified time.Time) error {
+	entry := self.entries[token]
+	entry.Verified = &verified
+	entry.Method = method
+	self.entries[token] = entry
+	return nil
+}
+
+type resolverStub struct {
+	txt       map[string][]string
+	wellKnown map[string]string
+}
+
+func (self *resolverStub) LookupTXT(name string) ([]string, error) {
+	records, ok := self.txt[name]
+	if !ok {
+		return nil, ErrNotPublished
+	}
+	return records, nil
+}
+
+func (self *resolverStub) FetchWellKnown(domain string) (string, error) {
+	content, ok := self.wellKnown[domain]
+	if !ok {
+		return "", ErrNotPublished
+	}
+	return content, nil
+}
+
+var testNow = time.Date(2020, 3, 23, 12, 0, 0, 0, time.UTC)
+
+func makeVerifierUut(resolver Resolver, now *time.Time) *Verifier {
+	return &Verifier{
+		verificationsDao: &verificationsDaoStub{
+			entries: map[string]dao.DomainVerificationsEntry{},
+			now:     now,
+			created: map[string]time.Time{},
+			checked: map[string]time.Time{},
+		},
+		resolver: resolver,
+		now:      func() time.Time { return *now },
+	}
+}
+
+func TestIssueSeparatesRequests(t *testing.T) {
+	now := testNow
+	uut := makeVerifierUut(&resolverStub{}, &now)
+	first, firstSecret, err := uut.Issue("example.com")
+	if err != nil {
+		t.Fatal("Issue failed:", err)
+	}
+	if len(first.Token) != 32 {
+		t.Error("Token is", first.Token)
+	}
+	if len(firstSecret) != 64 {
+		t.Error("Secret is", firstSecret)
+	}
+	second, secondSecret, err := uut.Issue("example.com")
+	if err != nil {
+		t.Fatal("Issue failed:", err)
+	}
+	if second.Token == first.Token || secondSecret == firstSecret {
+		t.Error("Requests share token or secret")
+	}
+}
+
+func TestCheckUnknownToken(t *testing.T) {
+	now := testNow
+	uut := makeVerifierUut(&resolverStub{}, &now)
+	entry, _, _ := uut.Issue("example.com")
+	_, err := uut.Check("example.com", "unknown")
+	if err != sql.ErrNoRows {
+		t.Error("Error is", err)
+	}
+	_, err = uut.Check("example.org", entry.Token)
+	if err != sql.ErrNoRows {
+		t.Error("Error is", err)
+	}
+}
+
+func TestCheckNothingPublished(t *testing.T) {
+	now := testNow
+	uut := makeVerifierUut(&resolverStub{}, &now)
+	entry, secret, _ := uut.Issue("example.com")
+	entry, err := uut.Check("example.com", entry.Token)
+	if err != nil {
+		t.Fatal("Check failed:", err)
+	}
+	if entry.Verified != nil {
+		t.Error("Domain has been verified")
+	}
+	verified, _ := uut.IsVerified("example.com", secret)
+	if verified {
+		t.Error("IsVerified is true")
+	}
+}
+
+func TestCheckDns(t *testing.T) {
+	now := testNow
+	resolver := &resolverStub{txt: map[string][]string{}}
+	uut := makeVerifierUut(resolver, &now)
+	entry, secret, _ := uut.Issue("example.com")
+	resolver.txt[TxtRecordPrefix+"example.com"] = []string{
+		"v=spf1 -all",
+		TxtValuePrefix + entry.Token,
+	}
+
+	entry, err := uut.Check("example.com", entry.Token)
+	if err != nil {
+		t.Fatal("Check failed:", err)
+	}
+	if entry.Verified == nil || !entry.Verified.Equal(testNow) {
+		t.Error("Verified is", entry.Verified)
+	}
+	if entry.Method != dao.DOMAIN_VERIFICATION_DNS {
+		t.Error("Method is", entry.Method)
+	}
+	verified, _ := uut.IsVerified("example.com", secret)
+	if !verified {
+		t.Error("IsVerified is false")
+	}
+}
+
+func TestCheckWrongToken(t *testing.T) {
+	now := testNow
+	resolver := &resolverStub{
+		txt:       map[string][]string{TxtRecordPrefix + "example.com": {TxtValuePrefix + "wrong"}},
+		wellKnown: map[string]string{"example.com": "wrong"},
+	}
+	uut := makeVerifierUut(resolver, &now)
+	entry, _, _ := uut.Issue("example.com")
+
+	entry, err := uut.Check("example.com", entry.Token)
+	if err != nil {
+		t.Fatal("Check failed:", err)
+	}
+	if entry.Verified != nil {
+		t.Error("Domain has been verified")
+	}
+}
+
+func TestCheckWellKnown(t *testing.T) {
+	now := testNow
+	resolver := &resolverStub{wellKnown: map[string]string{}}
+	uut := makeVerifierUut(resolver, &now)
+	entry, _, _ := uut.Issue("example.com")
+	resolver.wellKnown["example.com"] = entry.Token + "\n"
+
+	entry, err := uut.Check("example.com", entry.Token)
+	if err != nil {
+		t.Fatal("Check failed:", err)
+	}
+	if entry.Verified == nil {
+		t.Error("Domain hasn't been verified")
+	}
+	if entry.Method != dao.DOMAIN_VERIFICATION_WELL_KNOWN {
+		t.Error("Method is", entry.Method)
+	}
+}
+
+func TestIsVerifiedOnlyForRequester(t *testing.T) {
+	now := testNow
+	resolver := &resolverStub{wellKnown: map[string]string{}}
+	uut := makeVerifierUut(resolver, &now)
+	entry, secret, _ := uut.Issue("example.com")
+	_, otherSecret, _ := uut.Issue("example.com")
+	resolver.wellKnown["example.com"] = entry.Token
+	uut.Check("example.com", entry.Token)
+
+	verified, _ := uut.IsVerified("example.com", secret)
+	if !verified {
+		t.Error("IsVerified is false for requester")
+	}
+	for _, wrong := range []string{otherSecret, "", "wrong"} {
+		verified, _ = uut.IsVerified("example.com", wrong)
+		if verified {
+			t.Errorf("IsVerified is true for secret %#v", wrong)
+		}
+	}
+	verified, _ = uut.IsVerified("example.org", secret)
+	if verified {
+		t.Error("IsVerified is true for other domain")
+	}
+}
+
+func TestIsVerifiedExpires(t *testing.T) {
+	now := testNow
+	resolver := &resolverStub{wellKnown: map[string]string{}}
+	uut := makeVerifierUut(resolver, &now)
+	entry, secret, _ := uut.Issue("example.com")
+	resolver.wellKnown["example.com"] = entry.Token
+	uut.Check("example.com", entry.Token)
+
+	now = testNow.Add(Validity)
+	verified, _ := uut.IsVerified("example.com", secret)
+	if verified {
+		t.Error("IsVerified is true after expiry")
+	}
+
+	// checking again renews the verification
+	uut.Check("example.com", entry.Token)
+	verified, _ = uut.IsVerified("example.com", secret)
+	if !verified {
+		t.Error("IsVerified is false after renewal")
+	}
+}
+
+func TestIssueRateLimited(t *testing.T) {
+	now := testNow
+	uut := makeVerifierUut(&resolverStub{}, &now)
+	for i := 0; i < maxIssuedPerDomain; i++ {
+		_, _, err := uut.Issue("example.com")
+		if err != nil {
+			t.Fatal("Issue failed:", err)
+		}
+	}
+	_, _, err := uut.Issue("example.com")
+	if err != ErrRateLimited {
+		t.Error("Error is", err)
+	}
+
+	// other domains have their own limit
+	_, _, err = uut.Issue("example.org")
+	if err != nil {
+		t.Error("Issue for other domain failed:", err)
+	}
+
+	now = testNow.Add(issueWindow)
+	_, _, err = uut.Issue("example.com")
+	if err != nil {
+		t.Error("Issue after window failed:", err)
+	}
+}
+
+func TestCheckRateLimited(t *testing.T) {
+	now := testNow
+	uut := makeVerifierUut(&resolverStub{}, &now)
+	entry, _, _ := uut.Issue("example.com")
+	other, _, _ := uut.Issue("example.com")
+
+	_, err := uut.Check("example.com", entry.Token)
+	if err != nil {
+		t.Fatal("Check failed:", err)
+	}
+	_, err = uut.Check("example.com", entry.Token)
+	if err != ErrRateLimited {
+		t.Error("Error is", err)
+	}
+	_, err = uut.Check("example.com", other.Token)
+	if err != nil {
+		t.Error("Check of other token failed:", err)
+	}
+
+	now = testNow.Add(minCheckInterval)
+	_, err = uut.Check("example.com", entry.Token)
+	if err != nil {
+		t.Error("Check after interval failed:", err)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		if !isPublic(net.ParseIP(ip)) {
+			t.Error("Not public:", ip)
+		}
+	}
+	for _, ip := range []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254",
+		"0.0.0.0", "100.64.0.1", "::1", "::", "fe80::1", "fd00::1", "::ffff:127.0.0.1",
+	} {
+		if isPublic(net.ParseIP(ip)) {
+			t.Error("Public:", ip)
+		}
+	}
+}
+
+func TestNetResolverRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Server on loopback has been reached")
+	}))
+	defer server.Close()
+
+	uut := NewNetResolver()
+	_, err := uut.FetchWellKnown(strings.TrimPrefix(server.URL, "https://"))
+	if err == nil || !strings.Contains(err.Error(), ErrNotPublic.Error()) {
+		t.Error("Error is", err)
+	}
+}
+
+func TestStubResolver(t *testing.T) {
+	file, err := ioutil.TempFile("", "verification")
+	if err != nil {
+		t.Fatal("TempFile failed:", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("" +
+		"example.com:\n" +
+		"  txt:\n" +
+		"    - kullo-verification=abc\n" +
+		"  wellKnown: def\n")
+	file.Close()
+
+	uut := NewStubResolver(file.Name())
+	records, err := uut.LookupTXT(TxtRecordPrefix + "example.com")
+	if err != nil || len(records) != 1 || records[0] != "kullo-verification=abc" {
+		t.Error("LookupTXT returned", records, err)
+	}
+	content, err := uut.FetchWellKnown("example.com")
+	if err != nil || content != "def" {
+		t.Error("FetchWellKnown returned", content, err)
+	}
+	_, err = uut.LookupTXT(TxtRecordPrefix + "example.org")
+	if err != ErrNotPublished {
+		t.Error("Error is", err)
+	}
+}
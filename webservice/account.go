@@ -8,25 +8,57 @@ package webservice
 
 import (
 	"fmt"
+	"net/http"
+	"time"
 
 	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/verification"
 	"github.com/emicklei/go-restful"
 )
 
 type accountInfo struct {
-	SettingsLocation string `json:"settingsLocation"`
-	PlanName         string `json:"planName"`
-	StorageQuota     uint64 `json:"storageQuota"`
-	StorageUsed      uint64 `json:"storageUsed"`
+	SettingsLocation  string   `json:"settingsLocation"`
+	PlanName          string   `json:"planName"`
+	StorageQuota      uint64   `json:"storageQuota"`
+	StorageUsed       uint64   `json:"storageUsed"`
+	MaxAttachmentSize uint64   `json:"maxAttachmentSize"`
+	MaxDevices        uint32   `json:"maxDevices"`
+	MaxAliases        uint32   `json:"maxAliases"`
+	Features          []string `json:"features"`
+	InboundReadOnly   bool     `json:"inboundReadOnly"`
+}
+
+type accountDeletionRequest struct {
+	LoginKey string `json:"loginKey"`
+}
+
+type addressChangeRequest struct {
+	newAddressRecord
+	LoginKey string `json:"loginKey"`
+}
+
+type addressChangeInfo struct {
+	Address string `json:"address"`
+	// RFC3339, deliveries to the old address are forwarded until then
+	ForwardingUntil string `json:"forwardingUntil"`
+}
+
+type accountDeletionInfo struct {
+	// RFC3339, null if no deletion has been scheduled
+	DeletionScheduled *string `json:"deletionScheduled"`
 }
 
 type accountWebservice struct {
-	RestfulWebService *restful.WebService
-	dao               *dao.Users
-	messagesDao       *dao.Messages
+	RestfulWebService   *restful.WebService
+	dao                 *dao.Users
+	messagesDao         *dao.Messages
+	addressesDao        *dao.Addresses
+	verifier            *verification.Verifier
+	deletionGracePeriod time.Duration
+	forwardingPeriod    time.Duration
 }
 
-func NewAccount() *accountWebservice {
+func NewAccount(verifier *verification.Verifier, deletionGracePeriod time.Duration, forwardingPeriod time.Duration) *accountWebservice {
 	service := &restful.WebService{}
 	service.
 		Path("/{address}/account").
@@ -35,10 +67,22 @@ func NewAccount() *accountWebservice {
 
 	model := &dao.Users{}
 	messagesModel := &dao.Messages{}
-	webservice := &accountWebservice{RestfulWebService: service, dao: model, messagesDao: messagesModel}
+	addressesModel := &dao.Addresses{}
+	webservice := &accountWebservice{
+		RestfulWebService:   service,
+		dao:                 model,
+		messagesDao:         messagesModel,
+		addressesDao:        addressesModel,
+		verifier:            verifier,
+		deletionGracePeriod: deletionGracePeriod,
+		forwardingPeriod:    forwardingPeriod}
 
 	// private (filtered)
 	service.Route(service.GET("/info").To(webservice.getInfo))
+	service.Route(service.PUT("/address").To(webservice.changeAddress))
+	service.Route(service.DELETE("").To(webservice.scheduleDeletion))
+	service.Route(service.GET("/deletion").To(webservice.getDeletion))
+	service.Route(service.DELETE("/deletion").To(webservice.cancelDeletion))
 
 	service.Filter(AuthFilter)
 	return webservice
@@ -63,6 +107,13 @@ func (ws *accountWebservice) getInfo(request *restful.Request, response *restful
 		writeServerError(err, response)
 		return
 	}
+	if entry.InboundReadOnly {
+		entry.InboundReadOnly, err = ws.dao.RecheckInboundReadOnly(address)
+		if err != nil {
+			writeServerError(err, response)
+			return
+		}
+	}
 
 	info := &accountInfo{}
 	info.SettingsLocation =
@@ -71,5 +122,116 @@ func (ws *accountWebservice) getInfo(request *restful.Request, response *restful
 	info.PlanName = entry.PlanName
 	info.StorageQuota = entry.StorageQuota
 	info.StorageUsed = storageUsed
+	info.MaxAttachmentSize = entry.MaxAttachmentSize
+	info.MaxDevices = entry.MaxDevices
+	info.MaxAliases = entry.MaxAliases
+	info.Features = entry.Features
+	info.InboundReadOnly = entry.InboundReadOnly
 	response.WriteEntity(info)
 }
+
+// changeAddress moves the account from the address in the path to a new one.
+func (ws *accountWebservice) changeAddress(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	changeRequest := &addressChangeRequest{}
+	err := request.ReadEntity(changeRequest)
+	if err != nil || changeRequest.LoginKey == "" {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+	loginKeyOk, err := checkLoginKey(address, changeRequest.LoginKey)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	if !loginKeyOk {
+		writeClientError(response, http.StatusForbidden, "wrong login key")
+		return
+	}
+
+	newAddress, ok := checkNewAddress(response, &changeRequest.newAddressRecord, ws.dao, ws.verifier)
+	if !ok {
+		return
+	}
+
+	forwardingUntil := time.Now().Add(ws.forwardingPeriod).UTC()
+	err = ws.addressesDao.ChangeAddress(address, newAddress, forwardingUntil)
+	switch {
+	case err == dao.ErrAddressAlreadyExists:
+		writeAddressNotAvailableError(response)
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	response.WriteEntity(&addressChangeInfo{
+		Address:         newAddress.Address,
+		ForwardingUntil: forwardingUntil.Format(time.RFC3339),
+	})
+}
+
+func (ws *accountWebservice) scheduleDeletion(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	// credentials might have been stored by a client, so ask for them again
+	deletionRequest := &accountDeletionRequest{}
+	err := request.ReadEntity(deletionRequest)
+	if err != nil || deletionRequest.LoginKey == "" {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+	loginKeyOk, err := checkLoginKey(address, deletionRequest.LoginKey)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	if !loginKeyOk {
+		writeClientError(response, http.StatusForbidden, "wrong login key")
+		return
+	}
+
+	deletion := time.Now().Add(ws.deletionGracePeriod).UTC()
+	err = ws.dao.ScheduleDeletion(address, deletion)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	deletionStr := deletion.Format(time.RFC3339)
+	response.WriteEntity(&accountDeletionInfo{DeletionScheduled: &deletionStr})
+}
+
+func (ws *accountWebservice) getDeletion(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	entry, err := ws.dao.GetEntry(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	info := &accountDeletionInfo{}
+	if entry.DeletionScheduled != nil {
+		deletionStr := entry.DeletionScheduled.UTC().Format(time.RFC3339)
+		info.DeletionScheduled = &deletionStr
+	}
+	response.WriteEntity(info)
+}
+
+func (ws *accountWebservice) cancelDeletion(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	cancelled, err := ws.dao.CancelDeletion(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	if !cancelled {
+		writeClientError(response, http.StatusNotFound, "no deletion scheduled")
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
@@ -15,8 +15,10 @@ import (
 
 	"bitbucket.org/kullo/server/challenges"
 	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/domains"
 	"bitbucket.org/kullo/server/notifications"
 	"bitbucket.org/kullo/server/validation"
+	"bitbucket.org/kullo/server/verification"
 	"github.com/emicklei/go-restful"
 )
 
@@ -25,7 +27,7 @@ type accountsWebservice struct {
 	daoUsers          *dao.Users
 	daoKeysSymm       *dao.KeysSymm
 	daoKeysAsymm      *dao.KeysAsymm
-	localDomain       string
+	verifier          *verification.Verifier
 }
 
 type asymmKeyPair struct {
@@ -43,20 +45,23 @@ type registrationRecord struct {
 	Challenge         challenges.Challenge `json:"challenge"`
 	ChallengeAuth     string               `json:"challengeAuth"`
 	ChallengeAnswer   string               `json:"challengeAnswer"`
+	// required on domains that are not local, see domainVerificationInfo
+	DomainVerificationSecret string `json:"domainVerificationSecret"`
 }
 
 type registrationData struct {
-	Address        *dao.AddressesEntry
-	AcceptedTerms  string
-	SymmetricKeys  *dao.KeysSymmEntry
-	EncryptionKeys *dao.KeysAsymmEntry
-	SignatureKeys  *dao.KeysAsymmEntry
+	Address                  *dao.AddressesEntry
+	AcceptedTerms            string
+	SymmetricKeys            *dao.KeysSymmEntry
+	EncryptionKeys           *dao.KeysAsymmEntry
+	SignatureKeys            *dao.KeysAsymmEntry
+	DomainVerificationSecret string
 }
 
 var ErrInvalidJson = errors.New("Invalid JSON")
 var ErrInvalidChallenge = errors.New("Invalid Challenge.")
 
-func NewAccounts(localDomain string) *accountsWebservice {
+func NewAccounts(verifier *verification.Verifier) *accountsWebservice {
 	service := &restful.WebService{}
 	service.
 		Path("/accounts").
@@ -71,12 +76,12 @@ func NewAccounts(localDomain string) *accountsWebservice {
 		daoUsers:          modelUsers,
 		daoKeysSymm:       modelKeysSymm,
 		daoKeysAsymm:      modelKeysAsymm,
-		localDomain:       localDomain}
+		verifier:          verifier}
 
 	// private (filtered)
 
 	// public (unfiltered)
-	service.Route(service.POST("").To(webservice.createEntry))
+	service.Route(service.POST("").Filter(IdempotencyFilter).To(webservice.createEntry))
 
 	return webservice
 }
@@ -96,20 +101,39 @@ func (ws *accountsWebservice) createEntry(request *restful.Request, response *re
 		return
 	}
 
-	isLocalAddress := true
-	_, err = validation.ValidateLocalAddress(address, ws.localDomain)
-	if err != nil {
-		isLocalAddress = false
+	// addresses of deleted accounts cannot be registered again for some time
+	if !userExists {
+		tombstoned, err := ws.daoUsers.AddressTombstoned(address)
+		if err != nil {
+			writeServerError(err, response)
+			return
+		}
+		if tombstoned {
+			writeClientError(response, http.StatusConflict, "Address is not available.")
+			return
+		}
+	}
+
+	// resetting existing accounts is possible even if registration is closed
+	domain := domains.ForAddress(address)
+	if !userExists && domain != nil && !domain.RegistrationOpen {
+		writeRegistrationClosedError(response)
+		return
+	}
+	if !userExists && domain == nil && !checkDomainVerified(response, ws.verifier, address, regData.DomainVerificationSecret) {
+		return
 	}
+	isLocalAddress, challengesOptional := challengePolicy(domain)
 
-	challengeOk, err := challenges.CheckChallenge(challengeClientAnswer, userExists, isLocalAddress)
+	challengeOk, err := challenges.CheckChallenge(
+		challengeClientAnswer, userExists, isLocalAddress, challengesOptional)
 	if ws.handleChallengeError(response, err) {
 		return
 	}
 
 	if !challengeOk {
 		// challenge is invalid => return a new challenge to the user
-		ws.writeChallenge(response, address, userExists, isLocalAddress)
+		ws.writeChallenge(response, address, userExists, isLocalAddress, challengesOptional)
 
 	} else {
 		// challenge is valid => reset account or create user
@@ -118,14 +142,20 @@ func (ws *accountsWebservice) createEntry(request *restful.Request, response *re
 		if userExists {
 			ws.handleAccountReset(response, regData, language)
 		} else {
-			ws.handleUserRegistration(response, regData, language)
+			ws.handleUserRegistration(response, regData, language, domain)
 		}
 	}
 }
 
-func (ws *accountsWebservice) handleUserRegistration(response *restful.Response, regData *registrationData, language string) {
+func (ws *accountsWebservice) handleUserRegistration(response *restful.Response,
+	regData *registrationData, language string, domain *domains.Domain) {
+
 	address := regData.Address.Address
-	err := ws.daoUsers.InsertEntry(regData.Address, regData.AcceptedTerms)
+	planName := ""
+	if domain != nil {
+		planName = domain.DefaultPlan
+	}
+	err := ws.daoUsers.InsertEntry(regData.Address, regData.AcceptedTerms, planName)
 	switch {
 	case err == dao.ErrAddressAlreadyExists:
 		ws.writeUserExistsError(response)
@@ -197,6 +227,7 @@ func (ws *accountsWebservice) readRegistrationData(record *registrationRecord) (
 	var err error
 	regData := &registrationData{}
 
+	regData.DomainVerificationSecret = record.DomainVerificationSecret
 	regData.Address = &dao.AddressesEntry{}
 	regData.Address.Address, err = validation.ValidateAddress(record.Address)
 	if err != nil {
@@ -281,9 +312,10 @@ func (ws *accountsWebservice) storeKeys(address string, symmKeys *dao.KeysSymmEn
 
 func (ws *accountsWebservice) writeChallenge(
 	response *restful.Response, address string,
-	userExists bool, isLocalAddress bool) {
+	userExists bool, isLocalAddress bool, challengesOptional bool) {
 
-	challengeReply, err := challenges.CreateChallenge(address, userExists, isLocalAddress)
+	challengeReply, err := challenges.CreateChallenge(
+		address, userExists, isLocalAddress, challengesOptional)
 	if ws.handleChallengeError(response, err) {
 		return
 	}
@@ -308,3 +340,16 @@ func (ws *accountsWebservice) handleChallengeError(response *restful.Response, e
 func (ws *accountsWebservice) writeUserExistsError(response *restful.Response) {
 	writeClientError(response, http.StatusConflict, "User already exists.")
 }
+
+// Returns whether domain is local and whether challenges are optional there.
+// Addresses of other domains always need a challenge.
+func challengePolicy(domain *domains.Domain) (bool, bool) {
+	if domain == nil {
+		return false, false
+	}
+	return true, domain.ChallengesOptional
+}
+
+func writeRegistrationClosedError(response *restful.Response) {
+	writeClientError(response, http.StatusForbidden, "Registration is closed for this domain.")
+}
@@ -0,0 +1,315 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"bitbucket.org/kullo/server/dao"
+	"github.com/emicklei/go-restful"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const AttributeAdmin = "admin"
+
+// number of audit log entries returned per account
+const adminAuditLogLimit = 100
+
+// AdminCredentials maps admin names to bcrypt hashes of their passwords.
+type AdminCredentials map[string]string
+
+// HashAdminPassword creates the hash of an admin password for AdminCredentials.
+func HashAdminPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+type adminAccountInfo struct {
+	*dao.AdminAccountEntry
+	StorageUsed       uint64                      `json:"storageUsed"`
+	PushRegistrations []dao.NotificationsGcmEntry `json:"pushRegistrations"`
+}
+
+type adminDisabled struct {
+	Disabled *bool `json:"disabled"`
+}
+
+const (
+	// plan changes that leave the user with more data than the new quota fail
+	adminOverQuotaBlock = "block"
+	// such plan changes make the account read-only for inbound messages
+	adminOverQuotaReadOnlyInbound = "readOnlyInbound"
+)
+
+type adminPlan struct {
+	PlanName string `json:"planName"`
+	// what to do if storage usage exceeds the new quota, default: block
+	OverQuota string `json:"overQuota"`
+}
+
+type adminResetCode struct {
+	ResetCode string `json:"resetCode"`
+}
+
+type adminAuditLog struct {
+	Data []dao.AdminAuditLogEntry `json:"data"`
+}
+
+type adminWebservice struct {
+	RestfulWebService *restful.WebService
+	dao               *dao.Admin
+	daoUsers          *dao.Users
+	daoMessages       *dao.Messages
+	daoPush           *dao.NotificationsGcm
+	daoPlans          *dao.Plans
+}
+
+// NewAdmin creates the admin API. It must not be added to the public
+// container, but to a container that is served on a separate port.
+func NewAdmin(credentials AdminCredentials) *adminWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/accounts/{address}").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	webservice := &adminWebservice{
+		RestfulWebService: service,
+		dao:               &dao.Admin{},
+		daoUsers:          &dao.Users{},
+		daoMessages:       &dao.Messages{},
+		daoPush:           &dao.NotificationsGcm{},
+		daoPlans:          &dao.Plans{}}
+
+	// private (filtered)
+	service.Route(service.GET("").To(webservice.getAccount))
+	service.Route(service.PUT("/disabled").To(webservice.modifyDisabled))
+	service.Route(service.POST("/resetCode").To(webservice.createResetCode))
+	service.Route(service.PUT("/plan").To(webservice.modifyPlan))
+	service.Route(service.GET("/auditLog").To(webservice.getAuditLog))
+
+	service.Filter(newAdminAuthFilter(credentials))
+	service.Filter(webservice.accountExistsFilter)
+	return webservice
+}
+
+func newAdminAuthFilter(credentials AdminCredentials) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		name, password, ok := req.Request.BasicAuth()
+		if ok && credentials.check(name, password) {
+			req.SetAttribute(AttributeAdmin, name)
+			chain.ProcessFilter(req, resp)
+			return
+		}
+		resp.AddHeader("WWW-Authenticate", "Basic realm=\"Kullo Admin\"")
+		writeClientError(resp, http.StatusUnauthorized, "not authorized")
+	}
+}
+
+func (credentials AdminCredentials) check(name, password string) bool {
+	expected, found := credentials[name]
+	if !found {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil
+}
+
+// unlike UserFilter, this also lets disabled accounts pass
+func (ws *adminWebservice) accountExistsFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	exists, err := ws.daoUsers.UserExists(req.PathParameter("address"))
+	if err != nil {
+		writeServerError(err, resp)
+		return
+	}
+	if !exists {
+		writeClientError(resp, http.StatusNotFound, "user not found")
+		return
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+func (ws *adminWebservice) getAccount(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	// the account details are personal data, so looking them up is recorded
+	// before they are disclosed
+	if !adminAudit(ws.dao, request, response, address, "look up account", "") {
+		return
+	}
+
+	entry, err := ws.dao.GetAccount(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	storageUsed, err := ws.daoMessages.GetStorageSize(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	if entry.InboundReadOnly {
+		entry.InboundReadOnly, err = ws.daoUsers.RecheckInboundReadOnly(address)
+		if err != nil {
+			writeServerError(err, response)
+			return
+		}
+	}
+	pushRegistrations, err := ws.daoPush.GetTokens(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	response.WriteEntity(&adminAccountInfo{
+		AdminAccountEntry: entry,
+		StorageUsed:       storageUsed,
+		PushRegistrations: pushRegistrations,
+	})
+}
+
+func (ws *adminWebservice) modifyDisabled(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	body := &adminDisabled{}
+	err := request.ReadEntity(body)
+	if err != nil || body.Disabled == nil {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+
+	action := "enable"
+	if *body.Disabled {
+		action = "disable"
+	}
+	err = ws.dao.SetDisabled(address, *body.Disabled, newAdminAuditEntry(request, address, action, ""))
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func (ws *adminWebservice) createResetCode(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	codeBytes := make([]byte, 8)
+	_, err := rand.Read(codeBytes)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	resetCode := hex.EncodeToString(codeBytes)
+
+	// the code itself is a secret, so don't log it
+	audit := newAdminAuditEntry(request, address, "issue reset code", "")
+	err = ws.dao.SetResetCode(address, resetCode, audit)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	response.WriteEntity(&adminResetCode{ResetCode: resetCode})
+}
+
+func (ws *adminWebservice) modifyPlan(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	body := &adminPlan{}
+	err := request.ReadEntity(body)
+	if err != nil || body.PlanName == "" {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+	if body.OverQuota == "" {
+		body.OverQuota = adminOverQuotaBlock
+	}
+	if body.OverQuota != adminOverQuotaBlock && body.OverQuota != adminOverQuotaReadOnlyInbound {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+
+	oldEntry, err := ws.dao.GetAccount(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	plan, err := ws.daoPlans.GetEntry(body.PlanName)
+	switch {
+	case err == sql.ErrNoRows:
+		writeClientError(response, http.StatusNotFound, "plan not found")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+	storageUsed, err := ws.daoMessages.GetStorageSize(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	overQuota := storageUsed > plan.StorageQuota
+	if overQuota && body.OverQuota == adminOverQuotaBlock {
+		writeClientError(response, http.StatusConflict, "storage usage exceeds quota of the plan")
+		return
+	}
+
+	details := fmt.Sprintf("%s -> %s", oldEntry.PlanName, body.PlanName)
+	if overQuota {
+		details += " (read-only for inbound messages)"
+	}
+	audit := newAdminAuditEntry(request, address, "change plan", details)
+	err = ws.dao.SetPlan(address, body.PlanName, overQuota, audit)
+	switch {
+	case err == dao.ErrUnknownPlan:
+		writeClientError(response, http.StatusNotFound, "plan not found")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func (ws *adminWebservice) getAuditLog(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	entries, err := ws.dao.GetAuditLog(address, adminAuditLogLimit)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	response.WriteEntity(&adminAuditLog{Data: entries})
+}
+
+// Describes an admin action for the audit log. Actions that modify the
+// database record it in the same transaction.
+func newAdminAuditEntry(request *restful.Request, address string, action string, details string) *dao.AdminAuditLogEntry {
+	admin, _ := request.Attribute(AttributeAdmin).(string)
+	return &dao.AdminAuditLogEntry{
+		Admin:   admin,
+		Action:  action,
+		Address: address,
+		Details: details,
+	}
+}
+
+// Records an admin action that doesn't modify the database. Returns false if
+// an error response has been written.
+func adminAudit(daoAdmin *dao.Admin, request *restful.Request, response *restful.Response,
+	address string, action string, details string) bool {
+
+	err := daoAdmin.InsertAuditLogEntry(newAdminAuditEntry(request, address, action, details))
+	if err != nil {
+		writeServerError(err, response)
+		return false
+	}
+	return true
+}
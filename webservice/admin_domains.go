@@ -0,0 +1,68 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/domains"
+	"github.com/emicklei/go-restful"
+)
+
+type adminDomainList struct {
+	Data []domains.Domain `json:"data"`
+}
+
+type adminDomainsWebservice struct {
+	RestfulWebService *restful.WebService
+	daoAdmin          *dao.Admin
+}
+
+// NewAdminDomains creates the admin API for the local domains. Domains are
+// configured in domains.yml, which can be reloaded without a restart.
+func NewAdminDomains(credentials AdminCredentials) *adminDomainsWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/domains").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	webservice := &adminDomainsWebservice{
+		RestfulWebService: service,
+		daoAdmin:          &dao.Admin{}}
+
+	// private (filtered)
+	service.Route(service.GET("").To(webservice.getDomains))
+	service.Route(service.POST("/reload").To(webservice.reloadDomains))
+
+	service.Filter(newAdminAuthFilter(credentials))
+	return webservice
+}
+
+func (ws *adminDomainsWebservice) getDomains(request *restful.Request, response *restful.Response) {
+	response.WriteEntity(&adminDomainList{Data: domains.List()})
+}
+
+func (ws *adminDomainsWebservice) reloadDomains(request *restful.Request, response *restful.Response) {
+	// the previous configuration stays active if the config is broken
+	err := domains.Reload()
+	if err != nil {
+		log.Print("Reloading domains failed: ", err)
+		response.WriteHeaderAndEntity(http.StatusInternalServerError,
+			newErrorResponseBody(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	details := strings.Join(domains.Names(), ", ")
+	if !adminAudit(ws.daoAdmin, request, response, "", "reload domains", details) {
+		return
+	}
+	response.WriteEntity(&adminDomainList{Data: domains.List()})
+}
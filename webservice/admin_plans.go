@@ -0,0 +1,233 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/validation"
+	"github.com/emicklei/go-restful"
+)
+
+type adminPlanList struct {
+	Data []dao.PlansEntry `json:"data"`
+}
+
+type adminPlanDomainRules struct {
+	Data []dao.PlanDomainRulesEntry `json:"data"`
+}
+
+type adminPlansWebservice struct {
+	RestfulWebService *restful.WebService
+	dao               *dao.Plans
+}
+
+// NewAdminPlans creates the admin API for creating and editing plans.
+func NewAdminPlans(credentials AdminCredentials) *adminPlansWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/plans").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	webservice := newAdminPlansWebservice(service)
+
+	// private (filtered)
+	service.Route(service.GET("").To(webservice.getPlans))
+	service.Route(service.POST("").To(webservice.createPlan))
+	service.Route(service.GET("/{name}").To(webservice.getPlan))
+	service.Route(service.PUT("/{name}").To(webservice.modifyPlan))
+
+	service.Filter(newAdminAuthFilter(credentials))
+	return webservice
+}
+
+// NewAdminPlanDomainRules creates the admin API for the rules that decide
+// which plan new users get, depending on the domain of their address.
+func NewAdminPlanDomainRules(credentials AdminCredentials) *adminPlansWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/planDomainRules").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	webservice := newAdminPlansWebservice(service)
+
+	// private (filtered)
+	service.Route(service.GET("").To(webservice.getDomainRules))
+	service.Route(service.PUT("").To(webservice.modifyDomainRules))
+
+	service.Filter(newAdminAuthFilter(credentials))
+	return webservice
+}
+
+func newAdminPlansWebservice(service *restful.WebService) *adminPlansWebservice {
+	return &adminPlansWebservice{
+		RestfulWebService: service,
+		dao:               &dao.Plans{}}
+}
+
+func (ws *adminPlansWebservice) getPlans(request *restful.Request, response *restful.Response) {
+	entries, err := ws.dao.GetList()
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	response.WriteEntity(&adminPlanList{Data: entries})
+}
+
+func (ws *adminPlansWebservice) createPlan(request *restful.Request, response *restful.Response) {
+	entry, err := readPlan(request)
+	if err != nil {
+		writeRequestValidationError(response, err)
+		return
+	}
+
+	audit := newAdminAuditEntry(request, "", "create plan", describePlan(entry))
+	err = ws.dao.InsertEntry(entry, audit)
+	switch {
+	case err == dao.ErrPlanExists:
+		writeClientError(response, http.StatusConflict, "plan already exists")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	response.WriteEntity(entry)
+}
+
+func (ws *adminPlansWebservice) getPlan(request *restful.Request, response *restful.Response) {
+	entry, err := ws.dao.GetEntry(request.PathParameter("name"))
+	switch {
+	case err == sql.ErrNoRows:
+		writeClientError(response, http.StatusNotFound, "plan not found")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+	response.WriteEntity(entry)
+}
+
+func (ws *adminPlansWebservice) modifyPlan(request *restful.Request, response *restful.Response) {
+	entry, err := readPlan(request)
+	if err != nil {
+		writeRequestValidationError(response, err)
+		return
+	}
+	if entry.Name != request.PathParameter("name") {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+
+	// Users that are over the new quota keep their data. Use the plan change
+	// of single accounts to handle them.
+	audit := newAdminAuditEntry(request, "", "modify plan", describePlan(entry))
+	err = ws.dao.UpdateEntry(entry, audit)
+	switch {
+	case err == sql.ErrNoRows:
+		writeClientError(response, http.StatusNotFound, "plan not found")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	response.WriteEntity(entry)
+}
+
+func (ws *adminPlansWebservice) getDomainRules(request *restful.Request, response *restful.Response) {
+	entries, err := ws.dao.GetDomainRules()
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	response.WriteEntity(&adminPlanDomainRules{Data: entries})
+}
+
+func (ws *adminPlansWebservice) modifyDomainRules(request *restful.Request, response *restful.Response) {
+	body := &adminPlanDomainRules{}
+	err := request.ReadEntity(body)
+	if err != nil || body.Data == nil {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+
+	domains := map[string]bool{}
+	for _, rule := range body.Data {
+		if rule.Domain != dao.PLAN_DOMAIN_ANY {
+			if _, err := validation.ValidateDomain(rule.Domain); err != nil {
+				writeRequestValidationError(response, err)
+				return
+			}
+		}
+		if domains[rule.Domain] {
+			writeRequestValidationError(response, ErrBadRequestBodyFormat)
+			return
+		}
+		domains[rule.Domain] = true
+	}
+	// otherwise, registration fails for all domains without a rule
+	if !domains[dao.PLAN_DOMAIN_ANY] {
+		writeClientError(response, http.StatusBadRequest, "a rule for domain * is required")
+		return
+	}
+
+	details := ""
+	for _, rule := range body.Data {
+		details += fmt.Sprintf("%s -> %s; ", rule.Domain, rule.PlanName)
+	}
+	audit := newAdminAuditEntry(request, "", "modify plan domain rules", details)
+	err = ws.dao.ReplaceDomainRules(body.Data, audit)
+	switch {
+	case err == dao.ErrUnknownPlan:
+		writeClientError(response, http.StatusNotFound, "plan not found")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func readPlan(request *restful.Request) (*dao.PlansEntry, error) {
+	entry := &dao.PlansEntry{}
+	err := request.ReadEntity(entry)
+	if err != nil {
+		return nil, ErrBadRequestBodyFormat
+	}
+
+	if _, err := validation.ValidatePlanName(entry.Name); err != nil {
+		return nil, err
+	}
+	if entry.StorageQuota == 0 {
+		return nil, ErrBadRequestBodyFormat
+	}
+	if entry.MaxAttachmentSize == 0 ||
+		entry.MaxAttachmentSize > uint64(dao.MESSAGE_ATTACHMENTS_MAX_BYTES) {
+		return nil, ErrBadRequestBodyFormat
+	}
+	if entry.Features == nil {
+		entry.Features = []string{}
+	}
+	for _, feature := range entry.Features {
+		if _, err := validation.ValidateFeature(feature); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+func describePlan(entry *dao.PlansEntry) string {
+	return fmt.Sprintf("%s: storageQuota=%d, maxAttachmentSize=%d, maxDevices=%d, maxAliases=%d, features=%v",
+		entry.Name, entry.StorageQuota, entry.MaxAttachmentSize, entry.MaxDevices,
+		entry.MaxAliases, entry.Features)
+}
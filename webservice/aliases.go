@@ -0,0 +1,195 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"database/sql"
+	"net/http"
+
+	"bitbucket.org/kullo/server/challenges"
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/domains"
+	"bitbucket.org/kullo/server/validation"
+	"bitbucket.org/kullo/server/verification"
+	"github.com/emicklei/go-restful"
+)
+
+// an address that is to be added to an existing account
+type newAddressRecord struct {
+	Address         string               `json:"address"`
+	Challenge       challenges.Challenge `json:"challenge"`
+	ChallengeAuth   string               `json:"challengeAuth"`
+	ChallengeAnswer string               `json:"challengeAnswer"`
+	// required on domains that are not local, see domainVerificationInfo
+	DomainVerificationSecret string `json:"domainVerificationSecret"`
+}
+
+type aliasList struct {
+	Data []dao.AliasesEntry `json:"data"`
+}
+
+type aliasesWebservice struct {
+	RestfulWebService *restful.WebService
+	dao               *dao.Addresses
+	daoUsers          *dao.Users
+	verifier          *verification.Verifier
+}
+
+func NewAliases(verifier *verification.Verifier) *aliasesWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/{address}/aliases").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	model := &dao.Addresses{}
+	modelUsers := &dao.Users{}
+	webservice := &aliasesWebservice{
+		RestfulWebService: service,
+		dao:               model,
+		daoUsers:          modelUsers,
+		verifier:          verifier}
+
+	// private (filtered)
+	service.Route(service.GET("").To(webservice.listEntries))
+	service.Route(service.POST("").Filter(IdempotencyFilter).To(webservice.createEntry))
+	service.Route(service.DELETE("/{alias}").To(webservice.deleteEntry))
+
+	service.Filter(AuthFilter)
+	return webservice
+}
+
+func (ws *aliasesWebservice) listEntries(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	entries, err := ws.dao.GetList(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	response.WriteEntity(&aliasList{Data: entries})
+}
+
+func (ws *aliasesWebservice) createEntry(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	record := &newAddressRecord{}
+	err := request.ReadEntity(record)
+	if err != nil {
+		writeRequestValidationError(response, ErrInvalidJson)
+		return
+	}
+	alias, ok := checkNewAddress(response, record, ws.daoUsers, ws.verifier)
+	if !ok {
+		return
+	}
+
+	err = ws.dao.InsertAlias(address, alias)
+	switch {
+	case err == dao.ErrAddressAlreadyExists:
+		writeAddressNotAvailableError(response)
+		return
+	case err == dao.ErrTooManyAliases:
+		writeClientError(response, http.StatusForbidden, "maximum number of aliases reached")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func (ws *aliasesWebservice) deleteEntry(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+	alias := request.PathParameter("alias")
+
+	err := ws.dao.DeleteAlias(address, alias)
+	switch {
+	case err == sql.ErrNoRows:
+		writeClientError(response, http.StatusNotFound, "alias not found")
+		return
+	case err == dao.ErrPrimaryAddress:
+		writeClientError(response, http.StatusConflict, "primary address cannot be removed")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
+
+// Checks that the address is available and subject to the same challenges as
+// registering an account with that address. Returns false if an error
+// response or a challenge has been written.
+func checkNewAddress(response *restful.Response, record *newAddressRecord,
+	daoUsers *dao.Users, verifier *verification.Verifier) (*dao.AddressesEntry, bool) {
+
+	address, err := validation.ValidateAddress(record.Address)
+	if err != nil {
+		writeRequestValidationError(response, validation.NewValidationError("address", err))
+		return nil, false
+	}
+
+	exists, err := daoUsers.UserExists(address)
+	if err != nil {
+		writeServerError(err, response)
+		return nil, false
+	}
+	if !exists {
+		exists, err = daoUsers.AddressTombstoned(address)
+		if err != nil {
+			writeServerError(err, response)
+			return nil, false
+		}
+	}
+	if exists {
+		writeAddressNotAvailableError(response)
+		return nil, false
+	}
+
+	domain := domains.ForAddress(address)
+	if domain != nil && !domain.RegistrationOpen {
+		writeRegistrationClosedError(response)
+		return nil, false
+	}
+	if domain == nil && !checkDomainVerified(response, verifier, address, record.DomainVerificationSecret) {
+		return nil, false
+	}
+	isLocalAddress, challengesOptional := challengePolicy(domain)
+
+	challengeClientAnswer := &challenges.ChallengeClientAnswer{
+		Address:         address,
+		Challenge:       record.Challenge,
+		ChallengeAuth:   record.ChallengeAuth,
+		ChallengeAnswer: record.ChallengeAnswer,
+	}
+	challengeOk, err := challenges.CheckChallenge(challengeClientAnswer, false, isLocalAddress, challengesOptional)
+	if err != nil {
+		writeServerError(err, response)
+		return nil, false
+	}
+	if !challengeOk {
+		challengeReply, err := challenges.CreateChallenge(address, false, isLocalAddress, challengesOptional)
+		if err != nil {
+			writeServerError(err, response)
+			return nil, false
+		}
+		response.WriteHeaderAndEntity(http.StatusForbidden, challengeReply)
+		return nil, false
+	}
+
+	return &dao.AddressesEntry{
+		Address:          address,
+		RegistrationCode: record.ChallengeAnswer,
+	}, true
+}
+
+func writeAddressNotAvailableError(response *restful.Response) {
+	writeClientError(response, http.StatusConflict, "Address is not available.")
+}
@@ -18,6 +18,11 @@ import (
 
 const AttributeAuthOk = "authOk"
 const AttributeLanguage = "language"
+const AttributeSender = "sender"
+
+// request header by which senders of messages to other users prove their own
+// address, in the same format as the Authorization header
+const senderAuthHeader = "Kullo-Sender-Authorization"
 
 func checkLoginKey(address, loginKey string) (bool, error) {
 	loginKeyHash := sha512.Sum512([]byte(loginKey))
@@ -39,27 +44,39 @@ func checkLoginKey(address, loginKey string) (bool, error) {
 	return loginKeyBase64 == entry.LoginKey, nil
 }
 
-func checkAuthnAndAuthz(authHeader, expectedAddress string) (bool, error) {
-	if expectedAddress == "" {
-		return false, nil
-	}
+// Returns address and login key from Basic credentials.
+func parseBasicAuth(authHeader string) (string, string, bool) {
 	parts := strings.SplitN(authHeader, " ", 2)
 	if len(parts) != 2 || parts[0] != "Basic" {
-		return false, nil
+		return "", "", false
 	}
 	decoded, err := base64.StdEncoding.DecodeString(parts[1])
 	if err != nil {
-		return false, nil
+		return "", "", false
 	}
 	addressAndLoginKey := strings.SplitN(string(decoded), ":", 2)
 	if len(addressAndLoginKey) != 2 {
+		return "", "", false
+	}
+	return addressAndLoginKey[0], addressAndLoginKey[1], true
+}
+
+func checkAuthnAndAuthz(authHeader, expectedAddress string) (bool, error) {
+	if expectedAddress == "" {
 		return false, nil
 	}
-	address := addressAndLoginKey[0]
-	loginKey := addressAndLoginKey[1]
-	if expectedAddress != address {
+	address, loginKey, ok := parseBasicAuth(authHeader)
+	if !ok {
 		return false, nil
 	}
+	if expectedAddress != address {
+		// users may log in with any of their addresses
+		addresses := dao.Addresses{}
+		sameUser, err := addresses.SameUser(address, expectedAddress)
+		if !sameUser || err != nil {
+			return false, err
+		}
+	}
 	return checkLoginKey(address, loginKey)
 }
 
@@ -107,3 +124,30 @@ func OptionalAuthFilter(req *restful.Request, resp *restful.Response, chain *res
 	req.SetAttribute(AttributeAuthOk, authOk)
 	chain.ProcessFilter(req, resp)
 }
+
+// SenderFilter authenticates the sender of a message if the request carries
+// sender credentials. The sender may be any user, not only the owner of the
+// address in the path.
+func SenderFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	authHeader := req.HeaderParameter(senderAuthHeader)
+	if authHeader == "" {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	address, loginKey, ok := parseBasicAuth(authHeader)
+	if ok {
+		var err error
+		ok, err = checkLoginKey(address, loginKey)
+		if err != nil {
+			writeServerError(err, resp)
+			return
+		}
+	}
+	if !ok {
+		writeClientError(resp, http.StatusUnauthorized, "sender not authorized")
+		return
+	}
+	req.SetAttribute(AttributeSender, address)
+	chain.ProcessFilter(req, resp)
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/domains"
+	"bitbucket.org/kullo/server/validation"
+	"bitbucket.org/kullo/server/verification"
+	"github.com/emicklei/go-restful"
+)
+
+// tells the owner of a domain how to prove that they control it
+type domainVerificationInfo struct {
+	Domain string `json:"domain"`
+	// identifies the request, see the routes below
+	Token string `json:"token"`
+	// only returned when the request is created, required for registering
+	// addresses on the domain
+	Secret string `json:"secret,omitempty"`
+	// whether registrations are allowed, checking again renews this
+	Verified bool `json:"verified"`
+	// how the domain has been verified, "" if it hasn't
+	Method string `json:"method"`
+	// either publish this TXT record...
+	TxtRecordName  string `json:"txtRecordName"`
+	TxtRecordValue string `json:"txtRecordValue"`
+	// ...or serve this content at this URL
+	WellKnownUrl     string `json:"wellKnownUrl"`
+	WellKnownContent string `json:"wellKnownContent"`
+}
+
+type domainVerificationWebservice struct {
+	RestfulWebService *restful.WebService
+	verifier          *verification.Verifier
+}
+
+// NewDomainVerification creates the API for verifying domains that are not
+// hosted by this server. Addresses on such domains can only be registered
+// by the requester of a verification, using its secret, for some time after
+// the domain has been verified.
+func NewDomainVerification(verifier *verification.Verifier) *domainVerificationWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/domains/{domain}/verification").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	webservice := &domainVerificationWebservice{
+		RestfulWebService: service,
+		verifier:          verifier}
+
+	// public (unfiltered)
+	service.Route(service.POST("").To(webservice.createEntry))
+	service.Route(service.GET("/{token}").To(webservice.getEntry))
+	service.Route(service.POST("/{token}/check").To(webservice.checkEntry))
+
+	return webservice
+}
+
+func (ws *domainVerificationWebservice) getEntry(request *restful.Request, response *restful.Response) {
+	domain, ok := readVerifiableDomain(request, response)
+	if !ok {
+		return
+	}
+
+	entry, err := ws.verifier.Get(domain, request.PathParameter("token"))
+	ws.writeEntry(response, entry, "", err)
+}
+
+func (ws *domainVerificationWebservice) createEntry(request *restful.Request, response *restful.Response) {
+	domain, ok := readVerifiableDomain(request, response)
+	if !ok {
+		return
+	}
+
+	entry, secret, err := ws.verifier.Issue(domain)
+	ws.writeEntry(response, entry, secret, err)
+}
+
+func (ws *domainVerificationWebservice) checkEntry(request *restful.Request, response *restful.Response) {
+	domain, ok := readVerifiableDomain(request, response)
+	if !ok {
+		return
+	}
+
+	entry, err := ws.verifier.Check(domain, request.PathParameter("token"))
+	ws.writeEntry(response, entry, "", err)
+}
+
+func (ws *domainVerificationWebservice) writeEntry(response *restful.Response,
+	entry *dao.DomainVerificationsEntry, secret string, err error) {
+
+	switch {
+	case err == sql.ErrNoRows:
+		writeClientError(response, http.StatusNotFound, "no such verification request for this domain")
+		return
+	case err == verification.ErrRateLimited:
+		writeClientError(response, http.StatusTooManyRequests, "too many requests for this domain, try again later")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	response.WriteEntity(&domainVerificationInfo{
+		Domain:           entry.Domain,
+		Token:            entry.Token,
+		Secret:           secret,
+		Verified:         ws.verifier.Valid(entry),
+		Method:           entry.Method,
+		TxtRecordName:    verification.TxtRecordPrefix + entry.Domain,
+		TxtRecordValue:   verification.TxtValuePrefix + entry.Token,
+		WellKnownUrl:     "https://" + entry.Domain + verification.WellKnownPath,
+		WellKnownContent: entry.Token,
+	})
+}
+
+// Returns false if an error response has been written.
+func readVerifiableDomain(request *restful.Request, response *restful.Response) (string, bool) {
+	domain, err := validation.ValidateDomain(request.PathParameter("domain"))
+	if err != nil {
+		writeRequestValidationError(response, validation.NewValidationError("domain", err))
+		return "", false
+	}
+	if domains.Get(domain) != nil {
+		writeClientError(response, http.StatusConflict, "local domains need no verification")
+		return "", false
+	}
+	return domain, true
+}
+
+// Checks that new addresses on domains that are not local are only registered
+// by those who have verified the domain. Returns false if an error response
+// has been written.
+func checkDomainVerified(response *restful.Response, verifier *verification.Verifier,
+	address string, secret string) bool {
+
+	domain := address[strings.LastIndex(address, "#")+1:]
+	verified, err := verifier.IsVerified(domain, secret)
+	if err != nil {
+		writeServerError(err, response)
+		return false
+	}
+	if !verified {
+		writeClientError(response, http.StatusForbidden, "Domain has not been verified.")
+		return false
+	}
+	return true
+}
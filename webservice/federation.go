@@ -0,0 +1,204 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/domains"
+	"bitbucket.org/kullo/server/federation"
+	"bitbucket.org/kullo/server/validation"
+	"github.com/emicklei/go-restful"
+)
+
+// headers of peer replies that are passed on to the client
+var passedPeerHeaders = []string{restful.HEADER_ContentType, movedToHeader}
+
+type relayReply struct {
+	RelayID     string  `json:"relayId"`
+	Status      string  `json:"status"`
+	Attempts    uint32  `json:"attempts"`
+	LastError   string  `json:"lastError"`
+	NextAttempt *string `json:"nextAttempt"`
+}
+
+type federationWebservice struct {
+	RestfulWebService *restful.WebService
+	federation        *federation.Federation
+}
+
+// NewFederation creates the server-to-server API, through which peers fetch
+// public keys and postage challenges of local users and deliver messages to
+// them, as well as the status lookup of relays to other servers.
+func NewFederation(fed *federation.Federation, messages *messagesWebservice, keys *keysAsymmWebservice) *federationWebservice {
+	service := &restful.WebService{}
+	service.
+		Path(federation.ApiPrefix).
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	webservice := &federationWebservice{
+		RestfulWebService: service,
+		federation:        fed,
+	}
+
+	// server-to-server (filtered)
+	service.Route(service.GET("/users/{address}/keys/public").
+		Filter(webservice.peerFilter).
+		Filter(ForwardFilter).
+		Filter(UserFilter).
+		To(keys.listPublicEntries))
+	service.Route(service.GET("/users/{address}/keys/public/{id}").
+		Filter(webservice.peerFilter).
+		Filter(ForwardFilter).
+		Filter(UserFilter).
+		To(keys.getPublicEntry))
+	service.Route(service.GET("/users/{address}/messages/postage").
+		Filter(webservice.peerFilter).
+		Filter(ForwardFilter).
+		Filter(UserFilter).
+		To(messages.getPostageChallenge))
+	service.Route(service.POST("/users/{address}/messages").
+		Consumes("multipart/form-data").
+		Filter(webservice.peerFilter).
+		Filter(ForwardFilter).
+		Filter(UserFilter).
+		To(messages.createEntryFromMultipart))
+
+	// public (unfiltered)
+	service.Route(service.GET("/relays/{id}").To(webservice.getRelay))
+
+	return webservice
+}
+
+// peerFilter only lets through requests that have been signed by a peer.
+// Messages delivered by peers are treated like those of unauthenticated
+// senders. Peers may only name senders whose home server they are.
+func (ws *federationWebservice) peerFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	peer, err := ws.federation.Authenticate(req.Request)
+	if err != nil {
+		log.Printf("[federation] rejected request from %q: %v",
+			req.HeaderParameter(federation.PeerHeader), err)
+		writeClientError(resp, http.StatusUnauthorized, "not authorized")
+		return
+	}
+	// deletes the spooled body
+	defer req.Request.Body.Close()
+	log.Printf("[federation] request from peer %s", peer.Name)
+
+	sender := req.HeaderParameter(federation.SenderHeader)
+	if sender != "" {
+		if !ws.federation.VouchesFor(peer, sender) {
+			writeClientError(resp, http.StatusForbidden, "peer is not the home server of the sender")
+			return
+		}
+		req.SetAttribute(AttributeSender, sender)
+	}
+	req.SetAttribute(AttributeAuthOk, false)
+	chain.ProcessFilter(req, resp)
+}
+
+func (ws *federationWebservice) getRelay(request *restful.Request, response *restful.Response) {
+	entry, err := ws.federation.GetRelay(request.PathParameter("id"))
+	switch {
+	case err == sql.ErrNoRows:
+		writeClientError(response, http.StatusNotFound, "relay not found")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	response.WriteEntity(newRelayReply(entry))
+}
+
+func newRelayReply(entry *dao.RelaysEntry) *relayReply {
+	reply := &relayReply{
+		RelayID:   entry.ID,
+		Status:    entry.Status,
+		Attempts:  entry.Attempts,
+		LastError: entry.LastError,
+	}
+	if entry.Status == dao.RELAY_QUEUED {
+		nextAttempt := entry.NextAttempt.UTC().Format(time.RFC3339)
+		reply.NextAttempt = &nextAttempt
+	}
+	return reply
+}
+
+// Returns the peer that hosts address, nil if address is handled by this
+// server or its home server is unknown.
+func getHomeServer(fed *federation.Federation, address string) (*federation.Peer, error) {
+	if domains.ForAddress(address) != nil {
+		return nil, nil
+	}
+	if _, err := validation.ValidateAddress(address); err != nil {
+		return nil, nil
+	}
+
+	// users of verified domains may live on this server
+	var users dao.Users
+	exists, err := users.UserExists(address)
+	if exists || err != nil {
+		return nil, err
+	}
+
+	peer, err := fed.HomeServer(address)
+	if err == federation.ErrNoHomeServer {
+		return nil, nil
+	}
+	return peer, err
+}
+
+// newProxyFilter returns a filter that passes GET requests for users on other
+// servers on to their home server. It must precede ForwardFilter and
+// MovedFilter.
+func newProxyFilter(fed *federation.Federation) restful.FilterFunction {
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		address := req.PathParameter("address")
+
+		peer, err := getHomeServer(fed, address)
+		if err != nil {
+			writeServerError(err, resp)
+			return
+		}
+		if peer == nil {
+			chain.ProcessFilter(req, resp)
+			return
+		}
+
+		suffix := strings.TrimPrefix(req.Request.URL.Path, "/"+address)
+		peerResp, err := fed.Get(peer, address, suffix, req.Request.URL.RawQuery)
+		if err != nil {
+			writeBadGatewayError(err, resp)
+			return
+		}
+		writePeerResponse(resp, peerResp)
+	}
+}
+
+func writePeerResponse(response *restful.Response, peerResp *federation.Response) {
+	for _, header := range passedPeerHeaders {
+		if value := peerResp.Header.Get(header); value != "" {
+			response.Header().Set(header, value)
+		}
+	}
+	response.WriteHeader(peerResp.Status)
+	response.Write(peerResp.Body)
+}
+
+func writeBadGatewayError(err error, response *restful.Response) {
+	log.Print("Peer error: ", err)
+	response.WriteHeaderAndEntity(
+		http.StatusBadGateway,
+		newErrorResponseBody(http.StatusBadGateway, "recipient's server is not reachable"))
+}
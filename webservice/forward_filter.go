@@ -0,0 +1,80 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"bitbucket.org/kullo/server/dao"
+	"github.com/emicklei/go-restful"
+)
+
+// set on replies for addresses that have been changed
+const movedToHeader = "Kullo-Moved-To"
+
+type movedReply struct {
+	MovedTo string `json:"movedTo"`
+}
+
+// ForwardFilter makes the request apply to the new address if the address in
+// the path has been changed recently. It must precede UserFilter.
+func ForwardFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	address := req.PathParameter("address")
+
+	target, err := getForwardTarget(address)
+	if err != nil {
+		writeServerError(err, resp)
+		return
+	}
+	if target != "" {
+		req.PathParameters()["address"] = target
+		resp.AddHeader(movedToHeader, target)
+	}
+	chain.ProcessFilter(req, resp)
+}
+
+// MovedFilter redirects to the new address if the address in the path has
+// been changed recently, so that clients can update their contacts. It must
+// precede UserFilter.
+func MovedFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	address := req.PathParameter("address")
+
+	target, err := getForwardTarget(address)
+	if err != nil {
+		writeServerError(err, resp)
+		return
+	}
+	if target == "" {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+
+	location := "/" + url.PathEscape(target) +
+		strings.TrimPrefix(req.Request.URL.Path, "/"+address)
+	resp.AddHeader("Location", location)
+	resp.AddHeader(movedToHeader, target)
+	resp.WriteHeaderAndEntity(http.StatusMovedPermanently, &movedReply{MovedTo: target})
+}
+
+// Returns "" if address belongs to a user or isn't forwarded.
+func getForwardTarget(address string) (string, error) {
+	var users dao.Users
+	exists, err := users.UserExists(address)
+	if exists || err != nil {
+		return "", err
+	}
+
+	var addresses dao.Addresses
+	target, err := addresses.GetForwardTarget(address)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return target, err
+}
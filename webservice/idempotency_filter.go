@@ -0,0 +1,206 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"io"
+	"net/http"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/util"
+	"github.com/emicklei/go-restful"
+)
+
+// request header by which clients mark requests that they may repeat
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// response header that marks replayed results
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// upper bound for bodies of requests with an idempotency key: a multipart message
+const idempotentRequestMaxBytes = int64(dao.MESSAGE_ATTACHMENTS_MAX_BYTES + 2*dao.MEBIBYTE)
+
+// request bodies up to this size are kept in memory, larger ones are spooled
+// to a temporary file
+const idempotentRequestMemoryBytes = 1 * dao.MEBIBYTE
+
+// results larger than this aren't stored, repeating the request fails then
+const idempotentResultMaxBytes = 64 * dao.KIBIBYTE
+
+var idempotencyKeysDao = dao.IdempotencyKeys{}
+
+// recordingWriter passes everything on to the client and keeps a copy of the
+// body.
+type recordingWriter struct {
+	http.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (self *recordingWriter) Write(data []byte) (int, error) {
+	if self.body.Len()+len(data) > idempotentResultMaxBytes {
+		self.overflow = true
+	} else {
+		self.body.Write(data)
+	}
+	return self.ResponseWriter.Write(data)
+}
+
+// IdempotencyFilter remembers the results of successful requests that carry an
+// Idempotency-Key header and replays them when the request is repeated. Keys
+// that are reused for a different request are rejected. Keys are scoped by
+// path and credentials, so that clients cannot interfere with each other, see
+// idempotencyScope.
+func IdempotencyFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	key := req.HeaderParameter(idempotencyKeyHeader)
+	if key == "" {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	if len(key) > dao.IDEMPOTENCY_KEY_MAX_LENGTH {
+		writeClientError(resp, http.StatusBadRequest, "idempotency key too long")
+		return
+	}
+
+	body := util.NewSpool(idempotentRequestMemoryBytes)
+	defer body.Close()
+	_, err := io.Copy(&storageWriter{body}, io.LimitReader(req.Request.Body, idempotentRequestMaxBytes+1))
+	if storageErr, ok := err.(*storageError); ok {
+		writeServerError(storageErr.err, resp)
+		return
+	}
+	if err != nil {
+		writeClientError(resp, http.StatusBadRequest, "couldn't read request body")
+		return
+	}
+	if body.Size() > idempotentRequestMaxBytes {
+		writeClientError(resp, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	err = body.Rewind()
+	if err != nil {
+		writeServerError(err, resp)
+		return
+	}
+	req.Request.Body = body
+	requestHash := hashRequest(req.Request, body.SHA256())
+	scope := idempotencyScope(req.Request, requestHash)
+
+	reserved, err := idempotencyKeysDao.Reserve(scope, key, requestHash)
+	if err != nil {
+		writeServerError(err, resp)
+		return
+	}
+	if !reserved {
+		replayResult(scope, key, requestHash, resp)
+		return
+	}
+
+	recorder := &recordingWriter{ResponseWriter: resp.ResponseWriter}
+	resp.ResponseWriter = recorder
+	chain.ProcessFilter(req, resp)
+	resp.ResponseWriter = recorder.ResponseWriter
+
+	// only successful results are final, everything else may be retried
+	status := resp.StatusCode()
+	switch {
+	case status < 200 || status >= 300:
+		err = idempotencyKeysDao.Delete(scope, key)
+	case recorder.overflow:
+		err = idempotencyKeysDao.Discard(scope, key, status)
+	default:
+		err = idempotencyKeysDao.Complete(scope, key, status,
+			resp.Header().Get(restful.HEADER_ContentType), recorder.body.Bytes())
+	}
+	if err != nil {
+		// the response has been written already
+		util.LogServerError(err)
+	}
+}
+
+func replayResult(scope []byte, key string, requestHash []byte, resp *restful.Response) {
+	entry, err := idempotencyKeysDao.GetEntry(scope, key)
+	switch {
+	case err == sql.ErrNoRows:
+		// the original request has just failed
+		writeClientError(resp, http.StatusConflict, "request with this idempotency key failed, please retry")
+		return
+	case err != nil:
+		writeServerError(err, resp)
+		return
+	}
+
+	if !bytes.Equal(entry.RequestHash, requestHash) {
+		writeClientError(resp, http.StatusUnprocessableEntity,
+			"idempotency key has been used for a different request")
+		return
+	}
+	if entry.Status == 0 {
+		writeClientError(resp, http.StatusConflict,
+			"request with this idempotency key is still being processed")
+		return
+	}
+
+	if entry.Discarded {
+		// processing the request again would repeat its effects
+		writeClientError(resp, http.StatusConflict,
+			"request with this idempotency key has succeeded, but its result is too large to be replayed")
+		return
+	}
+
+	if entry.ContentType != "" {
+		resp.Header().Set(restful.HEADER_ContentType, entry.ContentType)
+	}
+	resp.Header().Set(idempotentReplayedHeader, "true")
+	resp.WriteHeader(entry.Status)
+	resp.Write(entry.Body)
+}
+
+// Returns the scope of idempotency keys of the client that has sent request.
+// Anonymous senders have no credentials that tell them apart, so their keys
+// are scoped by the request itself: senders never see each other's results
+// or conflicts, only a repetition of the very same request is replayed. A key
+// that an anonymous sender reuses for a different request therefore isn't
+// rejected, the request is processed as a new one.
+func idempotencyScope(request *http.Request, requestHash []byte) []byte {
+	hash := sha256.New()
+	credentials := request.Header.Get("Authorization") + request.Header.Get(senderAuthHeader)
+	for _, field := range []string{
+		request.URL.EscapedPath(),
+		request.Header.Get("Authorization"),
+		request.Header.Get(senderAuthHeader),
+	} {
+		io.WriteString(hash, field)
+		hash.Write([]byte{0})
+	}
+	if credentials == "" {
+		hash.Write(requestHash)
+	}
+	return hash.Sum(nil)
+}
+
+// Hashes everything that makes up a request, including credentials, so that
+// results are only replayed to whoever caused them.
+func hashRequest(request *http.Request, bodyDigest []byte) []byte {
+	hash := sha256.New()
+	for _, field := range []string{
+		request.Method,
+		request.URL.RequestURI(),
+		request.Header.Get("Content-Type"),
+		request.Header.Get("Authorization"),
+		request.Header.Get(senderAuthHeader),
+		request.Header.Get(postageHeader),
+	} {
+		io.WriteString(hash, field)
+		hash.Write([]byte{0})
+	}
+	hash.Write(bodyDigest)
+	return hash.Sum(nil)
+}
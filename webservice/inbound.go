@@ -0,0 +1,131 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"net/http"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/inbound"
+	"bitbucket.org/kullo/server/postage"
+	"bitbucket.org/kullo/server/validation"
+	"github.com/emicklei/go-restful"
+)
+
+type inboundInfo struct {
+	Limits *dao.InboundLimitsEntry `json:"limits"`
+	Usage  *dao.InboundUsage       `json:"usage"`
+	// whether unauthenticated senders must attach postage
+	PostageRequired bool `json:"postageRequired"`
+}
+
+type postageSettings struct {
+	Required *bool `json:"required"`
+}
+
+type inboundWebservice struct {
+	RestfulWebService *restful.WebService
+	dao               *dao.InboundLimits
+	daoPostage        *dao.PostageSettings
+	limiter           *inbound.Limiter
+	postmaster        *postage.Postmaster
+}
+
+func NewInbound(limiter *inbound.Limiter, postmaster *postage.Postmaster) *inboundWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/{address}/inbound").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	model := &dao.InboundLimits{}
+	modelPostage := &dao.PostageSettings{}
+	webservice := &inboundWebservice{
+		RestfulWebService: service,
+		dao:               model,
+		daoPostage:        modelPostage,
+		limiter:           limiter,
+		postmaster:        postmaster}
+
+	// private (filtered)
+	service.Route(service.GET("").To(webservice.getInfo))
+	service.Route(service.PUT("/limits").To(webservice.modifyLimits))
+	service.Route(service.PUT("/postage").To(webservice.modifyPostage))
+
+	service.Filter(AuthFilter)
+	return webservice
+}
+
+func (ws *inboundWebservice) getInfo(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	limits, err := ws.limiter.Limits(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	usage, err := ws.dao.GetUsage(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	postageRequired, err := ws.postmaster.Required(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	response.WriteEntity(&inboundInfo{
+		Limits:          limits,
+		Usage:           usage,
+		PostageRequired: postageRequired,
+	})
+}
+
+func (ws *inboundWebservice) modifyLimits(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	entry := &dao.InboundLimitsEntry{}
+	err := request.ReadEntity(entry)
+	if err != nil {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+	err = ws.limiter.Validate(entry)
+	if err != nil {
+		writeRequestValidationError(response, validation.NewValidationError("limits", err))
+		return
+	}
+
+	err = ws.dao.InsertOrUpdateEntry(address, entry)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func (ws *inboundWebservice) modifyPostage(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	settings := &postageSettings{}
+	err := request.ReadEntity(settings)
+	if err != nil || settings.Required == nil {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+
+	err = ws.daoPostage.SetRequired(address, *settings.Required)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
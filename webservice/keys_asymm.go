@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/federation"
 	"github.com/emicklei/go-restful"
 )
 
@@ -20,7 +21,7 @@ type keysAsymmWebservice struct {
 	dao               *dao.KeysAsymm
 }
 
-func NewKeysAsymm() *keysAsymmWebservice {
+func NewKeysAsymm(fed *federation.Federation) *keysAsymmWebservice {
 	service := &restful.WebService{}
 	service.
 		Path("/{address}/keys").
@@ -37,8 +38,9 @@ func NewKeysAsymm() *keysAsymmWebservice {
 	//service.Route(service.PATCH("/private/{id}").Filter(AuthFilter).To(webservice.revokeEntry))
 
 	// public (unfiltered)
-	service.Route(service.GET("/public").Filter(UserFilter).To(webservice.listPublicEntries))
-	service.Route(service.GET("/public/{id}").Filter(UserFilter).To(webservice.getPublicEntry))
+	proxyFilter := newProxyFilter(fed)
+	service.Route(service.GET("/public").Filter(proxyFilter).Filter(MovedFilter).Filter(UserFilter).To(webservice.listPublicEntries))
+	service.Route(service.GET("/public/{id}").Filter(proxyFilter).Filter(MovedFilter).Filter(UserFilter).To(webservice.getPublicEntry))
 
 	return webservice
 }
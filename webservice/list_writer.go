@@ -0,0 +1,116 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"bitbucket.org/kullo/server/util"
+	"github.com/emicklei/go-restful"
+)
+
+// listTrailer follows the data of a list, so that the result counts and
+// errors can be written once all entries are known. Together they make up the
+// envelope of lists:
+//
+//	{"data": [...], "resultsTotal": 42, "resultsReturned": 42}
+type listTrailer struct {
+	ResultsTotal    uint32 `json:"resultsTotal"`
+	ResultsReturned uint32 `json:"resultsReturned"`
+	// set if the list has been cut short, clients must discard it then
+	Error string `json:"error,omitempty"`
+}
+
+// listWriter streams a list to the client entry by entry, so that it doesn't
+// have to be held in memory.
+type listWriter struct {
+	response        *restful.Response
+	resultsReturned uint32
+	started         bool
+	// set once writing to the client has failed
+	writeErr error
+}
+
+func newListWriter(response *restful.Response) *listWriter {
+	return &listWriter{response: response}
+}
+
+func (self *listWriter) write(data string) {
+	if self.writeErr != nil {
+		return
+	}
+	_, self.writeErr = io.WriteString(self.response, data)
+}
+
+func (self *listWriter) start() {
+	if self.started {
+		return
+	}
+	self.started = true
+	self.response.Header().Set(restful.HEADER_ContentType, restful.MIME_JSON)
+	self.response.WriteHeader(http.StatusOK)
+	self.write(`{"data":[`)
+}
+
+// Write adds an entry to the list. Returns an error if the entry cannot be
+// encoded or the client cannot be written to anymore.
+func (self *listWriter) Write(entry interface{}) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if self.started {
+		self.write(",")
+	}
+	self.start()
+	self.write(string(data))
+	self.resultsReturned++
+	return self.writeErr
+}
+
+// Close finishes a list that has been written completely.
+func (self *listWriter) Close(resultsTotal uint32) {
+	self.start()
+	self.finish(&listTrailer{
+		ResultsTotal:    resultsTotal,
+		ResultsReturned: self.resultsReturned,
+	})
+}
+
+// Abort reports an error. Once entries have been written, the status code
+// cannot be changed anymore, so the error is reported in the trailer. Like for
+// Close, resultsTotal is the size of the complete list, so that clients can
+// tell how much is missing.
+func (self *listWriter) Abort(resultsTotal uint32, err error) {
+	if !self.started {
+		writeServerError(err, self.response)
+		return
+	}
+	util.LogServerError(err)
+	self.finish(&listTrailer{
+		ResultsTotal:    resultsTotal,
+		ResultsReturned: self.resultsReturned,
+		Error:           http500Message,
+	})
+}
+
+func (self *listWriter) finish(trailer *listTrailer) {
+	data, err := json.Marshal(trailer)
+	if err != nil {
+		util.LogServerError(err)
+		return
+	}
+	// the trailer continues the object that has been opened by start
+	self.write("],")
+	self.write(string(data[1:]))
+	if self.writeErr != nil {
+		log.Print("Couldn't write list: " + self.writeErr.Error())
+	}
+}
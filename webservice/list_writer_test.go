@@ -0,0 +1,99 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emicklei/go-restful"
+)
+
+type listEnvelope struct {
+	Data []int `json:"data"`
+	listTrailer
+}
+
+func makeListWriterUut() (*listWriter, *httptest.ResponseRecorder) {
+	recorder := httptest.NewRecorder()
+	response := restful.NewResponse(recorder)
+	// set by the router otherwise
+	response.SetRequestAccepts(restful.MIME_JSON)
+	return newListWriter(response), recorder
+}
+
+func parseList(t *testing.T, recorder *httptest.ResponseRecorder) *listEnvelope {
+	list := &listEnvelope{}
+	err := json.Unmarshal(recorder.Body.Bytes(), list)
+	if err != nil {
+		t.Fatalf("Body %q is no list: %v", recorder.Body.String(), err)
+	}
+	return list
+}
+
+func TestListWriterClose(t *testing.T) {
+	uut, recorder := makeListWriterUut()
+	for i := 1; i <= 3; i++ {
+		err := uut.Write(i)
+		if err != nil {
+			t.Fatal("Write failed:", err)
+		}
+	}
+	uut.Close(5)
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Status is", recorder.Code)
+	}
+	list := parseList(t, recorder)
+	if len(list.Data) != 3 || list.Data[0] != 1 || list.Data[2] != 3 {
+		t.Error("Data is", list.Data)
+	}
+	if list.ResultsTotal != 5 || list.ResultsReturned != 3 || list.Error != "" {
+		t.Error("Trailer is", list.listTrailer)
+	}
+}
+
+func TestListWriterCloseEmpty(t *testing.T) {
+	uut, recorder := makeListWriterUut()
+	uut.Close(0)
+
+	list := parseList(t, recorder)
+	if len(list.Data) != 0 || list.ResultsTotal != 0 || list.ResultsReturned != 0 {
+		t.Error("List is", list)
+	}
+}
+
+func TestListWriterAbort(t *testing.T) {
+	uut, recorder := makeListWriterUut()
+	uut.Write(1)
+	uut.Write(2)
+	uut.Abort(5, errors.New("broken"))
+
+	// the status has been sent with the first entry
+	if recorder.Code != http.StatusOK {
+		t.Error("Status is", recorder.Code)
+	}
+	list := parseList(t, recorder)
+	if len(list.Data) != 2 {
+		t.Error("Data is", list.Data)
+	}
+	if list.ResultsTotal != 5 || list.ResultsReturned != 2 || list.Error != http500Message {
+		t.Error("Trailer is", list.listTrailer)
+	}
+}
+
+func TestListWriterAbortBeforeStart(t *testing.T) {
+	uut, recorder := makeListWriterUut()
+	uut.Abort(5, errors.New("broken"))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Error("Status is", recorder.Code)
+	}
+}
@@ -8,18 +8,28 @@ package webservice
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/federation"
+	"bitbucket.org/kullo/server/inbound"
 	"bitbucket.org/kullo/server/notifications"
+	"bitbucket.org/kullo/server/postage"
+	"bitbucket.org/kullo/server/receipts"
+	"bitbucket.org/kullo/server/senders"
 	"bitbucket.org/kullo/server/util"
 	"github.com/emicklei/go-restful"
 )
@@ -30,12 +40,90 @@ type createMessageResult struct {
 	Received     string `json:"dateReceived"`
 }
 
+// request header that carries the postage stamp of unauthenticated messages
+const postageHeader = "Kullo-Postage"
+
+type postageReply struct {
+	Required  bool               `json:"required"`
+	Challenge *postage.Challenge `json:"challenge"`
+	Token     string             `json:"token"`
+}
+
+type messagesBatchBody struct {
+	// if set, nothing is changed unless all operations succeed
+	Atomic     bool                         `json:"atomic"`
+	Operations []dao.MessagesBatchOperation `json:"operations"`
+}
+
+type messagesBatchReply struct {
+	Committed bool                      `json:"committed"`
+	Results   []dao.MessagesBatchResult `json:"results"`
+}
+
+// scheduledReply tells senders when a message is going to be delivered and
+// by which ID they can cancel the delivery until then.
+type scheduledReply struct {
+	ID        string `json:"scheduledId"`
+	DeliverAt string `json:"deliverAt"`
+}
+
+// incomingReply is sent to unauthenticated senders once their message has
+// been accepted.
+type incomingReply struct {
+	// lets the sender recall the message as long as it hasn't been read
+	RecallToken string `json:"recallToken"`
+	// set if the message has been delivered right away
+	Receipt *receipts.Receipt `json:"receipt,omitempty"`
+	*scheduledReply
+}
+
+// body of PATCH /{address}/messages/{id}
+type modifyMetaBody struct {
+	Meta string `json:"meta"`
+	// if missing, the message is marked as read, see dao.Messages.ModifyMeta
+	Read *bool `json:"read"`
+}
+
+type readBody struct {
+	Read bool `json:"read"`
+}
+
+type unreadReply struct {
+	Count uint32 `json:"count"`
+}
+
+type recallBody struct {
+	RecallToken string `json:"recallToken"`
+}
+
+// upper bound for the time between sending and delivery of a message
+const scheduledDeliveryMaxDelay = 365 * 24 * time.Hour
+
+// resyncRequiredReply tells clients that they have to fetch the full list of
+// messages and drop all messages they know of that aren't in it.
+type resyncRequiredReply struct {
+	errorResponseBody
+	SyncHorizon uint64 `json:"syncHorizon"`
+}
+
 type messagesWebservice struct {
 	RestfulWebService *restful.WebService
 	dao               *dao.Messages
+	daoScheduled      *dao.ScheduledMessages
+	daoBlobUploads    *dao.BlobUploads
+	daoInbound        *dao.InboundLimits
+	daoUsers          *dao.Users
+	limiter           *inbound.Limiter
+	postmaster        *postage.Postmaster
+	senderFilter      *senders.Filter
+	receipts          *receipts.Signer
+	federation        *federation.Federation
+	// upper bound for the lifetime of messages with an expiry, 0 for none
+	maxLifetime time.Duration
 }
 
-func NewMessages() *messagesWebservice {
+func NewMessages(limiter *inbound.Limiter, postmaster *postage.Postmaster, senderFilter *senders.Filter,
+	receiptSigner *receipts.Signer, fed *federation.Federation, maxLifetime time.Duration) *messagesWebservice {
 	service := &restful.WebService{}
 	service.
 		Path("/{address}/messages").
@@ -43,24 +131,64 @@ func NewMessages() *messagesWebservice {
 		Produces(restful.MIME_JSON)
 
 	model := &dao.Messages{}
-	webservice := &messagesWebservice{RestfulWebService: service, dao: model}
+	modelInbound := &dao.InboundLimits{}
+	webservice := &messagesWebservice{
+		RestfulWebService: service,
+		dao:               model,
+		daoScheduled:      &dao.ScheduledMessages{},
+		daoBlobUploads:    &dao.BlobUploads{},
+		daoInbound:        modelInbound,
+		daoUsers:          &dao.Users{},
+		limiter:           limiter,
+		postmaster:        postmaster,
+		senderFilter:      senderFilter,
+		receipts:          receiptSigner,
+		federation:        fed,
+		maxLifetime:       maxLifetime}
 
 	// private (filtered)
 	service.Route(service.GET("").Filter(AuthFilter).To(webservice.listEntries))
+	service.Route(service.GET("/unread").Filter(AuthFilter).To(webservice.getUnread))
 	service.Route(service.GET("/{id}").Filter(AuthFilter).To(webservice.getEntry))
 	service.Route(service.PATCH("/{id}").Filter(AuthFilter).To(webservice.modifyMeta))
+	service.Route(service.PUT("/{id}/read").Filter(AuthFilter).To(webservice.modifyRead))
 	service.Route(service.DELETE("/{id}").Filter(AuthFilter).To(webservice.deleteEntry))
 	service.Route(service.GET("/{id}/attachments").Filter(AuthFilter).To(webservice.getAttachments))
+	service.Route(service.POST("/batch").Filter(AuthFilter).To(webservice.applyBatch))
+	service.Route(service.POST("/fanout").
+		Filter(IdempotencyFilter).
+		Filter(AuthFilter).
+		To(webservice.createFanOutFromJson))
+	service.Route(service.POST("/fanout").
+		Consumes("multipart/form-data").
+		Filter(IdempotencyFilter).
+		Filter(AuthFilter).
+		To(webservice.createFanOutFromMultipart))
 
 	// public (unfiltered)
+	service.Route(service.GET("/postage").
+		Filter(newProxyFilter(fed)).
+		Filter(ForwardFilter).
+		Filter(UserFilter).
+		To(webservice.getPostageChallenge))
+	service.Route(service.DELETE("/scheduled/{scheduledId}").To(webservice.cancelScheduledEntry))
+	service.Route(service.POST("/recall").To(webservice.recallEntry))
 	// JSON body
 	service.Route(service.POST("").
+		Filter(IdempotencyFilter).
+		Filter(SenderFilter).
+		Filter(webservice.relayFilter).
+		Filter(ForwardFilter).
 		Filter(UserFilter).
 		Filter(OptionalAuthFilter).
 		To(webservice.createEntryFromJson))
 	// multipart body
 	service.Route(service.POST("").
 		Consumes("multipart/form-data").
+		Filter(IdempotencyFilter).
+		Filter(SenderFilter).
+		Filter(webservice.relayFilter).
+		Filter(ForwardFilter).
 		Filter(UserFilter).
 		Filter(OptionalAuthFilter).
 		To(webservice.createEntryFromMultipart))
@@ -91,32 +219,162 @@ func (ws *messagesWebservice) readEntryFromJsonBody(request *restful.Request, re
 	return entry, true
 }
 
+// storageError is returned by part readers if a part couldn't be stored. All
+// other errors are caused by the client.
+type storageError struct {
+	err error
+}
+
+func (self *storageError) Error() string {
+	return self.err.Error()
+}
+
+func writePartError(err error, response *restful.Response) {
+	if storageErr, ok := err.(*storageError); ok {
+		writeServerError(storageErr.err, response)
+		return
+	}
+	writeClientError(response, http.StatusBadRequest, err.Error())
+}
+
+// partTooLongError is returned by part readers if a part exceeds its maximum
+// length.
+type partTooLongError struct {
+	name string
+}
+
+func (self *partTooLongError) Error() string {
+	return "part too long: " + self.name
+}
+
+// Copies a part to destination. Fails as soon as the part exceeds maxlen.
+func (ws *messagesWebservice) readPart(part *multipart.Part, maxlen int, destination io.Writer) error {
+	maxlenI64 := int64(maxlen)
+	copied, err := io.CopyN(destination, part, maxlenI64+1)
+	if copied > maxlenI64 {
+		return &partTooLongError{part.FormName()}
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
 func (ws *messagesWebservice) readAndEncodePart(part *multipart.Part, maxlen int, destination *string) error {
-	var buf []byte
-	err := ws.readBlob(part, maxlen, &buf)
+	var encoded strings.Builder
+	encoder := base64.NewEncoder(base64.StdEncoding, &encoded)
+	err := ws.readPart(part, maxlen, encoder)
 	if err != nil {
 		return err
 	}
-	*destination = base64.StdEncoding.EncodeToString(buf)
+	encoder.Close()
+	*destination = encoded.String()
 	return nil
 }
 
-func (ws *messagesWebservice) readBlob(part *multipart.Part, maxlen int, destination *[]byte) error {
+func (ws *messagesWebservice) readStringPart(part *multipart.Part, destination *string) error {
 	var buf bytes.Buffer
-	buf.Grow(2 * dao.MEBIBYTE)
-	maxlenI64 := int64(maxlen)
-	copied, err := io.CopyN(&buf, part, maxlenI64+1)
-	if copied > maxlenI64 {
-		return fmt.Errorf("part too long: %s", part.FormName())
+	err := ws.readPart(part, 64, &buf)
+	if err != nil {
+		return err
 	}
-	if err != nil && err != io.EOF {
+	*destination = buf.String()
+	return nil
+}
+
+// readAttachmentsPart streams attachments to storage, so that they don't have
+// to be held in memory. destination is nil if the part is empty.
+func (ws *messagesWebservice) readAttachmentsPart(part *multipart.Part, maxlen int, destination **dao.StoredBlob) error {
+	writer, err := ws.daoBlobUploads.NewWriter()
+	if err != nil {
+		return &storageError{err}
+	}
+	err = ws.readPart(part, maxlen, &storageWriter{writer})
+	if err == nil {
+		*destination, err = writer.Close()
+		if err != nil {
+			err = &storageError{err}
+		}
+	}
+	if err != nil {
+		abortErr := writer.Abort()
+		if abortErr != nil {
+			util.LogServerError(abortErr)
+		}
 		return err
 	}
-	*destination = buf.Bytes()
 	return nil
 }
 
-func (ws *messagesWebservice) readEntryFromMultipartBody(request *restful.Request, response *restful.Response) (*dao.MessagesEntry, bool) {
+// storageWriter marks errors of the underlying writer as storage errors.
+type storageWriter struct {
+	writer io.Writer
+}
+
+func (self *storageWriter) Write(data []byte) (int, error) {
+	n, err := self.writer.Write(data)
+	if err != nil {
+		err = &storageError{err}
+	}
+	return n, err
+}
+
+// Checks that the expiry of entry lies in the future and caps it to the
+// maximum lifetime of messages.
+func (ws *messagesWebservice) normalizeExpiresAt(entry *dao.MessagesEntry, now time.Time) bool {
+	if entry.ExpiresAt == "" {
+		return true
+	}
+	expiresAt, err := time.Parse(time.RFC3339, entry.ExpiresAt)
+	if err != nil || !expiresAt.After(now) {
+		return false
+	}
+	if ws.maxLifetime > 0 && expiresAt.After(now.Add(ws.maxLifetime)) {
+		expiresAt = now.Add(ws.maxLifetime)
+	}
+	entry.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+	return true
+}
+
+// Checks that the delivery time of entry lies in the future, but not too far,
+// and before its expiry.
+func normalizeDeliverAt(entry *dao.MessagesEntry, now time.Time) bool {
+	if entry.DeliverAt == "" {
+		return true
+	}
+	deliverAt, err := time.Parse(time.RFC3339, entry.DeliverAt)
+	if err != nil || !deliverAt.After(now) || deliverAt.After(now.Add(scheduledDeliveryMaxDelay)) {
+		return false
+	}
+	if entry.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, entry.ExpiresAt)
+		if err != nil || !expiresAt.After(deliverAt) {
+			return false
+		}
+	}
+	entry.DeliverAt = deliverAt.UTC().Format(time.RFC3339)
+	return true
+}
+
+const deliverAtInvalidMessage = "deliverAt must be a time in the future, within a year and before expiresAt"
+
+// attachmentsLimit is the maximum size of the attachments of a multipart body
+// and the reply if they exceed it.
+type attachmentsLimit struct {
+	maxBytes int
+	status   int
+	message  string
+}
+
+var defaultAttachmentsLimit = attachmentsLimit{
+	maxBytes: dao.MESSAGE_ATTACHMENTS_MAX_BYTES,
+	status:   http.StatusBadRequest,
+	message:  "part too long: attachments",
+}
+
+func (ws *messagesWebservice) readEntryFromMultipartBody(request *restful.Request, response *restful.Response,
+	limit attachmentsLimit) (*dao.MessagesEntry, bool) {
+
 	entry := &dao.MessagesEntry{}
 
 	_, ctParams, err := mime.ParseMediaType(request.HeaderParameter("Content-Type"))
@@ -144,12 +402,20 @@ func (ws *messagesWebservice) readEntryFromMultipartBody(request *restful.Reques
 		case "meta":
 			err = ws.readAndEncodePart(part, dao.MESSAGE_META_MAX_BYTES, &entry.Meta)
 		case "attachments":
-			err = ws.readBlob(part, dao.MESSAGE_ATTACHMENTS_MAX_BYTES, &entry.Attachments)
+			err = ws.readAttachmentsPart(part, limit.maxBytes, &entry.StoredAttachments)
+			if _, tooLong := err.(*partTooLongError); tooLong {
+				writeClientError(response, limit.status, limit.message)
+				return nil, false
+			}
+		case "expiresAt":
+			err = ws.readStringPart(part, &entry.ExpiresAt)
+		case "deliverAt":
+			err = ws.readStringPart(part, &entry.DeliverAt)
 		default:
 			err = fmt.Errorf("invalid part name: %s", part.FormName())
 		}
 		if err != nil {
-			writeClientError(response, http.StatusBadRequest, err.Error())
+			writePartError(err, response)
 			return nil, false
 		}
 	}
@@ -163,17 +429,30 @@ func (ws *messagesWebservice) listEntries(request *restful.Request, response *re
 		return
 	}
 
-	result := &dataWithResultCount{}
-	var rows *sql.Rows
-	var err error
-	result.ResultsTotal, result.ResultsReturned, rows, err = ws.dao.GetList(address, modifiedAfter, includeData)
+	// tombstones of deletions the client hasn't seen may have been purged
+	if modifiedAfter > 0 {
+		horizon, err := ws.dao.GetSyncHorizon(address)
+		if err != nil {
+			writeServerError(err, response)
+			return
+		}
+		if modifiedAfter < horizon {
+			response.WriteHeaderAndEntity(http.StatusGone, &resyncRequiredReply{
+				errorResponseBody: *newErrorResponseBody(http.StatusGone, "full resync required"),
+				SyncHorizon:       horizon,
+			})
+			return
+		}
+	}
+
+	resultsTotal, _, rows, err := ws.dao.GetList(address, modifiedAfter, includeData)
 	if err != nil {
 		writeServerError(err, response)
 		return
 	}
 	defer rows.Close()
 
-	result.Data = make([]interface{}, 0, 100)
+	list := newListWriter(response)
 	for rows.Next() {
 		var entry interface{}
 		if includeData {
@@ -181,86 +460,480 @@ func (ws *messagesWebservice) listEntries(request *restful.Request, response *re
 		} else {
 			entry, err = dao.GetNextIDLastModified(rows)
 		}
+		if err == nil {
+			err = list.Write(entry)
+		}
 		if err != nil {
-			writeServerError(err, response)
+			list.Abort(resultsTotal, err)
 			return
 		}
-		result.Data = append(result.Data, entry)
 	}
 	if rows.Err() != nil {
-		writeServerError(rows.Err(), response)
+		list.Abort(resultsTotal, rows.Err())
+		return
+	}
+	list.Close(resultsTotal)
+}
+
+func (ws *messagesWebservice) getPostageChallenge(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	size, err := strconv.ParseUint(request.QueryParameter("size"), 10, 64)
+	if err != nil {
+		writeClientError(response, http.StatusBadRequest, "bad value for size")
+		return
+	}
+
+	required, err := ws.postmaster.Required(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	challenge, err := ws.postmaster.CreateChallenge(address, size)
+	if err != nil {
+		writeServerError(err, response)
 		return
 	}
 
-	response.WriteEntity(&result)
+	// senders may always attach postage, even if it isn't required
+	response.WriteEntity(&postageReply{
+		Required:  required,
+		Challenge: challenge,
+		Token:     challenge.Token(),
+	})
 }
 
 func (ws *messagesWebservice) createEntry(entry *dao.MessagesEntry, request *restful.Request, response *restful.Response) {
 	address := request.PathParameter("address")
 	authenticated := request.Attribute(AttributeAuthOk)
 
-	entry.Received = time.Now().UTC().Format(time.RFC3339)
+	now := time.Now()
+	entry.Received = now.UTC().Format(time.RFC3339)
+	entry.Sender, _ = request.Attribute(AttributeSender).(string)
 
 	// unauthenticated users are not allowed to set meta
 	if authenticated == false {
 		entry.Meta = ""
 	}
+	// only the recipient marks messages as read, see insertOwnEntry
+	entry.Read = false
 
 	if !entry.ValidForCreation() {
 		writeClientError(response, http.StatusBadRequest, "invalid body sizes")
 		return
 	}
+	if !ws.normalizeExpiresAt(entry, now) {
+		writeClientError(response, http.StatusBadRequest, "expiresAt must be a time in the future")
+		return
+	}
+	if !normalizeDeliverAt(entry, now) {
+		writeClientError(response, http.StatusBadRequest, deliverAtInvalidMessage)
+		return
+	}
 
-	err := ws.dao.InsertEntry(address, entry)
+	user, err := ws.daoUsers.GetEntry(address)
 	if err != nil {
 		writeServerError(err, response)
 		return
 	}
+	if !attachmentsFitPlan(user, entry) {
+		writeClientError(response, http.StatusRequestEntityTooLarge, attachmentsTooLargeMessage)
+		return
+	}
 
 	if authenticated == true {
-		result := &createMessageResult{
-			ID:           entry.ID,
-			LastModified: entry.LastModified,
-			Received:     entry.Received,
+		if entry.DeliverAt != "" {
+			writeClientError(response, http.StatusBadRequest,
+				"deliverAt is only supported for messages to other users")
+			return
 		}
-		response.WriteEntity(result)
+		ws.createOwnEntry(address, entry, response)
 	} else {
-		writeEmptyJson(response, http.StatusOK)
+		delivery, err := ws.deliverIncomingEntry(
+			address, user, entry, request.HeaderParameter(postageHeader))
+		switch {
+		case err != nil:
+			writeServerError(err, response)
+		case delivery.status >= 400:
+			writeClientError(response, delivery.status, delivery.message)
+		default:
+			response.WriteHeaderAndEntity(delivery.status, &incomingReply{
+				RecallToken:    delivery.recallToken,
+				Receipt:        delivery.receipt,
+				scheduledReply: delivery.scheduled,
+			})
+		}
+	}
+}
+
+const attachmentsTooLargeMessage = "attachments exceed the maximum size of the recipient's plan"
+
+const inboundLimitsMessage = "recipient doesn't accept more messages at the moment"
+
+func attachmentsFitPlan(user *dao.UsersEntry, entry *dao.MessagesEntry) bool {
+	return user.MaxAttachmentSize == 0 || uint64(entry.AttachmentsSize()) <= user.MaxAttachmentSize
+}
+
+// authenticated sending means putting the message in the sender's inbox
+func (ws *messagesWebservice) createOwnEntry(address string, entry *dao.MessagesEntry, response *restful.Response) {
+	err := ws.insertOwnEntry(address, entry)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	result := &createMessageResult{
+		ID:           entry.ID,
+		LastModified: entry.LastModified,
+		Received:     entry.Received,
+	}
+	response.WriteEntity(result)
+}
+
+func (ws *messagesWebservice) insertOwnEntry(address string, entry *dao.MessagesEntry) error {
+	// users have read what they have sent themselves
+	entry.Read = true
+	err := ws.dao.InsertEntry(address, entry)
+	if err != nil {
+		return err
 	}
 
-	// send push notifications
-	notification := notifications.PushNotification{
+	notifications.SendPushNotifications(notifications.PushNotification{
+		Type:           notifications.PushTypeOther,
 		Address:        address,
 		MessageId:      -1,
 		UnreadMessages: -1,
+	})
+	return nil
+}
+
+// incomingDelivery is the outcome of delivering a message to a local recipient.
+type incomingDelivery struct {
+	status int
+	// reason why the message hasn't been delivered, for client errors
+	message string
+	// set if the message is going to be delivered later
+	scheduled *scheduledReply
+	// set if the message has been accepted
+	recallToken string
+	// set if the message has been inserted into the inbox
+	receipt *receipts.Receipt
+}
+
+// checkReadOnly returns a rejection if the recipient doesn't accept messages
+// because their storage is full.
+func (ws *messagesWebservice) checkReadOnly(address string, user *dao.UsersEntry) (*incomingDelivery, error) {
+	if !user.InboundReadOnly {
+		return nil, nil
 	}
-	if authenticated == true {
-		// authenticated sending means putting the message in the sender's inbox
-		notification.Type = notifications.PushTypeOther
-	} else {
-		// unauthenticated sending means putting the message in the recipient's inbox
-		notification.Type = notifications.PushTypeIncomingMessage
-		notification.MessageId = int(entry.ID)
-		notification.UnreadMessages = int(ws.dao.GetUnreadCount(address))
+	// messages might have been deleted since
+	readOnly, err := ws.daoUsers.RecheckInboundReadOnly(address)
+	if err != nil || !readOnly {
+		return nil, err
 	}
-	notifications.SendPushNotifications(notification)
+	return &incomingDelivery{
+		status:  http.StatusInsufficientStorage,
+		message: "recipient doesn't accept messages because their storage is full",
+	}, nil
+}
 
-	// send email notification(s) if applicable
-	if authenticated == false {
-		nDao := dao.Notifications{}
-		n, err := nDao.GetConfirmedEntry(address)
-		switch err {
-		case nil:
-			language := preferredLanguageFromDb(address)
-			notifications.SendMessageNotification(
-				address, n.Email, n.WebloginUsername, n.CancelSecret, language)
-		case sql.ErrNoRows:
-			// no (confirmed) email address found, do nothing
-		default:
-			util.LogServerError(err)
-			return
+// unauthenticated sending means putting the message in the recipient's inbox,
+// or in the recipient's scheduled messages if entry.DeliverAt is set.
+func (ws *messagesWebservice) deliverIncomingEntry(address string, user *dao.UsersEntry, entry *dao.MessagesEntry, stamp string) (*incomingDelivery, error) {
+	rejection, err := ws.checkReadOnly(address, user)
+	if rejection != nil || err != nil {
+		return rejection, err
+	}
+
+	// postage is checked first, so that dropped messages need it as well
+	size := entry.StorageSize()
+	postageStamp, err := ws.postmaster.CheckStamp(address, size, stamp)
+	if rejection := postageRejection(err); rejection != nil {
+		return rejection, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	senderDecision, err := ws.senderFilter.Check(address, entry.Sender)
+	if err != nil {
+		return nil, err
+	}
+	if senderDecision == senders.DecisionReject {
+		return &incomingDelivery{
+			status:  http.StatusForbidden,
+			message: "recipient doesn't accept messages from this sender",
+		}, nil
+	}
+
+	recallToken, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	entry.RecallHash = hashRecallToken(recallToken)
+
+	// concurrent deliveries must not exceed the limits together
+	delivery, err := ws.daoInbound.BeginDelivery(address)
+	if err != nil {
+		return nil, err
+	}
+	defer delivery.Rollback()
+
+	// The inbound limits and the sender rules are checked again when the
+	// message is due, see jobs.deliverScheduledMessages. Until then, the
+	// number of scheduled messages is capped.
+	if entry.DeliverAt != "" {
+		usage, err := delivery.GetUsage()
+		if err != nil {
+			return nil, err
+		}
+		if !ws.limiter.ScheduledMessagesFit(usage, size) {
+			return &incomingDelivery{
+				status:  http.StatusTooManyRequests,
+				message: "recipient doesn't accept more scheduled messages at the moment",
+			}, nil
 		}
+		scheduled, err := newScheduledDelivery(entry, recallToken)
+		if err != nil {
+			return nil, err
+		}
+		err = postageStamp.Use(delivery)
+		if rejection := postageRejection(err); rejection != nil {
+			return rejection, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if senderDecision == senders.DecisionDrop {
+			err = delivery.Drop(entry.RecallHash, scheduled.scheduled.ID, entry.DeliverAt)
+		} else {
+			err = delivery.Schedule(scheduled.scheduled.ID, entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = delivery.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return scheduled, nil
 	}
+
+	usage, err := delivery.GetUsage()
+	if err != nil {
+		return nil, err
+	}
+	decision, err := ws.limiter.Decide(address, usage, size)
+	if err != nil {
+		return nil, err
+	}
+	if decision != inbound.DecisionReject {
+		// only accepted messages use up their stamp
+		err = postageStamp.Use(delivery)
+		if rejection := postageRejection(err); rejection != nil {
+			return rejection, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case decision == inbound.DecisionReject:
+		return &incomingDelivery{
+			status:  http.StatusTooManyRequests,
+			message: inboundLimitsMessage,
+		}, nil
+
+	case decision == inbound.DecisionHold || senderDecision == senders.DecisionDrop:
+		// The sender must not learn that the message has been dropped, so it
+		// is answered like a held message, which has no receipt either.
+		if senderDecision == senders.DecisionDrop {
+			err = delivery.Drop(entry.RecallHash, "", "")
+		} else {
+			err = delivery.Hold(entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = delivery.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return &incomingDelivery{status: http.StatusAccepted, recallToken: recallToken}, nil
+	}
+
+	err = delivery.Deliver(entry)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := ws.receipts.Issue(delivery, address, entry)
+	if err != nil {
+		return nil, err
+	}
+	err = delivery.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	notifications.SendIncomingMessageNotifications(address, entry.ID)
+	return &incomingDelivery{status: http.StatusOK, recallToken: recallToken, receipt: receipt}, nil
+}
+
+// postageRejection returns the reply to a message whose postage has been
+// rejected with err, or nil if err isn't about the postage.
+func postageRejection(err error) *incomingDelivery {
+	switch err {
+	case postage.ErrMissing, postage.ErrMalformed, postage.ErrInvalid, postage.ErrExpired, postage.ErrUsed:
+		return &incomingDelivery{status: http.StatusPaymentRequired, message: err.Error()}
+	}
+	return nil
+}
+
+// newScheduledDelivery creates the random ID by which the sender can cancel
+// the delivery of entry.
+func newScheduledDelivery(entry *dao.MessagesEntry, recallToken string) (*incomingDelivery, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	return &incomingDelivery{
+		status: http.StatusAccepted,
+		scheduled: &scheduledReply{
+			ID:        id,
+			DeliverAt: entry.DeliverAt,
+		},
+		recallToken: recallToken,
+	}, nil
+}
+
+func randomHex(length int) (string, error) {
+	randomBytes := make([]byte, length)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// only the hash of recall tokens is stored
+func hashRecallToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// relayFilter passes messages for users on other servers on to their home
+// server. If it cannot be reached, the message is queued for later delivery.
+// It must precede ForwardFilter.
+func (ws *messagesWebservice) relayFilter(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	address := request.PathParameter("address")
+
+	peer, err := getHomeServer(ws.federation, address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	if peer == nil {
+		chain.ProcessFilter(request, response)
+		return
+	}
+
+	var entry *dao.MessagesEntry
+	var ok bool
+	mediaType, _, _ := mime.ParseMediaType(request.HeaderParameter("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		entry, ok = ws.readEntryFromMultipartBody(request, response, defaultAttachmentsLimit)
+	} else {
+		entry, ok = ws.readEntryFromJsonBody(request, response)
+	}
+	if !ok {
+		return
+	}
+
+	// senders can only set meta on their own messages
+	entry.Meta = ""
+	if !entry.ValidForCreation() {
+		writeClientError(response, http.StatusBadRequest, "invalid body sizes")
+		return
+	}
+	if !ws.normalizeExpiresAt(entry, time.Now()) {
+		writeClientError(response, http.StatusBadRequest, "expiresAt must be a time in the future")
+		return
+	}
+	if entry.DeliverAt != "" {
+		writeClientError(response, http.StatusBadRequest, deliverAtRemoteMessage)
+		return
+	}
+
+	sender, _ := request.Attribute(AttributeSender).(string)
+	stamp := request.HeaderParameter(postageHeader)
+	peerResp, relay, err := ws.relayEntry(peer, address, sender, stamp, entry)
+	switch {
+	case err == errBadEncoding:
+		writeClientError(response, http.StatusBadRequest, "invalid encoding")
+	case err == federation.ErrQueueFull:
+		writeClientError(response, http.StatusServiceUnavailable, relayQueueFullMessage)
+	case err != nil:
+		writeServerError(err, response)
+	case relay != nil:
+		response.WriteHeaderAndEntity(http.StatusAccepted, relay)
+	default:
+		writePeerResponse(response, peerResp)
+	}
+}
+
+const deliverAtRemoteMessage = "deliverAt isn't supported for recipients on other servers"
+
+const relayQueueFullMessage = "recipient's server is unreachable and too many messages are waiting for it"
+
+var errBadEncoding = errors.New("invalid encoding")
+
+// relayEntry passes a message on to its recipient's home server. Returns the
+// reply of the peer if the message has been delivered or rejected for good,
+// otherwise the relay by which the message is queued. Returns
+// federation.ErrQueueFull if the message can neither be delivered nor queued.
+func (ws *messagesWebservice) relayEntry(peer *federation.Peer, address string, sender string, stamp string,
+	entry *dao.MessagesEntry) (*federation.Response, *relayReply, error) {
+
+	// attachments that have been streamed to storage are streamed from there
+	var attachments io.Reader
+	switch {
+	case entry.StoredAttachments != nil:
+		attachments = ws.dao.OpenBlob(entry.StoredAttachments.Digest)
+	case len(entry.Attachments) > 0:
+		attachments = bytes.NewReader(entry.Attachments)
+	}
+
+	contentType, body, err := federation.EncodeMessage(entry, attachments)
+	if err == federation.ErrBadEncoding {
+		return nil, nil, errBadEncoding
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	peerResp, err := ws.federation.Relay(peer, address, sender, stamp, contentType, body)
+	var lastError string
+	switch {
+	case err != nil:
+		lastError = err.Error()
+	case peerResp.Retryable():
+		lastError = federation.DescribeFailure(peerResp)
+	default:
+		// delivered or rejected for good
+		return peerResp, nil, nil
+	}
+
+	id, err := ws.federation.Enqueue(address, sender, contentType, body, lastError)
+	if err != nil {
+		return nil, nil, err
+	}
+	relay, err := ws.federation.GetRelay(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, newRelayReply(relay), nil
 }
 
 func (ws *messagesWebservice) createEntryFromJson(request *restful.Request, response *restful.Response) {
@@ -273,7 +946,11 @@ func (ws *messagesWebservice) createEntryFromJson(request *restful.Request, resp
 }
 
 func (ws *messagesWebservice) createEntryFromMultipart(request *restful.Request, response *restful.Response) {
-	entry, ok := ws.readEntryFromMultipartBody(request, response)
+	limit, ok := ws.checkBeforeUpload(request, response)
+	if !ok {
+		return
+	}
+	entry, ok := ws.readEntryFromMultipartBody(request, response, limit)
 	if !ok {
 		return
 	}
@@ -281,6 +958,77 @@ func (ws *messagesWebservice) createEntryFromMultipart(request *restful.Request,
 	ws.createEntry(entry, request, response)
 }
 
+// checkBeforeUpload rejects messages that would be rejected anyway before
+// their attachments are stored. It only checks what doesn't depend on the
+// body, createEntry checks everything again. Returns the limit of the
+// attachments.
+func (ws *messagesWebservice) checkBeforeUpload(request *restful.Request, response *restful.Response) (attachmentsLimit, bool) {
+	address := request.PathParameter("address")
+	limit := defaultAttachmentsLimit
+
+	user, err := ws.daoUsers.GetEntry(address)
+	if err != nil {
+		writeServerError(err, response)
+		return limit, false
+	}
+	if user.MaxAttachmentSize != 0 && user.MaxAttachmentSize < uint64(limit.maxBytes) {
+		limit = attachmentsLimit{
+			maxBytes: int(user.MaxAttachmentSize),
+			status:   http.StatusRequestEntityTooLarge,
+			message:  attachmentsTooLargeMessage,
+		}
+	}
+	if request.Attribute(AttributeAuthOk) == true {
+		return limit, true
+	}
+
+	rejection, err := ws.checkReadOnly(address, user)
+	if err != nil {
+		writeServerError(err, response)
+		return limit, false
+	}
+	if rejection != nil {
+		writeClientError(response, rejection.status, rejection.message)
+		return limit, false
+	}
+
+	// the size of the message isn't known yet, but it can't exceed what the
+	// stamp pays for
+	postageStamp, err := ws.postmaster.CheckStamp(address, 0, request.HeaderParameter(postageHeader))
+	if rejection := postageRejection(err); rejection != nil {
+		writeClientError(response, rejection.status, rejection.message)
+		return limit, false
+	}
+	if err != nil {
+		writeServerError(err, response)
+		return limit, false
+	}
+	if postageStamp != nil && postageStamp.MaxSize() < uint64(limit.maxBytes) {
+		limit = attachmentsLimit{
+			maxBytes: int(postageStamp.MaxSize()),
+			status:   http.StatusPaymentRequired,
+			message:  postage.ErrInvalid.Error(),
+		}
+	}
+
+	// not locked, a message that fits now may still be rejected later
+	usage, err := ws.daoInbound.GetUsage(address)
+	if err != nil {
+		writeServerError(err, response)
+		return limit, false
+	}
+	decision, err := ws.limiter.Decide(address, usage, 0)
+	if err != nil {
+		writeServerError(err, response)
+		return limit, false
+	}
+	if decision == inbound.DecisionReject && !ws.limiter.ScheduledMessagesFit(usage, 0) {
+		writeClientError(response, http.StatusTooManyRequests, inboundLimitsMessage)
+		return limit, false
+	}
+	return limit, true
+}
+
 func (ws *messagesWebservice) getEntry(request *restful.Request, response *restful.Response) {
 	address := request.PathParameter("address")
 	id, ok := getID(request, response)
@@ -307,10 +1055,13 @@ func (ws *messagesWebservice) modifyMeta(request *restful.Request, response *res
 		return
 	}
 
-	entry, ok := ws.readEntryFromJsonBody(request, response)
-	if !ok {
+	body := &modifyMetaBody{}
+	err := request.ReadEntity(body)
+	if err != nil {
+		writeClientError(response, http.StatusBadRequest, "error in request body format")
 		return
 	}
+	entry := &dao.MessagesEntry{Meta: body.Meta}
 	entry.SetIDLastModifiedDeleted(id, lastModified, false)
 
 	if !entry.ValidForModification() {
@@ -318,10 +1069,38 @@ func (ws *messagesWebservice) modifyMeta(request *restful.Request, response *res
 		return
 	}
 
-	meta, err := ws.dao.ModifyMeta(address, entry)
+	meta, err := ws.dao.ModifyMeta(address, entry, body.Read)
 	writeEntityOrModificationErr(meta, err, response)
 }
 
+func (ws *messagesWebservice) modifyRead(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+	id, ok := getID(request, response)
+	if !ok {
+		return
+	}
+
+	body := &readBody{}
+	err := request.ReadEntity(body)
+	if err != nil {
+		writeClientError(response, http.StatusBadRequest, "error in request body format")
+		return
+	}
+
+	result, err := ws.dao.SetRead(address, id, body.Read)
+	writeEntityOrModificationErr(result, err, response)
+}
+
+func (ws *messagesWebservice) getUnread(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+	count, err := ws.dao.GetUnreadCount(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	response.WriteEntity(&unreadReply{Count: count})
+}
+
 func (ws *messagesWebservice) deleteEntry(request *restful.Request, response *restful.Response) {
 	address, id, lastModified, ok := getModificationParameters(request, response)
 	if !ok {
@@ -332,6 +1111,111 @@ func (ws *messagesWebservice) deleteEntry(request *restful.Request, response *re
 	writeEntityOrModificationErr(meta, err, response)
 }
 
+// recallEntry is public: the recall token is only known to the sender.
+func (ws *messagesWebservice) recallEntry(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	body := &recallBody{}
+	err := request.ReadEntity(body)
+	if err != nil || body.RecallToken == "" {
+		writeClientError(response, http.StatusBadRequest, "error in request body format")
+		return
+	}
+
+	changed, err := ws.dao.Recall(address, hashRecallToken(body.RecallToken))
+	switch {
+	case err == sql.ErrNoRows:
+		writeClientError(response, http.StatusNotFound, "message not found")
+		return
+	case err == dao.ErrAlreadyRead:
+		writeClientError(response, http.StatusConflict, "message has already been read")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	if changed {
+		notifications.SendPushNotifications(notifications.PushNotification{
+			Type:           notifications.PushTypeOther,
+			Address:        address,
+			MessageId:      -1,
+			UnreadMessages: -1,
+		})
+	}
+	writeEmptyJson(response, http.StatusOK)
+}
+
+// cancelScheduledEntry is public: the scheduled ID is only known to the sender.
+func (ws *messagesWebservice) cancelScheduledEntry(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+	id := request.PathParameter("scheduledId")
+
+	cancelled, err := ws.daoScheduled.Cancel(address, id)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	if !cancelled {
+		writeClientError(response, http.StatusNotFound, "scheduled message not found")
+		return
+	}
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func (ws *messagesWebservice) applyBatch(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	body := &messagesBatchBody{}
+	err := request.ReadEntity(body)
+	if err != nil {
+		writeClientError(response, http.StatusBadRequest, "error in request body format")
+		return
+	}
+	if len(body.Operations) == 0 || len(body.Operations) > dao.MESSAGES_BATCH_MAX_OPERATIONS {
+		writeClientError(response, http.StatusBadRequest,
+			fmt.Sprintf("number of operations must be between 1 and %d", dao.MESSAGES_BATCH_MAX_OPERATIONS))
+		return
+	}
+	for i := range body.Operations {
+		if !body.Operations[i].ValidForBatch() {
+			writeClientError(response, http.StatusBadRequest,
+				fmt.Sprintf("invalid operation at index %d", i))
+			return
+		}
+	}
+
+	results, committed, err := ws.dao.ApplyBatch(address, body.Operations, body.Atomic)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	status := http.StatusOK
+	if !committed {
+		status = http.StatusConflict
+	}
+	response.WriteHeaderAndEntity(status, &messagesBatchReply{
+		Committed: committed,
+		Results:   results,
+	})
+
+	if committed {
+		for _, result := range results {
+			if result.Status == dao.BATCH_OK {
+				// one push for the whole batch, so that other devices sync once
+				notifications.SendPushNotifications(notifications.PushNotification{
+					Type:           notifications.PushTypeOther,
+					Address:        address,
+					MessageId:      -1,
+					UnreadMessages: -1,
+				})
+				break
+			}
+		}
+	}
+}
+
 func (ws *messagesWebservice) getAttachments(request *restful.Request, response *restful.Response) {
 	address := request.PathParameter("address")
 	id, ok := getID(request, response)
@@ -339,7 +1223,7 @@ func (ws *messagesWebservice) getAttachments(request *restful.Request, response
 		return
 	}
 
-	attachments, err := ws.dao.GetAttachments(address, id)
+	attachments, digest, err := ws.dao.GetAttachments(address, id)
 	switch {
 	case err == sql.ErrNoRows:
 		writeClientError(response, http.StatusNotFound, "entry not found")
@@ -351,5 +1235,11 @@ func (ws *messagesWebservice) getAttachments(request *restful.Request, response
 
 	response.Header().Set(restful.HEADER_ContentType, "application/octet-stream")
 	response.Header().Set("Content-Length", strconv.Itoa(len(attachments)))
+	if digest != nil {
+		// Digest (RFC 3230) for older clients, Repr-Digest (RFC 9530) for newer ones
+		encodedDigest := base64.StdEncoding.EncodeToString(digest)
+		response.Header().Set("Digest", "SHA-256="+encodedDigest)
+		response.Header().Set("Repr-Digest", "sha-256=:"+encodedDigest+":")
+	}
 	response.Write(attachments) //TODO check return values everywhere
 }
@@ -0,0 +1,304 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"time"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/federation"
+	"bitbucket.org/kullo/server/receipts"
+	"bitbucket.org/kullo/server/util"
+	"github.com/emicklei/go-restful"
+)
+
+// maximum number of recipients of a fan-out message, including the sender
+const fanOutRecipientsMax = 100
+
+// upper bound for the keySafes and postage parts of multipart fan-out bodies
+const fanOutMapsMaxBytes = fanOutRecipientsMax * 2 * dao.KIBIBYTE
+
+// fanOutBody is a message that is sent to several recipients at once. Content
+// and attachments are shared, keySafes maps each recipient (including the
+// sender for their own copy) to the key safe encrypted for them.
+type fanOutBody struct {
+	Content           string            `json:"content"`
+	AttachmentsBase64 string            `json:"attachments"`
+	Attachments       []byte            `json:"-"`
+	StoredAttachments *dao.StoredBlob   `json:"-"`    // set instead of Attachments for multipart bodies
+	Meta              string            `json:"meta"` // only used for the sender's own copy
+	ExpiresAt         string            `json:"expiresAt"`
+	DeliverAt         string            `json:"deliverAt"` // not used for the sender's own copy
+	KeySafes          map[string]string `json:"keySafes"`
+	Postage           map[string]string `json:"postage"`
+}
+
+type fanOutResult struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+	MovedTo string `json:"movedTo,omitempty"`
+	// only set for the sender's own copy
+	ID           uint32 `json:"id,omitempty"`
+	LastModified uint64 `json:"lastModified,omitempty"`
+	// only set if the recipient's home server couldn't be reached
+	Relay *relayReply `json:"relay,omitempty"`
+	// only set for local recipients, see incomingReply
+	Scheduled   *scheduledReply   `json:"scheduled,omitempty"`
+	RecallToken string            `json:"recallToken,omitempty"`
+	Receipt     *receipts.Receipt `json:"receipt,omitempty"`
+}
+
+type fanOutReply struct {
+	Received string                   `json:"dateReceived"`
+	Results  map[string]*fanOutResult `json:"results"`
+}
+
+func (ws *messagesWebservice) createFanOutFromJson(request *restful.Request, response *restful.Response) {
+	body := &fanOutBody{}
+	err := request.ReadEntity(body)
+	if err != nil {
+		writeClientError(response, http.StatusBadRequest, "error in request body format")
+		return
+	}
+
+	if len(body.AttachmentsBase64)*3 > dao.MESSAGE_JSON_ATTACHMENTS_MAX_BYTES*4 {
+		writeClientError(response, http.StatusBadRequest, "attachments too long")
+		return
+	}
+	body.Attachments, err = base64.StdEncoding.DecodeString(body.AttachmentsBase64)
+	body.AttachmentsBase64 = ""
+	if err != nil {
+		writeClientError(response, http.StatusBadRequest, "attachments: invalid encoding")
+		return
+	}
+
+	ws.createFanOut(body, request, response)
+}
+
+func (ws *messagesWebservice) createFanOutFromMultipart(request *restful.Request, response *restful.Response) {
+	body := &fanOutBody{}
+
+	_, ctParams, err := mime.ParseMediaType(request.HeaderParameter("Content-Type"))
+	if err != nil {
+		writeClientError(response, http.StatusBadRequest, "couldn't parse content-type header")
+		return
+	}
+	mr := multipart.NewReader(request.Request.Body, ctParams["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeClientError(response, http.StatusBadRequest, "couldn't parse multipart message")
+			return
+		}
+		defer part.Close()
+
+		switch part.FormName() {
+		case "content":
+			err = ws.readAndEncodePart(part, dao.MESSAGE_CONTENT_MAX_BYTES, &body.Content)
+		case "meta":
+			err = ws.readAndEncodePart(part, dao.MESSAGE_META_MAX_BYTES, &body.Meta)
+		case "attachments":
+			err = ws.readAttachmentsPart(part, dao.MESSAGE_ATTACHMENTS_MAX_BYTES, &body.StoredAttachments)
+		case "expiresAt":
+			err = ws.readStringPart(part, &body.ExpiresAt)
+		case "deliverAt":
+			err = ws.readStringPart(part, &body.DeliverAt)
+		case "keySafes":
+			err = ws.readJsonPart(part, &body.KeySafes)
+		case "postage":
+			err = ws.readJsonPart(part, &body.Postage)
+		default:
+			err = fmt.Errorf("invalid part name: %s", part.FormName())
+		}
+		if err != nil {
+			writePartError(err, response)
+			return
+		}
+	}
+
+	ws.createFanOut(body, request, response)
+}
+
+func (ws *messagesWebservice) readJsonPart(part *multipart.Part, destination interface{}) error {
+	var buf bytes.Buffer
+	err := ws.readPart(part, fanOutMapsMaxBytes, &buf)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(buf.Bytes(), destination)
+	if err != nil {
+		return fmt.Errorf("invalid JSON in part: %s", part.FormName())
+	}
+	return nil
+}
+
+// createFanOut delivers a message to every recipient in body.KeySafes. Each
+// delivery succeeds or fails on its own, the reply contains the outcome per
+// recipient. Local copies share the blobs of content and attachments.
+func (ws *messagesWebservice) createFanOut(body *fanOutBody, request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	if len(body.KeySafes) == 0 || len(body.KeySafes) > fanOutRecipientsMax {
+		writeClientError(response, http.StatusBadRequest,
+			fmt.Sprintf("number of recipients must be between 1 and %d", fanOutRecipientsMax))
+		return
+	}
+
+	now := time.Now()
+	shared := dao.MessagesEntry{
+		Received:          now.UTC().Format(time.RFC3339),
+		Content:           body.Content,
+		Attachments:       body.Attachments,
+		StoredAttachments: body.StoredAttachments,
+		ExpiresAt:         body.ExpiresAt,
+	}
+	if !ws.normalizeExpiresAt(&shared, now) {
+		writeClientError(response, http.StatusBadRequest, "expiresAt must be a time in the future")
+		return
+	}
+	shared.DeliverAt = body.DeliverAt
+	if !normalizeDeliverAt(&shared, now) {
+		writeClientError(response, http.StatusBadRequest, deliverAtInvalidMessage)
+		return
+	}
+	recipients := make([]string, 0, len(body.KeySafes))
+	for recipient, keySafe := range body.KeySafes {
+		entry := shared
+		entry.KeySafe = keySafe
+		if recipient == address {
+			entry.Meta = body.Meta
+		}
+		if !entry.ValidForCreation() {
+			writeClientError(response, http.StatusBadRequest, "invalid body sizes")
+			return
+		}
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+
+	reply := &fanOutReply{
+		Received: shared.Received,
+		Results:  make(map[string]*fanOutResult, len(recipients)),
+	}
+	for _, recipient := range recipients {
+		entry := shared
+		entry.KeySafe = body.KeySafes[recipient]
+
+		var result *fanOutResult
+		var err error
+		if recipient == address {
+			entry.Meta = body.Meta
+			entry.DeliverAt = ""
+			result, err = ws.fanOutToSelf(address, &entry)
+		} else {
+			entry.Sender = address
+			result, err = ws.fanOutToRecipient(recipient, &entry, body.Postage[recipient])
+		}
+		if err != nil {
+			util.LogServerError(err)
+			result = &fanOutResult{Status: http.StatusInternalServerError, Error: http500Message}
+		}
+		reply.Results[recipient] = result
+	}
+
+	response.WriteEntity(reply)
+}
+
+func (ws *messagesWebservice) fanOutToSelf(address string, entry *dao.MessagesEntry) (*fanOutResult, error) {
+	err := ws.insertOwnEntry(address, entry)
+	if err != nil {
+		return nil, err
+	}
+	return &fanOutResult{
+		Status:       http.StatusOK,
+		ID:           entry.ID,
+		LastModified: entry.LastModified,
+	}, nil
+}
+
+// fanOutToRecipient delivers a copy like POST /{address}/messages does for an
+// unauthenticated sender whose address has been verified.
+func (ws *messagesWebservice) fanOutToRecipient(recipient string, entry *dao.MessagesEntry, stamp string) (*fanOutResult, error) {
+	peer, err := getHomeServer(ws.federation, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if peer != nil {
+		if entry.DeliverAt != "" {
+			return &fanOutResult{Status: http.StatusBadRequest, Error: deliverAtRemoteMessage}, nil
+		}
+		peerResp, relay, err := ws.relayEntry(peer, recipient, entry.Sender, stamp, entry)
+		switch {
+		case err == errBadEncoding:
+			return &fanOutResult{Status: http.StatusBadRequest, Error: "invalid encoding"}, nil
+		case err == federation.ErrQueueFull:
+			return &fanOutResult{Status: http.StatusServiceUnavailable, Error: relayQueueFullMessage}, nil
+		case err != nil:
+			return nil, err
+		case relay != nil:
+			return &fanOutResult{Status: http.StatusAccepted, Relay: relay}, nil
+		case !peerResp.Delivered():
+			return &fanOutResult{
+				Status: peerResp.Status,
+				Error:  federation.DescribeFailure(peerResp),
+			}, nil
+		}
+		return &fanOutResult{Status: peerResp.Status}, nil
+	}
+
+	result := &fanOutResult{}
+	target, err := getForwardTarget(recipient)
+	if err != nil {
+		return nil, err
+	}
+	if target != "" {
+		recipient = target
+		result.MovedTo = target
+	}
+
+	exists, err := ws.daoUsers.UserExistsAndActive(recipient)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		result.Status = http.StatusNotFound
+		result.Error = "user not found"
+		return result, nil
+	}
+	user, err := ws.daoUsers.GetEntry(recipient)
+	if err != nil {
+		return nil, err
+	}
+	if !attachmentsFitPlan(user, entry) {
+		result.Status = http.StatusRequestEntityTooLarge
+		result.Error = attachmentsTooLargeMessage
+		return result, nil
+	}
+
+	delivery, err := ws.deliverIncomingEntry(recipient, user, entry, stamp)
+	if err != nil {
+		return nil, err
+	}
+	result.Status = delivery.status
+	result.Error = delivery.message
+	result.Scheduled = delivery.scheduled
+	result.RecallToken = delivery.recallToken
+	result.Receipt = delivery.receipt
+	return result, nil
+}
@@ -54,33 +54,32 @@ func (ws *profileWebservice) listEntries(request *restful.Request, response *res
 		return
 	}
 
-	result := &dataWithResultCount{}
-	var rows *sql.Rows
-	var err error
-	rows, err = ws.dao.GetList(address, modifiedAfter)
+	rows, err := ws.dao.GetList(address, modifiedAfter)
 	if err != nil {
 		writeServerError(err, response)
 		return
 	}
 	defer rows.Close()
 
-	result.Data = make([]interface{}, 0, 10)
+	// the total isn't known until all entries have been read
+	list := newListWriter(response)
 	for rows.Next() {
 		entry, err := ws.dao.GetNextEntry(rows)
+		if err == nil {
+			err = list.Write(entry)
+		}
 		if err != nil {
-			writeServerError(err, response)
+			list.Abort(list.resultsReturned, err)
 			return
 		}
-		result.Data = append(result.Data, entry)
 	}
 	if rows.Err() != nil {
-		writeServerError(rows.Err(), response)
+		list.Abort(list.resultsReturned, rows.Err())
 		return
 	}
 
-	result.ResultsReturned = uint32(len(result.Data))
-	result.ResultsTotal = result.ResultsReturned
-	response.WriteEntity(&result)
+	// all entries are returned
+	list.Close(list.resultsReturned)
 }
 
 func (ws *profileWebservice) getEntry(request *restful.Request, response *restful.Response) {
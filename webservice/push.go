@@ -16,6 +16,7 @@ import (
 type pushWebservice struct {
 	RestfulWebService *restful.WebService
 	dao               *dao.NotificationsGcm
+	daoUsers          *dao.Users
 }
 
 func NewPush() *pushWebservice {
@@ -26,7 +27,7 @@ func NewPush() *pushWebservice {
 		Produces(restful.MIME_JSON)
 
 	model := &dao.NotificationsGcm{}
-	webservice := &pushWebservice{RestfulWebService: service, dao: model}
+	webservice := &pushWebservice{RestfulWebService: service, dao: model, daoUsers: &dao.Users{}}
 
 	// private (filtered)
 	service.Route(service.POST("/gcm").To(webservice.postGcm))
@@ -66,7 +67,17 @@ func (ws *pushWebservice) postGcm(request *restful.Request, response *restful.Re
 		return
 	}
 
-	err := ws.dao.InsertEntry(address, entry)
+	allowed, err := ws.deviceAllowed(address, entry)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	if !allowed {
+		writeClientError(response, http.StatusForbidden, "maximum number of devices reached")
+		return
+	}
+
+	err = ws.dao.InsertEntry(address, entry)
 	if err != nil {
 		writeServerError(err, response)
 		return
@@ -75,6 +86,28 @@ func (ws *pushWebservice) postGcm(request *restful.Request, response *restful.Re
 	writeEmptyJson(response, http.StatusOK)
 }
 
+// checks the number of devices allowed by the user's plan
+func (ws *pushWebservice) deviceAllowed(address string, entry *dao.NotificationsGcmEntry) (bool, error) {
+	user, err := ws.daoUsers.GetEntry(address)
+	if err != nil {
+		return false, err
+	}
+	if user.MaxDevices == 0 {
+		return true, nil
+	}
+
+	tokens, err := ws.dao.GetTokens(address)
+	if err != nil {
+		return false, err
+	}
+	for _, token := range tokens {
+		if token.RegistrationToken == entry.RegistrationToken {
+			return true, nil
+		}
+	}
+	return uint32(len(tokens)) < user.MaxDevices, nil
+}
+
 func (ws *pushWebservice) deleteGcm(request *restful.Request, response *restful.Response) {
 	address := request.PathParameter("address")
 	token := request.PathParameter("token")
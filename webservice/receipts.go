@@ -0,0 +1,42 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"bitbucket.org/kullo/server/receipts"
+	"github.com/emicklei/go-restful"
+)
+
+type receiptKeysReply struct {
+	Keys []receipts.PublicKey `json:"keys"`
+}
+
+type receiptsWebservice struct {
+	RestfulWebService *restful.WebService
+	receipts          *receipts.Signer
+}
+
+// NewReceipts publishes the keys by which delivery receipts can be verified.
+func NewReceipts(signer *receipts.Signer) *receiptsWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/.well-known/kullo").
+		Produces(restful.MIME_JSON)
+
+	webservice := &receiptsWebservice{
+		RestfulWebService: service,
+		receipts:          signer}
+
+	// public (unfiltered)
+	service.Route(service.GET("/receipt-keys").To(webservice.getKeys))
+
+	return webservice
+}
+
+func (ws *receiptsWebservice) getKeys(request *restful.Request, response *restful.Response) {
+	response.WriteEntity(&receiptKeysReply{Keys: ws.receipts.PublicKeys()})
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2013–2020 Kullo GmbH
+ *
+ * This source code is licensed under the 3-clause BSD license. See LICENSE.txt
+ * in the root directory of this source tree for details.
+ */
+package webservice
+
+import (
+	"database/sql"
+	"net/http"
+
+	"bitbucket.org/kullo/server/dao"
+	"bitbucket.org/kullo/server/senders"
+	"bitbucket.org/kullo/server/validation"
+	"github.com/emicklei/go-restful"
+)
+
+type sendersInfo struct {
+	Settings *dao.SenderSettingsEntry `json:"settings"`
+	Rules    []dao.SenderRulesEntry   `json:"rules"`
+	Counters *dao.SenderCounters      `json:"counters"`
+}
+
+type senderRuleBody struct {
+	Action string `json:"action"`
+}
+
+type sendersWebservice struct {
+	RestfulWebService *restful.WebService
+	dao               *dao.SenderFilters
+	filter            *senders.Filter
+}
+
+func NewSenders(filter *senders.Filter) *sendersWebservice {
+	service := &restful.WebService{}
+	service.
+		Path("/{address}/senders").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	webservice := &sendersWebservice{
+		RestfulWebService: service,
+		dao:               &dao.SenderFilters{},
+		filter:            filter}
+
+	// private (filtered)
+	service.Route(service.GET("").To(webservice.getInfo))
+	service.Route(service.PUT("/settings").To(webservice.modifySettings))
+	service.Route(service.PUT("/rules/{pattern}").To(webservice.setRule))
+	service.Route(service.DELETE("/rules/{pattern}").To(webservice.deleteRule))
+	service.Route(service.DELETE("/counters").To(webservice.resetCounters))
+
+	service.Filter(AuthFilter)
+	return webservice
+}
+
+func (ws *sendersWebservice) getInfo(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	settings, err := ws.filter.Settings(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	rules, err := ws.dao.GetRules(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+	counters, err := ws.dao.GetCounters(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	response.WriteEntity(&sendersInfo{
+		Settings: settings,
+		Rules:    rules,
+		Counters: counters,
+	})
+}
+
+func (ws *sendersWebservice) modifySettings(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	entry := &dao.SenderSettingsEntry{}
+	err := request.ReadEntity(entry)
+	if err != nil {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+	err = senders.ValidateSettings(entry)
+	if err != nil {
+		writeRequestValidationError(response, validation.NewValidationError("settings", err))
+		return
+	}
+
+	err = ws.dao.InsertOrUpdateSettings(address, entry)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func (ws *sendersWebservice) setRule(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+	pattern := request.PathParameter("pattern")
+
+	body := &senderRuleBody{}
+	err := request.ReadEntity(body)
+	if err != nil {
+		writeRequestValidationError(response, ErrBadRequestBodyFormat)
+		return
+	}
+	err = senders.ValidatePattern(pattern)
+	if err != nil {
+		writeRequestValidationError(response, validation.NewValidationError("pattern", err))
+		return
+	}
+	err = senders.ValidateRuleAction(body.Action)
+	if err != nil {
+		writeRequestValidationError(response, validation.NewValidationError("action", err))
+		return
+	}
+
+	err = ws.dao.SetRule(address, &dao.SenderRulesEntry{Pattern: pattern, Action: body.Action})
+	switch {
+	case err == dao.ErrTooManySenderRules:
+		writeClientError(response, http.StatusForbidden, "too many sender rules")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func (ws *sendersWebservice) deleteRule(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+	pattern := request.PathParameter("pattern")
+
+	err := ws.dao.DeleteRule(address, pattern)
+	switch {
+	case err == sql.ErrNoRows:
+		writeClientError(response, http.StatusNotFound, "rule not found")
+		return
+	case err != nil:
+		writeServerError(err, response)
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
+
+func (ws *sendersWebservice) resetCounters(request *restful.Request, response *restful.Response) {
+	address := request.PathParameter("address")
+
+	err := ws.dao.ResetCounters(address)
+	if err != nil {
+		writeServerError(err, response)
+		return
+	}
+
+	writeEmptyJson(response, http.StatusOK)
+}
@@ -23,12 +23,6 @@ const (
 	http500Message = "This is probably our fault. We're sorry :-("
 )
 
-type dataWithResultCount struct {
-	ResultsTotal    uint32        `json:"resultsTotal"`
-	ResultsReturned uint32        `json:"resultsReturned"`
-	Data            []interface{} `json:"data"`
-}
-
 type errorResponseBody struct {
 	Status  string `json:"httpStatus"`
 	Message string `json:"error"`
@@ -165,16 +159,3 @@ func preferredLanguage(req *restful.Request) string {
 		return defaultLanguage.String()
 	}
 }
-
-func preferredLanguageFromDb(address string) string {
-	users := dao.Users{}
-	recipient, err := users.GetEntry(address)
-	if err != nil {
-		util.LogServerError(err)
-		return defaultLanguage.String()
-	} else if recipient.Language != "" {
-		return recipient.Language
-	} else {
-		return defaultLanguage.String()
-	}
-}